@@ -0,0 +1,110 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// loopbackAddr returns addr with an empty host replaced by 127.0.0.1, or an
+// error if the host is not a loopback address.
+func loopbackAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if host == "localhost" {
+		return addr, nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return "", fmt.Errorf("admin address %q is not a loopback address", addr)
+	}
+	return addr, nil
+}
+
+// adminToken reads the bearer token of the monitor registry from
+// --admin-token-file, which is required because registry changes decide
+// which monitors vote.
+func (o *runOptions) adminToken() (string, error) {
+	if *o.adminTokenFile == "" {
+		return "", errors.New("--registry with --admin-addr requires --admin-token-file")
+	}
+	b, err := os.ReadFile(*o.adminTokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s: empty admin token", *o.adminTokenFile)
+	}
+	return token, nil
+}
+
+// requireToken wraps h so that only requests carrying token as a bearer
+// token are served.
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="collector admin"`)
+			http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminMux serves the pprof and expvar debug endpoints and, if set, the
+// monitor registry. It is kept separate from http.DefaultServeMux so the
+// endpoints are never exposed on the public metrics listener.
+func adminMux(registry http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	if registry != nil {
+		mux.Handle("/admin/v1/monitors", registry)
+	}
+	return mux
+}
+
+// serveAdmin serves the debug endpoints and the monitor registry on the
+// loopback address addr. Every request is recorded in audit, if set.
+func serveAdmin(addr string, audit *collector.AuditLog, registry http.Handler) error {
+	addr, err := loopbackAddr(addr)
+	if err != nil {
+		return err
+	}
+	// #nosec G114 -- the admin listener is only reachable from the local host
+	return http.ListenAndServe(addr, collector.AuditHandler(audit, adminMux(registry)))
+}
@@ -0,0 +1,98 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoopbackAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr, want string
+	}{
+		{":8081", "127.0.0.1:8081"},
+		{"localhost:8081", "localhost:8081"},
+		{"127.0.0.1:8081", "127.0.0.1:8081"},
+		{"127.0.0.2:8081", "127.0.0.2:8081"},
+		{"[::1]:8081", "[::1]:8081"},
+		{"0.0.0.0:8081", ""},
+		{"[::]:8081", ""},
+		{"192.0.2.1:8081", ""},
+		{"[2001:db8::1]:8081", ""},
+		{"example.com:8081", ""},
+		{"127.0.0.1", ""},
+	} {
+		got, err := loopbackAddr(tt.addr)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("loopbackAddr(%q) = %q, %v, expected %q", tt.addr, got, err, tt.want)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tt := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/v1/monitors?logfile=a", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: got %d, want %d", tt.auth, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	dir := t.TempDir()
+	empty, token := filepath.Join(dir, "empty"), filepath.Join(dir, "token")
+	if err := os.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(token, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		file, want string
+		ok         bool
+	}{
+		{"", "", false},
+		{filepath.Join(dir, "missing"), "", false},
+		{empty, "", false},
+		{token, "s3cret", true},
+	} {
+		o := &runOptions{adminTokenFile: &tt.file}
+		got, err := o.adminToken()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("adminToken(%q) = %q, %v", tt.file, got, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// alertTestCmd fires a test alert of every --kind through the sinks that the
+// run flags route it to, so that --alert-sink and --alert-route can be
+// checked before an incident depends on them. Each test alert is followed
+// by its resolution, closing the incidents and issues it opened.
+func alertTestCmd(args []string) error {
+	fs := flag.NewFlagSet("alert-test", flag.ExitOnError)
+	o := registerRunFlags(fs)
+	var kinds stringList
+	fs.Var(&kinds, "kind", "Kind of the test alert, such as conflict or stall (repeatable, defaults to conflict)")
+	origin := fs.String("test-origin", "alert-test", "Log origin of the test alerts, distinct from the logs monitored so that their incidents are not mixed up")
+	resolve := fs.Bool("resolve", true, "Follow every test alert with its resolution")
+	dryRun := fs.Bool("dry-run", false, "Print the sinks every test alert is routed to without sending it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := loadConfig(fs, &o.configDirs); err != nil {
+		return err
+	}
+	if len(kinds) == 0 {
+		kinds = stringList{collector.AnomalyConflict}
+	}
+
+	cfg, err := o.config()
+	if err != nil {
+		return err
+	}
+	if len(cfg.AlertRouting.Sinks) == 0 {
+		return fmt.Errorf("no --alert-sink configured")
+	}
+	c := collector.New(cfg)
+	failed, sent := 0, 0
+	for _, kind := range kinds {
+		sinks := c.AlertSinks(kind)
+		switch {
+		case len(sinks) == 0:
+			fmt.Printf("%s: not routed to any sink\n", kind)
+			continue
+		case *dryRun:
+			fmt.Printf("%s: %s\n", kind, strings.Join(sinks, ", "))
+			continue
+		}
+		a := collector.Alert{
+			Kind:    kind,
+			Origin:  *origin,
+			Size:    1,
+			Message: fmt.Sprintf("test %s alert of %s fired by the alert-test command", kind, *origin),
+		}
+		errs := fire(c, a, *o.exportTimeout)
+		if *resolve {
+			a.Resolved, a.Message = true, fmt.Sprintf("test %s alert of %s resolved by the alert-test command", kind, *origin)
+			for name, err := range fire(c, a, *o.exportTimeout) {
+				if errs[name] == nil {
+					errs[name] = err
+				}
+			}
+		}
+		for _, name := range sinks {
+			sent++
+			if errs[name] != nil {
+				failed++
+				fmt.Printf("FAIL %s -> %s: %v\n", kind, name, errs[name])
+				continue
+			}
+			fmt.Printf("ok   %s -> %s\n", kind, name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d test alerts failed", failed, sent)
+	}
+	return nil
+}
+
+// fire fires a through the sinks it is routed to within timeout.
+func fire(c *collector.Collector, a collector.Alert, timeout time.Duration) map[string]error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.FireAlert(ctx, a)
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// auditCmd verifies or exports the audit log.
+//
+//	collector audit verify --file audit.log
+//	collector audit export --file audit.log [--since 2023-01-01T00:00:00Z] [--action accept]
+func auditCmd(args []string) error {
+	if len(args) == 0 || (args[0] != "verify" && args[0] != "export") {
+		return errors.New("usage: audit verify|export --file <audit log> [flags]")
+	}
+	sub := args[0]
+
+	fs := flag.NewFlagSet("audit "+sub, flag.ExitOnError)
+	file := fs.String("file", "", "Path to the audit log")
+	since := fs.String("since", "", "Only export entries at or after this RFC 3339 time")
+	action := fs.String("action", "", "Only export entries for this action")
+	stateKeyFile := fs.String("state-key-file", "", "File with the key the audit log is encrypted with, defaults to $"+collector.StateKeyEnv)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("--file is required")
+	}
+
+	sc, err := collector.LoadStateCipher(*stateKeyFile)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := collector.ReadAuditLog(f, sc)
+	if err != nil {
+		return fmt.Errorf("audit log %q is corrupt: %w", *file, err)
+	}
+
+	if sub == "verify" {
+		fmt.Printf("Audit log verified: %d entries\n", len(entries))
+		return nil
+	}
+
+	var from time.Time
+	if *since != "" {
+		if from, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("parsing --since: %w", err)
+		}
+	}
+	exported := []collector.AuditEntry{}
+	for _, e := range entries {
+		if e.Time.Before(from) || (*action != "" && e.Action != *action) {
+			continue
+		}
+		exported = append(exported, e)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(exported)
+}
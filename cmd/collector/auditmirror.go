@@ -0,0 +1,59 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// auditMirrorCmd re-verifies the entries stored with run --mirror-dir
+// against the accepted checkpoints and reports corrupted or missing ranges.
+func auditMirrorCmd(args []string) error {
+	fs := flag.NewFlagSet("audit-mirror", flag.ExitOnError)
+	mirrorDir := fs.String("mirror-dir", "", "Directory of the mirror to audit, as written by run --mirror-dir")
+	acceptedFile := fs.String("accepted", AcceptedChptFile, "Name of the accepted checkpoint file to verify against")
+	chain := fs.Bool("chain", false, "The accepted file is chained, see run --chain")
+	keep := fs.Int("keep", collector.DefaultKeep, "Number of accepted checkpoints retained in the accepted file")
+	stateKeyFile := fs.String("state-key-file", "", "File with the key the accepted file is encrypted with, defaults to $"+collector.StateKeyEnv)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *mirrorDir == "" {
+		return errors.New("--mirror-dir is required")
+	}
+
+	sc, err := collector.LoadStateCipher(*stateKeyFile)
+	if err != nil {
+		return err
+	}
+	c := collector.New(collector.Config{AcceptedFile: *acceptedFile, Chain: *chain, Keep: *keep, StateCipher: sc})
+	report, err := c.AuditMirror(*mirrorDir)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%s: found %d problems in %d segments", *mirrorDir, len(report.Problems), report.Segments)
+	}
+	fmt.Printf("%s: %d entries in %d segments verified, %d against retained accepted checkpoints\n", *mirrorDir, report.Entries, report.Segments, report.Confirmed)
+	return nil
+}
@@ -0,0 +1,97 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// benchResult is a single line of the bench report.
+type benchResult struct {
+	Name        string `json:"name"`
+	Monitors    int    `json:"monitors"`
+	Iterations  int    `json:"iterations"`
+	NsPerOp     int64  `json:"nsPerOp"`
+	BytesPerOp  int64  `json:"bytesPerOp"`
+	AllocsPerOp int64  `json:"allocsPerOp"`
+}
+
+// benchCmd runs the collector benchmarks against synthetic fleets of
+// monitors, so that deployments can check how a fleet size performs on
+// their hardware.
+func benchCmd(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fleets := fs.String("monitors", "10,100,1000", "Comma separated sizes of the synthetic fleets to benchmark")
+	filter := fs.String("run", "", "Only run benchmarks whose name contains this string, e.g. quorum")
+	asJSON := fs.Bool("json", false, "Print the results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var sizes []int
+	for _, s := range strings.Split(*fleets, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid fleet size %q", s)
+		}
+		sizes = append(sizes, n)
+	}
+
+	dir, err := os.MkdirTemp("", "collector-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var results []benchResult
+	for _, bm := range collector.Benchmarks(dir, sizes) {
+		if !strings.Contains(bm.Name, *filter) {
+			continue
+		}
+		r := testing.Benchmark(bm.F)
+		if r.N == 0 {
+			return fmt.Errorf("benchmark %s/%d failed", bm.Name, bm.Monitors)
+		}
+		res := benchResult{
+			Name:        bm.Name,
+			Monitors:    bm.Monitors,
+			Iterations:  r.N,
+			NsPerOp:     r.NsPerOp(),
+			BytesPerOp:  r.AllocedBytesPerOp(),
+			AllocsPerOp: r.AllocsPerOp(),
+		}
+		if *asJSON {
+			results = append(results, res)
+			continue
+		}
+		fmt.Printf("%-10s%8d monitors%12d ns/op%12d B/op%10d allocs/op\n", res.Name, res.Monitors, res.NsPerOp, res.BytesPerOp, res.AllocsPerOp)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// serveChecks checks the settings of the servers enabled by the flags.
+func (o *runOptions) serveChecks() []collector.ConfigCheck {
+	var checks []collector.ConfigCheck
+	if *o.adminAddr != "" {
+		_, err := loopbackAddr(*o.adminAddr)
+		checks = append(checks, collector.ConfigCheck{Name: "admin address " + *o.adminAddr, Err: err})
+		if *o.registry {
+			_, err := o.adminToken()
+			checks = append(checks, collector.ConfigCheck{Name: "reading admin token", Err: err})
+		}
+	}
+	if *o.pushAddr != "" {
+		svid := &collector.SVIDFiles{CertFile: *o.svidCert, KeyFile: *o.svidKey, BundleFile: *o.svidBundle}
+		checks = append(checks, collector.ConfigCheck{Name: "loading X.509-SVID", Err: svid.Load()})
+	}
+	if *o.frostAddr != "" {
+		err := errors.New("--frost-addr requires --frost-share")
+		if *o.frostShare != "" {
+			_, err = readFROSTKeyFile(*o.frostShare)
+		}
+		checks = append(checks, collector.ConfigCheck{Name: "reading threshold key share", Err: err})
+	}
+	return checks
+}
+
+// startupChecks runs the configuration checks of every collector before
+// collection starts. Failed transient checks are logged as warnings, any
+// other failure is returned.
+func startupChecks(cs []*collector.Collector) error {
+	var failed []string
+	for _, c := range cs {
+		for _, ch := range c.CheckConfig() {
+			switch {
+			case ch.Err == nil:
+			case ch.Transient:
+				log.Printf("Warning: %s: %v\n", ch.Name, ch.Err)
+			default:
+				failed = append(failed, fmt.Sprintf("%s: %v", ch.Name, ch.Err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+// checkConfigCmd validates the configuration given by the run flags without
+// collecting: keys are parsed, monitors read, state files decrypted and
+// output locations checked for write access. It fails if any check fails,
+// so misconfigurations are caught before deployment.
+func checkConfigCmd(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	o := registerRunFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := loadConfig(fs, &o.configDirs); err != nil {
+		return err
+	}
+
+	cfg, err := o.config()
+	if err != nil {
+		return err
+	}
+	if *o.auditLog != "" {
+		if _, err := collector.OpenAuditLog(*o.auditLog, cfg.StateCipher); err != nil {
+			return err
+		}
+	}
+	cs, err := o.collectors(cfg, false, false)
+	if err != nil {
+		return err
+	}
+
+	checks := o.serveChecks()
+	for _, c := range cs {
+		checks = append(checks, c.CheckConfig()...)
+	}
+	failed := 0
+	for _, ch := range checks {
+		if ch.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", ch.Name, ch.Err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", ch.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
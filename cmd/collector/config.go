@@ -0,0 +1,118 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// envPrefix prefixes the environment variables that set flags.
+const envPrefix = "COLLECTOR_"
+
+// flagEnv returns the environment variable setting the named flag, e.g.
+// COLLECTOR_STATE_KEY_FILE for --state-key-file.
+func flagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig fills in fset from the sources other than the command line.
+// From highest to lowest precedence, a flag is taken from
+//
+//   - its environment variable, see flagEnv
+//   - the command line
+//   - a file named after it in one of dirs, as Kubernetes does when mounting
+//     the keys of a ConfigMap or Secret as a volume; earlier directories take
+//     precedence
+//   - its default value
+func loadConfig(fset *flag.FlagSet, dirs *stringList) error {
+	// Flags set from the environment count as set, so files only fill in
+	// the rest, and --config-dir itself may come from the environment.
+	if err := applyEnv(fset); err != nil {
+		return err
+	}
+	return applyConfigDirs(fset, *dirs)
+}
+
+// applyConfigDirs sets every flag of fset that is not set yet from a file
+// named after the flag in one of dirs.
+func applyConfigDirs(fset *flag.FlagSet, dirs stringList) error {
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fset.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		for _, dir := range dirs {
+			b, rerr := os.ReadFile(filepath.Join(dir, f.Name))
+			if errors.Is(rerr, fs.ErrNotExist) {
+				continue
+			}
+			if rerr != nil {
+				err = rerr
+				return
+			}
+			if serr := fset.Set(f.Name, strings.TrimSpace(string(b))); serr != nil {
+				err = fmt.Errorf("%s: %w", filepath.Join(dir, f.Name), serr)
+			}
+			return
+		}
+	})
+	return err
+}
+
+// applyEnv sets every flag of fset whose environment variable is set.
+// Repeatable flags take a comma separated list.
+func applyEnv(fset *flag.FlagSet) error {
+	var err error
+	fset.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(flagEnv(f.Name))
+		if err != nil || !ok {
+			return
+		}
+		values := []string{v}
+		if l, ok := f.Value.(*stringList); ok {
+			*l = nil
+			values = strings.Split(v, ",")
+		}
+		for _, v := range values {
+			if serr := fset.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("$%s: %w", flagEnv(f.Name), serr)
+				return
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,133 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		files [2]map[string]string
+		want  string
+		list  string
+	}{
+		{name: "default", want: "default"},
+		{
+			name:  "file",
+			files: [2]map[string]string{{"name": "file\n", "monitor": "a,b"}},
+			want:  "file", list: "a,b",
+		},
+		{
+			name:  "earlier directory",
+			files: [2]map[string]string{{"name": "first"}, {"name": "second", "monitor": "x"}},
+			want:  "first", list: "x",
+		},
+		{
+			name:  "flag over file",
+			args:  []string{"--name", "flag", "--monitor", "a", "--monitor", "b"},
+			files: [2]map[string]string{{"name": "file", "monitor": "c"}},
+			want:  "flag", list: "a|b",
+		},
+		{
+			name:  "env over flag and file",
+			env:   map[string]string{"COLLECTOR_NAME": "env", "COLLECTOR_MONITOR": "a,b,c"},
+			args:  []string{"--name", "flag", "--monitor", "d"},
+			files: [2]map[string]string{{"name": "file", "monitor": "e"}},
+			want:  "env", list: "a|b|c",
+		},
+		{
+			name: "empty env",
+			env:  map[string]string{"COLLECTOR_NAME": ""},
+			args: []string{"--name", "flag"},
+			want: "",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var dirs stringList
+			for _, files := range tt.files {
+				dir := t.TempDir()
+				for name, content := range files {
+					if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+				dirs = append(dirs, dir)
+			}
+
+			fset := flag.NewFlagSet("test", flag.ContinueOnError)
+			name := fset.String("name", "default", "")
+			var monitors stringList
+			fset.Var(&monitors, "monitor", "")
+			if err := fset.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfig(fset, &dirs); err != nil {
+				t.Fatal(err)
+			}
+			if *name != tt.want {
+				t.Errorf("expected --name %q, got %q", tt.want, *name)
+			}
+			if got := strings.Join(monitors, "|"); got != tt.list {
+				t.Errorf("expected --monitor %q, got %q", tt.list, got)
+			}
+		})
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	t.Setenv("COLLECTOR_KEEP", "many")
+	fset := flag.NewFlagSet("test", flag.ContinueOnError)
+	fset.Int("keep", 1, "")
+	if err := applyEnv(fset); err == nil || !strings.Contains(err.Error(), "$COLLECTOR_KEEP") {
+		t.Errorf("expected the invalid variable to be named, got %v", err)
+	}
+}
+
+func TestPodLabel(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		args []string
+		want string
+	}{
+		{env: "collector-0", want: "collector-0"},
+		{env: "collector-0", args: []string{"--lease-identity", "replica-a"}, want: "replica-a"},
+	} {
+		t.Setenv("POD_NAME", tt.env)
+		fset := flag.NewFlagSet("test", flag.ContinueOnError)
+		o := registerRunFlags(fset)
+		if err := fset.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := o.config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Pod != tt.want {
+			t.Errorf("%v: expected the pod label %q, got %q", tt.args, tt.want, cfg.Pod)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+	"github.com/sigstore/rekor-monitor/pkg/evidence"
+	"github.com/sigstore/rekor-monitor/pkg/frost"
+	"github.com/sigstore/rekor-monitor/pkg/hsm"
+)
+
+// frostSignTimeout bounds both rounds of a threshold signing operation.
+const frostSignTimeout = 30 * time.Second
+
+// frostKeyFile is the file holding a collector's share of a threshold
+// cosigning key.
+type frostKeyFile struct {
+	// Name is the key name of the group key in signed notes.
+	Name string `json:"name"`
+	frost.KeyShare
+}
+
+func readFROSTKeyFile(filename string) (frostKeyFile, error) {
+	var k frostKeyFile
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return k, err
+	}
+	if err := json.Unmarshal(b, &k); err != nil {
+		return k, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	return k, nil
+}
+
+// frostKeygenCmd splits a new cosigning key into shares for a group of
+// collectors.
+func frostKeygenCmd(args []string) error {
+	fs := flag.NewFlagSet("frost-keygen", flag.ExitOnError)
+	name := fs.String("name", "", "Key name of the group cosigning key, e.g. collector.example.com")
+	threshold := fs.Int("threshold", 2, "Number of collectors needed to cosign")
+	signers := fs.Int("signers", 3, "Number of collectors holding a share")
+	out := fs.String("out", ".", "Directory the share-<id>.json files are written to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("--name is required")
+	}
+
+	shares, err := frost.GenerateShares(*threshold, *signers)
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		b, err := json.MarshalIndent(frostKeyFile{Name: *name, KeyShare: s}, "", "  ")
+		if err != nil {
+			return err
+		}
+		filename := filepath.Join(*out, fmt.Sprintf("share-%d.json", s.ID))
+		if err := os.WriteFile(filename, append(b, '\n'), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", filename)
+	}
+	vkey, err := note.NewEd25519VerifierKey(*name, shares[0].GroupKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verifier key: %s\n", vkey)
+	return nil
+}
+
+// frostPeers are the participants of threshold cosigning given as id=url
+// pairs.
+type frostPeers map[uint16]string
+
+func (p frostPeers) String() string {
+	var pairs []string
+	for id, u := range p {
+		pairs = append(pairs, fmt.Sprintf("%d=%s", id, u))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p frostPeers) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		id, u, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid participant %q, expected id=url", pair)
+		}
+		n, err := strconv.ParseUint(id, 10, 16)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid participant identifier %q", id)
+		}
+		p[uint16(n)] = strings.TrimSuffix(u, "/") + "/frost/v1"
+	}
+	return nil
+}
+
+// cosigner returns the cosigner configured by the flags, if any.
+func (o *runOptions) cosigner() (collector.Cosigner, error) {
+	configured := 0
+	for _, set := range []bool{*o.cosignKey != "", len(o.frostPeers) > 0, *o.pkcs11Module != "", *o.cosignKeyless} {
+		if set {
+			configured++
+		}
+	}
+	switch {
+	case configured > 1:
+		return nil, errors.New("--cosign-key, --frost-peer, --pkcs11-module and --cosign-keyless are mutually exclusive")
+	case *o.pkcs11Module != "":
+		return o.pkcs11Cosigner()
+	case *o.cosignKeyless:
+		if *o.cosignName == "" {
+			return nil, errors.New("--cosign-keyless requires --cosign-name")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), evidenceSignTimeout)
+		defer cancel()
+		k, err := evidence.NewKeylessCosigner(ctx, *o.cosignName, &evidence.Fulcio{URL: *o.fulcioURL, Client: o.httpClient()}, *o.identityToken)
+		if err != nil {
+			return nil, fmt.Errorf("certifying keyless cosigning key: %w", err)
+		}
+		log.Printf("Cosigning keylessly as %s with certificates from %s\n", *o.cosignName, *o.fulcioURL)
+		return k, nil
+	case *o.cosignKey != "":
+		skey, err := os.ReadFile(*o.cosignKey)
+		if err != nil {
+			return nil, err
+		}
+		return collector.NoteKeyCosigner(strings.TrimSpace(string(skey)))
+	case len(o.frostPeers) > 0:
+		if *o.frostShare == "" {
+			return nil, errors.New("--frost-peer requires --frost-share")
+		}
+		k, err := readFROSTKeyFile(*o.frostShare)
+		if err != nil {
+			return nil, err
+		}
+		if len(o.frostPeers) < k.Threshold {
+			return nil, fmt.Errorf("%d participants configured, threshold is %d", len(o.frostPeers), k.Threshold)
+		}
+		coord := &frost.Coordinator{
+			GroupKey:     k.GroupKey,
+			Threshold:    k.Threshold,
+			PublicShares: k.PublicShares,
+			Participants: o.frostPeers,
+			Client:       &http.Client{Transport: o.httpClient().Transport, Timeout: frostSignTimeout},
+		}
+		return collector.Ed25519Cosigner(k.Name, k.GroupKey, func(msg []byte) ([]byte, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), frostSignTimeout)
+			defer cancel()
+			return coord.Sign(ctx, msg)
+		}), nil
+	}
+	return nil, nil
+}
+
+// secondaryLog returns the log cosigned notes are submitted to, or nil if
+// --secondary-log-url is not set.
+func (o *runOptions) secondaryLog() (collector.SecondaryLog, error) {
+	if *o.secondaryLogURL == "" {
+		return nil, nil
+	}
+	if *o.cosignedFile == "" {
+		return nil, errors.New("--secondary-log-url requires --cosigned")
+	}
+	l := &evidence.SecondaryLog{BundleFile: *o.secondaryBundles}
+	if *o.secondaryLogKey != "" {
+		s, err := evidence.LoadKey(*o.secondaryLogKey, []byte(os.Getenv(evidence.PasswordEnv)))
+		if err != nil {
+			return nil, err
+		}
+		s.RekorURL = *o.secondaryLogURL
+		l.Signer = func(context.Context) (*evidence.Signer, error) { return s, nil }
+		return l, nil
+	}
+	fulcio := &evidence.Fulcio{URL: *o.fulcioURL, Client: o.httpClient()}
+	l.Signer = func(ctx context.Context) (*evidence.Signer, error) {
+		token, err := evidence.ReadIDToken(*o.identityToken)
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			return nil, fmt.Errorf("--secondary-log-url requires --secondary-log-key or an identity token in $%s", evidence.IDTokenEnv)
+		}
+		s, err := fulcio.Keyless(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		s.RekorURL = *o.secondaryLogURL
+		return s, nil
+	}
+	return l, nil
+}
+
+// pkcs11Cosigner returns a cosigner for an Ed25519 key on a PKCS#11 token.
+// The module stays loaded for the lifetime of the process.
+func (o *runOptions) pkcs11Cosigner() (collector.Cosigner, error) {
+	if *o.cosignName == "" || *o.pkcs11KeyLabel == "" {
+		return nil, errors.New("--pkcs11-module requires --cosign-name and --pkcs11-key-label")
+	}
+	cfg := hsm.Config{Module: *o.pkcs11Module, TokenLabel: *o.pkcs11Token, KeyLabel: *o.pkcs11KeyLabel}
+	if *o.pkcs11PINFile != "" {
+		pin, err := os.ReadFile(*o.pkcs11PINFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.PIN = strings.TrimSpace(string(pin))
+	}
+	key, err := hsm.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	vkey, err := note.NewEd25519VerifierKey(*o.cosignName, key.Public())
+	if err != nil {
+		key.Close()
+		return nil, err
+	}
+	log.Printf("Cosigning with hardware key %s\n", vkey)
+	return collector.Ed25519Cosigner(*o.cosignName, key.Public(), key.Sign), nil
+}
+
+// serveFROST serves this collector's key share to threshold cosigning
+// coordinators on addr. It only signs checkpoints one of cs accepted.
+func serveFROST(addr, shareFile string, cs []*collector.Collector) error {
+	k, err := readFROSTKeyFile(shareFile)
+	if err != nil {
+		return err
+	}
+	p := &frost.Participant{Share: k.KeyShare, Approve: func(msg []byte) error {
+		var errs []string
+		for _, c := range cs {
+			err := c.ApproveCosignature(msg)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return errors.New(strings.Join(errs, "; "))
+	}}
+	mux := http.NewServeMux()
+	mux.Handle("/frost/v1/", p)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,430 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/fulcioroots"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+	"github.com/sigstore/rekor-monitor/pkg/evidence"
+	"github.com/sigstore/rekor-monitor/pkg/retry"
+)
+
+// evidenceSignTimeout bounds requesting a certificate and uploading the
+// signature.
+const evidenceSignTimeout = time.Minute
+
+// signFlags are the flags selecting how evidence is signed.
+type signFlags struct {
+	key, idTokenFile, fulcioURL, rekorURL *string
+	offline                               *bool
+}
+
+func addSignFlags(fs *flag.FlagSet) signFlags {
+	return signFlags{
+		key:         fs.String("key", "", "PEM private key to sign with, e.g. from cosign generate-key-pair; the password is read from $"+evidence.PasswordEnv),
+		idTokenFile: fs.String("identity-token", "", "File with an OIDC identity token to sign keylessly with a Fulcio certificate, defaults to $"+evidence.IDTokenEnv),
+		fulcioURL:   fs.String("fulcio-url", evidence.DefaultFulcioURL, "Fulcio instance issuing keyless signing certificates"),
+		rekorURL:    fs.String("rekor-url", evidence.DefaultRekorURL, "Rekor log signatures are uploaded to (not uploaded if empty)"),
+		offline:     fs.Bool("offline", false, "Sign without network access: only --key is allowed and the signature is not uploaded to Rekor"),
+	}
+}
+
+// signer returns the signer selected by the flags, or nil if neither a key
+// nor an identity token is set.
+func (f signFlags) signer(ctx context.Context) (*evidence.Signer, error) {
+	token, err := evidence.ReadIDToken(*f.idTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var s *evidence.Signer
+	switch {
+	case *f.offline && *f.key == "":
+		return nil, errors.New("signing with --offline requires --key")
+	case *f.key != "" && *f.idTokenFile != "":
+		return nil, errors.New("--key and --identity-token are mutually exclusive")
+	case *f.key != "":
+		if s, err = evidence.LoadKey(*f.key, []byte(os.Getenv(evidence.PasswordEnv))); err != nil {
+			return nil, err
+		}
+	case token != "":
+		fulcio := &evidence.Fulcio{URL: *f.fulcioURL, Client: retry.NewClient(retry.DefaultPolicy())}
+		if s, err = fulcio.Keyless(ctx, token); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	s.RekorURL = *f.rekorURL
+	if *f.offline {
+		s.RekorURL = ""
+	}
+	return s, nil
+}
+
+// signFile writes a cosign-compatible signature bundle of blob to
+// bundleFile.
+func signFile(s *evidence.Signer, blob []byte, bundleFile string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), evidenceSignTimeout)
+	defer cancel()
+	sig, err := s.Sign(ctx, blob)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(bundleFile, b, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote signature bundle %s\n", bundleFile)
+	return nil
+}
+
+// evidenceCmd exports, signs and verifies evidence bundles.
+//
+//	collector evidence observe --source enclave-a --monitor-list monitor_list.json --out observations.json --key cosign.key --offline
+//	collector evidence export --accepted accepted_chpt.txt --provenance provenance.jsonl --out evidence.json [--key cosign.key | --identity-token token]
+//	collector evidence sign --file evidence.json [--key cosign.key | --identity-token token]
+//	collector evidence verify --file evidence.json [--key cosign.pub | --certificate-identity id --certificate-oidc-issuer url]
+//	collector evidence verify-cosigned --file cosigned.txt --cosign-name name --certificate-identity id --certificate-oidc-issuer url
+func evidenceCmd(args []string) error {
+	if len(args) == 0 || (args[0] != "observe" && args[0] != "export" && args[0] != "sign" && args[0] != "verify" && args[0] != "verify-cosigned") {
+		return errors.New("usage: evidence observe|export|sign|verify|verify-cosigned [flags]")
+	}
+	sub := args[0]
+	fs := flag.NewFlagSet("evidence "+sub, flag.ExitOnError)
+	switch sub {
+	case "observe":
+		return evidenceObserve(fs, args[1:])
+	case "export":
+		return evidenceExport(fs, args[1:])
+	case "sign":
+		return evidenceSign(fs, args[1:])
+	case "verify-cosigned":
+		return evidenceVerifyCosigned(fs, args[1:])
+	}
+	return evidenceVerify(fs, args[1:])
+}
+
+// evidenceObserve bundles the latest checkpoints of local monitors, so they
+// can be carried out of an air-gapped network and imported by a collector.
+func evidenceObserve(fs *flag.FlagSet, args []string) error {
+	source := fs.String("source", "", "Name of the place the observations are made, e.g. the air-gapped network")
+	monitorGlob := fs.String("monitors", MonitorGlob, "Glob matching the monitor logfiles to read")
+	monitorList := fs.String("monitor-list", "", "Path to a monitor_list JSON file, overrides --monitors")
+	last := fs.Int("last", 1, "Number of latest checkpoints read from each monitor")
+	out := fs.String("out", "observations.json", "File the observation bundle is written to")
+	bundleFile := fs.String("bundle", "", "File the signature bundle is written to, defaults to the --out file with a .bundle suffix")
+	sf := addSignFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *source == "" {
+		return errors.New("--source is required")
+	}
+
+	var monitors []collector.Monitor
+	var err error
+	if *monitorList != "" {
+		monitors, err = collector.LoadMonitorList(*monitorList)
+	} else {
+		monitors, err = collector.GlobMonitors(*monitorGlob)
+	}
+	if err != nil {
+		return err
+	}
+	b, err := evidence.Observe(*source, monitors, *last)
+	if err != nil {
+		return err
+	}
+	blob, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	blob = append(blob, '\n')
+	if err := os.WriteFile(*out, blob, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote observations of %d monitors to %s\n", len(b.Monitors), *out)
+
+	ctx, cancel := context.WithTimeout(context.Background(), evidenceSignTimeout)
+	defer cancel()
+	s, err := sf.signer(ctx)
+	if err != nil || s == nil {
+		return err
+	}
+	if *bundleFile == "" {
+		*bundleFile = *out + ".bundle"
+	}
+	return signFile(s, blob, *bundleFile)
+}
+
+func evidenceExport(fs *flag.FlagSet, args []string) error {
+	acceptedFile := fs.String("accepted", AcceptedChptFile, "Name of the accepted checkpoint file")
+	provenanceFile := fs.String("provenance", "", "File with the provenance of the accepted checkpoints (omitted if empty)")
+	origin := fs.String("origin", "", "Only export checkpoints of this log origin")
+	last := fs.Int("last", 0, "Only export the latest n accepted checkpoints (all retained ones if 0)")
+	out := fs.String("out", "evidence.json", "File the evidence bundle is written to")
+	bundleFile := fs.String("bundle", "", "File the signature bundle is written to, defaults to the --out file with a .bundle suffix")
+	stateKeyFile := fs.String("state-key-file", "", "File with the key the state files are encrypted with, defaults to $"+collector.StateKeyEnv)
+	sf := addSignFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	sc, err := collector.LoadStateCipher(*stateKeyFile)
+	if err != nil {
+		return err
+	}
+	b, err := evidence.Build(*acceptedFile, *provenanceFile, *origin, *last, sc)
+	if err != nil {
+		return err
+	}
+	blob, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	blob = append(blob, '\n')
+	if err := os.WriteFile(*out, blob, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d checkpoints and %d provenance records to %s\n", len(b.Checkpoints), len(b.Provenance), *out)
+
+	ctx, cancel := context.WithTimeout(context.Background(), evidenceSignTimeout)
+	defer cancel()
+	s, err := sf.signer(ctx)
+	if err != nil || s == nil {
+		return err
+	}
+	if *bundleFile == "" {
+		*bundleFile = *out + ".bundle"
+	}
+	return signFile(s, blob, *bundleFile)
+}
+
+func evidenceSign(fs *flag.FlagSet, args []string) error {
+	file := fs.String("file", "", "File to sign")
+	bundleFile := fs.String("bundle", "", "File the signature bundle is written to, defaults to the signed file with a .bundle suffix")
+	sf := addSignFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("--file is required")
+	}
+
+	blob, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), evidenceSignTimeout)
+	defer cancel()
+	s, err := sf.signer(ctx)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("either --key, --identity-token or $%s is required", evidence.IDTokenEnv)
+	}
+	if *bundleFile == "" {
+		*bundleFile = *file + ".bundle"
+	}
+	return signFile(s, blob, *bundleFile)
+}
+
+// verifyFlags are the flags selecting how signatures are verified.
+type verifyFlags struct {
+	key, identity, issuer, roots, rekorKey *string
+	offline                                *bool
+}
+
+func addVerifyFlags(fs *flag.FlagSet) verifyFlags {
+	return verifyFlags{
+		key:      fs.String("key", "", "PEM public key of a signature made with a long-lived key"),
+		identity: fs.String("certificate-identity", "", "Identity a keyless signature's certificate must be issued to"),
+		issuer:   fs.String("certificate-oidc-issuer", "", "OIDC issuer a keyless signature's identity must be issued by"),
+		roots:    fs.String("roots", "", "PEM file with the trusted Fulcio root and intermediate certificates, defaults to those of the public Sigstore instance"),
+		rekorKey: fs.String("rekor-key", "", "PEM public key of the Rekor log; if set, the signature must have been uploaded to it"),
+		offline:  fs.Bool("offline", false, "Verify without network access against the pinned --key or --roots only"),
+	}
+}
+
+// options returns the verification options selected by the flags.
+func (f verifyFlags) options() (evidence.VerifyOptions, error) {
+	var opts evidence.VerifyOptions
+	if *f.offline && *f.key == "" && *f.roots == "" {
+		return opts, errors.New("verifying with --offline requires a pinned --key or --roots")
+	}
+	var err error
+	if opts.PublicKey, err = readPublicKey(*f.key); err != nil {
+		return opts, err
+	}
+	if opts.RekorKey, err = readPublicKey(*f.rekorKey); err != nil {
+		return opts, err
+	}
+	if opts.PublicKey == nil {
+		if *f.identity == "" || *f.issuer == "" {
+			return opts, errors.New("keyless signatures require --certificate-identity and --certificate-oidc-issuer")
+		}
+		opts.Identity, opts.Issuer = *f.identity, *f.issuer
+		if opts.Roots, opts.Intermediates, err = fulcioPools(*f.roots); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// verifyFile reads file and verifies it against the signature bundle in
+// bundleFile, returning its contents.
+func verifyFile(file, bundleFile string, opts evidence.VerifyOptions) ([]byte, error) {
+	blob, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+	var sig evidence.Signature
+	if err := json.Unmarshal(b, &sig); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", bundleFile, err)
+	}
+	if err := evidence.Verify(blob, &sig, opts); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return blob, nil
+}
+
+func evidenceVerify(fs *flag.FlagSet, args []string) error {
+	file := fs.String("file", "", "Signed file to verify")
+	bundleFile := fs.String("bundle", "", "Signature bundle, defaults to the signed file with a .bundle suffix")
+	vf := addVerifyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("--file is required")
+	}
+	if *bundleFile == "" {
+		*bundleFile = *file + ".bundle"
+	}
+
+	opts, err := vf.options()
+	if err != nil {
+		return err
+	}
+	if _, err := verifyFile(*file, *bundleFile, opts); err != nil {
+		return err
+	}
+	fmt.Printf("%s: signature verified\n", *file)
+	return nil
+}
+
+// evidenceVerifyCosigned verifies a checkpoint cosigned with
+// --cosign-keyless against the certificate chain written with it.
+func evidenceVerifyCosigned(fs *flag.FlagSet, args []string) error {
+	file := fs.String("file", "", "Cosigned note written with --cosign-keyless")
+	name := fs.String("cosign-name", "", "Key name of the collector's cosignature")
+	identity := fs.String("certificate-identity", "", "Identity the cosigning certificate must be issued to")
+	issuer := fs.String("certificate-oidc-issuer", "", "OIDC issuer the identity must be issued by")
+	roots := fs.String("roots", "", "PEM file with the trusted Fulcio root and intermediate certificates, defaults to those of the public Sigstore instance")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" || *name == "" || *identity == "" || *issuer == "" {
+		return errors.New("--file, --cosign-name, --certificate-identity and --certificate-oidc-issuer are required")
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	opts := evidence.VerifyOptions{Identity: *identity, Issuer: *issuer}
+	if opts.Roots, opts.Intermediates, err = fulcioPools(*roots); err != nil {
+		return err
+	}
+	n, err := evidence.VerifyCosigned(data, *name, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *file, err)
+	}
+	chpt, _, _ := strings.Cut(n.Text, "\n")
+	fmt.Printf("%s: cosignature of %s verified\n", *file, chpt)
+	return nil
+}
+
+// readPublicKey reads a PEM public key, returning nil if filename is empty.
+func readPublicKey(filename string) (crypto.PublicKey, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	return pub, nil
+}
+
+// fulcioPools returns the Fulcio roots and intermediates in filename, or
+// those of the public Sigstore instance if filename is empty. Self-signed
+// certificates are roots.
+func fulcioPools(filename string) (*x509.CertPool, *x509.CertPool, error) {
+	if filename == "" {
+		roots, err := fulcioroots.Get()
+		if err != nil {
+			return nil, nil, err
+		}
+		intermediates, err := fulcioroots.GetIntermediates()
+		return roots, intermediates, err
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil {
+			roots.AddCert(c)
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	return roots, intermediates, nil
+}
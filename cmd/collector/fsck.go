@@ -0,0 +1,60 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// fsckCmd verifies the hash chain of an accepted checkpoint file written
+// with --chain.
+func fsckCmd(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	acceptedFile := fs.String("accepted", AcceptedChptFile, "Name of the chained accepted checkpoint file to verify")
+	stateKeyFile := fs.String("state-key-file", "", "File with the key the accepted file is encrypted with, defaults to $"+collector.StateKeyEnv)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	sc, err := collector.LoadStateCipher(*stateKeyFile)
+	if err != nil {
+		return err
+	}
+
+	report, err := collector.VerifyChainFile(*acceptedFile, sc)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%s: found %d problems in %d lines", *acceptedFile, len(report.Problems), report.Lines)
+	}
+
+	fmt.Printf("%s: %d lines verified, entries %d to %d\n", *acceptedFile, report.Lines, report.FirstSeq, report.LastSeq)
+	if !report.Anchored {
+		fmt.Printf("%s: no anchor, entries lost from the head or tail of the file cannot be detected\n", *acceptedFile)
+		return nil
+	}
+	if report.FirstSeq > 1 {
+		fmt.Printf("%s: entries before %d were pruned\n", *acceptedFile, report.FirstSeq)
+	}
+	return nil
+}
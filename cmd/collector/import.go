@@ -0,0 +1,71 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/evidence"
+)
+
+// ImportDir is the default directory imported observations are written to.
+const ImportDir = "imported"
+
+// importCmd verifies a signed observation bundle, such as one written by
+// "evidence observe" in another enclave, and adds its monitors to the
+// import directory read by "run --import-dir".
+//
+//	collector import [--key cosign.pub | --certificate-identity id --certificate-oidc-issuer url] [--import-dir imported] observations.json
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	bundleFile := fs.String("bundle", "", "Signature bundle, defaults to the observation bundle with a .bundle suffix")
+	importDir := fs.String("import-dir", ImportDir, "Directory the imported observations are written to")
+	maxAge := fs.Duration("max-age", evidence.DefaultImportMaxAge, "Age after which observation bundles are too stale to import (0 disables the check)")
+	vf := addVerifyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: import [flags] <observation bundle>")
+	}
+	file := fs.Arg(0)
+	if *bundleFile == "" {
+		*bundleFile = file + ".bundle"
+	}
+
+	opts, err := vf.options()
+	if err != nil {
+		return err
+	}
+	blob, err := verifyFile(file, *bundleFile, opts)
+	if err != nil {
+		return err
+	}
+	var b evidence.ObservationBundle
+	if err := json.Unmarshal(blob, &b); err != nil {
+		return fmt.Errorf("parsing %s: %w", file, err)
+	}
+	monitors, err := evidence.Import(&b, *importDir, *maxAge, time.Now())
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", file, err)
+	}
+	fmt.Printf("Imported observations of %d monitors from %s to %s\n", len(monitors), b.Source, *importDir)
+	return nil
+}
@@ -0,0 +1,138 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// Default paths for the monitor logfiles and the accepted checkpoint file
+const (
+	AcceptedChptFile = "accepted_chpt.txt"
+	AuditLogFile     = "audit.log"
+	IntentFile       = "intent.json"
+	MonitorGlob      = "logInfo*.txt"
+	serviceName      = "rekor-collector"
+)
+
+// originIntervals is a repeatable flag of origin=interval pairs.
+type originIntervals map[string]time.Duration
+
+func (o originIntervals) String() string {
+	var pairs []string
+	for origin, interval := range o {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", origin, interval))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (o originIntervals) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		origin, interval, ok := strings.Cut(pair, "=")
+		if !ok || origin == "" {
+			return fmt.Errorf("expected origin=interval, got %q", pair)
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("interval for %s must be positive", origin)
+		}
+		o[origin] = d
+	}
+	return nil
+}
+
+// commands are the collector's subcommands. Running the collector without a
+// subcommand is equivalent to "run".
+var commands = map[string]func(args []string) error{
+	"alert-test":   alertTestCmd,
+	"audit":        auditCmd,
+	"audit-mirror": auditMirrorCmd,
+	"bench":        benchCmd,
+	"check-config": checkConfigCmd,
+	"evidence":     evidenceCmd,
+	"fsck":         fsckCmd,
+	"frost-keygen": frostKeygenCmd,
+	"import":       importCmd,
+	"mdns":         mdnsCmd,
+	"migrate":      migrateCmd,
+	"prune":        pruneCmd,
+	"run":          runCmd,
+	"spot-audit":   spotAuditCmd,
+	"sql-schema":   sqlSchemaCmd,
+	"version":      versionCmd,
+}
+
+// chaosFlagPrefix is the prefix of the chaos testing flags, which are
+// hidden from the usage message so that they are not mistaken for
+// production settings.
+const chaosFlagPrefix = "chaos-"
+
+// hideFlags leaves the flags of fs whose name starts with prefix out of its
+// usage message. They can still be set.
+func hideFlags(fs *flag.FlagSet, prefix string) {
+	fs.Usage = func() {
+		shown := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		shown.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, prefix) {
+				shown.Var(f.Value, f.Name, f.Usage)
+				shown.Lookup(f.Name).DefValue = f.DefValue
+			}
+		})
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		shown.PrintDefaults()
+	}
+}
+
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: %s [%s] [flags]\n", os.Args[0], strings.Join(names, "|"))
+}
+
+func main() {
+	args := os.Args[1:]
+	cmd := runCmd
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		c, ok := commands[args[0]]
+		if !ok {
+			usage()
+			os.Exit(2)
+		}
+		cmd, args = c, args[1:]
+	}
+
+	// Failures exit with the code of their class, see collector.ExitCode.
+	if err := cmd(args); err != nil {
+		log.Printf("%v (code=%s)", err, collector.ErrorCode(err))
+		os.Exit(collector.ExitCode(err))
+	}
+}
@@ -0,0 +1,65 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// mdnsCmd lists the monitors advertised over mDNS on the local network and
+// confirms them by adding them to the allow list.
+func mdnsCmd(args []string) error {
+	fs := flag.NewFlagSet("mdns", flag.ExitOnError)
+	allowFile := fs.String("allow-file", "mdns_allow.txt", "File listing the confirmed instance names")
+	allow := fs.String("allow", "", "Confirm the named instance so it counts towards quorum")
+	timeout := fs.Duration("timeout", collector.DefaultMDNSTimeout, "Time to wait for responses")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *allow != "" {
+		if err := collector.AllowInstance(*allowFile, *allow); err != nil {
+			return err
+		}
+		fmt.Printf("Allowed %s in %s\n", *allow, *allowFile)
+		return nil
+	}
+
+	allowed, err := collector.ReadAllowList(*allowFile)
+	if err != nil {
+		return err
+	}
+	instances, err := collector.BrowseMDNS(context.Background(), *timeout)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		fmt.Println("No monitors found")
+		return nil
+	}
+	for _, inst := range instances {
+		status := "pending"
+		if allowed[inst.Name] {
+			status = "allowed"
+		}
+		fmt.Printf("%-30s %-8s %s\n", inst.Name, status, inst.URL())
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// migrateCmd imports the file based state of a collector into the storage
+// given by --storage. The accepted file is validated first and nothing is
+// imported if any line is invalid. Its lines are then copied unchanged, so
+// checkpoint timestamps and chain links are kept, unless the storage
+// already holds checkpoints. With --history-dir or --provenance-file, the
+// history and provenance the collector did not record are recovered from
+// the logfiles of its local monitors.
+//
+//	collector migrate --storage bolt:///var/lib/collector/state.db [run flags]
+func migrateCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	o := registerRunFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := loadConfig(fs, &o.configDirs); err != nil {
+		return err
+	}
+
+	if *o.readOnly {
+		return errors.New("migrate cannot be used with --read-only")
+	}
+	if *o.tenants != "" {
+		return errors.New("migrate cannot be used with --tenants, run migrates the accepted file of each tenant into its storage on startup")
+	}
+	cfg, err := o.config()
+	if err != nil {
+		return err
+	}
+	accepted, problems, err := collector.ValidateAccepted(*o.acceptedFile, cfg.StateCipher, cfg.Chain)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s is invalid, nothing was migrated:\n  %s", *o.acceptedFile, strings.Join(problems, "\n  "))
+	}
+
+	s, scheme, err := o.storageBackend(cfg.StateCipher, "")
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errors.New("migrate requires --storage")
+	}
+	defer s.Close()
+	if _, err := s.Latest(1); err == nil {
+		fmt.Printf("%s storage already holds accepted checkpoints, not migrating %s\n", scheme, *o.acceptedFile)
+	} else {
+		n, err := s.Migrate(*o.acceptedFile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Migrated %d accepted checkpoints from %s to %s storage\n", n, *o.acceptedFile, scheme)
+	}
+
+	cfg.Storage = s
+	cs, err := o.collectors(cfg, false, false)
+	if err != nil {
+		return err
+	}
+	observations, records, err := cs[0].MigrateObservations(accepted)
+	if err != nil {
+		return err
+	}
+	if cfg.HistoryDir != "" {
+		fmt.Printf("Recovered %d observations into %s\n", observations, cfg.HistoryDir)
+	}
+	if cfg.ProvenanceFile != "" {
+		fmt.Printf("Recovered the provenance of %d of %d accepted checkpoints into %s\n", records, len(accepted), cfg.ProvenanceFile)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// pruneCmd prunes the storage given by the run flags to --keep accepted
+// checkpoints and compacts it, reporting the space reclaimed. It is run
+// while the collector is stopped, or by a scheduler for collectors running
+// without --maintenance-interval; storages that only one process can open
+// fail while the collector runs.
+//
+//	collector prune [--storage bolt://collector.db] [--keep 20] [run flags]
+func pruneCmd(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	o := registerRunFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := loadConfig(fs, &o.configDirs); err != nil {
+		return err
+	}
+
+	cfg, err := o.config()
+	if err != nil {
+		return err
+	}
+	defer o.closeStorages()
+	if cfg.Storage, err = o.openStorage(cfg.StateCipher); err != nil {
+		return err
+	}
+	cs, err := o.collectors(cfg, false, true)
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		report, err := c.Maintain()
+		name := c.Namespace()
+		if name == "" {
+			name = "storage"
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Printf("%s: %s\n", name, report)
+	}
+	return nil
+}
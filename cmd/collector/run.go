@@ -0,0 +1,1193 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+	"github.com/sigstore/rekor-monitor/pkg/etcd"
+	"github.com/sigstore/rekor-monitor/pkg/evidence"
+	"github.com/sigstore/rekor-monitor/pkg/kube"
+	"github.com/sigstore/rekor-monitor/pkg/postgres"
+	"github.com/sigstore/rekor-monitor/pkg/rediscache"
+	"github.com/sigstore/rekor-monitor/pkg/retry"
+	"github.com/sigstore/rekor-monitor/pkg/tsdb"
+	"github.com/sigstore/rekor-monitor/pkg/version"
+)
+
+// runOptions are the flags of the run command.
+type runOptions struct {
+	fs                *flag.FlagSet
+	interval          *time.Duration
+	schedule          *string
+	jitter            *time.Duration
+	intervals         originIntervals
+	intervalMin       *time.Duration
+	intervalMax       *time.Duration
+	intervalEntries   *int64
+	monitorGlob       *string
+	monitorList       *string
+	registry          *bool
+	probation         *time.Duration
+	acceptedFile      *string
+	storage           *string
+	storageNamespace  *string
+	keep              *int
+	maintenance       *time.Duration
+	quorum            *int
+	minNetworks       *int
+	quorumFailure     *string
+	resolution        *string
+	proofURL          *string
+	proofCacheSize    *int
+	proofCacheTTL     *time.Duration
+	proofCacheFile    *string
+	baselineURL       *string
+	baselineEntries   *int64
+	baselineRounds    *int
+	witnesses         stringList
+	peers             stringList
+	roughtime         stringList
+	timeSyncInterval  *time.Duration
+	timeMaxAge        *time.Duration
+	maxClockSkew      *time.Duration
+	entriesURL        *string
+	watchEmails       stringList
+	watchSANs         stringList
+	watchKeys         stringList
+	entriesOrigin     *string
+	mirrorDir         *string
+	witnessQuorum     *int
+	distributorURL    *string
+	distributorLogID  *string
+	discover          stringList
+	origins           stringList
+	strict            *bool
+	logKeys           stringList
+	extensionRules    stringList
+	discoveryInterval *time.Duration
+	chain             *bool
+	sshUser           *string
+	sshKeys           stringList
+	sshKnownHosts     *string
+	batch             *int
+	historyDir        *string
+	historyDedup      *bool
+	reportDir         *string
+	intentFile        *string
+	reportRetention   *time.Duration
+	publishDir        *string
+	statementsDir     *string
+	statementsIssuer  *string
+	scittURL          *string
+	follow            *bool
+	output            *string
+	cosignedFile      *string
+	cosignExtensions  *bool
+	cosignFormat      *string
+	cosignKey         *string
+	frostShare        *string
+	cosignName        *string
+	pkcs11Module      *string
+	pkcs11Token       *string
+	pkcs11KeyLabel    *string
+	pkcs11PINFile     *string
+	cosignKeyless     *bool
+	identityToken     *string
+	fulcioURL         *string
+	secondaryLogURL   *string
+	secondaryLogKey   *string
+	secondaryBundles  *string
+	frostPeers        frostPeers
+	frostAddr         *string
+	provenanceFile    *string
+	influxURL         *string
+	influxTokenFile   *string
+	timescaleDSN      *string
+	redisURL          *string
+	redisTTL          *time.Duration
+	heartbeatTimeout  *time.Duration
+	breakerThreshold  *int
+	breakerBackoff    *time.Duration
+	breakerMaxBackoff *time.Duration
+	maxFileSize       *int64
+	stallAfter        *time.Duration
+	spikeFactor       *float64
+	divergeEntries    *int64
+	divergeRounds     *int
+	staleRounds       *int
+	maxMergeDelays    originIntervals
+	alertTemplate     *string
+	alertSinks        stringList
+	alertRoutes       stringList
+	readTimeout       *time.Duration
+	roundTimeout      *time.Duration
+	verifyTimeout     *time.Duration
+	persistTimeout    *time.Duration
+	exportTimeout     *time.Duration
+	offline           *bool
+	readOnly          *bool
+	importDir         *string
+	httpAttempts      *int
+	httpBackoff       *time.Duration
+	httpTimeout       *time.Duration
+	httpBudget        *time.Duration
+	logAPIRate        *float64
+	logAPIBurst       *int
+	logAPIDaily       *int64
+	logAPIReserve     *int64
+	sampleSize        *int
+	sampleMaxSkip     *int
+	chaosDrop         *float64
+	chaosDelay        *time.Duration
+	logAPITransport   *collector.QuotaTransport
+	metricsAddr       *string
+	apiAddr           *string
+	grpcAddr          *string
+	apiSocket         *string
+	adminAddr         *string
+	adminTokenFile    *string
+	pushAddr          *string
+	pushQueue         *string
+	pushQueueSize     *int
+	svidCert          *string
+	svidKey           *string
+	svidBundle        *string
+	auditLog          *string
+	stateKeyFile      *string
+	tenants           *string
+	stateDir          *string
+	configDirs        stringList
+	leaseName         *string
+	leaseNamespace    *string
+	leaseIdentity     *string
+	etcdEndpoints     *string
+	etcdUser          *string
+	etcdPasswordFile  *string
+	etcdElection      *string
+	election          *etcd.Election
+	storages          []collector.Storage
+	service           *bool
+}
+
+// registerRunFlags registers the flags configuring a collector on fs.
+func registerRunFlags(fs *flag.FlagSet) *runOptions {
+	o := &runOptions{fs: fs, intervals: originIntervals{}, maxMergeDelays: originIntervals{}, frostPeers: frostPeers{}}
+	o.interval = fs.Duration("interval", collector.DefaultInterval, "Length of interval between each periodical check")
+	o.schedule = fs.String("schedule", "", "Cron expression, e.g. \"*/5 * * * *\", to run collection rounds at instead of every --interval")
+	o.jitter = fs.Duration("jitter", 0, "Maximum random delay added to each interval")
+	fs.Var(o.intervals, "origin-interval", "Comma-separated origin=interval pairs collected on their own schedule, e.g. rekor.sigstore.dev=1m (repeatable)")
+	o.intervalMin = fs.Duration("interval-min", 10*time.Second, "Shortest interval --interval and --origin-interval adapt to while the log grows fast, with --interval-max")
+	o.intervalMax = fs.Duration("interval-max", 0, "Longest interval --interval and --origin-interval adapt to while the log is quiet (0 keeps them fixed)")
+	o.intervalEntries = fs.Int64("interval-entries", collector.DefaultAdaptiveEntries, "Number of new log entries an adaptive interval aims to find in each round")
+	o.monitorGlob = fs.String("monitors", MonitorGlob, "Glob matching the monitor logfiles to read")
+	o.registry = fs.Bool("registry", false, "Keep the monitors in a registry in the storage, seeded from --monitor-list or --monitors, with pending, active, quarantined and retired states managed at /admin/v1/monitors on --admin-addr")
+	o.probation = fs.Duration("probation", collector.DefaultProbation, "How long a monitor new to the --registry is read, its checkpoints only checked for conflicts, before it votes")
+	o.monitorList = fs.String("monitor-list", "", "Path to a monitor_list JSON file, overrides --monitors")
+	fs.Var(&o.discover, "discover", "Source of additional monitors: dns:<name> for TXT records, srv:<domain> for _rekor-monitor._tcp SRV records, mdns:<allow file> for confirmed instances on the local network or the HTTPS URL of a monitor_list document (repeatable)")
+	o.discoveryInterval = fs.Duration("discovery-interval", collector.DefaultDiscoveryInterval, "Time between refreshes of discovered monitors")
+	home, _ := os.UserHomeDir()
+	o.sshUser = fs.String("ssh-user", os.Getenv("USER"), "User name for ssh:// monitor logfiles without one")
+	fs.Var(&o.sshKeys, "ssh-key", "Unencrypted private key file used to read ssh:// monitor logfiles over SFTP (repeatable)")
+	o.sshKnownHosts = fs.String("ssh-known-hosts", filepath.Join(home, ".ssh", "known_hosts"), "known_hosts file the host keys of ssh:// monitors are verified against")
+	o.acceptedFile = fs.String("accepted", AcceptedChptFile, "Name of the file accepted checkpoints are written to")
+	o.intentFile = fs.String("intent-file", IntentFile, "File recording the acceptance of a round while it is persisted and published, so that a round interrupted by a crash is completed or abandoned on restart (disabled if empty)")
+	o.storage = fs.String("storage", "", "Where accepted checkpoints are stored instead of --accepted, filled from --accepted on first use: bolt://<path> for a bbolt database, a postgres:// connection URL, dynamodb://<table> or etcd://<key prefix>")
+	o.storageNamespace = fs.String("storage-namespace", "", "Namespace of the accepted checkpoints in a database shared by several collectors; only one collector writes to a namespace at a time")
+	o.keep = fs.Int("keep", collector.DefaultKeep, "Number of accepted checkpoints retained in the storage")
+	o.maintenance = fs.Duration("maintenance-interval", 0, "Interval at which the storage is pruned to --keep and compacted in the background, instead of pruning it after every accepted checkpoint (0 disables the background task)")
+	o.quorum = fs.Int("quorum", collector.DefaultQuorum, "Number of monitors that must agree on a tree size")
+	o.minNetworks = fs.Int("min-networks", 0, "Number of distinct networks, tagged in the monitor list, the monitors agreeing on a tree size must be in")
+	fs.Var(&o.origins, "expected-origin", "Origin of a log monitors are expected to observe, e.g. rekor.sigstore.dev; checkpoints of other origins are rejected unless a monitor list entry sets its own origin (repeatable)")
+	o.strict = fs.Bool("strict", false, "Exclude a monitor from the round with an alert if any line read from it is malformed, unsigned or signed by a key other than --log-key, instead of failing the round")
+	fs.Var(&o.logKeys, "log-key", "PEM public key of a log whose signatures are verified in --strict mode, e.g. from /api/v1/log/publicKey (repeatable)")
+	fs.Var(&o.extensionRules, "extension", "Extension policy rule for checkpoints read from monitors: require:<key>[=<pattern>], validate:<key>=<pattern>, reject:<key> or strip:<key> removing the line from the cosigned note, where <key> is the text before the colon of an extension line (repeatable)")
+	o.quorumFailure = fs.String("quorum-failure", collector.QuorumHold, "What a round does when no tree size reaches quorum: hold keeps the last accepted checkpoint, degrade accepts the best supported tree size marked as degraded and alerts, alert accepts nothing and alerts")
+	o.resolution = fs.String("resolution", collector.ResolveLargest, "Which checkpoint to accept when several tree sizes reach quorum in a round: largest, votes for the most monitors, recent for the newest timestamp, or consistent for the largest one linked to the others by consistency proofs from --proof-url")
+	o.proofURL = fs.String("proof-url", "", "Rekor API consistency proofs are fetched from for --resolution consistent and to bridge inclusion proofs in /api/v1/verify-inclusion, e.g. https://rekor.sigstore.dev")
+	o.proofCacheSize = fs.Int("proof-cache-size", collector.DefaultProofCacheSize, "Number of consistency proofs fetched from --proof-url kept in memory")
+	o.proofCacheTTL = fs.Duration("proof-cache-ttl", 0, "How long a cached consistency proof is used before it is fetched again (0 keeps it until evicted)")
+	o.proofCacheFile = fs.String("proof-cache-file", "", "File the consistency proof cache is persisted to, so that it survives restarts (disabled if empty)")
+	o.baselineURL = fs.String("baseline-url", "", "Rekor API whose tree head every accepted checkpoint is compared with, as a sanity baseline of the monitoring pipeline, e.g. https://rekor.sigstore.dev (disabled if empty)")
+	o.baselineEntries = fs.Int64("baseline-entries", collector.DefaultBaselineEntries, "Alert when the tree size reported by --baseline-url and the accepted tree size differ by more than this many entries for --baseline-rounds rounds")
+	o.baselineRounds = fs.Int("baseline-rounds", collector.DefaultBaselineRounds, "Number of consecutive rounds the accepted tree size must diverge from --baseline-url before alerting")
+	o.entriesURL = fs.String("entries-url", "", "Rekor API the entries added between accepted checkpoints are read from, to scan them for --watch-email, --watch-san and --watch-fingerprint and to store them in --mirror-dir, e.g. https://rekor.sigstore.dev")
+	fs.Var(&o.watchEmails, "watch-email", "Email address whose certificates are alerted on when they appear in the log read from --entries-url (repeatable)")
+	fs.Var(&o.watchSANs, "watch-san", "URI, DNS or email subject alternative name whose certificates are alerted on when they appear in the log read from --entries-url (repeatable)")
+	fs.Var(&o.watchKeys, "watch-fingerprint", "Hex SHA-256 fingerprint of a DER public key alerted on when it appears in the log read from --entries-url (repeatable)")
+	o.entriesOrigin = fs.String("entries-origin", "", "Origin of the log read from --entries-url, e.g. rekor.sigstore.dev; checkpoints of other logs are neither scanned nor mirrored (all if empty)")
+	o.mirrorDir = fs.String("mirror-dir", "", "Directory the entries read from --entries-url between consecutive accepted checkpoints are stored in, verified against their root hashes (disabled if empty)")
+	fs.Var(&o.witnesses, "witness", "Note verifier key of a witness whose cosignatures count towards --witness-quorum, e.g. witness.example.com+1234abcd+AeT... (repeatable)")
+	o.witnessQuorum = fs.Int("witness-quorum", 0, "Number of --witness keys that must have cosigned a checkpoint before it is accepted (0 disables the check)")
+	fs.Var(&o.peers, "peer", "Peer collector whose signed attestations of its latest accepted checkpoints are read every round, as <API URL>,<note verifier key>; its checkpoints are checked for conflicts but do not count towards the quorum (repeatable)")
+	o.distributorURL = fs.String("distributor-url", "", "Witness distributor, such as omniwitness's, whose collected cosignatures count towards --witness-quorum (disabled if empty)")
+	o.distributorLogID = fs.String("distributor-log-id", "", "ID of the log in the --distributor-url API")
+	o.batch = fs.Int("batch", 0, "Number of latest checkpoints read from each monitor per round; every new tree size among them reaching quorum is accepted in a single write (0 accepts only the largest)")
+	o.sampleSize = fs.Int("sample-size", 0, "Number of monitors read per round, chosen at random with rotation, for fleets too large to read every round; the quorum is counted over the sample (0 reads every monitor)")
+	o.sampleMaxSkip = fs.Int("sample-max-skip", 0, "Number of consecutive rounds a monitor may be left out of the --sample-size sample before it is read regardless (0 is twice the rounds needed to read every monitor once)")
+	o.provenanceFile = fs.String("provenance", "", "File recording which monitors' observations supported each accepted checkpoint, served by the API (disabled if empty)")
+	o.cosignedFile = fs.String("cosigned", "", "File the newest accepted checkpoint is written to as a signed note cosigned by the collector (disabled if empty)")
+	o.cosignFormat = fs.String("cosign-format", collector.CosignNoteFormat, "Format of the collector's signature in the --cosigned note: note for a plain note signature, or cosignature/v1 for a timestamped witness cosignature (needs an Ed25519 key)")
+	o.cosignExtensions = fs.Bool("cosign-extensions", false, "Add extension lines with the collector's key name, round ID and number of agreeing monitors to the --cosigned note; the log's signatures do not cover them and are left out")
+	o.cosignKey = fs.String("cosign-key", "", "File with the collector's note signing key, as created by golang.org/x/mod/sumdb/note.GenerateKey")
+	o.cosignName = fs.String("cosign-name", "", "Key name of a hardware or keyless cosigning key in signed notes, e.g. collector.example.com")
+	o.cosignKeyless = fs.Bool("cosign-keyless", false, "Cosign with ephemeral keys certified by Fulcio for the collector's OIDC identity, writing the certificate chain after the cosigned note")
+	o.identityToken = fs.String("identity-token", "", "File with the OIDC identity token for keyless cosigning, re-read whenever a key is certified; defaults to $"+evidence.IDTokenEnv)
+	o.fulcioURL = fs.String("fulcio-url", evidence.DefaultFulcioURL, "Fulcio instance certifying keyless cosigning keys")
+	o.secondaryLogURL = fs.String("secondary-log-url", "", "Rekor log every --cosigned note is submitted to as a hashedrekord entry, so that third parties can monitor the collector (disabled if empty)")
+	o.secondaryLogKey = fs.String("secondary-log-key", "", "PEM private key signing --secondary-log-url entries, e.g. from cosign generate-key-pair, with the password in $"+evidence.PasswordEnv+"; entries are signed keylessly with --identity-token if empty")
+	o.secondaryBundles = fs.String("secondary-log-bundles", "", "File a JSON line with every note submitted to --secondary-log-url and its signature bundle is appended to (disabled if empty)")
+	o.pkcs11Module = fs.String("pkcs11-module", "", "PKCS#11 module of a token holding an Ed25519 cosigning key, e.g. /usr/lib/libykcs11.so for a YubiKey")
+	o.pkcs11Token = fs.String("pkcs11-token", "", "Label of the PKCS#11 token, defaults to the first token")
+	o.pkcs11KeyLabel = fs.String("pkcs11-key-label", "", "Label of the cosigning key objects on the PKCS#11 token")
+	o.pkcs11PINFile = fs.String("pkcs11-pin-file", "", "File with the user PIN of the PKCS#11 token")
+	o.frostShare = fs.String("frost-share", "", "File with this collector's share of a threshold cosigning key, see the frost-keygen command")
+	fs.Var(o.frostPeers, "frost-peer", "Comma-separated id=url pairs of the collectors holding shares of the threshold cosigning key, including this one; cosigns with them instead of --cosign-key (repeatable)")
+	o.frostAddr = fs.String("frost-addr", "", "Address to serve this collector's key share to threshold cosigning coordinators on at /frost/v1/ (disabled if empty)")
+	o.follow = fs.Bool("follow", false, "Stream every accepted checkpoint to stdout in the --output format, e.g. for jq or a log shipper; log messages stay on stderr")
+	o.output = fs.String("output", collector.StreamJSON, "Format of --follow: json for a JSON object per line, text for the flattened checkpoint line, cbor for a CBOR sequence or protobuf for length-delimited messages")
+	o.publishDir = fs.String("publish-dir", "", "Directory accepted checkpoints are published to as a static tree with latest, by-size/ and by-date/ files per origin, for syncing to a CDN (disabled if empty)")
+	o.statementsDir = fs.String("statements-dir", "", "Directory every acceptance decision is written to as a SCITT signed statement, a COSE_Sign1 message signed with the Ed25519 cosigning key (disabled if empty)")
+	o.statementsIssuer = fs.String("statements-issuer", "", "Issuer claim of the --statements-dir signed statements, such as the collector's URL; defaults to the cosigning key name")
+	o.scittURL = fs.String("scitt-url", "", "SCITT transparency service every --statements-dir signed statement is registered with, saving the receipts next to the statements (disabled if empty)")
+	o.importDir = fs.String("import-dir", "", "Directory of observations imported with the import command, whose monitors join every round (disabled if empty)")
+	o.historyDir = fs.String("history-dir", "", "Directory recording every checkpoint read from each monitor in a file per monitor (disabled if empty)")
+	o.historyDedup = fs.Bool("history-dedup", false, "Store each checkpoint recorded in --history-dir once, content-addressed and compressed with zstd dictionaries trained on the checkpoints, instead of in every monitor's history file")
+	o.reportDir = fs.String("report-dir", "", "Directory the report of every round is archived to as zstd compressed JSON, served by the API for the round that accepted a checkpoint (disabled if empty)")
+	o.reportRetention = fs.Duration("report-retention", collector.DefaultReportRetention, "How long archived round reports are kept (0 keeps them)")
+	o.influxURL = fs.String("influx-url", "", "InfluxDB write endpoint every round is exported to, e.g. http://localhost:8086/api/v2/write?org=sigstore&bucket=rekor (disabled if empty)")
+	o.influxTokenFile = fs.String("influx-token-file", "", "File with the InfluxDB API token")
+	o.timescaleDSN = fs.String("timescale-dsn", "", "PostgreSQL connection string of a TimescaleDB database every round is exported to (disabled if empty)")
+	o.redisURL = fs.String("redis-url", "", "Redis server the latest accepted checkpoint and monitor freshness are cached in for verifiers, e.g. rediss://:password@redis.example.com:6379/0 (disabled if empty)")
+	o.redisTTL = fs.Duration("redis-ttl", 0, "How long cached keys live in Redis without being refreshed by a round (0 keeps them)")
+	o.chain = fs.Bool("chain", false, "Prefix each accepted checkpoint with a sequence number and the hash of the previous line, see the fsck command")
+	fs.Var(&o.roughtime, "roughtime", "Roughtime server, as <address>,<base64 Ed25519 public key>, whose signed time replaces the local clock for freshness checks and acceptance timestamps (repeatable, tried in order)")
+	o.timeSyncInterval = fs.Duration("time-sync-interval", collector.DefaultTimeSyncInterval, "How often the local clock is measured against the --roughtime servers")
+	o.timeMaxAge = fs.Duration("time-max-age", collector.DefaultTimeMaxAge, "How long the last measurement against the --roughtime servers is used while none answers, after which rounds hold")
+	o.maxClockSkew = fs.Duration("max-clock-skew", 0, "Alert when the local clock is off from the --roughtime servers by more than this (0 disables the check)")
+	o.heartbeatTimeout = fs.Duration("heartbeat-timeout", 0, "Time after which a monitor without a heartbeat is reported down and one whose tree size has not grown idle (defaults to 3 intervals)")
+	o.breakerThreshold = fs.Int("breaker-threshold", collector.DefaultBreakerThreshold, "Consecutive read failures after which a monitor is skipped")
+	o.breakerBackoff = fs.Duration("breaker-backoff", collector.DefaultBreakerBackoff, "Initial time a failing monitor is skipped for, doubled on every further failure")
+	o.breakerMaxBackoff = fs.Duration("breaker-max-backoff", collector.DefaultBreakerMaxWait, "Maximum time a failing monitor is skipped for")
+	o.stallAfter = fs.Duration("stall-after", 0, "Alert when the accepted tree size of a log has not grown for this long (0 disables the check)")
+	o.spikeFactor = fs.Float64("spike-factor", collector.DefaultSpikeFactor, "Alert when a log grows this many times faster than its average rate (0 disables the check)")
+	o.divergeEntries = fs.Int64("divergence-entries", collector.DefaultDivergenceEntries, "Alert when a monitor's tree size differs from the fleet median by more than this many entries (0 disables the check)")
+	o.divergeRounds = fs.Int("divergence-rounds", collector.DefaultDivergenceRounds, "Number of consecutive rounds a monitor must diverge before alerting")
+	o.staleRounds = fs.Int("stale-rounds", collector.DefaultStaleRounds, "Alert when a monitor reports the same tree size, behind the accepted one, for this many rounds in which the log grew (0 disables the check)")
+	fs.Var(o.maxMergeDelays, "max-merge-delay", "Comma-separated origin=duration pairs; alert when the accepted checkpoint of the log is older than the duration while all monitors are healthy, a potential freeze attack (repeatable)")
+	o.alertTemplate = fs.String("alert-template", "", "File holding a Go text/template rendering the body of every alert from its fields: Kind, Severity, Namespace, Origin, Size, Previous, Roots, Monitors, Message and Time")
+	fs.Var(&o.alertSinks, "alert-sink", "Sink alerts are sent to: webhook:<url> posting them as JSON, slack:<incoming webhook url>, teams:<incoming webhook url>, pagerduty:<routing key file>, matrix:<homeserver url>#<room id>,<access token file>, or github:<owner>/<name>,<token file> and gitlab:<project>,<token file> tracking each incident in an issue, optionally followed by ,<api url>; optionally prefixed with <name>= (repeatable)")
+	fs.Var(&o.alertRoutes, "alert-route", "Comma-separated alert kinds or severities (critical, warning or *) and the comma-separated names of the sinks they are sent to, such as conflict,freeze=pagerduty,slack; without routes every alert is sent to every sink (repeatable)")
+	o.maxFileSize = fs.Int64("max-file-size", collector.DefaultMaxFileSize, "Size in bytes above which a monitor logfile is skipped for the round (0 disables the check)")
+	o.readTimeout = fs.Duration("read-timeout", collector.DefaultReadTimeout, "Maximum time spent reading a monitor logfile (0 disables the timeout)")
+	o.roundTimeout = fs.Duration("round-timeout", 0, "Maximum duration of a collection round; a round that times out is retried on schedule (0 disables the timeout)")
+	o.verifyTimeout = fs.Duration("verify-timeout", collector.DefaultVerifyTimeout, "Maximum time spent on each consistency proof and witness distributor request")
+	o.persistTimeout = fs.Duration("persist-timeout", collector.DefaultPersistTimeout, "Maximum time spent writing the accepted checkpoints of a round, with their provenance and audit records")
+	o.exportTimeout = fs.Duration("export-timeout", collector.DefaultExportTimeout, "Maximum time spent exporting the report of a round")
+	o.readOnly = fs.Bool("read-only", false, "Serve the query APIs from --storage shared with a collector writing it, without collecting or writing, so read traffic can be spread over several replicas")
+	o.chaosDrop = fs.Float64(chaosFlagPrefix+"drop-observations", 0, "Probability between 0 and 1 of dropping the checkpoints read from a monitor as if the read failed, for game days in staging")
+	o.chaosDelay = fs.Duration(chaosFlagPrefix+"delay-storage", 0, "Delay added to every read and write of the storage, for game days in staging")
+	hideFlags(fs, chaosFlagPrefix)
+	o.offline = fs.Bool("offline", false, "Disable all outbound network access for air-gapped deployments: monitors are only read from local logfiles, such as those written by the import command, and flags needing the network are rejected")
+	o.httpAttempts = fs.Int("http-attempts", retry.DefaultAttempts, "Maximum attempts of outbound HTTP requests failing with a network error or status 429, 502, 503 or 504")
+	o.httpBackoff = fs.Duration("http-backoff", retry.DefaultBackoff, "Upper bound of the random delay before the first retry of an outbound HTTP request, doubling with every retry")
+	o.httpTimeout = fs.Duration("http-timeout", retry.DefaultTimeout, "Timeout of every attempt of an outbound HTTP request")
+	o.httpBudget = fs.Duration("http-budget", retry.DefaultBudget, "Maximum time spent on all attempts of an outbound HTTP request")
+	o.logAPIRate = fs.Float64("log-api-rate", 0, "Requests per second sent to the log APIs at --proof-url and --entries-url (0 is unlimited)")
+	o.logAPIBurst = fs.Int("log-api-burst", 1, "Number of requests to the log APIs that may be sent at once within --log-api-rate")
+	o.logAPIDaily = fs.Int64("log-api-daily-budget", 0, "Requests sent to the log APIs per UTC day; identity scans and mirroring stop first, leaving --log-api-reserve requests for consistency proofs (0 is unlimited)")
+	o.logAPIReserve = fs.Int64("log-api-reserve", 0, "Requests of --log-api-daily-budget that identity scans and mirroring may not use (defaults to 10% of the budget)")
+	o.metricsAddr = fs.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. :2112 (disabled if empty)")
+	o.pushAddr = fs.String("push-addr", "", "Address to accept checkpoints pushed by monitors with a spiffe_id in the monitor list on at /push, over mTLS with X.509-SVIDs (disabled if empty)")
+	o.pushQueue = fs.String("push-queue", "", "File of a persistent queue buffering checkpoints pushed to --push-addr until they are collected; pushes are refused with 503 while it is full (disabled if empty)")
+	o.pushQueueSize = fs.Int("push-queue-size", collector.DefaultPushQueueSize, "Number of pushes --push-queue holds")
+	o.svidCert = fs.String("svid-cert", "svid.pem", "File with the collector's X.509-SVID, reloaded when it changes")
+	o.svidKey = fs.String("svid-key", "svid_key.pem", "File with the private key of the collector's X.509-SVID")
+	o.svidBundle = fs.String("svid-bundle", "svid_bundle.pem", "File with the trust bundle pushing monitors' SVIDs are verified against")
+	o.apiAddr = fs.String("api-addr", "", "Address to serve the read API on at /api/v1/, e.g. :8080 (disabled if empty)")
+	o.grpcAddr = fs.String("grpc-addr", "", "Address to serve the read API over gRPC on, with server reflection, e.g. :9090 (disabled if empty)")
+	o.apiSocket = fs.String("api-socket", "", "Unix socket to serve the read API on for co-located consumers, or \"systemd\" to use the socket named api passed by systemd socket activation (disabled if empty)")
+	o.adminAddr = fs.String("admin-addr", "", "Loopback address to serve pprof and expvar debug endpoints on, e.g. localhost:6060 (disabled if empty)")
+	o.adminTokenFile = fs.String("admin-token-file", "", "File with the bearer token required by the monitor registry at /admin/v1/monitors on --admin-addr")
+	o.auditLog = fs.String("audit-log", "", "Path to a hash-chained audit log of acceptance decisions and admin requests (disabled if empty)")
+	o.stateKeyFile = fs.String("state-key-file", "", "File with a base64 encoded 32 byte key encrypting the accepted file and audit log, defaults to $"+collector.StateKeyEnv)
+	o.tenants = fs.String("tenants", "", "Path to a tenants JSON file; each tenant is collected in an isolated namespace with its own monitors and state")
+	o.stateDir = fs.String("state-dir", ".", "Directory holding a subdirectory of state files per tenant")
+	fs.Var(&o.configDirs, "config-dir", "Directory with a file per flag, such as a mounted ConfigMap or Secret, setting flags not given on the command line (repeatable)")
+	o.leaseName = fs.String("lease", "", "Name of a Kubernetes Lease to hold while collecting, so only one replica runs at a time (disabled if empty)")
+	o.leaseNamespace = fs.String("lease-namespace", "", "Namespace of the Lease, defaults to the pod's namespace")
+	o.leaseIdentity = fs.String("lease-identity", os.Getenv("POD_NAME"), "Holder identity recorded in the Lease or etcd election and pod label of the metrics, defaults to $POD_NAME or the hostname")
+	o.etcdEndpoints = fs.String("etcd-endpoints", "", "Comma-separated URLs of the etcd members used by --storage etcd:// and --etcd-election, e.g. https://etcd-0:2379,https://etcd-1:2379")
+	o.etcdUser = fs.String("etcd-user", "", "User authenticating to etcd (disabled if empty)")
+	o.etcdPasswordFile = fs.String("etcd-password-file", "", "File with the password of --etcd-user")
+	o.etcdElection = fs.String("etcd-election", "", "etcd key to hold while collecting, so only one collector of a cluster runs at a time; appends to etcd storage are fenced by it (disabled if empty)")
+	o.service = fs.Bool("service", false, "Run as a Windows service, logging to the Windows event log")
+	return o
+}
+
+// servePush accepts checkpoints pushed by monitors on addr, authenticating
+// them with their X.509-SVIDs.
+func servePush(addr string, svid *collector.SVIDFiles, cs []*collector.Collector) error {
+	mux := http.NewServeMux()
+	mux.Handle("/push", collector.PushHandler(cs...))
+	mux.Handle("/heartbeat", collector.HeartbeatHandler(cs...))
+	mux.Handle("/hint/conflict", collector.ConflictHintHandler(cs...))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(tls.NewListener(ln, svid.TLSConfig()))
+}
+
+// httpClient returns the client for outbound HTTP requests, retrying them
+// according to the flags. In offline mode every request fails.
+func (o *runOptions) httpClient() *http.Client {
+	if *o.offline {
+		return &http.Client{Transport: offlineTransport{}}
+	}
+	p := retry.DefaultPolicy()
+	p.Attempts = *o.httpAttempts
+	p.Backoff = *o.httpBackoff
+	p.Timeout = *o.httpTimeout
+	p.Budget = *o.httpBudget
+	return retry.NewClient(p)
+}
+
+// logAPIClient returns the HTTP client for requests to the log APIs at
+// --proof-url and --entries-url, which share the limits of --log-api-rate
+// and --log-api-daily-budget.
+func (o *runOptions) logAPIClient() *http.Client {
+	client := o.httpClient()
+	if *o.logAPIRate <= 0 && *o.logAPIDaily <= 0 {
+		return client
+	}
+	if o.logAPITransport == nil {
+		o.logAPITransport = collector.NewQuotaTransport(client.Transport, collector.Quota{
+			Rate:    *o.logAPIRate,
+			Burst:   *o.logAPIBurst,
+			Daily:   *o.logAPIDaily,
+			Reserve: *o.logAPIReserve,
+		})
+	}
+	return &http.Client{Transport: o.logAPITransport}
+}
+
+// offlineTransport refuses every request in offline mode.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), collector.ErrOffline)
+}
+
+// onlineFlags are the flags that need outbound network access and cannot be
+// used in offline mode.
+var onlineFlags = []string{"discover", "ssh-key", "influx-url", "timescale-dsn", "redis-url", "frost-peer", "cosign-keyless", "lease", "etcd-endpoints", "proof-url", "baseline-url", "distributor-url", "peer", "roughtime", "entries-url", "secondary-log-url", "scitt-url", "alert-sink"}
+
+// checkOffline returns an error if a flag needing network access is set in
+// offline mode.
+func (o *runOptions) checkOffline() error {
+	if !*o.offline {
+		return nil
+	}
+	var err error
+	o.fs.Visit(func(f *flag.Flag) {
+		for _, name := range onlineFlags {
+			if f.Name == name && err == nil {
+				err = fmt.Errorf("--%s needs network access and cannot be used with --offline", name)
+			}
+		}
+	})
+	return err
+}
+
+// writerFlags are the flags of a collector writing its storage, which
+// cannot be used in read-only mode.
+var writerFlags = []string{"push-addr", "push-queue", "lease", "etcd-election", "maintenance-interval"}
+
+// checkReadOnly returns an error if a flag of a writing collector is set in
+// read-only mode.
+func (o *runOptions) checkReadOnly() error {
+	if !*o.readOnly {
+		return nil
+	}
+	var err error
+	o.fs.Visit(func(f *flag.Flag) {
+		for _, name := range writerFlags {
+			if f.Name == name && err == nil {
+				err = fmt.Errorf("--%s cannot be used with --read-only", name)
+			}
+		}
+	})
+	return err
+}
+
+// config returns the collector configuration described by the flags.
+func (o *runOptions) config() (collector.Config, error) {
+	if err := o.checkOffline(); err != nil {
+		return collector.Config{}, err
+	}
+	if err := o.checkReadOnly(); err != nil {
+		return collector.Config{}, err
+	}
+	chaos := collector.Chaos{DropObservations: *o.chaosDrop, DelayStorage: *o.chaosDelay}
+	if err := collector.ValidChaos(chaos); err != nil {
+		return collector.Config{}, err
+	}
+	sampling := collector.Sampling{Size: *o.sampleSize, MaxSkip: *o.sampleMaxSkip}
+	if err := collector.ValidSampling(sampling); err != nil {
+		return collector.Config{}, err
+	}
+	adaptive := collector.AdaptiveInterval{Min: *o.intervalMin, Max: *o.intervalMax, Entries: *o.intervalEntries}
+	if err := collector.ValidAdaptiveInterval(adaptive); err != nil {
+		return collector.Config{}, err
+	}
+	var sched collector.Schedule
+	if *o.schedule != "" {
+		cs, err := collector.ParseCron(*o.schedule)
+		if err != nil {
+			return collector.Config{}, fmt.Errorf("parsing schedule: %w", err)
+		}
+		sched = cs
+	}
+
+	if err := collector.ValidQuorumFailure(*o.quorumFailure); err != nil {
+		return collector.Config{}, err
+	}
+	if err := collector.ValidResolution(*o.resolution); err != nil {
+		return collector.Config{}, err
+	}
+	if err := collector.ValidCosignFormat(*o.cosignFormat); err != nil {
+		return collector.Config{}, err
+	}
+	var witnesses []collector.Witness
+	for _, vkey := range o.witnesses {
+		w, err := collector.ParseWitness(vkey)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		witnesses = append(witnesses, w)
+	}
+	var peers []collector.Peer
+	for _, spec := range o.peers {
+		p, err := collector.ParsePeer(spec)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		peers = append(peers, p)
+	}
+	var registry *collector.Registry
+	if *o.registry {
+		registry = &collector.Registry{Probation: *o.probation}
+	}
+	var trusted *collector.TrustedTime
+	for _, spec := range o.roughtime {
+		rt, err := collector.ParseRoughtime(spec)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		if trusted == nil {
+			trusted = &collector.TrustedTime{Interval: *o.timeSyncInterval, MaxAge: *o.timeMaxAge, MaxSkew: *o.maxClockSkew}
+		}
+		trusted.Sources = append(trusted.Sources, rt)
+	}
+	var distributor *collector.Distributor
+	if *o.distributorURL != "" {
+		if *o.distributorLogID == "" {
+			return collector.Config{}, errors.New("--distributor-url requires --distributor-log-id")
+		}
+		distributor = &collector.Distributor{URL: *o.distributorURL, LogID: *o.distributorLogID, Client: o.httpClient()}
+	}
+	var prover collector.ConsistencyProver
+	if *o.proofURL != "" {
+		cp, err := collector.NewCachingProver(&collector.RekorProver{URL: *o.proofURL, Client: o.logAPIClient()}, *o.proofCacheSize, *o.proofCacheTTL, *o.proofCacheFile)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		prover = cp
+	}
+	baseline := collector.Baseline{Entries: *o.baselineEntries, Rounds: *o.baselineRounds}
+	if *o.baselineURL != "" {
+		baseline.Source = &collector.RekorTreeHead{URL: *o.baselineURL, Client: o.logAPIClient()}
+	}
+	var identities *collector.IdentityWatch
+	if len(o.watchEmails)+len(o.watchSANs)+len(o.watchKeys) > 0 {
+		if *o.entriesURL == "" {
+			return collector.Config{}, errors.New("--watch-email, --watch-san and --watch-fingerprint require --entries-url")
+		}
+		identities = &collector.IdentityWatch{
+			Emails:       o.watchEmails,
+			SANs:         o.watchSANs,
+			Fingerprints: o.watchKeys,
+			Origin:       *o.entriesOrigin,
+			Entries:      &collector.RekorEntries{URL: *o.entriesURL, Client: o.logAPIClient()},
+		}
+	}
+	var mirror *collector.Mirror
+	if *o.mirrorDir != "" {
+		if *o.entriesURL == "" {
+			return collector.Config{}, errors.New("--mirror-dir requires --entries-url")
+		}
+		mirror = &collector.Mirror{
+			Dir:     *o.mirrorDir,
+			Origin:  *o.entriesOrigin,
+			Entries: &collector.RekorEntries{URL: *o.entriesURL, Client: o.logAPIClient()},
+		}
+	}
+	var logKeys []collector.LogKey
+	for _, f := range o.logKeys {
+		k, err := collector.LoadLogKey(f)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		logKeys = append(logKeys, k)
+	}
+	var extensionPolicy collector.ExtensionPolicy
+	for _, spec := range o.extensionRules {
+		r, err := collector.ParseExtensionRule(spec)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		extensionPolicy = append(extensionPolicy, r)
+	}
+	sc, err := collector.LoadStateCipher(*o.stateKeyFile)
+	if err != nil {
+		return collector.Config{}, err
+	}
+	alertTemplate, err := collector.LoadAlertTemplate(*o.alertTemplate)
+	if err != nil {
+		return collector.Config{}, err
+	}
+	alertRouting := collector.AlertRouting{Sinks: make(map[string]collector.AlertSink)}
+	for _, spec := range o.alertSinks {
+		name, sink, err := collector.ParseAlertSink(spec, o.httpClient())
+		if err != nil {
+			return collector.Config{}, err
+		}
+		if alertRouting.Sinks[name] != nil {
+			return collector.Config{}, fmt.Errorf("duplicate alert sink name %q", name)
+		}
+		alertRouting.Sinks[name] = sink
+	}
+	for _, spec := range o.alertRoutes {
+		route, err := collector.ParseAlertRoute(spec)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		alertRouting.Routes = append(alertRouting.Routes, route)
+	}
+	if err := collector.ValidAlertRouting(alertRouting); err != nil {
+		return collector.Config{}, err
+	}
+	exporters, err := o.exporters()
+	if err != nil {
+		return collector.Config{}, err
+	}
+	cosigner, err := o.cosigner()
+	if err != nil {
+		return collector.Config{}, err
+	}
+	secondary, err := o.secondaryLog()
+	if err != nil {
+		return collector.Config{}, err
+	}
+	var sshCfg *collector.SSHConfig
+	if len(o.sshKeys) > 0 {
+		if sshCfg, err = collector.LoadSSHConfig(*o.sshUser, o.sshKeys, *o.sshKnownHosts); err != nil {
+			return collector.Config{}, err
+		}
+	}
+	var stream io.Writer
+	if *o.follow {
+		if *o.output != collector.StreamText && collector.ValidEncoding(*o.output) != nil {
+			return collector.Config{}, fmt.Errorf("unknown --output format %q, expected json, text, cbor or protobuf", *o.output)
+		}
+		stream = os.Stdout
+	}
+	var discovery []collector.Discoverer
+	for _, spec := range o.discover {
+		d, err := collector.ParseDiscoverer(spec)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		if hd, ok := d.(collector.HTTPDiscovery); ok {
+			hd.Client = o.httpClient()
+			d = hd
+		}
+		discovery = append(discovery, d)
+	}
+
+	var statements *collector.Statements
+	switch {
+	case *o.statementsDir != "":
+		statements = &collector.Statements{Dir: *o.statementsDir, Issuer: *o.statementsIssuer, TransparencyURL: *o.scittURL, Client: o.httpClient()}
+	case *o.scittURL != "":
+		return collector.Config{}, errors.New("--scitt-url needs --statements-dir")
+	}
+
+	var reports *collector.ReportArchive
+	if *o.reportDir != "" {
+		reports = &collector.ReportArchive{Dir: *o.reportDir, Retention: *o.reportRetention}
+	}
+
+	return collector.Config{
+		StateCipher:         sc,
+		Pod:                 *o.leaseIdentity,
+		MonitorGlob:         *o.monitorGlob,
+		MonitorList:         *o.monitorList,
+		Discovery:           discovery,
+		DiscoveryInterval:   *o.discoveryInterval,
+		AcceptedFile:        *o.acceptedFile,
+		Keep:                *o.keep,
+		MaintenanceInterval: *o.maintenance,
+		Quorum:              *o.quorum,
+		MinNetworks:         *o.minNetworks,
+		QuorumFailure:       *o.quorumFailure,
+		Resolution:          *o.resolution,
+		Prover:              prover,
+		Baseline:            baseline,
+		WitnessQuorum:       *o.witnessQuorum,
+		Witnesses:           witnesses,
+		Peers:               peers,
+		Distributor:         distributor,
+		Identities:          identities,
+		Mirror:              mirror,
+		Origins:             o.origins,
+		Strict:              *o.strict,
+		LogKeys:             logKeys,
+		ExtensionPolicy:     extensionPolicy,
+		Chain:               *o.chain,
+		Batch:               *o.batch,
+		ProvenanceFile:      *o.provenanceFile,
+		Cosigner:            cosigner,
+		SecondaryLog:        secondary,
+		CosignedFile:        *o.cosignedFile,
+		CosignFormat:        *o.cosignFormat,
+		Extensions:          *o.cosignExtensions,
+		HistoryDir:          *o.historyDir,
+		DedupHistory:        *o.historyDedup,
+		PublishDir:          *o.publishDir,
+		Statements:          statements,
+		ImportDir:           *o.importDir,
+		HTTPClient:          o.httpClient(),
+		Stream:              stream,
+		StreamFormat:        *o.output,
+		Exporters:           exporters,
+		Reports:             reports,
+		IntentFile:          *o.intentFile,
+		Interval:            *o.interval,
+		HeartbeatTimeout:    *o.heartbeatTimeout,
+		Schedule:            sched,
+		OriginIntervals:     o.intervals,
+		Jitter:              *o.jitter,
+		AdaptiveInterval:    adaptive,
+		Breaker: collector.BreakerConfig{
+			Threshold:  *o.breakerThreshold,
+			Backoff:    *o.breakerBackoff,
+			MaxBackoff: *o.breakerMaxBackoff,
+		},
+		Anomaly: collector.AnomalyConfig{
+			StallAfter:        *o.stallAfter,
+			SpikeFactor:       *o.spikeFactor,
+			DivergenceEntries: *o.divergeEntries,
+			DivergenceRounds:  *o.divergeRounds,
+			StaleRounds:       *o.staleRounds,
+			MaxMergeDelay:     o.maxMergeDelays,
+		},
+		AlertTemplate: alertTemplate,
+		AlertRouting:  alertRouting,
+		SSH:           sshCfg,
+		MaxFileSize:   *o.maxFileSize,
+		ReadTimeout:   *o.readTimeout,
+		Timeouts: collector.Timeouts{
+			Round:   *o.roundTimeout,
+			Verify:  *o.verifyTimeout,
+			Persist: *o.persistTimeout,
+			Export:  *o.exportTimeout,
+		},
+		Offline:     *o.offline,
+		ReadOnly:    *o.readOnly,
+		Chaos:       chaos,
+		Sampling:    sampling,
+		TrustedTime: trusted,
+		Registry:    registry,
+	}, nil
+}
+
+// exporters returns the time series exporters enabled by the flags.
+func (o *runOptions) exporters() ([]collector.Exporter, error) {
+	var exporters []collector.Exporter
+	if *o.influxURL != "" {
+		influx := &tsdb.Influx{WriteURL: *o.influxURL, Client: o.httpClient()}
+		if *o.influxTokenFile != "" {
+			token, err := os.ReadFile(*o.influxTokenFile)
+			if err != nil {
+				return nil, err
+			}
+			influx.Token = strings.TrimSpace(string(token))
+		}
+		exporters = append(exporters, influx)
+	}
+	if *o.timescaleDSN != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		ts, err := tsdb.OpenTimescale(ctx, *o.timescaleDSN)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, ts)
+	}
+	if *o.redisURL != "" {
+		cache, err := rediscache.Parse(*o.redisURL)
+		if err != nil {
+			return nil, err
+		}
+		cache.TTL = *o.redisTTL
+		exporters = append(exporters, cache)
+	}
+	return exporters, nil
+}
+
+// migratingStorage is a Storage that can import a legacy accepted file.
+type migratingStorage interface {
+	collector.Storage
+	Migrate(filename string) (int, error)
+}
+
+// openStorage opens the storage given by --storage, migrating --accepted to
+// it while it is empty, or returns nil to store accepted checkpoints in
+// --accepted. In multi-tenant mode it returns nil as well; collectors opens
+// a storage per tenant instead.
+func (o *runOptions) openStorage(sc *collector.StateCipher) (collector.Storage, error) {
+	if *o.tenants != "" {
+		return nil, nil
+	}
+	return o.openStorageFor(sc, "", *o.acceptedFile)
+}
+
+// openStorageFor opens the storage of tenant, or of the only collector if
+// tenant is empty, migrating accepted to it while it is empty. The storage
+// is closed by closeStorages.
+func (o *runOptions) openStorageFor(sc *collector.StateCipher, tenant, accepted string) (collector.Storage, error) {
+	s, scheme, err := o.storageBackend(sc, tenant)
+	if s == nil || err != nil {
+		return nil, err
+	}
+	if !*o.readOnly {
+		n, err := s.Migrate(accepted)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if n > 0 {
+			log.Printf("Migrated %d accepted checkpoints from %s to %s storage\n", n, accepted, scheme)
+		}
+	}
+	o.storages = append(o.storages, s)
+	return s, nil
+}
+
+// closeStorages closes the storages opened by openStorageFor.
+func (o *runOptions) closeStorages() {
+	for _, s := range o.storages {
+		s.Close()
+	}
+	o.storages = nil
+}
+
+// storageBackend opens the storage given by --storage and returns it with
+// its scheme, or returns nil if accepted checkpoints are stored in
+// --accepted. The storage of a tenant is kept apart from the other tenants':
+// in the namespace named after it, under the etcd prefix <prefix>/<name>/ or
+// in the bbolt database <dir>/<name>/<file> for bolt://<dir>/<file>.
+func (o *runOptions) storageBackend(sc *collector.StateCipher, tenant string) (migratingStorage, string, error) {
+	if *o.storage == "" || *o.storage == "file" {
+		return nil, "", nil
+	}
+	scheme, path, ok := strings.Cut(*o.storage, "://")
+	if !ok || path == "" {
+		return nil, "", fmt.Errorf("invalid --storage %q, expected <scheme>://<location>", *o.storage)
+	}
+	var s migratingStorage
+	switch scheme {
+	case "bolt":
+		if *o.readOnly {
+			return nil, "", errors.New("bolt storage can only be opened by the collector writing it, not with --read-only")
+		}
+		if tenant != "" {
+			dir := filepath.Join(filepath.Dir(path), tenant)
+			if err := os.MkdirAll(dir, 0750); err != nil {
+				return nil, "", err
+			}
+			path = filepath.Join(dir, filepath.Base(path))
+		}
+		bs, err := collector.OpenBoltStorage(path, sc)
+		if err != nil {
+			return nil, "", err
+		}
+		s = bs
+	case "postgres", "postgresql":
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		open := postgres.Open
+		if *o.readOnly {
+			open = postgres.OpenReadOnly
+		}
+		ps, err := open(ctx, *o.storage, o.storageNamespaceFor(tenant), sc)
+		if err != nil {
+			return nil, "", err
+		}
+		s = ps
+	case "etcd":
+		client, err := o.etcdClient()
+		if err != nil {
+			return nil, "", err
+		}
+		election, err := o.etcdElectionFor()
+		if err != nil {
+			return nil, "", err
+		}
+		prefix := strings.TrimSuffix(path, "/") + "/"
+		if tenant != "" {
+			prefix += tenant + "/"
+		}
+		s = &etcd.Storage{Client: client, Prefix: prefix, Cipher: sc, Fence: election}
+	case "dynamodb":
+		ds := collector.DynamoDBStorageFromEnv(path, o.storageNamespaceFor(tenant), sc)
+		ds.Client = o.httpClient()
+		s = ds
+	default:
+		return nil, "", fmt.Errorf("unsupported --storage scheme %q", scheme)
+	}
+	return s, scheme, nil
+}
+
+// storageNamespaceFor returns the database namespace of the accepted
+// checkpoints of tenant, named after it within --storage-namespace if set.
+func (o *runOptions) storageNamespaceFor(tenant string) string {
+	switch {
+	case tenant == "":
+		return *o.storageNamespace
+	case *o.storageNamespace == "":
+		return tenant
+	}
+	return *o.storageNamespace + "/" + tenant
+}
+
+// auditDetails returns the flags that were set explicitly, for the audit log.
+func (o *runOptions) auditDetails() map[string]string {
+	details := map[string]string{"version": version.Get().GitVersion}
+	o.fs.Visit(func(f *flag.Flag) {
+		details[f.Name] = f.Value.String()
+	})
+	return details
+}
+
+// withLease wraps run so that it only runs while holding the Kubernetes
+// Lease given by the flags.
+func (o *runOptions) withLease(run func(context.Context) error) (func(context.Context) error, error) {
+	client, err := kube.InClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := o.identity()
+	if err != nil {
+		return nil, err
+	}
+	le := &kube.LeaderElector{
+		Client:    client,
+		Namespace: *o.leaseNamespace,
+		Name:      *o.leaseName,
+		Identity:  identity,
+	}
+	return func(ctx context.Context) error {
+		return le.Run(ctx, run)
+	}, nil
+}
+
+// identity returns the identity of this replica in leader elections.
+func (o *runOptions) identity() (string, error) {
+	if *o.leaseIdentity != "" {
+		return *o.leaseIdentity, nil
+	}
+	return os.Hostname()
+}
+
+// etcdClient returns the etcd client given by the flags.
+func (o *runOptions) etcdClient() (*etcd.Client, error) {
+	if *o.etcdEndpoints == "" {
+		return nil, errors.New("--etcd-endpoints is required for etcd storage and elections")
+	}
+	client := &etcd.Client{Endpoints: strings.Split(*o.etcdEndpoints, ","), Username: *o.etcdUser, HTTPClient: o.httpClient()}
+	if *o.etcdPasswordFile != "" {
+		password, err := os.ReadFile(*o.etcdPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		client.Password = strings.TrimSpace(string(password))
+	}
+	return client, nil
+}
+
+// etcdElectionFor returns the etcd election given by the flags, or nil if
+// it is disabled. The election is created once, so that etcd storage is
+// fenced by the election that run is wrapped in.
+func (o *runOptions) etcdElectionFor() (*etcd.Election, error) {
+	if *o.etcdElection == "" || o.election != nil {
+		return o.election, nil
+	}
+	if *o.leaseName != "" {
+		return nil, errors.New("--etcd-election cannot be used with --lease")
+	}
+	client, err := o.etcdClient()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := o.identity()
+	if err != nil {
+		return nil, err
+	}
+	o.election = &etcd.Election{Client: client, Key: *o.etcdElection, Identity: identity}
+	return o.election, nil
+}
+
+// collectors returns the collector described by the flags or, in multi-tenant
+// mode, one collector per tenant. If start is set, the start is recorded in
+// the audit log of each tenant. If storage is set, each tenant's accepted
+// checkpoints are kept in its own storage within --storage.
+func (o *runOptions) collectors(cfg collector.Config, start, storage bool) ([]*collector.Collector, error) {
+	if *o.tenants == "" {
+		return []*collector.Collector{collector.New(cfg)}, nil
+	}
+
+	tenants, err := collector.LoadTenants(*o.tenants)
+	if err != nil {
+		return nil, err
+	}
+	var cs []*collector.Collector
+	for _, t := range tenants {
+		tcfg, err := t.Config(cfg, *o.stateDir, AcceptedChptFile, AuditLogFile)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		if storage {
+			if tcfg.Storage, err = o.openStorageFor(cfg.StateCipher, t.Name, tcfg.AcceptedFile); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+			}
+		}
+		if !start {
+			tcfg.Audit = nil
+		} else if err := tcfg.Audit.Record(collector.AuditStart, "collector/"+t.Name, o.auditDetails()); err != nil {
+			return nil, fmt.Errorf("recording start in audit log of tenant %s: %w", t.Name, err)
+		}
+		cs = append(cs, collector.New(tcfg))
+	}
+	return cs, nil
+}
+
+// runCmd periodically reads the checkpoints written by each monitor and
+// appends the checkpoint a quorum of monitors agree on to the accepted file.
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	o := registerRunFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := loadConfig(fs, &o.configDirs); err != nil {
+		return err
+	}
+
+	cfg, err := o.config()
+	if err != nil {
+		return err
+	}
+	if cfg.Chaos.Enabled() {
+		log.Printf("Warning: chaos testing is enabled, dropping observations with probability %g and delaying storage by %v\n", cfg.Chaos.DropObservations, cfg.Chaos.DelayStorage)
+	}
+	if *o.auditLog != "" {
+		if cfg.Audit, err = collector.OpenAuditLog(*o.auditLog, cfg.StateCipher); err != nil {
+			return err
+		}
+		if err := cfg.Audit.Record(collector.AuditStart, "collector", o.auditDetails()); err != nil {
+			return fmt.Errorf("recording start in audit log: %w", err)
+		}
+	}
+	defer o.closeStorages()
+	if cfg.Storage, err = o.openStorage(cfg.StateCipher); err != nil {
+		return err
+	}
+	if *o.pushQueue != "" {
+		if *o.pushAddr == "" {
+			return errors.New("--push-queue requires --push-addr")
+		}
+		if cfg.PushQueue, err = collector.OpenPushQueue(*o.pushQueue, *o.pushQueueSize); err != nil {
+			return err
+		}
+		defer cfg.PushQueue.Close()
+	}
+	cs, err := o.collectors(cfg, true, true)
+	if err != nil {
+		return err
+	}
+	if err := startupChecks(cs); err != nil {
+		return err
+	}
+	for _, c := range cs {
+		if _, err := c.Recover(context.Background()); err != nil {
+			if ns := c.Namespace(); ns != "" {
+				return fmt.Errorf("tenant %s: recovering state: %w", ns, err)
+			}
+			return fmt.Errorf("recovering state: %w", err)
+		}
+	}
+	run := func(ctx context.Context) error {
+		for _, c := range cs {
+			go c.RunMaintenance(ctx)
+		}
+		return collector.RunAll(ctx, cs)
+	}
+	if *o.leaseName != "" {
+		if run, err = o.withLease(run); err != nil {
+			return err
+		}
+	}
+	election, err := o.etcdElectionFor()
+	if err != nil {
+		return err
+	}
+	if election != nil {
+		lead := run
+		run = func(ctx context.Context) error {
+			return election.Run(ctx, lead)
+		}
+	}
+
+	if *o.adminAddr != "" {
+		if _, err := loopbackAddr(*o.adminAddr); err != nil {
+			return err
+		}
+		expvar.Publish("monitor_circuits", expvar.Func(func() any {
+			if len(cs) == 1 && cs[0].Namespace() == "" {
+				return cs[0].BreakerStates()
+			}
+			states := make(map[string]map[string]string)
+			for _, c := range cs {
+				states[c.Namespace()] = c.BreakerStates()
+			}
+			return states
+		}))
+		var registry http.Handler
+		if *o.registry {
+			token, err := o.adminToken()
+			if err != nil {
+				return err
+			}
+			registry = requireToken(token, collector.RegistryHandler(cs...))
+		}
+		go func() {
+			log.Fatal(serveAdmin(*o.adminAddr, cfg.Audit, registry))
+		}()
+	}
+
+	if *o.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", collector.MetricsHandler(cs...))
+		go func() {
+			// #nosec G114 -- the metrics endpoint only serves small responses
+			log.Fatal(http.ListenAndServe(*o.metricsAddr, mux))
+		}()
+	}
+
+	if *o.apiAddr != "" {
+		srv := &http.Server{Addr: *o.apiAddr, Handler: collector.APIHandler(cs...), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Fatal(srv.ListenAndServe())
+		}()
+	}
+
+	if *o.grpcAddr != "" {
+		ln, err := net.Listen("tcp", *o.grpcAddr)
+		if err != nil {
+			return fmt.Errorf("listening for gRPC: %w", err)
+		}
+		go func() {
+			log.Fatal(collector.NewGRPCServer(cs).Serve(ln))
+		}()
+	}
+
+	if *o.apiSocket != "" {
+		listeners, err := apiSocketListeners(*o.apiSocket)
+		if err != nil {
+			return fmt.Errorf("listening on API socket: %w", err)
+		}
+		srv := &http.Server{Handler: collector.APIHandler(cs...), ReadHeaderTimeout: 10 * time.Second}
+		for _, ln := range listeners {
+			go func(ln net.Listener) {
+				log.Fatal(srv.Serve(ln))
+			}(ln)
+		}
+	}
+
+	if *o.frostAddr != "" {
+		if *o.frostShare == "" {
+			return errors.New("--frost-addr requires --frost-share")
+		}
+		go func() {
+			log.Fatal(serveFROST(*o.frostAddr, *o.frostShare, cs))
+		}()
+	}
+
+	if *o.pushAddr != "" {
+		svid := &collector.SVIDFiles{CertFile: *o.svidCert, KeyFile: *o.svidKey, BundleFile: *o.svidBundle}
+		if err := svid.Load(); err != nil {
+			return err
+		}
+		if cfg.PushQueue != nil {
+			go func() {
+				_ = cfg.PushQueue.Run(context.Background(), cs...)
+			}()
+		}
+		go func() {
+			log.Fatal(servePush(*o.pushAddr, svid, cs))
+		}()
+	}
+
+	if *o.service {
+		if err := runService(serviceName, run); err != nil {
+			return fmt.Errorf("running service: %w", err)
+		}
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return run(ctx)
+}
@@ -0,0 +1,70 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTenantStorage(t *testing.T) {
+	dir := t.TempDir()
+	tenants := filepath.Join(dir, "tenants.json")
+	if err := os.WriteFile(tenants, []byte(`{"tenants":[{"name":"prod","monitors":"prod/*.txt"},{"name":"staging","monitors":"staging/*.txt"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fset := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := registerRunFlags(fset)
+	if err := fset.Parse([]string{"--tenants", tenants, "--state-dir", dir, "--storage", "bolt://" + filepath.Join(dir, "db", "collector.db")}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := o.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.closeStorages()
+	if cfg.Storage, err = o.openStorage(cfg.StateCipher); err != nil || cfg.Storage != nil {
+		t.Fatalf("expected no storage shared by the tenants, got %v (%v)", cfg.Storage, err)
+	}
+	cs, err := o.collectors(cfg, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2 || len(o.storages) != 2 {
+		t.Fatalf("expected a storage for each of the 2 tenants, got %d collectors and %d storages", len(cs), len(o.storages))
+	}
+	for _, name := range []string{"prod", "staging"} {
+		if _, err := os.Stat(filepath.Join(dir, "db", name, "collector.db")); err != nil {
+			t.Errorf("expected the bbolt database of tenant %s: %v", name, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		namespace, tenant, want string
+	}{
+		{"", "", ""},
+		{"eu", "", "eu"},
+		{"", "prod", "prod"},
+		{"eu", "prod", "eu/prod"},
+	} {
+		*o.storageNamespace = tt.namespace
+		if got := o.storageNamespaceFor(tt.tenant); got != tt.want {
+			t.Errorf("namespace %q, tenant %q: expected %q, got %q", tt.namespace, tt.tenant, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// socketActivation is the --api-socket value selecting a socket passed by
+// systemd.
+const socketActivation = "systemd"
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// activatedListeners returns the listeners passed by systemd socket
+// activation whose name, as set with FileDescriptorName=, is name, or all
+// of them if they are unnamed.
+func activatedListeners(name string) ([]net.Listener, error) {
+	fds, err := activatedFDs(name)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// activatedFDs returns the file descriptors of the sockets named name
+// passed by systemd socket activation, or all of them if they are unnamed.
+// The environment variables are cleared so that child processes do not
+// inherit them.
+func activatedFDs(name string) ([]int, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd socket activation")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("no sockets passed by systemd socket activation")
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	var fds []int
+	for i := 0; i < n; i++ {
+		if i < len(names) && names[i] != name && names[i] != "unknown" {
+			continue
+		}
+		fds = append(fds, listenFDsStart+i)
+	}
+	if len(fds) == 0 {
+		return nil, fmt.Errorf("no socket named %q passed by systemd socket activation", name)
+	}
+	return fds, nil
+}
+
+// listenUnix listens on the Unix socket path, replacing a stale socket left
+// by a previous run, and restricts access to the owner and group.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// apiSocketListeners returns the listeners for --api-socket, which is the
+// path of a Unix socket or "systemd" for sockets passed by socket
+// activation.
+func apiSocketListeners(value string) ([]net.Listener, error) {
+	if value == socketActivation {
+		return activatedListeners("api")
+	}
+	ln, err := listenUnix(value)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
@@ -0,0 +1,70 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestActivatedFDs(t *testing.T) {
+	pid := fmt.Sprint(os.Getpid())
+	for _, tt := range []struct {
+		name                    string
+		listenPID, fds, fdNames string
+		want                    string
+	}{
+		{name: "unnamed", listenPID: pid, fds: "2", want: "3,4"},
+		{name: "named", listenPID: pid, fds: "3", fdNames: "metrics:api:api", want: "4,5"},
+		{name: "unknown names", listenPID: pid, fds: "2", fdNames: "unknown:metrics", want: "3"},
+		{name: "fewer names", listenPID: pid, fds: "2", fdNames: "metrics", want: "4"},
+		{name: "no such name", listenPID: pid, fds: "1", fdNames: "metrics"},
+		{name: "other process", listenPID: "1", fds: "1"},
+		{name: "no pid", fds: "1"},
+		{name: "zero count", listenPID: pid, fds: "0"},
+		{name: "invalid count", listenPID: pid, fds: "one"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.listenPID)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			t.Setenv("LISTEN_FDNAMES", tt.fdNames)
+
+			fds, err := activatedFDs("api")
+			var got []string
+			for _, fd := range fds {
+				got = append(got, fmt.Sprint(fd))
+			}
+			if strings.Join(got, ",") != tt.want || (err == nil) != (tt.want != "") {
+				t.Errorf("expected descriptors %q, got %v: %v", tt.want, fds, err)
+			}
+			for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+				if _, ok := os.LookupEnv(v); ok {
+					t.Errorf("expected %s to be cleared", v)
+				}
+			}
+		})
+	}
+}
+
+func TestActivatedListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := activatedListeners("api"); err == nil {
+		t.Error("expected sockets of another process to be refused")
+	}
+}
@@ -0,0 +1,134 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+	"github.com/sigstore/rekor-monitor/pkg/retry"
+)
+
+// spotAuditCmd verifies the inclusion of many entries against the accepted
+// checkpoints, either every entry of a range of the log or the inclusion
+// proofs of a file.
+//
+//	collector spot-audit --rekor-url https://rekor.sigstore.dev --start 0 --end 1000000 --state-file audit.state
+//	collector spot-audit --proofs proofs.jsonl
+func spotAuditCmd(args []string) error {
+	fs := flag.NewFlagSet("spot-audit", flag.ExitOnError)
+	rekorURL := fs.String("rekor-url", "", "Rekor API the entries and inclusion proofs of --start to --end are read from, e.g. https://rekor.sigstore.dev")
+	start := fs.Int64("start", 0, "First log index to audit")
+	end := fs.Int64("end", 0, "Log index to stop auditing at, excluded")
+	proofs := fs.String("proofs", "", "File with an inclusion proof per line, as taken by /api/v1/verify-inclusion, to verify instead of a range of the log")
+	workers := fs.Int("workers", collector.DefaultPipelineWorkers, "Number of entries verified concurrently")
+	stateFile := fs.String("state-file", "", "File the progress is saved to, so that an interrupted audit resumes where it stopped")
+	acceptedFile := fs.String("accepted", AcceptedChptFile, "Name of the accepted checkpoint file to verify against")
+	chain := fs.Bool("chain", false, "The accepted file is chained, see run --chain")
+	keep := fs.Int("keep", collector.DefaultKeep, "Number of accepted checkpoints retained in the accepted file")
+	proofURL := fs.String("proof-url", "", "Rekor API consistency proofs bridging to accepted checkpoints are fetched from, defaults to --rekor-url")
+	proofCacheFile := fs.String("proof-cache-file", "", "File the consistency proof cache is persisted to (disabled if empty)")
+	stateKeyFile := fs.String("state-key-file", "", "File with the key the accepted file is encrypted with, defaults to $"+collector.StateKeyEnv)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*proofs == "") == (*rekorURL == "") {
+		return errors.New("either --rekor-url with --start and --end or --proofs is required")
+	}
+
+	sc, err := collector.LoadStateCipher(*stateKeyFile)
+	if err != nil {
+		return err
+	}
+	client := retry.NewClient(retry.DefaultPolicy())
+	cfg := collector.Config{AcceptedFile: *acceptedFile, Chain: *chain, Keep: *keep, StateCipher: sc}
+	if *proofURL == "" {
+		*proofURL = *rekorURL
+	}
+	if *proofURL != "" {
+		if cfg.Prover, err = collector.NewCachingProver(&collector.RekorProver{URL: *proofURL, Client: client}, 0, 0, *proofCacheFile); err != nil {
+			return err
+		}
+	}
+	c := collector.New(cfg)
+
+	p := collector.Pipeline{
+		Workers:   *workers,
+		StateFile: *stateFile,
+		Progress: func(pr collector.PipelineProgress) {
+			log.Printf("%d/%d verified, %d failed, %.0f entries/s\n", pr.Done, pr.Total, pr.Failed, float64(pr.Done)/pr.Elapsed.Seconds())
+		},
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var report collector.PipelineReport
+	if *proofs != "" {
+		reqs, err := readInclusionRequests(*proofs)
+		if err != nil {
+			return err
+		}
+		report, err = c.AuditInclusionRequests(ctx, reqs, p)
+		if err != nil {
+			return err
+		}
+	} else {
+		if *end <= *start {
+			return errors.New("--end must be larger than --start")
+		}
+		report, err = c.AuditInclusion(ctx, &collector.RekorEntries{URL: *rekorURL, Client: client}, *start, *end, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range report.Failures {
+		fmt.Printf("%d: %s\n", f.Index, f.Error)
+	}
+	if len(report.Failures) > 0 {
+		return fmt.Errorf("inclusion of %d of %d entries could not be verified", len(report.Failures), report.End-report.Start)
+	}
+	fmt.Printf("Inclusion of %d entries verified\n", report.End-report.Start)
+	return nil
+}
+
+// readInclusionRequests reads a file of an inclusion proof per line.
+func readInclusionRequests(filename string) ([]collector.InclusionRequest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reqs []collector.InclusionRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var req collector.InclusionRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", filename, len(reqs)+1, err)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, scanner.Err()
+}
@@ -0,0 +1,37 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// sqlSchemaCmd prints the SQL statements creating PostgreSQL foreign tables
+// over the tables of a collector's read API, so that analysts can query the
+// history of observations and acceptances with SQL.
+func sqlSchemaCmd(args []string) error {
+	fs := flag.NewFlagSet("sql-schema", flag.ExitOnError)
+	apiURL := fs.String("api-url", "http://localhost:8080", "URL of the read API of the collector, served on --api-addr, as reachable from the PostgreSQL server")
+	namespace := fs.String("namespace", "", "Tenant whose tables are read in multi-tenant mode")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fmt.Print(collector.ForeignTableDDL(*apiURL, *namespace))
+	return nil
+}
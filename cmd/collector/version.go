@@ -0,0 +1,68 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+	"github.com/sigstore/rekor-monitor/pkg/version"
+)
+
+// versionReport is the output of the version command.
+type versionReport struct {
+	version.Info
+	Capabilities map[string][]string `json:"capabilities"`
+}
+
+// versionCmd prints the build information and the log types, storage
+// backends and alert sinks compiled into the binary.
+func versionCmd(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	report := versionReport{Info: version.Get(), Capabilities: collector.Capabilities()}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Printf("%-17s%s\n", "GitVersion:", report.GitVersion)
+	fmt.Printf("%-17s%s\n", "GitCommit:", report.GitCommit)
+	fmt.Printf("%-17s%t\n", "GitDirty:", report.GitDirty)
+	fmt.Printf("%-17s%s\n", "BuildDate:", report.BuildDate)
+	fmt.Printf("%-17s%s\n", "GoVersion:", report.GoVersion)
+	fmt.Printf("%-17s%s\n", "Platform:", report.Platform)
+
+	var kinds []string
+	for k := range report.Capabilities {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		fmt.Printf("%-17s%s\n", k+":", strings.Join(report.Capabilities[k], ", "))
+	}
+	return nil
+}
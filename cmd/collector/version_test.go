@@ -0,0 +1,71 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestVersionJSON(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = versionCmd([]string{"--json"})
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report struct {
+		GitVersion   string              `json:"gitVersion"`
+		GoVersion    string              `json:"goVersion"`
+		Platform     string              `json:"platform"`
+		Capabilities map[string][]string `json:"capabilities"`
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("expected JSON output, got %q: %v", b, err)
+	}
+	if report.GitVersion == "" {
+		t.Error("expected a git version")
+	}
+	if report.GoVersion != runtime.Version() || report.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("expected the Go version and platform of the test binary, got %q and %q", report.GoVersion, report.Platform)
+	}
+	for kind, want := range map[string]string{"logTypes": "rekor", "storageBackends": "file"} {
+		found := false
+		for _, name := range report.Capabilities[kind] {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("expected %s to include %q, got %v", kind, want, report.Capabilities[kind])
+		}
+	}
+	if _, ok := report.Capabilities["alertSinks"]; !ok {
+		t.Error("expected alertSinks to be listed even if empty")
+	}
+}
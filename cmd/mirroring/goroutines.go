@@ -1,28 +1,33 @@
+//go:build ignore
+
+// This program launches three monitors and a collector side by side for
+// local testing. Run it from this directory with `go run goroutines.go`.
 package main
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
-	"os"
 )
 
 func main() {
-    // Get the current working directory.
-    cwd, err := os.Getwd()
-    if err != nil {
-        fmt.Println("Error:", err)
-        return
-    }
+	// Get the current working directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(4)
 
 	//Run 3 rekor-monitor goroutines concurrently
 	for i := 0; i < 3; i++ {
 		go func(filename string) {
 			defer wg.Done()
-			cmd := exec.Command("go", "run", cwd+"/main.go", filename)
+			cmd := exec.Command("go", "run", filepath.Join(cwd, "main.go"), filename)
 			err := cmd.Run()
 			if err != nil {
 				fmt.Println(err)
@@ -33,7 +38,7 @@ func main() {
 	//Run a client goroutines
 	go func() {
 		defer wg.Done()
-		cmd := exec.Command("go", "run", cwd+"/client.go")
+		cmd := exec.Command("go", "run", filepath.Join(cwd, "..", "collector"))
 		err := cmd.Run()
 		if err != nil {
 			fmt.Println(err)
@@ -0,0 +1,157 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultAdaptiveEntries is the number of new entries an adaptive interval
+// aims to find in each round.
+const DefaultAdaptiveEntries = 1000
+
+// AdaptiveInterval adjusts the interval between the rounds of every target
+// collected on an interval to the growth of its log. The interval shortens
+// while the log grows fast, so that a round finds about Entries new
+// entries, and lengthens while it is quiet. It changes by at most a factor
+// of two per round and stays between Min and Max.
+type AdaptiveInterval struct {
+	Min, Max time.Duration
+	// Entries is the number of new entries a round aims to find. It
+	// defaults to DefaultAdaptiveEntries.
+	Entries int64
+}
+
+// Enabled reports whether the interval adapts to the log.
+func (a AdaptiveInterval) Enabled() bool {
+	return a.Max > 0
+}
+
+// ValidAdaptiveInterval checks the settings of a.
+func ValidAdaptiveInterval(a AdaptiveInterval) error {
+	if !a.Enabled() {
+		return nil
+	}
+	if a.Min <= 0 {
+		return errors.New("the minimum adaptive interval must be positive")
+	}
+	if a.Max < a.Min {
+		return errors.New("the maximum adaptive interval must not be below the minimum")
+	}
+	if a.Entries < 0 {
+		return errors.New("the number of entries per adaptive interval must not be negative")
+	}
+	return nil
+}
+
+// adaptiveSchedule is the Schedule of a target on an adaptive interval.
+type adaptiveSchedule struct {
+	cfg AdaptiveInterval
+
+	mu       sync.Mutex
+	interval time.Duration
+	// origin, size and at are the latest checkpoint accepted for the
+	// target and when.
+	origin string
+	size   int64
+	at     time.Time
+}
+
+func newAdaptiveSchedule(cfg AdaptiveInterval, interval time.Duration) *adaptiveSchedule {
+	if cfg.Entries <= 0 {
+		cfg.Entries = DefaultAdaptiveEntries
+	}
+	s := &adaptiveSchedule{cfg: cfg}
+	s.interval = s.clamp(interval)
+	return s
+}
+
+func (s *adaptiveSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.current())
+}
+
+func (s *adaptiveSchedule) current() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interval
+}
+
+func (s *adaptiveSchedule) clamp(d time.Duration) time.Duration {
+	if d < s.cfg.Min {
+		return s.cfg.Min
+	}
+	if d > s.cfg.Max {
+		return s.cfg.Max
+	}
+	return d
+}
+
+// observe adjusts the interval to the checkpoint accepted in a round at
+// now, if any, and returns the new interval. Rounds without an accepted
+// checkpoint leave it unchanged, as do the first round and rounds
+// accepting a different log than the previous one.
+func (s *adaptiveSchedule) observe(accepted Checkpoint, ok bool, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok {
+		return s.interval
+	}
+	if accepted.Origin == s.origin && !s.at.IsZero() && accepted.Size >= s.size {
+		next := 2 * s.interval
+		if grown := accepted.Size - s.size; grown > 0 {
+			rate := float64(grown) / now.Sub(s.at).Seconds()
+			next = time.Duration(float64(s.cfg.Entries) / rate * float64(time.Second))
+		}
+		if next < s.interval/2 {
+			next = s.interval / 2
+		}
+		if next > 2*s.interval {
+			next = 2 * s.interval
+		}
+		s.interval = s.clamp(next)
+	}
+	s.origin, s.size, s.at = accepted.Origin, accepted.Size, now
+	return s.interval
+}
+
+// adaptiveSchedules holds the schedules of targets on an adaptive interval
+// by target origin.
+type adaptiveSchedules struct {
+	mu sync.Mutex
+	m  map[string]*adaptiveSchedule
+}
+
+func (a *adaptiveSchedules) add(origin string, s *adaptiveSchedule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.m == nil {
+		a.m = make(map[string]*adaptiveSchedule)
+	}
+	a.m[origin] = s
+}
+
+// intervals returns the current interval of every target by origin.
+func (a *adaptiveSchedules) intervals() map[string]time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m := make(map[string]time.Duration, len(a.m))
+	for o, s := range a.m {
+		m[o] = s.current()
+	}
+	return m
+}
@@ -0,0 +1,215 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Kinds of alerts that are not counted as anomalies
+const (
+	AlertLimit         = "limit"
+	AlertRoundTimeout  = "round_timeout"
+	AlertUntrustedTime = "untrusted_time"
+)
+
+// Severities of alerts
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+)
+
+// criticalKinds are the kinds of alerts that point at a misbehaving log
+// rather than at the monitoring pipeline.
+var criticalKinds = map[string]bool{
+	AnomalyConflict:     true,
+	AnomalyInconsistent: true,
+	AnomalyFreeze:       true,
+	AnomalyMirror:       true,
+	AnomalyIdentity:     true,
+	AnomalyPeerConflict: true,
+}
+
+// alertSeverity returns the severity of alerts of kind.
+func alertSeverity(kind string) string {
+	if criticalKinds[kind] {
+		return SeverityCritical
+	}
+	return SeverityWarning
+}
+
+// Alert is an event the collector alerts on. Its fields are available to
+// Config.AlertTemplate.
+type Alert struct {
+	// Kind is one of the Anomaly or Alert constants.
+	Kind string `json:"kind"`
+	// Severity is SeverityCritical or SeverityWarning, set from Kind.
+	Severity string `json:"severity"`
+	// Namespace is the tenant of the collector, see Config.Namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Origin is the log alerted on, if any.
+	Origin string `json:"origin,omitempty"`
+	// Size is the tree size alerted on and Previous the tree size it was
+	// compared with, if any.
+	Size     int64 `json:"size,omitempty"`
+	Previous int64 `json:"previous,omitempty"`
+	// Roots are the root hashes involved, such as the conflicting ones of
+	// a split view.
+	Roots []string `json:"roots,omitempty"`
+	// Monitors are the monitors involved.
+	Monitors []string `json:"monitors,omitempty"`
+	// Resolved is set when the condition of an earlier alert of the same
+	// kind and origin cleared: a split view no longer read from any
+	// monitor, or a quorum reached again.
+	Resolved bool `json:"resolved,omitempty"`
+	// Message is the default description of the alert.
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// String returns the default description of the alert.
+func (a Alert) String() string {
+	return a.Message
+}
+
+// alertFuncs are the functions available to alert templates in addition to
+// the text/template builtins.
+var alertFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"short": func(root string) string {
+		if len(root) > 12 {
+			return root[:12]
+		}
+		return root
+	},
+}
+
+// ParseAlertTemplate parses a text/template rendering Alert values, with the
+// additional functions join, upper and short, the latter abbreviating root
+// hashes. The template is executed against a sample alert so that
+// references to unknown fields fail early.
+func ParseAlertTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("alert").Funcs(alertFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing alert template: %w", err)
+	}
+	sample := Alert{Kind: AnomalyConflict, Severity: SeverityCritical, Origin: "rekor.sigstore.dev", Size: 2, Previous: 1, Roots: []string{"00", "01"}, Monitors: []string{"monitor"}, Message: "sample", Time: time.Now()}
+	if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, fmt.Errorf("executing alert template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// LoadAlertTemplate parses the alert template in file, see
+// ParseAlertTemplate. It returns nil if file is empty.
+func LoadAlertTemplate(file string) (*template.Template, error) {
+	if file == "" {
+		return nil, nil
+	}
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading alert template: %w", err)
+	}
+	return ParseAlertTemplate(string(text))
+}
+
+// render returns the body of a, rendered with tmpl if set. Alerts that fail
+// to render fall back to their default description, with the error.
+func (a Alert) render(tmpl *template.Template) string {
+	if tmpl == nil {
+		return a.Message
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, a); err != nil {
+		return fmt.Sprintf("%s (rendering alert template: %v)", a.Message, err)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// alert logs a, rendered with Config.AlertTemplate, and sends it to the
+// sinks it is routed to. Failures to send are logged.
+func (c *Collector) alert(a Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Export)
+	defer cancel()
+	errs := c.FireAlert(ctx, a)
+	sinks := make([]string, 0, len(errs))
+	for name := range errs {
+		sinks = append(sinks, name)
+	}
+	sort.Strings(sinks)
+	for _, name := range sinks {
+		if errs[name] != nil {
+			c.logf("Sending alert to %s: %v\n", name, errs[name])
+		}
+	}
+}
+
+// FireAlert logs a, rendered with Config.AlertTemplate, and sends it to the
+// sinks Config.AlertRouting routes it to. It returns the result of every
+// sink sent to, by name. The severity, namespace and time of a are filled
+// in.
+func (c *Collector) FireAlert(ctx context.Context, a Alert) map[string]error {
+	a.Namespace = c.cfg.Namespace
+	a.Severity = alertSeverity(a.Kind)
+	if a.Time.IsZero() {
+		a.Time = c.now().UTC()
+	}
+	body := a.render(c.cfg.AlertTemplate)
+	if a.Resolved {
+		c.logf("RESOLVED: %s\n", body)
+	} else {
+		c.logf("ALERT: %s\n", body)
+	}
+
+	errs := make(map[string]error)
+	for _, name := range c.cfg.AlertRouting.route(a) {
+		errs[name] = c.cfg.AlertRouting.Sinks[name].Send(ctx, a, body)
+	}
+	return errs
+}
+
+// AlertSinks returns the names of the sinks an alert of kind is routed to.
+func (c *Collector) AlertSinks(kind string) []string {
+	return c.cfg.AlertRouting.route(Alert{Kind: kind, Severity: alertSeverity(kind)})
+}
+
+// resolveIncidents sends a resolved alert, described by describe, for every
+// open incident of kind whose subject cleared returns true for.
+func (c *Collector) resolveIncidents(kind string, cleared func(subject string) bool, describe func(subject string) string) {
+	for _, s := range c.anoms.resolveIncidents(kind, cleared) {
+		c.alert(Alert{Kind: kind, Origin: s, Resolved: true, Message: describe(s)})
+	}
+}
+
+// conflictAlert describes a conflict: the roots and the monitors that read
+// them.
+func conflictAlert(c Conflict) Alert {
+	a := Alert{Kind: AnomalyConflict, Origin: c.Origin, Size: c.Size, Message: c.String() + "; the log is presenting a split view"}
+	for root, monitors := range c.Monitors {
+		a.Roots = append(a.Roots, root)
+		a.Monitors = append(a.Monitors, monitors...)
+	}
+	sort.Strings(a.Roots)
+	sort.Strings(a.Monitors)
+	return a
+}
@@ -0,0 +1,350 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default anomaly detection parameters
+const (
+	DefaultSpikeFactor       = 10
+	DefaultDivergenceEntries = 1000
+	DefaultDivergenceRounds  = 3
+	DefaultStaleRounds       = 5
+)
+
+// Kinds of anomalies, used as the kind label of rekor_collector_anomalies_total
+const (
+	AnomalyStall          = "stall"
+	AnomalySpike          = "spike"
+	AnomalyDivergence     = "divergence"
+	AnomalyStaleMonitor   = "stale_monitor"
+	AnomalyFreeze         = "freeze"
+	AnomalyOriginMismatch = "origin_mismatch"
+	AnomalyNoQuorum       = "no_quorum"
+	AnomalyInvalidInput   = "invalid_input"
+	AnomalyConflict       = "conflict"
+	AnomalyInconsistent   = "inconsistent"
+	AnomalyIdentity       = "identity"
+	AnomalyMirror         = "mirror"
+	AnomalyPanic          = "panic"
+	AnomalyBaseline       = "baseline_divergence"
+	AnomalyPeerConflict   = "peer_conflict"
+	AnomalyClockSkew      = "clock_skew"
+)
+
+// spikeMinSamples is the number of growth rate samples needed before spikes
+// are detected.
+const spikeMinSamples = 3
+
+// AnomalyConfig controls the detection of implausible log growth and of
+// monitors that disagree with the rest of the fleet. Zero values disable the
+// corresponding check.
+type AnomalyConfig struct {
+	// StallAfter alerts when the accepted tree size of a log has not grown
+	// for this long.
+	StallAfter time.Duration
+	// SpikeFactor alerts when a log grows this many times faster than its
+	// average growth rate.
+	SpikeFactor float64
+	// DivergenceEntries and DivergenceRounds alert when the tree size read
+	// from a monitor differs from the fleet median by more than
+	// DivergenceEntries for DivergenceRounds consecutive rounds.
+	DivergenceEntries int64
+	DivergenceRounds  int
+	// StaleRounds alerts when the newest tree size read from a monitor
+	// stays behind the accepted tree size without advancing for this many
+	// consecutive rounds in which the log grew. The monitor may be served
+	// old but validly signed checkpoints, a freeze attack against its
+	// vantage point.
+	StaleRounds int
+	// MaxMergeDelay maps log origins, matched with MatchOrigin, to the
+	// longest time the log may go without signing a new checkpoint. An
+	// accepted checkpoint whose timestamp is older than that while every
+	// monitor is healthy is a potential freeze attack against the whole
+	// fleet.
+	MaxMergeDelay map[string]time.Duration
+}
+
+// growthHistory is the growth history of a log origin.
+type growthHistory struct {
+	size       int64
+	lastGrowth time.Time
+	// rate is an exponentially weighted moving average of the growth
+	// rate in entries per second, computed from samples observations.
+	rate    float64
+	samples int
+	stalled bool
+}
+
+// divergence tracks how long a monitor has diverged from the fleet.
+type divergence struct {
+	rounds  int
+	alerted bool
+}
+
+// staleness tracks how long a monitor has reported the same tree size while
+// the accepted tree size grew past it.
+type staleness struct {
+	size     int64
+	accepted int64
+	rounds   int
+	alerted  bool
+}
+
+// anomalies detects anomalies across rounds.
+type anomalies struct {
+	cfg AnomalyConfig
+
+	mu       sync.Mutex
+	logs     map[string]*growthHistory
+	monitors map[string]*divergence
+	stale    map[string]*staleness
+	// frozen holds the timestamp of the checkpoint a freeze was alerted
+	// for, by origin.
+	frozen map[string]int64
+	// conflicted holds the tree sizes a conflict was alerted for, by
+	// origin.
+	conflicted map[string]map[int64]bool
+	// recentConflicts holds the latest maxRecentConflicts conflicts by
+	// origin.
+	recentConflicts map[string][]RecentConflict
+	// baseline holds the divergence of each log from the tree size it
+	// reports, by origin.
+	baseline map[string]*baselineDivergence
+	// incidents holds the open incidents by kind and subject, conditions
+	// alerted on until they clear.
+	incidents map[[2]string]bool
+	counts    map[[2]string]int
+}
+
+func newAnomalies(cfg AnomalyConfig) *anomalies {
+	return &anomalies{
+		cfg:             cfg,
+		logs:            make(map[string]*growthHistory),
+		monitors:        make(map[string]*divergence),
+		stale:           make(map[string]*staleness),
+		frozen:          make(map[string]int64),
+		conflicted:      make(map[string]map[int64]bool),
+		recentConflicts: make(map[string][]RecentConflict),
+		baseline:        make(map[string]*baselineDivergence),
+		incidents:       make(map[[2]string]bool),
+		counts:          make(map[[2]string]int),
+	}
+}
+
+// check updates the history with the accepted checkpoint of a round and the
+// latest tree size read from each monitor, and returns every anomaly found.
+func (a *anomalies) check(chpt Checkpoint, latest map[string]int64, now time.Time) []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var alerts []Alert
+	alert := func(al Alert, subject, format string, args ...any) {
+		a.counts[[2]string{al.Kind, subject}]++
+		al.Origin, al.Message = chpt.Origin, fmt.Sprintf(format, args...)
+		alerts = append(alerts, al)
+	}
+
+	g, ok := a.logs[chpt.Origin]
+	switch {
+	case !ok:
+		a.logs[chpt.Origin] = &growthHistory{size: chpt.Size, lastGrowth: now}
+	case chpt.Size > g.size:
+		if elapsed := now.Sub(g.lastGrowth).Seconds(); elapsed > 0 {
+			rate := float64(chpt.Size-g.size) / elapsed
+			if a.cfg.SpikeFactor > 0 && g.samples >= spikeMinSamples && rate > a.cfg.SpikeFactor*g.rate {
+				alert(Alert{Kind: AnomalySpike, Size: chpt.Size, Previous: g.size}, chpt.Origin, "%s grew by %d entries at %.1f entries/s, %.0f times its average rate", chpt.Origin, chpt.Size-g.size, rate, rate/g.rate)
+			}
+			if g.samples == 0 {
+				g.rate = rate
+			} else {
+				g.rate = 0.8*g.rate + 0.2*rate
+			}
+			g.samples++
+		}
+		g.size, g.lastGrowth, g.stalled = chpt.Size, now, false
+	case a.cfg.StallAfter > 0 && !g.stalled && now.Sub(g.lastGrowth) > a.cfg.StallAfter:
+		g.stalled = true
+		alert(Alert{Kind: AnomalyStall, Size: g.size}, chpt.Origin, "%s has not grown beyond tree size %d for %s", chpt.Origin, g.size, now.Sub(g.lastGrowth).Round(time.Second))
+	}
+
+	if a.cfg.StaleRounds > 0 {
+		for m, size := range latest {
+			st, ok := a.stale[m]
+			if !ok || size != st.size || size >= chpt.Size {
+				a.stale[m] = &staleness{size: size, accepted: chpt.Size}
+				continue
+			}
+			if chpt.Size <= st.accepted {
+				continue
+			}
+			st.accepted = chpt.Size
+			st.rounds++
+			if st.rounds >= a.cfg.StaleRounds && !st.alerted {
+				st.alerted = true
+				alert(Alert{Kind: AnomalyStaleMonitor, Size: size, Previous: chpt.Size, Monitors: []string{m}}, m, "monitor %s has reported tree size %d of %s for %d rounds while the accepted tree size grew to %d; it may be served a frozen view of the log", m, size, chpt.Origin, st.rounds, chpt.Size)
+			}
+		}
+	}
+
+	if a.cfg.DivergenceEntries <= 0 || a.cfg.DivergenceRounds <= 0 || len(latest) == 0 {
+		return alerts
+	}
+	median := medianSize(latest)
+	for m, size := range latest {
+		d, ok := a.monitors[m]
+		if !ok {
+			d = &divergence{}
+			a.monitors[m] = d
+		}
+		diff := size - median
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= a.cfg.DivergenceEntries {
+			*d = divergence{}
+			continue
+		}
+		d.rounds++
+		if d.rounds >= a.cfg.DivergenceRounds && !d.alerted {
+			d.alerted = true
+			alert(Alert{Kind: AnomalyDivergence, Size: size, Previous: median, Monitors: []string{m}}, m, "monitor %s reported tree size %d for %d rounds while the fleet median is %d", m, size, d.rounds, median)
+		}
+	}
+	return alerts
+}
+
+// checkFreeze alerts if the timestamp of the checkpoint accepted in a round
+// in which every monitor was read is older than the maximum merge delay of
+// its log. A frozen log is alerted once until its timestamp advances.
+func (a *anomalies) checkFreeze(chpt Checkpoint, healthy bool, now time.Time) []Alert {
+	var mmd time.Duration
+	for origin, d := range a.cfg.MaxMergeDelay {
+		if MatchOrigin(origin, chpt.Origin) {
+			mmd = d
+		}
+	}
+	if mmd <= 0 || chpt.Timestamp == 0 || !healthy {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	age := now.Sub(time.Unix(0, chpt.Timestamp))
+	if age <= mmd {
+		delete(a.frozen, chpt.Origin)
+		return nil
+	}
+	if ts, ok := a.frozen[chpt.Origin]; ok && ts == chpt.Timestamp {
+		return nil
+	}
+	a.frozen[chpt.Origin] = chpt.Timestamp
+	a.counts[[2]string{AnomalyFreeze, chpt.Origin}]++
+	return []Alert{{
+		Kind:    AnomalyFreeze,
+		Origin:  chpt.Origin,
+		Size:    chpt.Size,
+		Roots:   []string{chpt.Hash},
+		Message: fmt.Sprintf("the accepted checkpoint of %s at tree size %d was signed %s ago, longer than its maximum merge delay of %s, while all monitors are healthy; the log may be frozen", chpt.Origin, chpt.Size, age.Round(time.Second), mmd),
+	}}
+}
+
+// checkConflicts counts and returns alerts for the conflicts found in a round.
+// Each conflicting tree size is alerted as soon as it is read, and only once.
+func (a *anomalies) checkConflicts(conflicts []Conflict) []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var alerts []Alert
+	for _, c := range conflicts {
+		a.incidents[[2]string{AnomalyConflict, c.Origin}] = true
+		if a.conflicted[c.Origin][c.Size] {
+			continue
+		}
+		if a.conflicted[c.Origin] == nil {
+			a.conflicted[c.Origin] = make(map[int64]bool)
+		}
+		a.conflicted[c.Origin][c.Size] = true
+		a.counts[[2]string{AnomalyConflict, c.Origin}]++
+		recent := append(a.recentConflicts[c.Origin], recentConflict(c, time.Now()))
+		if len(recent) > maxRecentConflicts {
+			recent = recent[len(recent)-maxRecentConflicts:]
+		}
+		a.recentConflicts[c.Origin] = recent
+		alerts = append(alerts, conflictAlert(c))
+	}
+	return alerts
+}
+
+// record counts an anomaly detected outside of check, such as a round
+// without quorum.
+func (a *anomalies) record(kind, subject string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.counts[[2]string{kind, subject}]++
+}
+
+// openIncident records that the condition of kind alerted on for subject
+// persists until it is resolved.
+func (a *anomalies) openIncident(kind, subject string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.incidents[[2]string{kind, subject}] = true
+}
+
+// resolveIncidents closes the open incidents of kind whose subject cleared
+// returns true for, and returns their sorted subjects.
+func (a *anomalies) resolveIncidents(kind string, cleared func(subject string) bool) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var subjects []string
+	for k := range a.incidents {
+		if k[0] == kind && cleared(k[1]) {
+			delete(a.incidents, k)
+			subjects = append(subjects, k[1])
+		}
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// medianSize returns the median of the tree sizes. For an even number of
+// sizes the lower middle one is returned.
+func medianSize(latest map[string]int64) int64 {
+	sizes := make([]int64, 0, len(latest))
+	for _, s := range latest {
+		sizes = append(sizes, s)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	return sizes[(len(sizes)-1)/2]
+}
+
+// anomalyCounts returns the number of anomalies detected by kind and
+// subject, the log origin or monitor.
+func (a *anomalies) anomalyCounts() map[[2]string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	counts := make(map[[2]string]int, len(a.counts))
+	for k, n := range a.counts {
+		counts[k] = n
+	}
+	return counts
+}
@@ -0,0 +1,509 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIHandler returns an http.Handler serving the read API of the given
+// collectors:
+//
+//	GET /api/v1/provenance[?origin=<origin>][&tree_size=<size>][&since=<time>][&until=<time>][&page_size=<n>]
+//
+// lists the provenance of retained accepted checkpoints, oldest first. With
+// page_size, at most that many records are returned and the Link header
+// holds the URL of the next page.
+//
+//	GET /api/v1/monitors
+//
+// lists the status of every monitor, see MonitorStatuses.
+//
+//	GET /api/v1/checkpoint/by-hash/<sha256>
+//
+// returns the exact bytes of an accepted checkpoint with the given hex
+// encoded SHA-256, see CheckpointByHash.
+//
+//	GET /api/v1/checkpoint/wait?tree_size=<size>[&origin=<origin>][&timeout=<seconds>]
+//
+// waits until a checkpoint covering the tree size is accepted, see
+// WaitForTreeSize, and answers with 204 No Content if the timeout expires
+// first.
+//
+//	GET /api/v1/checkpoint/latest[?origin=<origin>][&max_age=<seconds>]
+//
+// returns the accepted checkpoint with the largest tree size, see
+// LatestAccepted.
+//
+//	GET /api/v1/tables/<table>[?since=<time>][&until=<time>]
+//
+// returns the rows of one of Tables as CSV, see TableRows and
+// ForeignTableDDL.
+//
+//	GET /api/v1/reports/by-checkpoint?origin=<origin>&tree_size=<size>
+//
+// returns the archived report of the round that accepted a checkpoint, see
+// RoundReportFor.
+//
+//	GET /api/v1/attestation
+//
+// returns the collector's signed attestation of its latest accepted
+// checkpoints for peer collectors, see Attest.
+//
+//	POST /api/v1/verify-inclusion
+//
+// verifies the inclusion proof in the JSON request body against the
+// accepted checkpoints, see VerifyInclusion.
+//
+//	GET /status/<origin>[?max_age=<seconds>]
+//
+// returns the health of a log for status pages, see LogStatus. In
+// multi-tenant mode the namespace query parameter selects the tenant.
+//
+// Checkpoints are served with the time the collector last accepted them in
+// AcceptedAtHeader, if known. With max_age, the latest checkpoint and status
+// requests are answered with 412 Precondition Failed if the latest checkpoint
+// was accepted longer ago, or at an unknown time, so that consumers can
+// enforce freshness server-side.
+//
+// Error responses of failures with an ErrorCode carry it in
+// ErrorCodeHeader.
+//
+// Responses carry an ETag, so that pollers sending If-None-Match are
+// answered with 304 Not Modified while nothing changed.
+//
+// Responses are JSON unless the Accept header asks for application/cbor or
+// application/x-protobuf, see Marshal. The API is described by the OpenAPI
+// document served at /openapi.json, and requests not conforming to it are
+// rejected.
+func APIHandler(cs ...*Collector) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/openapi.json", OpenAPIHandler())
+	mux.Handle("/api/v1/provenance", validated(apiOperationByID("listProvenance"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		records, err := c.Provenance()
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		q := r.URL.Query()
+		f := provenanceFilter{origin: q.Get("origin"), size: -1}
+		if s := q.Get("tree_size"); s != "" {
+			f.size, _ = strconv.ParseInt(s, 10, 64)
+		}
+		if s := q.Get("since"); s != "" {
+			f.since, _ = time.Parse(time.RFC3339, s)
+		}
+		if s := q.Get("until"); s != "" {
+			f.until, _ = time.Parse(time.RFC3339, s)
+		}
+		records = f.apply(records)
+
+		if s := q.Get("page_size"); s != "" {
+			n, _ := strconv.Atoi(s)
+			page, next, err := paginate(records, q.Get("page_token"), n)
+			if err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+			if next != "" {
+				u := *r.URL
+				q.Set("page_token", next)
+				u.RawQuery = q.Encode()
+				w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", u.RequestURI()))
+			}
+			records = page
+		}
+		writeEncoded(w, r, records)
+	})))
+	mux.Handle("/api/v1/tables/", validated(apiOperationByID("readTable"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		t, _ := TableByName(strings.TrimPrefix(r.URL.Path, "/api/v1/tables/"))
+		q := r.URL.Query()
+		var since, until time.Time
+		if s := q.Get("since"); s != "" {
+			since, _ = time.Parse(time.RFC3339, s)
+		}
+		if s := q.Get("until"); s != "" {
+			until, _ = time.Parse(time.RFC3339, s)
+		}
+		rows, err := c.TableRows(t, since, until)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		if err := WriteTableCSV(w, t, rows); err != nil {
+			c.logf("Writing table %s: %v\n", t.Name, err)
+		}
+	})))
+	mux.Handle("/api/v1/reports/by-checkpoint", validated(apiOperationByID("roundReportByCheckpoint"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		size, err := strconv.ParseInt(q.Get("tree_size"), 10, 64)
+		if err != nil {
+			http.Error(w, "tree_size is required", http.StatusBadRequest)
+			return
+		}
+		report, err := c.RoundReportFor(q.Get("origin"), size)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if report == nil {
+			http.Error(w, "no archived round accepted this checkpoint", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, report)
+	})))
+	mux.Handle("/api/v1/checkpoint/by-hash/", validated(apiOperationByID("checkpointByHash"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		sum := strings.TrimPrefix(r.URL.Path, "/api/v1/checkpoint/by-hash/")
+		b, err := c.CheckpointByHash(sum)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if b == nil {
+			http.Error(w, "no accepted checkpoint has this hash", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("ETag", `"`+sum+`"`)
+		// Shared caches must not hand a tenant's checkpoints to clients
+		// without its token.
+		cache := "public"
+		if c.cfg.APIToken != "" {
+			cache = "private"
+		}
+		w.Header().Set("Cache-Control", cache+", max-age=31536000, immutable")
+		w.Write(b)
+	})))
+	mux.Handle("/api/v1/checkpoint/wait", validated(apiOperationByID("waitForTreeSize"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		size, err := strconv.ParseInt(q.Get("tree_size"), 10, 64)
+		if err != nil {
+			http.Error(w, "tree_size is required", http.StatusBadRequest)
+			return
+		}
+		timeout := 30 * time.Second
+		if s := q.Get("timeout"); s != "" {
+			n, _ := strconv.Atoi(s)
+			timeout = time.Duration(n) * time.Second
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		raw, err := c.WaitForTreeSize(ctx, q.Get("origin"), size)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			w.WriteHeader(http.StatusNoContent)
+		case err != nil:
+			writeError(w, err, http.StatusInternalServerError)
+		default:
+			if chpt, err := ParseCheckpoint(raw); err == nil {
+				if _, err := c.setAcceptedAt(w, chpt); err != nil {
+					writeError(w, err, http.StatusInternalServerError)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(checkpointNote(raw)))
+		}
+	})))
+	mux.Handle("/api/v1/checkpoint/latest", validated(apiOperationByID("latestCheckpoint"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		chpt, ok, err := c.LatestAccepted(r.URL.Query().Get("origin"))
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "no checkpoint of this log has been accepted", http.StatusNotFound)
+			return
+		}
+		at, err := c.setAcceptedAt(w, chpt)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if tooOld(r, at, c.now()) {
+			http.Error(w, "the latest checkpoint was accepted longer than max_age ago", http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(checkpointNote(chpt.Raw)))
+	})))
+	mux.Handle("/api/v1/attestation", validated(apiOperationByID("attestation"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		if c.cfg.Cosigner == nil {
+			http.Error(w, "the collector has no signing key to attest with", http.StatusNotFound)
+			return
+		}
+		msg, err := c.Attest(c.now())
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(msg)
+	})))
+	mux.Handle("/api/v1/verify-inclusion", validated(apiOperationByID("verifyInclusion"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		var req InclusionRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("decoding inclusion proof: %v", err), http.StatusBadRequest)
+			return
+		}
+		verdict, err := c.VerifyInclusion(r.Context(), req)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, verdict)
+	})))
+	mux.Handle("/api/v1/monitors", validated(apiOperationByID("listMonitors"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		statuses, err := c.MonitorStatuses()
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeEncoded(w, r, statuses)
+	})))
+	mux.Handle("/status/", validated(apiOperationByID("logStatus"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		status, err := c.LogStatus(strings.TrimPrefix(r.URL.Path, "/status/"))
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if status == nil {
+			http.Error(w, "no checkpoint of this log has been accepted", http.StatusNotFound)
+			return
+		}
+		var at *time.Time
+		if status.Accepted != nil {
+			at = status.Accepted.AcceptedAt
+		}
+		if tooOld(r, at, c.now()) {
+			http.Error(w, "the latest checkpoint was accepted longer than max_age ago", http.StatusPreconditionFailed)
+			return
+		}
+		// Status pages embed the document from other sites.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeEncoded(w, r, status)
+	})))
+	return mux
+}
+
+// apiCollector returns the collector of the namespace requested by r,
+// writing an error response if there is none or r lacks its API token.
+func apiCollector(w http.ResponseWriter, r *http.Request, cs []*Collector) (*Collector, bool) {
+	ns := r.URL.Query().Get("namespace")
+	c := findCollector(cs, ns)
+	if c == nil {
+		http.Error(w, fmt.Sprintf("unknown namespace %q", ns), http.StatusNotFound)
+		return nil, false
+	}
+	if !c.authorized(r.Header.Get("Authorization")) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="collector"`)
+		http.Error(w, fmt.Sprintf("missing or invalid API token for namespace %q", ns), http.StatusUnauthorized)
+		return nil, false
+	}
+	return c, true
+}
+
+// authorized reports whether the Authorization header value carries the
+// collector's API token, if it has one.
+func (c *Collector) authorized(header string) bool {
+	if c.cfg.APIToken == "" {
+		return true
+	}
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(c.cfg.APIToken)) == 1
+}
+
+// CheckpointByHash returns the exact bytes of a retained accepted
+// checkpoint whose SHA-256 is the hex encoded sum, or nil if there is none.
+// A checkpoint matches by the hash of its signed note, of its flattened line
+// as read from a monitor, or, for the latest one, of the cosigned note in
+// CosignedFile.
+func (c *Collector) CheckpointByHash(sum string) ([]byte, error) {
+	if c.cfg.CosignedFile != "" {
+		b, err := os.ReadFile(c.cfg.CosignedFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil && lineHash(string(b)) == sum {
+			return b, nil
+		}
+	}
+
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		for _, b := range [][]byte{[]byte(checkpointNote(lines[i])), []byte(lines[i])} {
+			if lineHash(string(b)) == sum {
+				return b, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// findCollector returns the collector of namespace ns, or nil.
+func findCollector(cs []*Collector, ns string) *Collector {
+	for _, c := range cs {
+		if c.Namespace() == ns {
+			return c
+		}
+	}
+	return nil
+}
+
+// provenanceFilter selects provenance records.
+type provenanceFilter struct {
+	// origin is an origin or origin pattern, every origin if empty.
+	origin string
+	// size is a tree size, every tree size if negative.
+	size int64
+	// since and until bound the acceptance time if they are not zero.
+	since, until time.Time
+}
+
+// apply returns the records matching the filter.
+func (f provenanceFilter) apply(records []Provenance) []Provenance {
+	filtered := []Provenance{}
+	for _, p := range records {
+		switch {
+		case f.origin != "" && !MatchOrigin(f.origin, p.Origin):
+		case f.size >= 0 && p.TreeSize != f.size:
+		case !f.since.IsZero() && p.AcceptedAt.Before(f.since):
+		case !f.until.IsZero() && !p.AcceptedAt.Before(f.until):
+		default:
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+// A page token identifies the last record of the previous page by its
+// acceptance time, origin and tree size. Records are kept in the order they
+// were accepted, so the next page starts after that record, or after its
+// acceptance time if it has since been pruned.
+type pageToken struct {
+	AcceptedAt time.Time `json:"t"`
+	Origin     string    `json:"o"`
+	TreeSize   int64     `json:"s"`
+}
+
+// paginate returns the page of at most size records following the record
+// identified by token, or the first page if token is empty, and the token of
+// the next page if there are more records.
+func paginate(records []Provenance, token string, size int) ([]Provenance, string, error) {
+	start := 0
+	if token != "" {
+		b, err := base64.RawURLEncoding.DecodeString(token)
+		var last pageToken
+		if err == nil {
+			err = json.Unmarshal(b, &last)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid page_token: %w", err)
+		}
+		start = len(records)
+		for i, p := range records {
+			if p.Origin == last.Origin && p.TreeSize == last.TreeSize && p.AcceptedAt.Equal(last.AcceptedAt) {
+				start = i + 1
+				break
+			}
+			if p.AcceptedAt.After(last.AcceptedAt) {
+				start = i
+				break
+			}
+		}
+	}
+	end := start + size
+	if end >= len(records) {
+		return records[start:], "", nil
+	}
+	last := records[end-1]
+	b, err := json.Marshal(pageToken{AcceptedAt: last.AcceptedAt, Origin: last.Origin, TreeSize: last.TreeSize})
+	if err != nil {
+		return nil, "", err
+	}
+	return records[start:end], base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
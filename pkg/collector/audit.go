@@ -0,0 +1,240 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditStart         = "start"
+	AuditAccept        = "accept"
+	AuditAdminRequest  = "admin_request"
+	AuditMonitorChange = "monitor_change"
+)
+
+// AuditEntry is a single record of the audit log. Hash covers every other
+// field, including PrevHash, so entries form a hash chain.
+type AuditEntry struct {
+	Seq      int64             `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Action   string            `json:"action"`
+	Actor    string            `json:"actor,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// computeHash returns the hex encoded SHA-256 of the entry without its hash.
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog is an append-only, hash-chained log of administrative and
+// policy-relevant actions, stored as one JSON entry per line.
+type AuditLog struct {
+	path string
+	sc   *StateCipher
+
+	mu   sync.Mutex
+	seq  int64
+	prev string
+	// last is the last line of the file as stored, which the next line is
+	// encrypted after.
+	last string
+	// now is the clock of the collector the log belongs to, see New.
+	now func() time.Time
+}
+
+// OpenAuditLog opens the audit log at path, creating it if needed. The
+// existing chain is verified so that new entries extend an intact log.
+// Entries are encrypted with sc if set.
+func OpenAuditLog(path string, sc *StateCipher) (*AuditLog, error) {
+	a := &AuditLog{path: path, sc: sc, now: time.Now}
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return a, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	last, err := VerifyAuditLog(f, sc)
+	if err != nil {
+		return nil, fmt.Errorf("verifying audit log %q: %w", path, err)
+	}
+	if last != nil {
+		a.seq = last.Seq
+		a.prev = last.Hash
+	}
+	lines, err := ReadLatestCheckpoints(path, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 1 {
+		a.last = lines[0]
+	}
+	return a, nil
+}
+
+// setClock makes the log timestamp entries with now, the clock of its
+// collector.
+func (a *AuditLog) setClock(now func() time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.now = now
+}
+
+// Record appends an entry for action to the audit log.
+func (a *AuditLog) Record(action, actor string, details map[string]string) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e := AuditEntry{
+		Seq:      a.seq + 1,
+		Time:     a.now().UTC(),
+		Action:   action,
+		Actor:    actor,
+		Details:  details,
+		PrevHash: a.prev,
+	}
+	var err error
+	if e.Hash, err = e.computeHash(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line, err := a.sc.sealLine(sealAudit, a.last, string(b))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	a.seq, a.prev, a.last = e.Seq, e.Hash, line
+	return nil
+}
+
+// ReadAuditLog reads and verifies every entry of an audit log, decrypting
+// them with sc if set.
+func ReadAuditLog(r io.Reader, sc *StateCipher) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := scanAuditLog(r, sc, func(e AuditEntry) { entries = append(entries, e) })
+	return entries, err
+}
+
+// VerifyAuditLog checks the hash chain of an audit log and returns its last
+// entry, or nil if the log is empty.
+func VerifyAuditLog(r io.Reader, sc *StateCipher) (*AuditEntry, error) {
+	var last *AuditEntry
+	err := scanAuditLog(r, sc, func(e AuditEntry) { last = &e })
+	return last, err
+}
+
+func scanAuditLog(r io.Reader, sc *StateCipher, fn func(AuditEntry)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	o := lineOpener{sc: sc, kind: sealAudit}
+	var prev string
+	var seq int64
+	for scanner.Scan() {
+		line, err := o.open(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", seq+1, err)
+		}
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return fmt.Errorf("entry %d: %w", seq+1, err)
+		}
+		if e.Seq != seq+1 {
+			return fmt.Errorf("entry %d: unexpected sequence number %d", seq+1, e.Seq)
+		}
+		if e.PrevHash != prev {
+			return fmt.Errorf("entry %d: previous hash does not match, the log was modified", e.Seq)
+		}
+		h, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if h != e.Hash {
+			return fmt.Errorf("entry %d: hash does not match its contents, the log was modified", e.Seq)
+		}
+		fn(e)
+		prev, seq = e.Hash, e.Seq
+	}
+	return scanner.Err()
+}
+
+// AuditHandler wraps h so that every request is recorded in the audit log.
+func AuditHandler(a *AuditLog, h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		details := map[string]string{"method": r.Method, "path": r.URL.Path}
+		if r.URL.RawQuery != "" {
+			details["query"] = r.URL.RawQuery
+		}
+		if err := a.Record(AuditAdminRequest, r.RemoteAddr, details); err != nil {
+			http.Error(w, "recording audit entry failed", http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// containerCredentialsHost is the link-local host of the ECS container
+// credentials endpoint, which AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is
+// relative to.
+const containerCredentialsHost = "http://169.254.170.2"
+
+// containerCredentialsRefresh is how long before they expire the
+// credentials of a ContainerCredentials are fetched again.
+const containerCredentialsRefresh = 5 * time.Minute
+
+// errNoAWSCredentials is returned when neither static nor container
+// credentials are configured.
+var errNoAWSCredentials = errors.New("no AWS credentials configured")
+
+// ContainerCredentials provides the temporary credentials of the task role
+// of an ECS or Fargate task, read from the container credentials endpoint
+// and fetched again shortly before they expire.
+type ContainerCredentials struct {
+	// URL is the container credentials endpoint.
+	URL string
+	// Token, if set, is sent as the Authorization header, as is the
+	// content of TokenFile, which is read for every request.
+	Token, TokenFile string
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+
+	now func() time.Time
+
+	mu      sync.Mutex
+	creds   awsCredentials
+	expires time.Time
+}
+
+// ContainerCredentialsFromEnv returns the ContainerCredentials configured
+// by the environment variables ECS and Fargate set for tasks with a task
+// role, AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI with AWS_CONTAINER_AUTHORIZATION_TOKEN
+// or AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE, or nil if they are not set.
+func ContainerCredentialsFromEnv() *ContainerCredentials {
+	c := &ContainerCredentials{
+		URL:       os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"),
+		Token:     os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+		TokenFile: os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+	}
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		c.URL = containerCredentialsHost + rel
+	}
+	if c.URL == "" {
+		return nil
+	}
+	return c
+}
+
+// get returns the current credentials, fetching them if they expire
+// within containerCredentialsRefresh.
+func (c *ContainerCredentials) get(ctx context.Context) (awsCredentials, error) {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.AccessKeyID != "" && now().Add(containerCredentialsRefresh).Before(c.expires) {
+		return c.creds, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := c.Token
+	if c.TokenFile != "" {
+		b, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("reading container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching container credentials: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("fetching container credentials: %s", resp.Status)
+	}
+	var out struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return awsCredentials{}, fmt.Errorf("decoding container credentials: %w", err)
+	}
+	if out.AccessKeyID == "" || out.SecretAccessKey == "" {
+		return awsCredentials{}, errors.New("container credentials endpoint returned no credentials")
+	}
+	c.creds = awsCredentials{out.AccessKeyID, out.SecretAccessKey, out.Token}
+	c.expires = out.Expiration
+	return c.creds, nil
+}
+
+// resolveAWSCredentials returns static if it has a key, or else the
+// credentials of the container, if any.
+func resolveAWSCredentials(ctx context.Context, static awsCredentials, container *ContainerCredentials) (awsCredentials, error) {
+	if static.AccessKeyID != "" && static.SecretAccessKey != "" {
+		return static, nil
+	}
+	if container != nil {
+		return container.get(ctx)
+	}
+	return awsCredentials{}, errNoAWSCredentials
+}
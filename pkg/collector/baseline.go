@@ -0,0 +1,164 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Default baseline comparison parameters
+const (
+	DefaultBaselineEntries = 1000
+	DefaultBaselineRounds  = 3
+)
+
+// TreeHeadSource reads the latest checkpoint of a log directly from the
+// log, bypassing the monitors.
+type TreeHeadSource interface {
+	TreeHead(ctx context.Context) (Checkpoint, error)
+}
+
+// RekorTreeHead reads the signed tree head of the active shard from the
+// Rekor API at URL, such as https://rekor.sigstore.dev.
+type RekorTreeHead struct {
+	URL    string
+	Client *http.Client
+}
+
+// TreeHead implements TreeHeadSource.
+func (r *RekorTreeHead) TreeHead(ctx context.Context) (Checkpoint, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.URL, "/")+"/api/v1/log", nil)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Checkpoint{}, fmt.Errorf("fetching tree head: %s", resp.Status)
+	}
+
+	var body struct {
+		SignedTreeHead string `json:"signedTreeHead"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return Checkpoint{}, fmt.Errorf("decoding tree head: %w", err)
+	}
+	return ParseCheckpoint(strings.ReplaceAll(body.SignedTreeHead, "\n", lineSeparator))
+}
+
+// Baseline compares every accepted checkpoint with the tree head the log
+// itself reports, as a sanity check of the monitoring pipeline: monitors
+// falling far behind, or agreeing on tree sizes the log does not report.
+type Baseline struct {
+	// Source reads the tree head of the log. Comparison is disabled if it
+	// is nil.
+	Source TreeHeadSource
+	// Entries and Rounds alert when the tree size of the log and the
+	// accepted tree size differ by more than Entries for Rounds
+	// consecutive rounds.
+	Entries int64
+	Rounds  int
+}
+
+// baselineDivergence tracks how far the accepted tree size of a log is from
+// the tree size the log reports.
+type baselineDivergence struct {
+	// entries is the tree size of the log minus the accepted tree size.
+	entries int64
+	rounds  int
+	alerted bool
+}
+
+// checkBaseline compares the checkpoint accepted in a round with the tree
+// head of its log and returns every anomaly found.
+// Failures to read the tree head are logged, since the baseline is only a
+// sanity check.
+func (c *Collector) checkBaseline(ctx context.Context, accepted Checkpoint) []Alert {
+	b := c.cfg.Baseline
+	if b.Source == nil || c.cfg.Offline {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Verify)
+	defer cancel()
+	head, err := b.Source.TreeHead(ctx)
+	if err != nil {
+		c.logf("Reading the baseline tree head of %s: %v\n", accepted.Origin, err)
+		return nil
+	}
+	// Rekor reports the tree head of its active shard only.
+	if head.Origin != accepted.Origin {
+		return nil
+	}
+	return c.anoms.checkBaseline(accepted, head.Size, b)
+}
+
+// checkBaseline updates the divergence of the accepted checkpoint of a log
+// from the tree size reported by the log itself. A divergence is alerted
+// once until it recovers.
+func (a *anomalies) checkBaseline(chpt Checkpoint, logSize int64, b Baseline) []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d, ok := a.baseline[chpt.Origin]
+	if !ok {
+		d = &baselineDivergence{}
+		a.baseline[chpt.Origin] = d
+	}
+	d.entries = logSize - chpt.Size
+	diff := d.entries
+	if diff < 0 {
+		diff = -diff
+	}
+	if b.Entries <= 0 || b.Rounds <= 0 || diff <= b.Entries {
+		d.rounds, d.alerted = 0, false
+		return nil
+	}
+	d.rounds++
+	if d.rounds < b.Rounds || d.alerted {
+		return nil
+	}
+	d.alerted = true
+	a.counts[[2]string{AnomalyBaseline, chpt.Origin}]++
+	al := Alert{Kind: AnomalyBaseline, Origin: chpt.Origin, Size: chpt.Size, Previous: logSize}
+	if d.entries > 0 {
+		al.Message = fmt.Sprintf("%s reports tree size %d, %d entries ahead of the accepted tree size %d for %d rounds; monitors are falling behind the log", chpt.Origin, logSize, d.entries, chpt.Size, d.rounds)
+	} else {
+		al.Message = fmt.Sprintf("the accepted tree size %d of %s is %d entries ahead of the tree size %d the log reports for %d rounds; monitors agree on tree sizes the log does not serve", chpt.Size, chpt.Origin, -d.entries, logSize, d.rounds)
+	}
+	return []Alert{al}
+}
+
+// baselineDivergences returns the tree size reported by each log minus its
+// accepted tree size, as of the last comparison.
+func (a *anomalies) baselineDivergences() map[string]int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries := make(map[string]int64, len(a.baseline))
+	for o, d := range a.baseline {
+		entries[o] = d.entries
+	}
+	return entries
+}
@@ -0,0 +1,73 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeMonitorFile writes a monitor logfile with the given number of
+// checkpoints and returns its path.
+func writeMonitorFile(b *testing.B, dir string, lines int) string {
+	b.Helper()
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		sb.WriteString(testCheckpoint(int64(i), int64(i)) + "\n")
+	}
+	path := filepath.Join(dir, fmt.Sprintf("logInfo%d.txt", lines))
+	if err := os.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+func BenchmarkReadLatestCheckpoints(b *testing.B) {
+	dir := b.TempDir()
+	for _, lines := range []int{100, 10000, 100000} {
+		path := writeMonitorFile(b, dir, lines)
+
+		b.Run(fmt.Sprintf("reverse/%d", lines), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ReadLatestCheckpoints(path, 2); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("scan/%d", lines), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = scanLastLines(f, 2)
+				f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCollector(b *testing.B) {
+	for _, bm := range Benchmarks(b.TempDir(), []int{10, 100, 1000}) {
+		b.Run(fmt.Sprintf("%s/%d", bm.Name, bm.Monitors), bm.F)
+	}
+}
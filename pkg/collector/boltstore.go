@@ -0,0 +1,267 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	RegisterCapability(CapabilityStorage, "bolt")
+}
+
+// acceptedBucket is the bbolt bucket holding accepted checkpoint lines,
+// keyed by a big endian sequence number.
+var acceptedBucket = []byte("accepted")
+
+// registryBucket is the bbolt bucket holding the monitor registry under
+// registryKey.
+var (
+	registryBucket = []byte("registry")
+	registryKey    = []byte("monitors")
+)
+
+// BoltStorage is a Storage keeping the accepted checkpoints in a bbolt
+// database, a single file written by pure Go code. Lines are encrypted with
+// the StateCipher given to OpenBoltStorage, if any.
+type BoltStorage struct {
+	path string
+	sc   *StateCipher
+
+	// mu guards db, which Compact replaces.
+	mu sync.RWMutex
+	db *bolt.DB
+}
+
+// OpenBoltStorage opens the bbolt database at path, creating it if needed.
+// Only one process can open the database at a time.
+func OpenBoltStorage(path string, sc *StateCipher) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt storage: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(acceptedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening bolt storage: %w", err)
+	}
+	return &BoltStorage{path: path, db: db, sc: sc}, nil
+}
+
+// Append implements Storage.
+func (s *BoltStorage) Append(lines []string) error {
+	sealed := make([]string, len(lines))
+	for i, l := range lines {
+		var err error
+		if sealed[i], err = s.sc.Seal(l); err != nil {
+			return err
+		}
+	}
+	return s.appendSealed(sealed)
+}
+
+func (s *BoltStorage) appendSealed(lines []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(acceptedBucket)
+		for _, l := range lines {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+			if err := b.Put(key, []byte(l)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Latest implements Storage.
+func (s *BoltStorage) Latest(n int) ([]string, error) {
+	var lines []string
+	empty := false
+	s.mu.RLock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(acceptedBucket)
+		empty = b.Sequence() == 0
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(lines) < n; k, v = c.Prev() {
+			lines = append(lines, string(v))
+		}
+		return nil
+	})
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return nil, fmt.Errorf("bolt storage: %w", fs.ErrNotExist)
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	for i, l := range lines {
+		if lines[i], err = s.sc.Open(l); err != nil {
+			return nil, fmt.Errorf("bolt storage: %w", err)
+		}
+	}
+	return lines, nil
+}
+
+// Prune implements Storage.
+func (s *BoltStorage) Prune(keep int) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(acceptedBucket)
+		n := b.Stats().KeyN
+		var old [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && len(old) < n-keep; k, _ = c.Next() {
+			old = append(old, append([]byte(nil), k...))
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compact implements Compacter. bbolt keeps the pages freed by Prune for
+// reuse instead of shrinking the file, so the database is copied into a new
+// file that replaces it.
+func (s *BoltStorage) Compact() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before, err := os.Stat(s.path)
+	if err != nil {
+		return 0, err
+	}
+	tmp := s.path + ".compact"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	dst, err := bolt.Open(tmp, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return 0, err
+	}
+	if err := bolt.Compact(dst, s.db, 1<<20); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	if err := s.db.Close(); err != nil {
+		return 0, err
+	}
+	renameErr := os.Rename(tmp, s.path)
+	// If the database cannot be reopened, the closed one stays in place so
+	// that later operations fail with bolt.ErrDatabaseNotOpen.
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return 0, fmt.Errorf("reopening bolt storage: %w", err)
+	}
+	s.db = db
+	if renameErr != nil {
+		os.Remove(tmp)
+		return 0, renameErr
+	}
+	after, err := os.Stat(s.path)
+	if err != nil {
+		return 0, err
+	}
+	return before.Size() - after.Size(), nil
+}
+
+// LoadRegistry implements RegistryStorage.
+func (s *BoltStorage) LoadRegistry() ([]byte, error) {
+	var sealed []byte
+	s.mu.RLock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(registryBucket); b != nil {
+			sealed = append([]byte(nil), b.Get(registryKey)...)
+		}
+		return nil
+	})
+	s.mu.RUnlock()
+	if err != nil || sealed == nil {
+		return nil, err
+	}
+	return s.sc.openBlob(sealRegistry, sealed)
+}
+
+// SaveRegistry implements RegistryStorage.
+func (s *BoltStorage) SaveRegistry(registry []byte) error {
+	sealed, err := s.sc.sealBlob(sealRegistry, registry)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(registryBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(registryKey, sealed)
+	})
+}
+
+// Close implements Storage.
+func (s *BoltStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+// Migrate copies the lines of a legacy accepted file into the storage if
+// the storage is still empty, returning the number of lines copied. Lines
+// are copied as stored, so the file must be encrypted with the same
+// StateCipher as the storage, if any. A missing file is not an error.
+func (s *BoltStorage) Migrate(filename string) (int, error) {
+	if _, err := s.Latest(1); !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	lines, err := ReadLegacyLines(filename)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.appendSealed(lines); err != nil {
+		return 0, fmt.Errorf("migrating %s: %w", filename, err)
+	}
+	return len(lines), nil
+}
@@ -0,0 +1,202 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Default circuit breaker parameters
+const (
+	DefaultBreakerThreshold = 3
+	DefaultBreakerBackoff   = 1 * time.Minute
+	DefaultBreakerMaxWait   = 1 * time.Hour
+)
+
+// BreakerConfig controls when a failing monitor is skipped.
+type BreakerConfig struct {
+	// Threshold is the number of consecutive failures that opens the circuit.
+	Threshold int
+	// Backoff is how long the circuit stays open after it first opens. It
+	// doubles each time a trial read fails, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// BreakerState is the state of a monitor's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed means the monitor is read every round.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means the monitor is skipped until its backoff expires.
+	BreakerOpen
+	// BreakerHalfOpen means a single trial read is allowed.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type breaker struct {
+	state     BreakerState
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+}
+
+// breakers tracks one circuit breaker per monitor.
+type breakers struct {
+	cfg BreakerConfig
+	now func() time.Time
+	// prefix is prepended to log messages.
+	prefix string
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+func newBreakers(cfg BreakerConfig, prefix string) *breakers {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = DefaultBreakerThreshold
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBreakerBackoff
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = DefaultBreakerMaxWait
+		if cfg.MaxBackoff < cfg.Backoff {
+			cfg.MaxBackoff = cfg.Backoff
+		}
+	}
+	return &breakers{cfg: cfg, now: time.Now, prefix: prefix, m: make(map[string]*breaker)}
+}
+
+func (b *breakers) get(key string) *breaker {
+	br, ok := b.m[key]
+	if !ok {
+		br = &breaker{}
+		b.m[key] = br
+	}
+	return br
+}
+
+// blocked reports whether the circuit of the monitor is open and its
+// backoff has not expired, without changing its state.
+func (b *breakers) blocked(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.m[key]
+	return ok && br.state == BreakerOpen && b.now().Before(br.openUntil)
+}
+
+// allow reports whether the monitor should be read this round. An open
+// circuit whose backoff has expired moves to half-open and allows one read.
+func (b *breakers) allow(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br := b.get(key)
+	if br.state == BreakerOpen {
+		if b.now().Before(br.openUntil) {
+			return false
+		}
+		br.state = BreakerHalfOpen
+	}
+	return true
+}
+
+// success records a successful read, closing the circuit.
+func (b *breakers) success(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br := b.get(key)
+	if br.state != BreakerClosed {
+		log.Printf(b.prefix+"Monitor %s recovered, closing circuit\n", key)
+	}
+	*br = breaker{}
+}
+
+// failure records a failed read. The first failures are logged individually;
+// once the threshold is reached the circuit opens and only state changes are
+// logged until the monitor recovers.
+func (b *breakers) failure(key string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br := b.get(key)
+	br.failures++
+	switch {
+	case br.state == BreakerHalfOpen:
+		br.backoff *= 2
+		if br.backoff > b.cfg.MaxBackoff {
+			br.backoff = b.cfg.MaxBackoff
+		}
+	case br.failures >= b.cfg.Threshold:
+		br.backoff = b.cfg.Backoff
+	default:
+		log.Printf(b.prefix+"Reading monitor %s failed (%d/%d): %v\n", key, br.failures, b.cfg.Threshold, err)
+		return
+	}
+	br.state = BreakerOpen
+	br.openUntil = b.now().Add(br.backoff)
+	log.Printf(b.prefix+"Monitor %s failed %d times, opening circuit for %s: %v\n", key, br.failures, br.backoff, err)
+}
+
+// states returns the current breaker state of every monitor seen so far.
+func (b *breakers) states() map[string]BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := make(map[string]BreakerState, len(b.m))
+	for k, br := range b.m {
+		states[k] = br.state
+	}
+	return states
+}
+
+// failureCounts returns the consecutive failures of every monitor seen so far.
+func (b *breakers) failureCounts() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	counts := make(map[string]int, len(b.m))
+	for k, br := range b.m {
+		counts[k] = br.failures
+	}
+	return counts
+}
+
+// BreakerStates returns the circuit breaker state of every monitor read so far.
+func (c *Collector) BreakerStates() map[string]string {
+	states := make(map[string]string)
+	for m, st := range c.breakers.states() {
+		states[m] = st.String()
+	}
+	return states
+}
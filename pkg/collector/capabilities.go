@@ -0,0 +1,65 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"sync"
+)
+
+// Kinds of capabilities a collector binary can be built with
+const (
+	CapabilityLogType   = "logTypes"
+	CapabilityStorage   = "storageBackends"
+	CapabilityAlertSink = "alertSinks"
+)
+
+var (
+	capabilitiesMu sync.Mutex
+	capabilities   = map[string]map[string]bool{
+		CapabilityLogType:   {"rekor": true},
+		CapabilityStorage:   {"file": true},
+		CapabilityAlertSink: {},
+	}
+)
+
+// RegisterCapability records that the binary supports the named log type,
+// storage backend or alert sink. Implementations call it from init.
+func RegisterCapability(kind, name string) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+
+	if capabilities[kind] == nil {
+		capabilities[kind] = make(map[string]bool)
+	}
+	capabilities[kind][name] = true
+}
+
+// Capabilities returns the sorted names of every registered capability by kind.
+func Capabilities() map[string][]string {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+
+	caps := make(map[string][]string, len(capabilities))
+	for kind, names := range capabilities {
+		caps[kind] = []string{}
+		for n := range names {
+			caps[kind] = append(caps[kind], n)
+		}
+		sort.Strings(caps[kind])
+	}
+	return caps
+}
@@ -0,0 +1,292 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// In chained mode every line of the accepted file has the form
+//
+//	<sequence number> <hex SHA-256 of the previous line> <checkpoint>
+//
+// The first line ever written links to genesisHash. Pruning removes lines
+// from the head of the file, so the first retained line links to a line
+// that is no longer present. The ChainAnchor kept next to the file records
+// that line and the last one, so that lines lost from either end are not
+// mistaken for pruned ones.
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// ChainedLine is a parsed line of a chained accepted file.
+type ChainedLine struct {
+	Seq        int64
+	PrevHash   string
+	Checkpoint string
+}
+
+// ParseChainedLine parses a line of a chained accepted file.
+func ParseChainedLine(line string) (ChainedLine, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return ChainedLine{}, errors.New("line is not chained")
+	}
+	seq, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || seq <= 0 {
+		return ChainedLine{}, fmt.Errorf("invalid sequence number %q", fields[0])
+	}
+	if _, err := hex.DecodeString(fields[1]); err != nil || len(fields[1]) != len(genesisHash) {
+		return ChainedLine{}, fmt.Errorf("invalid previous hash %q", fields[1])
+	}
+	return ChainedLine{Seq: seq, PrevHash: fields[1], Checkpoint: fields[2]}, nil
+}
+
+// String formats the line as it is stored.
+func (l ChainedLine) String() string {
+	return fmt.Sprintf("%d %s %s", l.Seq, l.PrevHash, l.Checkpoint)
+}
+
+func lineHash(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendChained appends a checkpoint to a chained accepted file, linking it
+// to the current last line. Lines are hashed before they are encrypted.
+func AppendChained(filename, checkpoint string, sc *StateCipher) error {
+	return AppendChainedBatch(filename, []string{checkpoint}, sc)
+}
+
+// AppendChainedBatch appends several checkpoints to a chained accepted file
+// with a single write, each linking to the one before it.
+func AppendChainedBatch(filename string, checkpoints []string, sc *StateCipher) error {
+	return appendChained(&FileStorage{File: filename, Cipher: sc, Chained: true}, checkpoints)
+}
+
+// appendChained appends several checkpoints to the chained accepted
+// checkpoints in s, each linking to the one before it.
+func appendChained(s Storage, checkpoints []string) error {
+	next := ChainedLine{Seq: 1, PrevHash: genesisHash}
+
+	last, err := s.Latest(1)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case len(last) == 1:
+		prev, err := ParseChainedLine(last[0])
+		if err != nil {
+			return fmt.Errorf("last accepted line: %w", err)
+		}
+		next.Seq = prev.Seq + 1
+		next.PrevHash = lineHash(last[0])
+	}
+
+	lines := make([]string, len(checkpoints))
+	for i, c := range checkpoints {
+		next.Checkpoint = c
+		lines[i] = next.String()
+		next.Seq++
+		next.PrevHash = lineHash(lines[i])
+	}
+	return s.Append(lines)
+}
+
+// ChainAnchor holds the ends of a chained accepted file. A FileStorage in
+// chained mode keeps it in a file next to File, with the extension .anchor,
+// encrypted like the accepted lines.
+type ChainAnchor struct {
+	// PrunedSeq and PrunedHash identify the last pruned line, which the
+	// first retained line links to. They are zero and genesisHash until a
+	// line is pruned.
+	PrunedSeq  int64
+	PrunedHash string
+	// LastSeq and LastHash identify the last appended line.
+	LastSeq  int64
+	LastHash string
+}
+
+// ReadChainAnchor reads the anchor of a chained accepted file. It returns an
+// error wrapping fs.ErrNotExist if the file has none.
+func ReadChainAnchor(filename string, sc *StateCipher) (ChainAnchor, error) {
+	b, err := os.ReadFile(filename + ".anchor")
+	if err != nil {
+		return ChainAnchor{}, err
+	}
+	b, err = sc.openBlob(sealAnchor, b)
+	if err != nil {
+		return ChainAnchor{}, fmt.Errorf("%s.anchor: %w", filename, err)
+	}
+	var a ChainAnchor
+	if _, err := fmt.Sscanf(string(b), "pruned %d %s\nlast %d %s\n", &a.PrunedSeq, &a.PrunedHash, &a.LastSeq, &a.LastHash); err != nil {
+		return ChainAnchor{}, fmt.Errorf("%s.anchor: %w", filename, err)
+	}
+	return a, nil
+}
+
+// writeChainAnchor atomically replaces the anchor of a chained accepted file.
+func writeChainAnchor(filename string, a ChainAnchor, sc *StateCipher) error {
+	sealed, err := sc.sealBlob(sealAnchor, []byte(fmt.Sprintf("pruned %d %s\nlast %d %s\n", a.PrunedSeq, a.PrunedHash, a.LastSeq, a.LastHash)))
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".anchor.tmp"
+	if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename+".anchor")
+}
+
+// readChainAnchorOrGenesis is ReadChainAnchor, returning the anchor of an
+// empty chain if the file has none yet.
+func readChainAnchorOrGenesis(filename string, sc *StateCipher) (ChainAnchor, error) {
+	a, err := ReadChainAnchor(filename, sc)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ChainAnchor{PrunedHash: genesisHash, LastHash: genesisHash}, nil
+	}
+	return a, err
+}
+
+// ChainReport is the result of verifying a chained accepted file.
+type ChainReport struct {
+	Lines    int
+	FirstSeq int64
+	LastSeq  int64
+	// Anchored is set if the file was verified against its ChainAnchor.
+	// Without one, lines lost from the head look like pruned lines and
+	// whole lines lost from the tail go unnoticed.
+	Anchored bool
+	// Problems lists every inconsistency found. The file is intact if it
+	// is empty.
+	Problems []string
+}
+
+// VerifyChain checks that every line of a chained accepted file links to the
+// line before it, that sequence numbers are contiguous, that every checkpoint
+// parses and that the file ends with a complete line. Lines are decrypted with
+// sc if set.
+func VerifyChain(r io.Reader, sc *StateCipher) (ChainReport, error) {
+	return verifyChain(r, nil, sc)
+}
+
+// verifyChain is VerifyChain, also checking that the file starts right after
+// the pruned line of anchor and reaches its last line if anchor is set.
+func verifyChain(r io.Reader, anchor *ChainAnchor, sc *StateCipher) (ChainReport, error) {
+	report := ChainReport{Anchored: anchor != nil}
+	problem := func(format string, args ...any) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	br := bufio.NewReader(r)
+	o := lineOpener{sc: sc, kind: sealAccepted}
+	var prev string
+	for {
+		line, err := br.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			if line != "" {
+				problem("line %d: incomplete final line, the file was truncated", report.Lines+1)
+			}
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Lines++
+		line, err = o.open(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			problem("line %d: %v", report.Lines, err)
+			prev = ""
+			continue
+		}
+
+		cl, err := ParseChainedLine(line)
+		if err != nil {
+			problem("line %d: %v", report.Lines, err)
+			prev = line
+			continue
+		}
+		if _, err := ParseCheckpoint(cl.Checkpoint); err != nil {
+			problem("line %d: %v", report.Lines, err)
+		}
+
+		switch {
+		case report.FirstSeq == 0:
+			report.FirstSeq = cl.Seq
+			if cl.Seq == 1 && cl.PrevHash != genesisHash {
+				problem("line %d: first entry does not link to the genesis hash", report.Lines)
+			}
+		case cl.Seq != report.LastSeq+1:
+			problem("line %d: sequence number %d follows %d, entries are missing", report.Lines, cl.Seq, report.LastSeq)
+		case cl.PrevHash != lineHash(prev):
+			problem("line %d: previous hash does not match line %d, the file was modified", report.Lines, report.Lines-1)
+		}
+		if anchor != nil {
+			if cl.Seq == anchor.PrunedSeq+1 && cl.PrevHash != anchor.PrunedHash {
+				problem("line %d: previous hash does not match the last pruned entry %d, the file was modified", report.Lines, anchor.PrunedSeq)
+			}
+			if cl.Seq == anchor.LastSeq && lineHash(line) != anchor.LastHash {
+				problem("line %d: hash does not match the last appended entry %d, the file was modified", report.Lines, anchor.LastSeq)
+			}
+		}
+		report.LastSeq = cl.Seq
+		prev = line
+	}
+
+	// Lines appended after the anchor was last written are not a problem:
+	// the collector writes the anchor after the lines, and may have
+	// stopped in between.
+	if anchor != nil && anchor.LastSeq > anchor.PrunedSeq {
+		if report.FirstSeq == 0 {
+			problem("entries %d to %d are missing, the file was truncated", anchor.PrunedSeq+1, anchor.LastSeq)
+			return report, nil
+		}
+		if report.FirstSeq > anchor.PrunedSeq+1 {
+			problem("entries %d to %d are missing from the head of the file but were not pruned", anchor.PrunedSeq+1, report.FirstSeq-1)
+		}
+		if report.LastSeq < anchor.LastSeq {
+			problem("entries %d to %d are missing from the tail of the file, it was truncated", report.LastSeq+1, anchor.LastSeq)
+		}
+	}
+	return report, nil
+}
+
+// VerifyChainFile runs VerifyChain on the named file, also checking it
+// against its ChainAnchor if it has one.
+func VerifyChainFile(filename string, sc *StateCipher) (ChainReport, error) {
+	var anchor *ChainAnchor
+	a, err := ReadChainAnchor(filename, sc)
+	switch {
+	case err == nil:
+		anchor = &a
+	case !errors.Is(err, fs.ErrNotExist):
+		return ChainReport{}, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return ChainReport{}, err
+	}
+	defer f.Close()
+	return verifyChain(f, anchor, sc)
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Chaos injects controlled failures for game days in staging, confirming
+// that alerts, circuit breakers and degraded consensus work. It must not be
+// enabled in production.
+type Chaos struct {
+	// DropObservations is the probability, between 0 and 1, with which the
+	// checkpoints read from a monitor are dropped as if the read failed.
+	DropObservations float64
+	// DelayStorage delays every read and write of the storage.
+	DelayStorage time.Duration
+}
+
+// Enabled reports whether any failure is injected.
+func (ch Chaos) Enabled() bool {
+	return ch.DropObservations > 0 || ch.DelayStorage > 0
+}
+
+// ValidChaos checks the settings of ch.
+func ValidChaos(ch Chaos) error {
+	if ch.DropObservations < 0 || ch.DropObservations > 1 {
+		return errors.New("the probability of dropping observations must be between 0 and 1")
+	}
+	if ch.DelayStorage < 0 {
+		return errors.New("the storage delay must not be negative")
+	}
+	return nil
+}
+
+// errChaosDropped is the failure of a monitor read dropped by Chaos.
+var errChaosDropped = errors.New("observations dropped by chaos testing")
+
+// chaosDice decides which observations Chaos drops.
+type chaosDice struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newChaosDice() *chaosDice {
+	// #nosec G404 -- chaos testing does not need to be cryptographically secure
+	return &chaosDice{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// roll reports true with probability p.
+func (d *chaosDice) roll(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rnd.Float64() < p
+}
+
+// delayedStorage delays every operation of a Storage.
+type delayedStorage struct {
+	Storage
+	delay time.Duration
+}
+
+// delayStorage returns s with every operation delayed by d, keeping it a
+// Compacter if it is one.
+func delayStorage(s Storage, d time.Duration) Storage {
+	ds := &delayedStorage{Storage: s, delay: d}
+	if cs, ok := s.(Compacter); ok {
+		return delayedCompacter{ds, cs}
+	}
+	return ds
+}
+
+// Append implements Storage.
+func (s *delayedStorage) Append(lines []string) error {
+	time.Sleep(s.delay)
+	return s.Storage.Append(lines)
+}
+
+// Latest implements Storage.
+func (s *delayedStorage) Latest(n int) ([]string, error) {
+	time.Sleep(s.delay)
+	return s.Storage.Latest(n)
+}
+
+// Prune implements Storage.
+func (s *delayedStorage) Prune(keep int) error {
+	time.Sleep(s.delay)
+	return s.Storage.Prune(keep)
+}
+
+// delayedCompacter is a delayedStorage of a Compacter.
+type delayedCompacter struct {
+	*delayedStorage
+	cs Compacter
+}
+
+// Compact implements Compacter.
+func (s delayedCompacter) Compact() (int64, error) {
+	time.Sleep(s.delay)
+	return s.cs.Compact()
+}
@@ -0,0 +1,175 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ConfigCheck is the result of a configuration check.
+type ConfigCheck struct {
+	Name string
+	// Err is nil if the check passed.
+	Err error
+	// Transient is set for checks of conditions that may change while
+	// the collector runs, such as a monitor being reachable. They do not
+	// prevent the collector from starting.
+	Transient bool
+}
+
+// CheckConfig checks that the collector's configuration works: that its
+// monitors can be read and enough of them exist to reach the policy, that
+// its state files can be read and decrypted and that the files and
+// directories it writes to are writable. It has no side effects.
+func (c *Collector) CheckConfig() []ConfigCheck {
+	var checks []ConfigCheck
+	check := func(transient bool, err error, format string, args ...any) {
+		name := fmt.Sprintf(format, args...)
+		if c.cfg.Namespace != "" {
+			name = c.cfg.Namespace + ": " + name
+		}
+		checks = append(checks, ConfigCheck{Name: name, Err: err, Transient: transient})
+	}
+
+	check(false, ValidQuorumFailure(c.cfg.QuorumFailure), "quorum failure mode")
+	check(false, c.checkResolution(), "conflict resolution rule")
+	check(false, c.checkCosignFormat(), "cosigned note format")
+	if c.registry != nil && c.registry.store == nil {
+		check(false, errors.New("the storage cannot hold a monitor registry"), "monitor registry")
+	}
+	if _, ok := c.cfg.Cosigner.(Ed25519KeyCosigner); c.cfg.Statements != nil && !ok {
+		check(false, errors.New("signed statements need an Ed25519 cosigning key"), "signed statements")
+	}
+	if c.cfg.WitnessQuorum > len(c.cfg.Witnesses) {
+		check(false, fmt.Errorf("witness quorum %d is larger than the %d witnesses", c.cfg.WitnessQuorum, len(c.cfg.Witnesses)), "witness quorum")
+	}
+	if c.cfg.ReadOnly {
+		// Monitors are read and state files written by the collector
+		// writing the storage.
+		_, err := c.cfg.Storage.Latest(1)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		check(false, err, "reading accepted checkpoints")
+		return checks
+	}
+	monitors, err := c.Monitors()
+	check(false, err, "finding monitors")
+	networks := make(map[string]bool)
+	for _, m := range monitors {
+		if m.Network != "" {
+			networks[m.Network] = true
+		}
+		if m.SPIFFEID != "" {
+			continue
+		}
+		chpts, err := c.readMonitor(context.Background(), m, 1)
+		if err == nil && len(chpts) == 1 {
+			_, err = ParseCheckpoint(chpts[0])
+		}
+		check(true, err, "reading monitor %s", m.Logfile)
+	}
+	var quorumErr, networksErr error
+	if len(monitors) < c.cfg.Quorum {
+		quorumErr = fmt.Errorf("a quorum of %d cannot be reached by %d monitors", c.cfg.Quorum, len(monitors))
+	}
+	check(true, quorumErr, "quorum")
+	if len(networks) < c.cfg.MinNetworks {
+		networksErr = fmt.Errorf("%d networks are required but monitors are tagged with %d", c.cfg.MinNetworks, len(networks))
+	}
+	check(true, networksErr, "minimum networks")
+
+	_, err = c.cfg.Storage.Latest(1)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	acceptedFile := ""
+	if file, ok := c.cfg.Storage.(*FileStorage); ok {
+		acceptedFile = file.File
+		check(false, err, "reading accepted file %s", acceptedFile)
+	} else {
+		check(false, err, "reading accepted checkpoints")
+	}
+	for _, f := range []string{acceptedFile, c.cfg.ProvenanceFile, c.cfg.CosignedFile, c.cfg.IntentFile} {
+		if f != "" {
+			check(false, checkWritable(filepath.Dir(f)), "writing %s", f)
+		}
+	}
+	dirs := []string{c.cfg.HistoryDir, c.cfg.PublishDir, c.cfg.ImportDir}
+	if c.cfg.Statements != nil {
+		dirs = append(dirs, c.cfg.Statements.Dir)
+	}
+	for _, dir := range dirs {
+		if dir != "" {
+			check(false, checkWritable(dir), "writing to %s", dir)
+		}
+	}
+	return checks
+}
+
+// checkWritable checks that files can be created in dir or, if it does not
+// exist yet, in its closest existing parent, which it would be created in.
+func checkWritable(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if errors.Is(err, fs.ErrNotExist) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		break
+	}
+	f, err := os.CreateTemp(dir, ".collector-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkResolution checks that the conflict resolution rule is known and that
+// consistency proofs can be fetched if it needs them.
+func (c *Collector) checkResolution() error {
+	if err := ValidResolution(c.cfg.Resolution); err != nil {
+		return err
+	}
+	if c.cfg.Resolution == ResolveConsistent && c.cfg.Prover == nil {
+		return errors.New("the consistent rule needs a consistency prover")
+	}
+	return nil
+}
+
+// checkCosignFormat checks that the cosigned note format is known and that
+// the cosigner can produce it.
+func (c *Collector) checkCosignFormat() error {
+	if err := ValidCosignFormat(c.cfg.CosignFormat); err != nil {
+		return err
+	}
+	if _, ok := c.cfg.Cosigner.(Ed25519KeyCosigner); c.cfg.CosignFormat == CosignV1Format && c.cfg.Cosigner != nil && !ok {
+		return errors.New("cosignature/v1 needs an Ed25519 cosigning key")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lineSeparator is the escaped newline monitors use to flatten a signed
+// checkpoint onto a single line of their logfile.
+const lineSeparator = "\\n"
+
+// Checkpoint is the subset of a flattened signed checkpoint the collector
+// needs to reach consensus. Raw holds the line exactly as it was read.
+type Checkpoint struct {
+	Origin    string
+	Size      int64
+	Hash      string
+	Timestamp int64
+	Raw       string
+}
+
+// CheckpointKey identifies the tree a checkpoint commits to. Checkpoints
+// with equal keys agree, however they are formatted and whatever extension
+// lines or signatures they carry.
+type CheckpointKey struct {
+	Origin string
+	Size   int64
+	Hash   string
+}
+
+// Key returns the canonical fields of the checkpoint.
+func (c Checkpoint) Key() CheckpointKey {
+	return CheckpointKey{Origin: c.Origin, Size: c.Size, Hash: c.Hash}
+}
+
+// ParseCheckpoint parses a single flattened checkpoint line as written by
+// rekor-monitor. Surrounding whitespace and carriage returns are stripped
+// from the origin, size and root hash lines so that monitors formatting the
+// same checkpoint differently agree. The timestamp is read from the first
+// "Timestamp:" extension line; when it is missing or malformed Timestamp is
+// left as zero.
+func ParseCheckpoint(line string) (Checkpoint, error) {
+	fields := strings.Split(line, lineSeparator)
+	if len(fields) < 3 {
+		return Checkpoint{}, fmt.Errorf("checkpoint has %d lines, expected at least 3", len(fields))
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("converting tree size to int: %w", err)
+	}
+	if size < 0 {
+		return Checkpoint{}, fmt.Errorf("negative tree size %d", size)
+	}
+
+	c := Checkpoint{
+		Origin: strings.TrimSpace(fields[0]),
+		Size:   size,
+		Hash:   strings.TrimSpace(fields[2]),
+		Raw:    line,
+	}
+
+	// Extension lines end at the blank line before the signatures.
+	for _, ext := range fields[3:] {
+		ext = strings.TrimSpace(ext)
+		if ext == "" {
+			break
+		}
+		key, ts, ok := strings.Cut(ext, ":")
+		if !ok || key != "Timestamp" {
+			continue
+		}
+		if t, err := strconv.ParseInt(strings.TrimSpace(ts), 10, 64); err == nil {
+			c.Timestamp = t
+		}
+		break
+	}
+
+	return c, nil
+}
@@ -0,0 +1,945 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector reads the checkpoints written by a set of rekor-monitor
+// instances and accepts the largest tree size a quorum of them agree on.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Config holds the parameters of a collector.
+type Config struct {
+	// Namespace names the tenant the collector runs for in multi-tenant
+	// mode. It labels log messages, metrics and audit entries.
+	Namespace string
+	// APIToken, if set, is the bearer token API requests for the
+	// collector's namespace must carry.
+	APIToken string
+	// Pod, if set, names the replica the collector runs in. It labels
+	// every exported metric so that replicas behind one scrape target can
+	// be told apart.
+	Pod string
+	// MonitorGlob matches the monitor logfiles to read. It is ignored when
+	// MonitorList is set.
+	MonitorGlob string
+	// MonitorList is the path to a monitor_list JSON file.
+	MonitorList string
+	// Discovery finds additional monitors, refreshed every
+	// DiscoveryInterval.
+	Discovery         []Discoverer
+	DiscoveryInterval time.Duration
+	// AcceptedFile is the file accepted checkpoints are appended to.
+	AcceptedFile string
+	// Storage, if set, holds the accepted checkpoints instead of
+	// AcceptedFile.
+	Storage Storage
+	// Quorum is the number of monitors that must agree on a tree size.
+	Quorum int
+	// MinNetworks is the number of distinct networks, as tagged in the
+	// monitor list, that the monitors agreeing on a tree size must be in.
+	MinNetworks int
+	// Origins, if set, are the log origins monitors are expected to
+	// observe, matched with MatchOrigin. Checkpoints of other origins are
+	// rejected unless the monitor has its own Origin.
+	Origins []string
+	// Strict excludes a monitor from the round, with an alert, if any line
+	// read from it is malformed or unsigned or, if LogKeys are set, signed
+	// by another key, instead of failing the round. See ValidateCheckpoint.
+	Strict  bool
+	LogKeys []LogKey
+	// ExtensionPolicy, if set, is checked by every checkpoint read from
+	// monitors, after Strict. Checkpoints violating it are left out of the
+	// round with an alert.
+	ExtensionPolicy ExtensionPolicy
+	// QuorumFailure selects what a round does when no tree size reaches
+	// quorum: QuorumHold, the default, QuorumDegrade or QuorumAlert.
+	QuorumFailure string
+	// Resolution selects the checkpoint accepted when several tree sizes
+	// reach quorum in a round: ResolveLargest, the default, ResolveVotes,
+	// ResolveRecent or ResolveConsistent, which fetches the consistency
+	// proofs it checks from Prover.
+	Resolution string
+	Prover     ConsistencyProver
+	// WitnessQuorum, if positive, is the number of Witnesses that must
+	// have cosigned a checkpoint before it is accepted. Cosignatures are
+	// taken from the checkpoints read from monitors and from Distributor,
+	// if set, whose cosignatures are added to the accepted checkpoint.
+	WitnessQuorum int
+	Witnesses     []Witness
+	Distributor   *Distributor
+	// Peers are other collectors whose attestations are read every round,
+	// see Attest. Their checkpoints are advisory observations: they take
+	// part in finding conflicts but not in the quorum.
+	Peers []Peer
+	// Keep is the number of accepted checkpoints retained in AcceptedFile.
+	Keep int
+	// MaintenanceInterval, if set, is the interval at which RunMaintenance
+	// prunes the storage to Keep accepted checkpoints and compacts it.
+	// Otherwise the storage is pruned after every accepted checkpoint.
+	MaintenanceInterval time.Duration
+	// Batch, if positive, is the number of latest checkpoints read from
+	// each monitor per round. Every tree size among them that is newer
+	// than the last accepted one and reaches quorum is accepted, and the
+	// checkpoints are written to AcceptedFile together. Otherwise only the
+	// largest such tree size is accepted every round.
+	Batch int
+	// ProvenanceFile, if set, records which monitors' observations
+	// supported each accepted checkpoint, see ReadProvenance. It retains as
+	// many records as AcceptedFile.
+	ProvenanceFile string
+	// PublishDir, if set, is a directory accepted checkpoints are published
+	// to as a static tree for hosting on a CDN, see Publish.
+	PublishDir string
+	// Statements, if set, emits every acceptance decision as a signed
+	// statement, signed with the Ed25519 key of Cosigner.
+	Statements *Statements
+	// Stream, if set, receives every accepted checkpoint as it is accepted,
+	// formatted according to StreamFormat: StreamJSON, the default, writes
+	// a StreamEvent per line, StreamCBOR and StreamProtobuf encode it in
+	// CBOR or protobuf and StreamText writes the flattened checkpoint line.
+	Stream       io.Writer
+	StreamFormat string
+	// ImportDir, if set, is the directory the import command writes
+	// observations of other collectors' monitors to. The monitors in its
+	// ImportedMonitorList join every round.
+	ImportDir string
+	// HistoryDir, if set, is the directory each monitor's checkpoints are
+	// recorded in as they are first read, see ReadHistory.
+	HistoryDir string
+	// DedupHistory stores each checkpoint recorded in HistoryDir once,
+	// content-addressed and compressed with zstd dictionaries trained on
+	// the checkpoints stored before, and references it from the history
+	// files.
+	DedupHistory bool
+	// Chain prefixes every line of AcceptedFile with a sequence number and
+	// the hash of the previous line, see VerifyChain.
+	Chain bool
+	// HeartbeatTimeout is the time after which a monitor that has not sent
+	// a heartbeat is down, and a monitor whose tree size has not grown is
+	// idle, see MonitorStatuses. It defaults to DefaultHeartbeatRounds
+	// times Interval, or times the maximum of AdaptiveInterval.
+	HeartbeatTimeout time.Duration
+	// Interval is the time between collection rounds for origins without
+	// an entry in OriginIntervals.
+	Interval time.Duration
+	// OriginIntervals overrides Interval for checkpoints of the given log
+	// origins, e.g. "rekor.sigstore.dev". Each origin is collected separately.
+	OriginIntervals map[string]time.Duration
+	// Schedule, if set, replaces Interval for the default target, e.g. with
+	// a CronSchedule.
+	Schedule Schedule
+	// Jitter is the upper bound of a random delay added to every interval.
+	Jitter time.Duration
+	// AdaptiveInterval, if enabled, adjusts Interval and OriginIntervals
+	// to the growth of the logs. It does not apply to Schedule.
+	AdaptiveInterval AdaptiveInterval
+	// Breaker controls when monitors that repeatedly fail to be read are
+	// skipped.
+	Breaker BreakerConfig
+	// Anomaly controls alerts on implausible log growth and diverging
+	// monitors.
+	Anomaly AnomalyConfig
+	// AlertTemplate, if set, renders the body of every alert from its
+	// Alert fields instead of the default description, see
+	// ParseAlertTemplate.
+	AlertTemplate *template.Template
+	// AlertRouting sends alerts to external sinks in addition to logging
+	// them.
+	AlertRouting AlertRouting
+	// Exporters receive a report of every round.
+	Exporters []Exporter
+	// Reports, if set, archives the report of every round.
+	Reports *ReportArchive
+	// IntentFile, if set, holds the intent of a round while its acceptance
+	// is persisted and published, so that a round interrupted by a crash
+	// is completed or abandoned on restart, see Recover.
+	IntentFile string
+	// MaxFileSize is the size in bytes above which a monitor logfile is
+	// skipped for the round. Zero disables the check.
+	MaxFileSize int64
+	// ReadTimeout bounds the time spent reading a monitor logfile. Zero
+	// disables the timeout.
+	ReadTimeout time.Duration
+	// Timeouts bound the other stages of collection rounds.
+	Timeouts Timeouts
+	// Fetchers read monitor logfiles by URI scheme, overriding or adding to
+	// the built-in file, http, https, s3, ssh and spiffe fetchers.
+	Fetchers map[string]Fetcher
+	// Offline disables network access for air-gapped deployments: only
+	// local monitor logfiles are read, for example ones written by the
+	// import command, and Discovery is ignored.
+	Offline bool
+	// ReadOnly runs the collector as a replica serving queries from a
+	// Storage written by another collector: Run follows the storage
+	// instead of collecting, and Collect and writes to Storage fail with
+	// ErrReadOnly.
+	ReadOnly bool
+	// Baseline compares accepted checkpoints with the tree head reported by
+	// the log itself.
+	Baseline Baseline
+	// Chaos injects failures for resilience testing in staging.
+	Chaos Chaos
+	// Sampling, if enabled, reads a random sample of the monitors in each
+	// round rather than all of them.
+	Sampling Sampling
+	// TrustedTime, if set, replaces the local clock for freshness checks
+	// and acceptance timestamps.
+	TrustedTime *TrustedTime
+	// Registry, if set, keeps the monitors in a registry with lifecycle
+	// states, stored in Storage.
+	Registry *Registry
+	// HTTPClient sends the requests of the built-in http, https and s3
+	// fetchers, http.DefaultClient if nil. Use a client with a
+	// retry.Transport to ride out transient network failures.
+	HTTPClient *http.Client
+	// SSH, if set, holds the credentials for monitor logfiles given as
+	// ssh:// URLs, which are read over SFTP.
+	SSH *SSHConfig
+	// Cosigner, if set, signs the newest checkpoint accepted every round,
+	// which is written as a signed note to CosignedFile.
+	Cosigner     Cosigner
+	CosignedFile string
+	// CosignFormat is the format of the cosignature, CosignNoteFormat, the
+	// default, or CosignV1Format, which needs an Ed25519KeyCosigner.
+	CosignFormat string
+	// Extensions adds extension lines with the collector's key name, the
+	// round ID and the number of agreeing monitors out of the quorum to
+	// the cosigned note. The log's signatures do not cover them and are
+	// left out of it, so only the collector's signature remains.
+	Extensions bool
+	// SecondaryLog, if set, records every note written to CosignedFile.
+	SecondaryLog SecondaryLog
+	// PushQueue, if set, buffers checkpoints accepted by PushHandler until
+	// PushQueue.Run delivers them.
+	PushQueue *PushQueue
+	// StateCipher, if set, encrypts the lines of AcceptedFile.
+	StateCipher *StateCipher
+	// Audit, if set, records every acceptance decision.
+	Audit *AuditLog
+	// Identities, if set, are scanned for in the entries added to the log
+	// since the previously accepted checkpoint whenever one is accepted.
+	// Matches are alerted and counted as identity anomalies.
+	Identities *IdentityWatch
+	// Mirror, if set, stores the entries between consecutive accepted
+	// checkpoints, verified against their root hashes.
+	Mirror *Mirror
+}
+
+// Collector periodically reaches consensus over monitor checkpoints.
+type Collector struct {
+	cfg      Config
+	breakers *breakers
+	limits   limitCounts
+	history  *history
+	disc     *discovery
+	stats    *roundStats
+	anoms    *anomalies
+	inbox    inbox
+	beats    heartbeats
+	ssh      *sshConns
+	fetch    map[string]Fetcher
+	accepts  acceptSignal
+	// acceptTimes holds the time each checkpoint was accepted.
+	acceptTimes acceptTimes
+	// sizes holds the largest tree size accepted of each origin.
+	sizes acceptedSizes
+	// writes serializes writes to the storage across targets.
+	writes writeLock
+	// reclaimed is the number of bytes reclaimed by Maintain.
+	reclaimed atomic.Int64
+	// chaos decides which observations Config.Chaos drops.
+	chaos *chaosDice
+	// peerConflicts records the cross-collector conflicts alerted.
+	peerConflicts peerConflicts
+	// hints holds the conflict hints waiting for an urgent round.
+	hints chan conflictHint
+	// adaptive holds the schedules of targets on an adaptive interval.
+	adaptive adaptiveSchedules
+	// sampler chooses the monitors of each round if Config.Sampling is
+	// enabled.
+	sampler *sampler
+	// clock is the local clock, corrected if Config.TrustedTime is set.
+	clock *trustedClock
+	// registry holds the monitors if Config.Registry is set.
+	registry *registry
+}
+
+// New returns a collector for the given configuration, filling in defaults
+// for unset fields.
+func New(cfg Config) *Collector {
+	if cfg.Quorum <= 0 {
+		cfg.Quorum = DefaultQuorum
+	}
+	if cfg.Keep <= 0 {
+		cfg.Keep = DefaultKeep
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.DiscoveryInterval <= 0 {
+		cfg.DiscoveryInterval = DefaultDiscoveryInterval
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = &FileStorage{File: cfg.AcceptedFile, Cipher: cfg.StateCipher, Chained: cfg.Chain}
+	}
+	reg := newRegistry(cfg.Registry, cfg.Storage)
+	if cfg.ReadOnly {
+		cfg.Storage = readOnlyStorage{cfg.Storage}
+	}
+	if cfg.Chaos.DelayStorage > 0 {
+		cfg.Storage = delayStorage(cfg.Storage, cfg.Chaos.DelayStorage)
+	}
+	cfg.Timeouts = cfg.Timeouts.withDefaults()
+	c := &Collector{cfg: cfg, writes: make(writeLock, 1), breakers: newBreakers(cfg.Breaker, logPrefix(cfg.Namespace)), stats: newRoundStats(), anoms: newAnomalies(cfg.Anomaly), chaos: newChaosDice(), hints: make(chan conflictHint, maxPendingHints), clock: newTrustedClock(cfg.TrustedTime), registry: reg}
+	if len(cfg.Discovery) > 0 && !cfg.Offline {
+		c.disc = &discovery{sources: cfg.Discovery, interval: cfg.DiscoveryInterval, now: time.Now}
+	}
+	if cfg.SSH != nil {
+		c.ssh = newSSHConns(cfg.SSH)
+	}
+	c.fetch = c.fetchers()
+	if cfg.Sampling.Enabled() {
+		c.sampler = newSampler(cfg.Sampling, cfg.Quorum)
+	}
+	if cfg.HistoryDir != "" {
+		c.history = &history{dir: cfg.HistoryDir, sc: cfg.StateCipher, dedup: cfg.DedupHistory, last: make(map[string]string), logf: c.logf, now: c.now}
+	}
+	cfg.Audit.setClock(c.now)
+	return c
+}
+
+// Monitors returns the monitors the collector currently reads from,
+// including discovered ones.
+func (c *Collector) Monitors() ([]Monitor, error) {
+	var extra []Monitor
+	if c.cfg.ImportDir != "" {
+		imported, err := LoadMonitorList(filepath.Join(c.cfg.ImportDir, ImportedMonitorList))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("loading imported monitors: %w", err)
+		}
+		extra = imported
+	}
+	if c.disc != nil {
+		extra = mergeMonitors(extra, c.disc.get(c.logf))
+	}
+	if c.registry != nil {
+		return c.registryMonitors(c.listedMonitors, extra)
+	}
+	monitors, err := c.listedMonitors()
+	if err != nil {
+		return nil, err
+	}
+	return mergeMonitors(monitors, extra), nil
+}
+
+// listedMonitors returns the monitors of MonitorList or MonitorGlob.
+func (c *Collector) listedMonitors() ([]Monitor, error) {
+	if c.cfg.MonitorList != "" {
+		return LoadMonitorList(c.cfg.MonitorList)
+	}
+	return GlobMonitors(c.cfg.MonitorGlob)
+}
+
+// Collect performs a single collection round for origin. It reads the latest
+// checkpoints of every monitor, appends the accepted checkpoint, if any, to the
+// accepted file and prunes old entries. Monitors that cannot be read are left
+// out of the round and skipped with exponential backoff once they fail
+// repeatedly. Monitors exceeding MaxFileSize or ReadTimeout are skipped for
+// the round with an alert; timeouts also count as failures. Monitors with a
+// SPIFFE ID contribute the checkpoints they pushed, see PushHandler. In batch
+// mode the returned checkpoint is the newest one accepted. An empty origin
+// collects checkpoints of every origin that is not scheduled separately in
+// OriginIntervals.
+func (c *Collector) Collect(origin string) (Checkpoint, bool, error) {
+	return c.CollectContext(context.Background(), origin)
+}
+
+// CollectContext is like Collect, but the round ends with an error wrapping
+// ctx's error once ctx is done. Monitors that were not read by then are not
+// counted as failing, see Timeouts for the deadlines of each stage.
+func (c *Collector) CollectContext(ctx context.Context, origin string) (Checkpoint, bool, error) {
+	return c.collect(ctx, origin, false)
+}
+
+// collect runs a round of origin. An urgent round, run on a conflict hint,
+// reads every monitor, including those left out of the sample and those
+// with an open circuit.
+func (c *Collector) collect(ctx context.Context, origin string, urgent bool) (Checkpoint, bool, error) {
+	if c.cfg.ReadOnly {
+		return Checkpoint{}, false, ErrReadOnly
+	}
+	round, done := c.stats.start()
+	defer done()
+
+	if err := c.syncTime(ctx); err != nil {
+		return Checkpoint{}, false, err
+	}
+	monitors, err := c.Monitors()
+	if err != nil {
+		return Checkpoint{}, false, fmt.Errorf("finding monitors: %w", err)
+	}
+	var sample *SampleReport
+	if !urgent {
+		monitors, sample = c.sampler.sample(monitors, c.breakers.blocked)
+	}
+
+	var observations [][]string
+	var observed, networks []string
+	var reads []monitorRead
+	var advisory []string
+	var advisoryObservations [][]string
+	for _, m := range monitors {
+		if !urgent && !c.breakers.allow(m.Logfile) {
+			continue
+		}
+		chpts, err := c.readMonitor(ctx, m, c.readCount())
+		if ctx.Err() != nil {
+			return Checkpoint{}, false, fmt.Errorf("reading monitors: %w", ctx.Err())
+		}
+		if err != nil {
+			if c.limitExceeded(m, err) != LimitFileSize && !errors.Is(err, ErrNotPushed) {
+				c.breakers.failure(m.Logfile, err)
+			}
+			continue
+		}
+		if c.chaos.roll(c.cfg.Chaos.DropObservations) {
+			c.logf("Chaos: dropping the observations of monitor %s\n", m.Logfile)
+			c.breakers.failure(m.Logfile, errChaosDropped)
+			continue
+		}
+		c.breakers.success(m.Logfile)
+		c.beats.observe(m.Logfile, chpts, c.now())
+		if err := c.history.record(m.Logfile, chpts); err != nil {
+			return Checkpoint{}, false, fmt.Errorf("recording history of monitor %s: %w", m.Logfile, err)
+		}
+		if c.cfg.Strict {
+			if err := c.validateStrict(chpts); err != nil {
+				c.anoms.record(AnomalyInvalidInput, m.Logfile)
+				c.alert(Alert{Kind: AnomalyInvalidInput, Monitors: []string{m.Logfile}, Message: fmt.Sprintf("excluding monitor %s from this round: %s", m.Logfile, coded(err))})
+				continue
+			}
+		} else if kept, err := parseable(chpts); err != nil {
+			c.anoms.record(AnomalyInvalidInput, m.Logfile)
+			c.alert(Alert{Kind: AnomalyInvalidInput, Monitors: []string{m.Logfile}, Message: fmt.Sprintf("ignoring checkpoints of monitor %s: %v", m.Logfile, err)})
+			chpts = kept
+		}
+		chpts, err = c.cfg.ExtensionPolicy.filter(chpts)
+		if err != nil {
+			c.anoms.record(AnomalyInvalidInput, m.Logfile)
+			c.alert(Alert{Kind: AnomalyInvalidInput, Monitors: []string{m.Logfile}, Message: fmt.Sprintf("ignoring checkpoints of monitor %s: %v", m.Logfile, err)})
+		}
+		chpts = c.filterOrigin(origin, c.expectedOrigins(m, chpts))
+		if !c.votes(m.Logfile) {
+			// Monitors on probation or in quarantine are only checked
+			// for conflicts.
+			advisory = append(advisory, m.Logfile)
+			advisoryObservations = append(advisoryObservations, chpts)
+			continue
+		}
+		observations = append(observations, chpts)
+		observed = append(observed, m.Logfile)
+		networks = append(networks, m.Network)
+		reads = append(reads, monitorRead{monitor: m.Logfile, network: m.Network, at: c.now().UTC(), chpts: chpts})
+	}
+
+	peers, peerObservations := c.checkPeers(ctx, origin)
+	// A checkpoint read now conflicts with an accepted one of the same
+	// tree size just as much as with another monitor's read.
+	acceptedLines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return Checkpoint{}, false, fmt.Errorf("reading accepted checkpoints: %w", err)
+	}
+	conflicts := FindConflicts(
+		append(append(append([]string{acceptedObserver}, observed...), peers...), advisory...),
+		append(append(append([][]string{c.filterOrigin(origin, acceptedLines)}, observations...), peerObservations...), advisoryObservations...))
+	for _, a := range c.anoms.checkConflicts(conflicts) {
+		c.alert(a)
+	}
+	if len(observed) > 0 {
+		c.resolveIncidents(AnomalyConflict, func(o string) bool {
+			if len(c.cfg.OriginIntervals) > 0 && c.scheduledOrigin(o) != origin {
+				return false
+			}
+			for _, cf := range conflicts {
+				if cf.Origin == o {
+					return false
+				}
+			}
+			return true
+		}, func(o string) string {
+			return fmt.Sprintf("monitors no longer read different root hashes of %s", o)
+		})
+	}
+
+	policy := Policy{Quorum: c.cfg.Quorum, MinNetworks: c.cfg.MinNetworks}
+	candidates, err := policy.Candidates(observations, networks)
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+	candidates = c.witnessed(ctx, candidates, observations)
+	var accepted Checkpoint
+	var rule string
+	ok := len(candidates) > 0
+	split := false
+	if !ok {
+		if chpt, found := policy.contestedQuorum(observations, networks); found {
+			c.logf("Tree size %d of %s reached quorum but monitors read other root hashes of it, holding the last accepted checkpoint\n", chpt.Size, chpt.Origin)
+			split = true
+		}
+	}
+	if ok {
+		accepted, rule = c.resolve(ctx, candidates)
+		// At most one root hash of a tree size is genuine, and a quorum
+		// does not tell which.
+		if conflicted(conflicts, accepted) {
+			c.logf("Tree size %d of %s reached quorum but monitors read other root hashes of it, holding the last accepted checkpoint\n", accepted.Size, accepted.Origin)
+			accepted, ok, rule, split = Checkpoint{}, false, "", true
+		}
+	}
+	degraded := false
+	if !ok && !split {
+		switch c.cfg.QuorumFailure {
+		case QuorumDegrade:
+			if accepted, ok, err = SelectDegraded(observations); err != nil {
+				return accepted, ok, err
+			}
+			// Without a quorum, even less is known about which root
+			// hash of a split tree size is genuine.
+			if ok && conflicted(conflicts, accepted) {
+				c.logf("Tree size %d of %s has the most support but monitors read other root hashes of it, not accepting it as degraded\n", accepted.Size, accepted.Origin)
+				accepted, ok = Checkpoint{}, false
+			}
+			degraded = ok
+		case QuorumAlert:
+			c.anoms.record(AnomalyNoQuorum, origin)
+			c.anoms.openIncident(AnomalyNoQuorum, origin)
+			c.alert(Alert{Kind: AnomalyNoQuorum, Origin: origin, Monitors: observed, Message: coded(noQuorumError(origin, c.cfg.Quorum))})
+		}
+	}
+	if ok {
+		// Monitors that agreed on the last accepted tree size may have moved
+		// on to different ones, leaving only lagging monitors in agreement.
+		// The accepted tree size never goes back.
+		last, err := c.lastAcceptedSize(accepted.Origin)
+		if err != nil {
+			return Checkpoint{}, false, fmt.Errorf("reading last accepted checkpoint: %w", err)
+		}
+		if accepted.Size < last {
+			c.logf("Tree size %d of %s reached quorum behind the accepted tree size %d, holding the last accepted checkpoint\n", accepted.Size, accepted.Origin, last)
+			accepted, ok, degraded = Checkpoint{}, false, false
+		}
+	}
+	if ok {
+		// Nor is the root hash of an accepted tree size ever replaced.
+		prev, err := c.acceptedAt(accepted.Key())
+		if err != nil {
+			return Checkpoint{}, false, fmt.Errorf("reading last accepted checkpoint: %w", err)
+		}
+		if prev != nil && prev.Hash != accepted.Hash {
+			cf := Conflict{Origin: accepted.Origin, Size: accepted.Size, Monitors: map[string][]string{
+				prev.Hash:     {acceptedObserver},
+				accepted.Hash: readersOf(accepted.Key(), observed, observations),
+			}}
+			for _, a := range c.anoms.checkConflicts([]Conflict{cf}) {
+				c.alert(a)
+			}
+			c.logf("Tree size %d of %s reached quorum with root hash %s, not the accepted %s, holding the last accepted checkpoint\n", accepted.Size, accepted.Origin, accepted.Hash, prev.Hash)
+			accepted, ok, degraded = Checkpoint{}, false, false
+		}
+	}
+	if !ok {
+		c.export(ctx, withPeers(c.roundReport(round, observed, observations, conflicts, nil, "", false, sample, urgent), peers, peerObservations))
+		return accepted, ok, nil
+	}
+	if degraded {
+		c.anoms.record(AnomalyNoQuorum, origin)
+		c.anoms.openIncident(AnomalyNoQuorum, origin)
+		c.alert(Alert{Kind: AnomalyNoQuorum, Origin: origin, Size: accepted.Size, Roots: []string{accepted.Hash}, Monitors: observed, Message: fmt.Sprintf("%s, accepting tree size %d of %s as degraded", noQuorumMessage(origin, c.cfg.Quorum), accepted.Size, accepted.Origin)})
+	}
+	if !degraded {
+		c.resolveIncidents(AnomalyNoQuorum, func(o string) bool { return o == origin }, func(string) string {
+			return fmt.Sprintf("tree size %d of %s reached a quorum of %d monitors again", accepted.Size, accepted.Origin, c.cfg.Quorum)
+		})
+	}
+	c.export(ctx, withPeers(c.roundReport(round, observed, observations, conflicts, &accepted, rule, degraded, sample, urgent), peers, peerObservations))
+	latest := latestSizes(accepted.Origin, observed, observations)
+	c.stats.accepted(accepted, latest)
+	alerts := c.anoms.check(accepted, latest, c.now())
+	alerts = append(alerts, c.anoms.checkFreeze(accepted, len(reads)+len(advisory) == len(monitors), c.now())...)
+	alerts = append(alerts, c.checkBaseline(ctx, accepted)...)
+	for _, a := range alerts {
+		c.alert(a)
+	}
+
+	var in *intent
+	err = c.persist(ctx, func() error {
+		var err error
+		in, err = c.writeAccepted(origin, round, accepted, candidates, degraded, reads, len(observations))
+		return err
+	})
+	if err != nil || in == nil {
+		return accepted, ok, err
+	}
+
+	now := c.now().UTC()
+	for _, a := range in.batch {
+		c.acceptTimes.record(a.Key(), now)
+		c.sizes.record(a.Origin, a.Size)
+	}
+
+	if err := c.writes.lock(ctx); err != nil {
+		return accepted, ok, fmt.Errorf("waiting to publish accepted checkpoints: %w", err)
+	}
+	defer c.writes.unlock()
+	c.complete(ctx, in)
+
+	return accepted, ok, nil
+}
+
+// writeAccepted appends the checkpoints accepted in a round to the storage
+// and records their provenance and acceptance, after writing the intent of
+// the round. It returns the intent, nil if batch mode has nothing new to
+// write.
+func (c *Collector) writeAccepted(origin, round string, accepted Checkpoint, candidates []Candidate, degraded bool, reads []monitorRead, monitors int) (*intent, error) {
+	batch := []Checkpoint{accepted}
+	var after int64
+	if c.cfg.Batch > 0 || c.cfg.Identities != nil || c.cfg.Mirror != nil {
+		var err error
+		if after, err = c.lastAcceptedSize(origin); err != nil {
+			return nil, fmt.Errorf("reading last accepted checkpoint: %w", err)
+		}
+	}
+	if c.cfg.Batch > 0 {
+		switch {
+		case accepted.Size <= after:
+			return nil, nil
+		case !degraded:
+			batch = batchOf(candidates, after, accepted)
+		}
+	}
+	records := make([]Provenance, len(batch))
+	for i, a := range batch {
+		records[i] = provenance(a, round, c.cfg.Quorum, reads, c.now())
+		records[i].Degraded = degraded
+	}
+	in := newIntent(c.cfg.Namespace, round, c.now(), batch, degraded, len(records[len(records)-1].Supporters), after)
+	if c.cfg.Statements != nil {
+		in.Provenance = records
+	}
+	if err := c.writeIntent(in); err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, len(batch))
+	for i, a := range batch {
+		lines[i] = a.Raw
+	}
+	appendFn := c.cfg.Storage.Append
+	if c.cfg.Chain {
+		appendFn = func(lines []string) error { return appendChained(c.cfg.Storage, lines) }
+	}
+	if err := appendFn(lines); err != nil {
+		return nil, withClass(ErrStorage, fmt.Errorf("writing accepted checkpoint: %w", err))
+	}
+	if c.cfg.MaintenanceInterval <= 0 {
+		if err := c.cfg.Storage.Prune(c.cfg.Keep); err != nil {
+			return nil, withClass(ErrStorage, fmt.Errorf("deleting old checkpoints: %w", err))
+		}
+	}
+	if c.cfg.ProvenanceFile != "" {
+		if err := appendProvenance(c.cfg.ProvenanceFile, records, c.cfg.Keep, c.cfg.StateCipher); err != nil {
+			return nil, fmt.Errorf("recording provenance: %w", err)
+		}
+	}
+	for _, a := range batch {
+		if err := c.cfg.Audit.Record(AuditAccept, c.actor(), map[string]string{
+			"origin":    a.Origin,
+			"tree_size": strconv.FormatInt(a.Size, 10),
+			"root_hash": a.Hash,
+			"monitors":  strconv.Itoa(monitors),
+			"quorum":    strconv.Itoa(c.cfg.Quorum),
+			"round":     round,
+			"degraded":  strconv.FormatBool(degraded),
+			"intent":    in.Key,
+		}); err != nil {
+			return nil, fmt.Errorf("recording acceptance in audit log: %w", err)
+		}
+	}
+	in.Persisted = true
+	if err := c.writeIntent(in); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// batchOf returns the checkpoints accepted in batch mode: of every tree size
+// of the accepted log among the candidates larger than after, its
+// checkpoint, up to the checkpoint accepted by the resolution rule. Larger
+// tree sizes wait for a later round. Candidates hold a single root hash of
+// a tree size, but a size with several is left out rather than chosen from.
+func batchOf(candidates []Candidate, after int64, accepted Checkpoint) []Checkpoint {
+	roots := make(map[int64]int)
+	for _, c := range candidates {
+		if c.Origin == accepted.Origin {
+			roots[c.Size]++
+		}
+	}
+	var batch []Checkpoint
+	for _, c := range candidates {
+		if c.Origin != accepted.Origin || c.Size <= after || c.Size >= accepted.Size || roots[c.Size] > 1 {
+			continue
+		}
+		batch = append(batch, c.Checkpoint)
+	}
+	return append(batch, accepted)
+}
+
+// latestSizes returns the largest tree size of origin read from each
+// monitor.
+func latestSizes(origin string, monitors []string, observations [][]string) map[string]int64 {
+	latest := make(map[string]int64, len(monitors))
+	for i, chpts := range observations {
+		for _, line := range chpts {
+			chpt, err := ParseCheckpoint(line)
+			if err != nil || chpt.Origin != origin {
+				continue
+			}
+			if size, ok := latest[monitors[i]]; !ok || chpt.Size > size {
+				latest[monitors[i]] = chpt.Size
+			}
+		}
+	}
+	return latest
+}
+
+// readCount returns the number of latest checkpoints read from each monitor.
+func (c *Collector) readCount() int {
+	if c.cfg.Batch > 2 {
+		return c.cfg.Batch
+	}
+	return 2
+}
+
+// acceptedCheckpoints returns the retained accepted checkpoints, oldest
+// first, without the chain fields of a chained accepted file. Failures
+// to read the storage are ErrStorage.
+func (c *Collector) acceptedCheckpoints() ([]string, error) {
+	lines, err := c.cfg.Storage.Latest(c.cfg.Keep)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, withClass(ErrStorage, err)
+	}
+	if c.cfg.Chain {
+		for i, l := range lines {
+			cl, err := ParseChainedLine(l)
+			if err != nil {
+				return nil, err
+			}
+			lines[i] = cl.Checkpoint
+		}
+	}
+	return lines, nil
+}
+
+// acceptedObserver names the collector's own accepted checkpoints among the
+// monitors of conflicts.
+const acceptedObserver = "accepted"
+
+// acceptedAt returns the newest retained accepted checkpoint of the origin
+// and tree size of k, or nil if there is none.
+func (c *Collector) acceptedAt(k CheckpointKey) (*Checkpoint, error) {
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		chpt, err := ParseCheckpoint(lines[i])
+		if err != nil {
+			return nil, err
+		}
+		if chpt.Origin == k.Origin && chpt.Size == k.Size {
+			return &chpt, nil
+		}
+	}
+	return nil, nil
+}
+
+// readersOf returns the monitors that read a checkpoint with key k.
+func readersOf(k CheckpointKey, monitors []string, observations [][]string) []string {
+	var readers []string
+	for i, chpts := range observations {
+		for _, line := range chpts {
+			if chpt, err := ParseCheckpoint(line); err == nil && chpt.Key() == k {
+				readers = append(readers, monitors[i])
+				break
+			}
+		}
+	}
+	return readers
+}
+
+// lastAcceptedSize returns the largest tree size of origin among the
+// retained accepted checkpoints and those accepted or recovered since the
+// collector started, or zero if there are none.
+func (c *Collector) lastAcceptedSize(origin string) (int64, error) {
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return 0, err
+	}
+
+	size := c.sizes.max(func(o string) bool {
+		switch {
+		case len(c.cfg.OriginIntervals) == 0:
+			return true
+		case origin != "":
+			return MatchOrigin(origin, o)
+		default:
+			return c.scheduledOrigin(o) == ""
+		}
+	})
+	for _, l := range c.filterOrigin(origin, lines) {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			return 0, err
+		}
+		if chpt.Size > size {
+			size = chpt.Size
+		}
+	}
+	return size, nil
+}
+
+// Namespace returns the tenant namespace of the collector, if any.
+func (c *Collector) Namespace() string {
+	return c.cfg.Namespace
+}
+
+// actor identifies the collector in audit entries.
+func (c *Collector) actor() string {
+	if c.cfg.Namespace != "" {
+		return "collector/" + c.cfg.Namespace
+	}
+	return "collector"
+}
+
+func logPrefix(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return "[" + namespace + "] "
+}
+
+// logf logs a message prefixed with the collector's namespace.
+func (c *Collector) logf(format string, args ...any) {
+	log.Printf(logPrefix(c.cfg.Namespace)+format, args...)
+}
+
+// expectedOrigins returns the checkpoints in chpts whose origin is expected
+// from m: its own origin if set, otherwise one of Config.Origins. Other
+// checkpoints are rejected with an alert, so that a monitor pointed at the
+// wrong log cannot contribute to consensus. Lines that cannot be parsed are
+// kept so that consensus reports them.
+func (c *Collector) expectedOrigins(m Monitor, chpts []string) []string {
+	expected := c.cfg.Origins
+	if m.Origin != "" {
+		expected = []string{m.Origin}
+	}
+	if len(expected) == 0 {
+		return chpts
+	}
+
+	var filtered []string
+	var unexpected string
+	for _, line := range chpts {
+		chpt, err := ParseCheckpoint(line)
+		if err != nil {
+			filtered = append(filtered, line)
+			continue
+		}
+		matched := false
+		for _, origin := range expected {
+			matched = matched || MatchOrigin(origin, chpt.Origin)
+		}
+		if matched {
+			filtered = append(filtered, line)
+		} else {
+			unexpected = chpt.Origin
+		}
+	}
+	if unexpected != "" {
+		c.anoms.record(AnomalyOriginMismatch, m.Logfile)
+		c.alert(Alert{Kind: AnomalyOriginMismatch, Origin: unexpected, Monitors: []string{m.Logfile}, Message: fmt.Sprintf("monitor %s reported checkpoints of %q, expected %s; rejecting them", m.Logfile, unexpected, strings.Join(expected, " or "))})
+	}
+	return filtered
+}
+
+// filterOrigin returns the checkpoints in chpts that belong to origin. Lines
+// that cannot be parsed are kept so that consensus reports them.
+func (c *Collector) filterOrigin(origin string, chpts []string) []string {
+	if len(c.cfg.OriginIntervals) == 0 {
+		return chpts
+	}
+
+	var filtered []string
+	for _, line := range chpts {
+		chpt, err := ParseCheckpoint(line)
+		if err != nil {
+			filtered = append(filtered, line)
+			continue
+		}
+		if origin != "" && MatchOrigin(origin, chpt.Origin) {
+			filtered = append(filtered, line)
+			continue
+		}
+		if origin == "" && c.scheduledOrigin(chpt.Origin) == "" {
+			filtered = append(filtered, line)
+		}
+	}
+	return filtered
+}
+
+// scheduledOrigin returns the configured origin in OriginIntervals that
+// matches the checkpoint origin, or the empty string if there is none.
+func (c *Collector) scheduledOrigin(chptOrigin string) string {
+	for o := range c.cfg.OriginIntervals {
+		if MatchOrigin(o, chptOrigin) {
+			return o
+		}
+	}
+	return ""
+}
+
+// MatchOrigin reports whether a checkpoint origin line belongs to the
+// configured origin. Rekor origins have the form "<hostname> - <tree ID>",
+// so the configured origin may omit the tree ID.
+func MatchOrigin(configured, chptOrigin string) bool {
+	return chptOrigin == configured || strings.HasPrefix(chptOrigin, configured+" - ")
+}
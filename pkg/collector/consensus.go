@@ -0,0 +1,408 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultQuorum is the number of monitors that must agree on a tree size
+// before a checkpoint for it is accepted.
+const DefaultQuorum = 2
+
+// Quorum failure modes, selecting what a round does when no tree size
+// reaches quorum.
+const (
+	// QuorumHold keeps the last accepted checkpoint and accepts nothing.
+	QuorumHold = "hold"
+	// QuorumDegrade accepts the tree size with the most support, marked as
+	// degraded in its provenance, round report and stream event, and
+	// alerts.
+	QuorumDegrade = "degrade"
+	// QuorumAlert accepts nothing and alerts.
+	QuorumAlert = "alert"
+)
+
+// ValidQuorumFailure returns an error if mode is not a quorum failure mode.
+// The empty mode is QuorumHold.
+func ValidQuorumFailure(mode string) error {
+	switch mode {
+	case "", QuorumHold, QuorumDegrade, QuorumAlert:
+		return nil
+	}
+	return fmt.Errorf("unknown quorum failure mode %q, expected hold, degrade or alert", mode)
+}
+
+// Conflict resolution rules, selecting the checkpoint accepted when several
+// tree sizes reach quorum in a round.
+const (
+	// ResolveLargest accepts the largest tree size.
+	ResolveLargest = "largest"
+	// ResolveVotes accepts the tree size the most monitors agree on, the
+	// largest one on a tie.
+	ResolveVotes = "votes"
+	// ResolveRecent accepts the checkpoint with the newest timestamp, the
+	// largest one on a tie.
+	ResolveRecent = "recent"
+	// ResolveConsistent accepts the largest tree size that consistency
+	// proofs link to the smallest one through every tree size between
+	// them, and alerts if a proof fails.
+	ResolveConsistent = "consistent"
+)
+
+// ValidResolution returns an error if rule is not a conflict resolution
+// rule. The empty rule is ResolveLargest.
+func ValidResolution(rule string) error {
+	switch rule {
+	case "", ResolveLargest, ResolveVotes, ResolveRecent, ResolveConsistent:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict resolution rule %q, expected largest, votes, recent or consistent", rule)
+}
+
+// Policy is the agreement required before a tree size is accepted.
+type Policy struct {
+	// Quorum is the number of monitors that must agree on a tree size.
+	Quorum int
+	// MinNetworks, if positive, is the number of distinct networks the
+	// agreeing monitors must be in, so that a split view served to a
+	// single network cannot reach consensus. Monitors without a network
+	// do not count towards it.
+	MinNetworks int
+}
+
+// SelectAccepted parses the checkpoints read from each monitor and returns the
+// checkpoint with the largest tree size that at least quorum monitors agree on.
+// Monitors agree if their checkpoints have the same origin, tree size and root
+// hash; formatting, extension lines and signatures are ignored. When several
+// checkpoints share that size, the one with the newest timestamp is returned.
+// The boolean result is false if no tree size reached quorum.
+func SelectAccepted(observations [][]string, quorum int) (Checkpoint, bool, error) {
+	return Policy{Quorum: quorum}.Select(observations, nil)
+}
+
+// SelectAcceptedBatch returns a checkpoint for every tree size of a log
+// larger than after that at least quorum monitors agree on, in increasing
+// order of size. As in SelectAccepted, the newest checkpoint of each size is
+// returned, and sizes read with several root hashes are left out.
+func SelectAcceptedBatch(observations [][]string, quorum int, after int64) ([]Checkpoint, error) {
+	return Policy{Quorum: quorum}.SelectBatch(observations, nil, after)
+}
+
+// Select is SelectAccepted for the policy. networks holds the network of the
+// monitor of each observation, or is nil if they are unknown.
+func (p Policy) Select(observations [][]string, networks []string) (Checkpoint, bool, error) {
+	candidates, err := p.Candidates(observations, networks)
+	if err != nil || len(candidates) == 0 {
+		return Checkpoint{}, false, err
+	}
+	return Resolve(candidates, ResolveLargest), true, nil
+}
+
+// Candidate is a checkpoint that reached quorum.
+type Candidate struct {
+	Checkpoint
+	// Votes is the number of monitors that agree on the checkpoint.
+	Votes int
+}
+
+// Candidates returns every checkpoint that reached quorum, in increasing
+// order of tree size and timestamp, then by origin and root hash so that
+// the order does not depend on map iteration. Of equal checkpoints, the one
+// with the newest timestamp is returned. A tree size read with several root
+// hashes has no candidate, even if more than one of them reached quorum:
+// the timestamp and the number of votes are for whoever forged a checkpoint
+// to choose.
+func (p Policy) Candidates(observations [][]string, networks []string) ([]Candidate, error) {
+	parsed, support, err := countKeys(observations, networks)
+	if err != nil {
+		return nil, err
+	}
+
+	split := contested(parsed)
+	byKey := make(map[CheckpointKey]Candidate)
+	for _, c := range parsed {
+		s := support[c.Key()]
+		if !p.reached(s) || split[originSize{c.Origin, c.Size}] {
+			continue
+		}
+		if prev, ok := byKey[c.Key()]; !ok || c.Timestamp > prev.Timestamp {
+			byKey[c.Key()] = Candidate{Checkpoint: c, Votes: s.monitors}
+		}
+	}
+
+	candidates := make([]Candidate, 0, len(byKey))
+	for _, c := range byKey {
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch {
+		case a.Size != b.Size:
+			return a.Size < b.Size
+		case a.Timestamp != b.Timestamp:
+			return a.Timestamp < b.Timestamp
+		case a.Origin != b.Origin:
+			return a.Origin < b.Origin
+		}
+		return a.Hash < b.Hash
+	})
+	return candidates, nil
+}
+
+// contestedQuorum returns a checkpoint that reached quorum at a tree size
+// read with several root hashes, which Candidates leaves out.
+func (p Policy) contestedQuorum(observations [][]string, networks []string) (Checkpoint, bool) {
+	parsed, support, err := countKeys(observations, networks)
+	if err != nil {
+		return Checkpoint{}, false
+	}
+	split := contested(parsed)
+	for _, c := range parsed {
+		if split[originSize{c.Origin, c.Size}] && p.reached(support[c.Key()]) {
+			return c, true
+		}
+	}
+	return Checkpoint{}, false
+}
+
+// Resolve returns the candidate selected by rule, ResolveLargest,
+// ResolveVotes or ResolveRecent. Ties are broken by the larger tree size,
+// then by the newest timestamp. ResolveConsistent needs consistency proofs
+// and is resolved by the collector; here it selects the largest tree size.
+// Resolve never chooses between root hashes of a tree size, which Candidates
+// does not return.
+func Resolve(candidates []Candidate, rule string) Checkpoint {
+	better := func(c, best Candidate) bool {
+		switch {
+		case rule == ResolveVotes && c.Votes != best.Votes:
+			return c.Votes > best.Votes
+		case rule == ResolveRecent && c.Timestamp != best.Timestamp:
+			return c.Timestamp > best.Timestamp
+		case c.Size != best.Size:
+			return c.Size > best.Size
+		}
+		return c.Timestamp > best.Timestamp
+	}
+	var best Candidate
+	for i, c := range candidates {
+		if i == 0 || better(c, best) {
+			best = c
+		}
+	}
+	return best.Checkpoint
+}
+
+// SelectDegraded returns the checkpoint the most monitors agree on, regardless
+// of any quorum, for accepting a checkpoint in QuorumDegrade mode. Ties are
+// broken by the larger tree size, then by the newest timestamp. The boolean
+// result is false if no checkpoint was read.
+func SelectDegraded(observations [][]string) (Checkpoint, bool, error) {
+	parsed, support, err := countKeys(observations, nil)
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+
+	var accepted Checkpoint
+	better := func(c Checkpoint) bool {
+		n, best := support[c.Key()].monitors, support[accepted.Key()].monitors
+		if n != best {
+			return n > best
+		}
+		if c.Size != accepted.Size {
+			return c.Size > accepted.Size
+		}
+		return c.Timestamp > accepted.Timestamp
+	}
+	found := false
+	for _, c := range parsed {
+		if !found || better(c) {
+			accepted = c
+			found = true
+		}
+	}
+	return accepted, found, nil
+}
+
+// SelectBatch is SelectAcceptedBatch for the policy.
+func (p Policy) SelectBatch(observations [][]string, networks []string, after int64) ([]Checkpoint, error) {
+	parsed, support, err := countKeys(observations, networks)
+	if err != nil {
+		return nil, err
+	}
+
+	split := contested(parsed)
+	byKey := make(map[originSize]Checkpoint)
+	for _, c := range parsed {
+		k := originSize{c.Origin, c.Size}
+		// As in Candidates, a contested tree size has no checkpoint.
+		if c.Size <= after || split[k] || !p.reached(support[c.Key()]) {
+			continue
+		}
+		if prev, ok := byKey[k]; !ok || c.Timestamp > prev.Timestamp {
+			byKey[k] = c
+		}
+	}
+
+	accepted := make([]Checkpoint, 0, len(byKey))
+	for _, c := range byKey {
+		accepted = append(accepted, c)
+	}
+	sort.Slice(accepted, func(i, j int) bool {
+		if accepted[i].Size != accepted[j].Size {
+			return accepted[i].Size < accepted[j].Size
+		}
+		return accepted[i].Origin < accepted[j].Origin
+	})
+	return accepted, nil
+}
+
+// support is the set of monitors that agree on a checkpoint.
+type support struct {
+	monitors int
+	networks map[string]bool
+}
+
+func (p Policy) reached(s *support) bool {
+	return s != nil && s.monitors >= p.Quorum && len(s.networks) >= p.MinNetworks
+}
+
+// originSize is a tree size of a log.
+type originSize struct {
+	origin string
+	size   int64
+}
+
+// contested returns the tree sizes of each log read with more than one
+// root hash.
+func contested(parsed []Checkpoint) map[originSize]bool {
+	hashes := make(map[originSize]string)
+	split := make(map[originSize]bool)
+	for _, c := range parsed {
+		k := originSize{c.Origin, c.Size}
+		if h, ok := hashes[k]; ok && h != c.Hash {
+			split[k] = true
+		}
+		hashes[k] = c.Hash
+	}
+	return split
+}
+
+// countKeys parses the checkpoints read from each monitor and counts the
+// monitors and networks that agree on each checkpoint, comparing them by
+// their canonical origin, tree size and root hash.
+func countKeys(observations [][]string, networks []string) ([]Checkpoint, map[CheckpointKey]*support, error) {
+	keys := make(map[CheckpointKey]*support)
+	var parsed []Checkpoint
+	for i, chpts := range observations {
+		seen := make(map[CheckpointKey]bool)
+		for _, line := range chpts {
+			c, err := ParseCheckpoint(line)
+			if err != nil {
+				return nil, nil, err
+			}
+			parsed = append(parsed, c)
+			k := c.Key()
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			s, ok := keys[k]
+			if !ok {
+				s = &support{networks: make(map[string]bool)}
+				keys[k] = s
+			}
+			s.monitors++
+			if i < len(networks) && networks[i] != "" {
+				s.networks[networks[i]] = true
+			}
+		}
+	}
+	return parsed, keys, nil
+}
+
+// Conflict is a tree size of a log for which monitors read checkpoints with
+// different root hashes. At most one of them can be genuine, so the log or
+// the path to some monitors is presenting a split view.
+type Conflict struct {
+	Origin string
+	Size   int64
+	// Monitors maps each root hash to the monitors that read it.
+	Monitors map[string][]string
+}
+
+// FindConflicts returns the conflicts among the checkpoints read from each
+// monitor, sorted by origin and tree size. Unparseable checkpoints are
+// ignored.
+func FindConflicts(monitors []string, observations [][]string) []Conflict {
+	hashes := make(map[originSize]map[string][]string)
+	for i, chpts := range observations {
+		for _, line := range chpts {
+			c, err := ParseCheckpoint(line)
+			if err != nil {
+				continue
+			}
+			k := originSize{c.Origin, c.Size}
+			if hashes[k] == nil {
+				hashes[k] = make(map[string][]string)
+			}
+			ms := hashes[k][c.Hash]
+			if len(ms) == 0 || ms[len(ms)-1] != monitors[i] {
+				hashes[k][c.Hash] = append(ms, monitors[i])
+			}
+		}
+	}
+
+	var conflicts []Conflict
+	for k, byHash := range hashes {
+		if len(byHash) > 1 {
+			conflicts = append(conflicts, Conflict{Origin: k.origin, Size: k.size, Monitors: byHash})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Origin != conflicts[j].Origin {
+			return conflicts[i].Origin < conflicts[j].Origin
+		}
+		return conflicts[i].Size < conflicts[j].Size
+	})
+	return conflicts
+}
+
+// conflicted reports whether conflicts include the tree size of c.
+func conflicted(conflicts []Conflict, c Checkpoint) bool {
+	for _, cf := range conflicts {
+		if cf.Origin == c.Origin && cf.Size == c.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the conflict for an alert.
+func (c Conflict) String() string {
+	hashes := make([]string, 0, len(c.Monitors))
+	for h := range c.Monitors {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	views := make([]string, len(hashes))
+	for i, h := range hashes {
+		views[i] = fmt.Sprintf("%s from %s", h, strings.Join(c.Monitors[h], ", "))
+	}
+	return fmt.Sprintf("monitors read different root hashes for tree size %d of %s: %s", c.Size, c.Origin, strings.Join(views, "; "))
+}
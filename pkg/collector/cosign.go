@@ -0,0 +1,340 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the cosigned note.
+const (
+	// CosignNoteFormat signs the checkpoint text as a plain signed note.
+	CosignNoteFormat = "note"
+	// CosignV1Format signs a timestamped cosignature/v1 statement about
+	// the checkpoint, as witnesses do following the C2SP tlog-cosignature
+	// specification, so that witness-aware verifiers accept the
+	// collector as a witness.
+	CosignV1Format = "cosignature/v1"
+)
+
+// cosignatureV1Header starts the message signed by a cosignature/v1; the
+// time line and the checkpoint text follow it.
+const cosignatureV1Header = "cosignature/v1\n"
+
+// ValidCosignFormat returns an error if format is not a cosigned note
+// format. The empty format is CosignNoteFormat.
+func ValidCosignFormat(format string) error {
+	switch format {
+	case "", CosignNoteFormat, CosignV1Format:
+		return nil
+	}
+	return fmt.Errorf("unknown cosigned note format %q, expected note or cosignature/v1", format)
+}
+
+// Cosigner adds the collector's signature to accepted checkpoints in the
+// signed note format. It has the method set of
+// golang.org/x/mod/sumdb/note.Signer, so signers created with
+// note.NewSigner can be used directly.
+type Cosigner interface {
+	// Name is the key name shown in the signature line.
+	Name() string
+	// KeyHash is the hash of the key name and public key identifying the
+	// key in the signature.
+	KeyHash() uint32
+	// Sign returns a signature of the note text msg.
+	Sign(msg []byte) ([]byte, error)
+}
+
+// Ed25519KeyCosigner is a Cosigner that exposes its Ed25519 public key, as
+// needed to identify it in a cosignature/v1.
+type Ed25519KeyCosigner interface {
+	Cosigner
+	PublicKey() ed25519.PublicKey
+}
+
+// ed25519Cosigner is a Cosigner for an Ed25519 public key whose signatures
+// are produced elsewhere.
+type ed25519Cosigner struct {
+	name string
+	hash uint32
+	pub  ed25519.PublicKey
+	sign func(msg []byte) ([]byte, error)
+}
+
+// Ed25519Cosigner returns a Cosigner named name for the Ed25519 public key
+// pub, whose signatures are produced by sign, e.g. by a threshold of
+// collectors or a hardware token.
+func Ed25519Cosigner(name string, pub ed25519.PublicKey, sign func(msg []byte) ([]byte, error)) Cosigner {
+	// The key hash of an Ed25519 note key is the first four bytes of
+	// SHA-256(name || "\n" || 0x01 || public key).
+	h := sha256.New()
+	h.Write([]byte(name + "\n\x01"))
+	h.Write(pub)
+	return &ed25519Cosigner{name: name, hash: binary.BigEndian.Uint32(h.Sum(nil)), pub: pub, sign: sign}
+}
+
+// NoteKeyCosigner returns a Cosigner for a note signing key as created by
+// golang.org/x/mod/sumdb/note.GenerateKey.
+func NoteKeyCosigner(skey string) (Cosigner, error) {
+	// The key has the form PRIVATE+KEY+<name>+<hash>+<base64(0x01 || seed)>.
+	fields := strings.SplitN(skey, "+", 5)
+	if len(fields) != 5 || fields[0] != "PRIVATE" || fields[1] != "KEY" {
+		return nil, errors.New("malformed note signing key")
+	}
+	b, err := base64.StdEncoding.DecodeString(fields[4])
+	if err != nil || len(b) != 1+ed25519.SeedSize || b[0] != 1 {
+		return nil, errors.New("malformed note signing key")
+	}
+	key := ed25519.NewKeyFromSeed(b[1:])
+	return Ed25519Cosigner(fields[2], key.Public().(ed25519.PublicKey), func(msg []byte) ([]byte, error) {
+		return ed25519.Sign(key, msg), nil
+	}), nil
+}
+
+// CertifiedCosigner is a Cosigner whose key is bound to an identity by a
+// certificate chain, such as an ephemeral key certified by Fulcio. The chain
+// is written after the cosigned note so that the cosignature can be verified
+// after the key is gone.
+type CertifiedCosigner interface {
+	Cosigner
+	// Chain returns the PEM encoded certificate chain of the key of the
+	// last signature, leaf first.
+	Chain() []byte
+}
+
+func (s *ed25519Cosigner) Name() string                    { return s.name }
+func (s *ed25519Cosigner) KeyHash() uint32                 { return s.hash }
+func (s *ed25519Cosigner) Sign(msg []byte) ([]byte, error) { return s.sign(msg) }
+func (s *ed25519Cosigner) PublicKey() ed25519.PublicKey    { return s.pub }
+
+// splitNote splits a flattened checkpoint into its note text, ending in a
+// newline, and its signature lines.
+func splitNote(raw string) (string, []string, error) {
+	text := strings.ReplaceAll(raw, lineSeparator, "\n")
+	body, sigs, ok := strings.Cut(text, "\n\n")
+	if !ok {
+		return "", nil, errors.New("checkpoint has no signatures")
+	}
+	var lines []string
+	for _, l := range strings.Split(sigs, "\n") {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return body + "\n", lines, nil
+}
+
+// ExtendNote returns a flattened checkpoint whose note text has the given
+// extension lines appended after the log's own, such as its timestamp. The
+// log's signatures do not cover the extension lines and are dropped, so the
+// result must be signed again, e.g. with CosignNote.
+func ExtendNote(raw string, extensions []string) (string, error) {
+	text, _, err := splitNote(raw)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range extensions {
+		if e == "" || strings.Contains(e, "\n") {
+			return "", fmt.Errorf("invalid extension line %q", e)
+		}
+		text += e + "\n"
+	}
+	return strings.ReplaceAll(text+"\n", "\n", lineSeparator), nil
+}
+
+// CosignNote returns the signed note of a flattened checkpoint with a
+// signature by s appended to the log's signatures. If s is a
+// CertifiedCosigner, its certificate chain follows the note after a blank
+// line; SplitCosigned separates them.
+func CosignNote(raw string, s Cosigner) (string, error) {
+	return cosignNote(raw, s, CosignNoteFormat, time.Time{})
+}
+
+// CosignNoteV1 is CosignNote with a cosignature/v1 made at time t, which
+// needs an Ed25519KeyCosigner.
+func CosignNoteV1(raw string, s Cosigner, t time.Time) (string, error) {
+	return cosignNote(raw, s, CosignV1Format, t)
+}
+
+func cosignNote(raw string, s Cosigner, format string, t time.Time) (string, error) {
+	text, sigs, err := splitNote(raw)
+	if err != nil {
+		return "", err
+	}
+
+	msg := text
+	ks, v1 := s.(Ed25519KeyCosigner)
+	if format == CosignV1Format {
+		if !v1 {
+			return "", errors.New("cosignature/v1 needs an Ed25519 cosigning key")
+		}
+		msg = cosignatureV1Message(text, t.Unix())
+	}
+	sig, err := s.Sign([]byte(msg))
+	if err != nil {
+		return "", err
+	}
+	// Signing may replace the key, so it is identified afterwards.
+	hash := s.KeyHash()
+	var prefix []byte
+	if format == CosignV1Format {
+		hash = cosignatureV1KeyHash(s.Name(), ks.PublicKey())
+		prefix = binary.BigEndian.AppendUint64(nil, uint64(t.Unix()))
+	}
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], hash)
+	sig = append(append(h[:], prefix...), sig...)
+
+	sigs = append(sigs, "— "+s.Name()+" "+base64.StdEncoding.EncodeToString(sig))
+	signed := text + "\n" + strings.Join(sigs, "\n") + "\n"
+	if cs, ok := s.(CertifiedCosigner); ok {
+		signed += "\n" + string(cs.Chain())
+	}
+	return signed, nil
+}
+
+// cosignatureV1Message returns the message signed by a cosignature/v1 of
+// the checkpoint text made at the given Unix time.
+func cosignatureV1Message(text string, timestamp int64) string {
+	return cosignatureV1Header + "time " + strconv.FormatInt(timestamp, 10) + "\n" + text
+}
+
+// cosignatureV1KeyHash returns the key hash identifying an Ed25519 key in a
+// cosignature/v1, the first four bytes of
+// SHA-256(name || "\n" || 0x04 || public key).
+func cosignatureV1KeyHash(name string, pub ed25519.PublicKey) uint32 {
+	h := sha256.New()
+	h.Write([]byte(name + "\n\x04"))
+	h.Write(pub)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// VerifyCosignatureV1 checks the cosignature/v1 by the key named name in a
+// signed note and returns the time it was made.
+func VerifyCosignatureV1(signedNote []byte, name string, pub ed25519.PublicKey) (time.Time, error) {
+	text, sigs, ok := strings.Cut(string(signedNote), "\n\n")
+	if !ok {
+		return time.Time{}, errors.New("note has no signatures")
+	}
+	text += "\n"
+	want := cosignatureV1KeyHash(name, pub)
+	for _, line := range strings.Split(sigs, "\n") {
+		n, b64, ok := strings.Cut(strings.TrimPrefix(line, "— "), " ")
+		if !ok || n != name {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(sig) != 4+8+ed25519.SignatureSize || binary.BigEndian.Uint32(sig) != want {
+			continue
+		}
+		ts := int64(binary.BigEndian.Uint64(sig[4:]))
+		if !ed25519.Verify(pub, []byte(cosignatureV1Message(text, ts)), sig[12:]) {
+			return time.Time{}, fmt.Errorf("cosignature/v1 by %s does not verify", name)
+		}
+		return time.Unix(ts, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("no cosignature/v1 by %s", name)
+}
+
+// SplitCosigned splits the output of CosignNote into the signed note and
+// the PEM encoded certificate chain of the cosigner, which is empty unless
+// it was a CertifiedCosigner.
+func SplitCosigned(data []byte) (signedNote, chain []byte) {
+	i := bytes.Index(data, []byte("\n\n-----BEGIN "))
+	if i < 0 {
+		return data, nil
+	}
+	return data[:i+1], data[i+2:]
+}
+
+// cosign writes the cosigned note of an accepted checkpoint to
+// CosignedFile, without the extension lines stripped by ExtensionPolicy and
+// with the collector's extension lines if Extensions is set.
+// Failures are logged so that collection continues, and signing is retried
+// with the checkpoint accepted next round.
+func (c *Collector) cosign(ctx context.Context, accepted Checkpoint, round string, supporters int) {
+	if c.cfg.Cosigner == nil || c.cfg.CosignedFile == "" {
+		return
+	}
+	raw := c.cfg.ExtensionPolicy.Strip(accepted.Raw)
+	var err error
+	if c.cfg.Extensions {
+		raw, err = ExtendNote(raw, c.extensions(round, supporters))
+	}
+	var signed string
+	if err == nil {
+		signed, err = cosignNote(raw, c.cfg.Cosigner, c.cfg.CosignFormat, c.now())
+	}
+	if err == nil {
+		err = replaceFile(c.cfg.CosignedFile, strings.Split(strings.TrimSuffix(signed, "\n"), "\n"))
+	}
+	if err != nil {
+		c.logf("Cosigning checkpoint of %s at tree size %d: %v\n", accepted.Origin, accepted.Size, err)
+		return
+	}
+	c.submit(ctx, accepted, signed)
+}
+
+// extensions returns the extension lines describing how a checkpoint was
+// accepted: the collector's key name, the round and the number of monitors
+// that agreed on it out of the quorum.
+func (c *Collector) extensions(round string, supporters int) []string {
+	return []string{
+		"Collector: " + c.cfg.Cosigner.Name(),
+		"Collector-Round: " + round,
+		fmt.Sprintf("Collector-Quorum: %d/%d", supporters, c.cfg.Quorum),
+	}
+}
+
+// ApproveCosignature returns an error unless the note text msg is a
+// checkpoint the collector accepted among its retained checkpoints, or a
+// cosignature/v1 message about one. It lets the collector take part in
+// threshold cosigning without trusting the coordinator.
+func (c *Collector) ApproveCosignature(msg []byte) error {
+	if rest := bytes.TrimPrefix(msg, []byte(cosignatureV1Header)); len(rest) < len(msg) && bytes.HasPrefix(rest, []byte("time ")) {
+		if _, text, ok := bytes.Cut(rest, []byte("\n")); ok {
+			msg = text
+		}
+	}
+	chpt, err := ParseCheckpoint(strings.ReplaceAll(strings.TrimSuffix(string(msg), "\n"), "\n", lineSeparator))
+	if err != nil {
+		return err
+	}
+	lines, err := c.cfg.Storage.Latest(c.cfg.Keep)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if cl, err := ParseChainedLine(line); err == nil {
+			line = cl.Checkpoint
+		}
+		a, err := ParseCheckpoint(line)
+		if err == nil && a.Key() == chpt.Key() {
+			return nil
+		}
+	}
+	return fmt.Errorf("tree size %d of %s was not accepted by this collector", chpt.Size, chpt.Origin)
+}
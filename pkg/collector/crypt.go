@@ -0,0 +1,264 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// StateKeyEnv is the environment variable holding the base64 encoded state key.
+const StateKeyEnv = "REKOR_COLLECTOR_STATE_KEY"
+
+// sealedPrefix marks a line encrypted by a StateCipher. The sealed bytes
+// start with the link of the line, see lineLink.
+const sealedPrefix = "enc:v2:"
+
+// legacySealedPrefix marks a line encrypted before lines were bound to their
+// file and position. Such lines are still read.
+const legacySealedPrefix = "enc:v1:"
+
+// The kinds of state a StateCipher seals. The kind is authenticated with
+// every line and blob, so that one cannot be moved into a file of another
+// kind.
+const (
+	sealAccepted   = "accepted"
+	sealHistory    = "history"
+	sealProvenance = "provenance"
+	sealAudit      = "audit"
+	sealAnchor     = "anchor"
+	sealRegistry   = "registry"
+	sealNote       = "note"
+	sealNoteDict   = "note-dictionary"
+)
+
+// linkSize is the size of the link of a sealed line.
+const linkSize = 8
+
+// StateCipher encrypts the lines of the collector's own state files, the
+// accepted checkpoint file and the audit log, with AES-256-GCM. Each line is
+// sealed independently so files can still be appended to and pruned line by
+// line, but is bound to the kind of file and to the line before it. A nil
+// *StateCipher leaves lines in plaintext.
+type StateCipher struct {
+	aead cipher.AEAD
+}
+
+// NewStateCipher returns a cipher for a 32 byte key.
+func NewStateCipher(key []byte) (*StateCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("state key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &StateCipher{aead: aead}, nil
+}
+
+// LoadStateCipher reads a base64 encoded key from keyFile or, if keyFile is
+// empty, from the StateKeyEnv environment variable. It returns nil if
+// neither is set.
+func LoadStateCipher(keyFile string) (*StateCipher, error) {
+	encoded := os.Getenv(StateKeyEnv)
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding state key: %w", err)
+	}
+	return NewStateCipher(key)
+}
+
+// Seal encrypts a single line of accepted checkpoints, or the monitor
+// registry, for storage outside this package, such as by a Storage. The
+// order of the lines is left to the storage. A nil cipher returns the line
+// unchanged.
+func (c *StateCipher) Seal(line string) (string, error) {
+	return c.sealLine(sealAccepted, "", line)
+}
+
+// Open decrypts a line sealed by Seal, or copied unchanged from an accepted
+// checkpoint file.
+func (c *StateCipher) Open(line string) (string, error) {
+	plain, _, err := c.openLine(sealAccepted, line)
+	return plain, err
+}
+
+// lineLink returns the link of a line stored right after the stored line
+// prev, the start of its SHA-256 hash, or zeros if prev is empty.
+func lineLink(prev string) []byte {
+	link := make([]byte, linkSize)
+	if prev != "" {
+		sum := sha256.Sum256([]byte(prev))
+		copy(link, sum[:])
+	}
+	return link
+}
+
+// lineAAD returns the additional data authenticated with a line of the
+// given kind and link.
+func lineAAD(kind string, link []byte) []byte {
+	return append([]byte("rekor-collector/"+kind+"\n"), link...)
+}
+
+// sealLine encrypts a single line of the given kind that is stored right
+// after the stored line prev. prev is empty for the first line of a file
+// and for lines whose order is kept by their storage.
+func (c *StateCipher) sealLine(kind, prev, line string) (string, error) {
+	if c == nil {
+		return line, nil
+	}
+	link := lineLink(prev)
+	sealed, err := c.sealBytes([]byte(line), lineAAD(kind, link))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(append(link, sealed...)), nil
+}
+
+// openLine decrypts a line of the given kind sealed by sealLine and returns
+// its link, which is nil for a legacy line. Plaintext lines are rejected so
+// that lines cannot be injected into an encrypted file.
+func (c *StateCipher) openLine(kind, line string) (string, []byte, error) {
+	if c == nil {
+		return line, nil, nil
+	}
+	var link, aad []byte
+	var encoded string
+	switch {
+	case strings.HasPrefix(line, sealedPrefix):
+		encoded = strings.TrimPrefix(line, sealedPrefix)
+	case strings.HasPrefix(line, legacySealedPrefix):
+		encoded = strings.TrimPrefix(line, legacySealedPrefix)
+	default:
+		return "", nil, errors.New("line is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.HasPrefix(line, sealedPrefix) {
+		if len(sealed) < linkSize {
+			return "", nil, errors.New("encrypted line is too short")
+		}
+		link, sealed = sealed[:linkSize], sealed[linkSize:]
+		aad = lineAAD(kind, link)
+	}
+	plain, err := c.openBytes(sealed, aad)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(plain), link, nil
+}
+
+// lineOpener opens the consecutive lines of a file of one kind and checks
+// that each was sealed right after the line before it, so that lines
+// removed, reordered or inserted between them are noticed. The first line
+// is not checked, since the lines before it may have been pruned.
+type lineOpener struct {
+	sc   *StateCipher
+	kind string
+	prev string
+	// linked is set once a line with a link was opened, after which legacy
+	// lines are rejected.
+	linked bool
+}
+
+// open decrypts the next line of the file.
+func (o *lineOpener) open(line string) (string, error) {
+	prev := o.prev
+	o.prev = line
+	plain, link, err := o.sc.openLine(o.kind, line)
+	if err != nil || o.sc == nil {
+		return plain, err
+	}
+	switch {
+	case link == nil && o.linked:
+		return "", errors.New("line was encrypted by an older collector but follows a newer line")
+	case link != nil && prev != "" && !bytes.Equal(link, lineLink(prev)):
+		return "", errors.New("line does not follow the line before it, lines were removed, reordered or inserted")
+	}
+	o.linked = o.linked || link != nil
+	return plain, nil
+}
+
+// sealBlob encrypts a whole file of the given kind.
+func (c *StateCipher) sealBlob(kind string, b []byte) ([]byte, error) {
+	return c.sealBytes(b, []byte("rekor-collector/"+kind))
+}
+
+// openBlob decrypts a file sealed by sealBlob. Files sealed before they
+// were bound to their kind are still read.
+func (c *StateCipher) openBlob(kind string, sealed []byte) ([]byte, error) {
+	plain, err := c.openBytes(sealed, []byte("rekor-collector/"+kind))
+	if err != nil && c != nil {
+		if legacy, legacyErr := c.openBytes(sealed, nil); legacyErr == nil {
+			return legacy, nil
+		}
+	}
+	return plain, err
+}
+
+// sealBytes encrypts b, prefixed with a random nonce, authenticating aad
+// with it.
+func (c *StateCipher) sealBytes(b, aad []byte) ([]byte, error) {
+	if c == nil {
+		return b, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, b, aad), nil
+}
+
+// openBytes decrypts bytes sealed by sealBytes with the same aad.
+func (c *StateCipher) openBytes(sealed, aad []byte) ([]byte, error) {
+	if c == nil {
+		return sealed, nil
+	}
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("encrypted line is too short")
+	}
+	plain, err := c.aead.Open(nil, sealed[:n], sealed[n:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting line: %w", err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,251 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDiscoveryInterval is how often discovered monitors are refreshed.
+const DefaultDiscoveryInterval = 5 * time.Minute
+
+// WellKnownCheckpointsPath is the path monitors found through SRV records
+// serve their checkpoints at.
+const WellKnownCheckpointsPath = "/.well-known/rekor-monitor/checkpoints"
+
+// discoveryTimeout bounds a single discovery lookup.
+const discoveryTimeout = 30 * time.Second
+
+// maxDiscoveryResponse bounds the size of a discovery document.
+const maxDiscoveryResponse = 1 << 20
+
+// Discoverer finds monitors that are not configured statically, so that new
+// monitors can join the fleet by publishing a record.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]Monitor, error)
+}
+
+// DNSDiscovery finds monitors through the TXT records of Name. Each record
+// describes one monitor as space separated key=value pairs, for example
+//
+//	url=https://monitor.example.com/logInfo.txt network=AS15169
+//
+// The url key is required; description and network are optional.
+type DNSDiscovery struct {
+	Name     string
+	Resolver *net.Resolver
+}
+
+// Discover implements Discoverer.
+func (d DNSDiscovery) Discover(ctx context.Context) ([]Monitor, error) {
+	records, err := resolver(d.Resolver).LookupTXT(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	var monitors []Monitor
+	for _, r := range records {
+		m, err := parseMonitorRecord(r)
+		if err != nil {
+			return nil, fmt.Errorf("TXT record of %s: %w", d.Name, err)
+		}
+		monitors = append(monitors, m)
+	}
+	return monitors, nil
+}
+
+func parseMonitorRecord(record string) (Monitor, error) {
+	var m Monitor
+	for _, field := range strings.Fields(record) {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return Monitor{}, fmt.Errorf("invalid field %q", field)
+		}
+		switch k {
+		case "url":
+			m.Logfile = v
+		case "network":
+			m.Network = v
+		case "description":
+			m.Description = v
+		}
+	}
+	if !isRemote(m.Logfile) {
+		return Monitor{}, fmt.Errorf("record %q has no HTTP(S) url", record)
+	}
+	if m.Description == "" {
+		m.Description = m.Logfile
+	}
+	return m, nil
+}
+
+// SRVDiscovery finds monitors through the _rekor-monitor._tcp SRV records of
+// Domain. Each target serves its checkpoints over HTTPS at
+// WellKnownCheckpointsPath.
+type SRVDiscovery struct {
+	Domain   string
+	Resolver *net.Resolver
+}
+
+// Discover implements Discoverer.
+func (d SRVDiscovery) Discover(ctx context.Context) ([]Monitor, error) {
+	_, records, err := resolver(d.Resolver).LookupSRV(ctx, "rekor-monitor", "tcp", d.Domain)
+	if err != nil {
+		return nil, err
+	}
+	monitors := make([]Monitor, len(records))
+	for i, r := range records {
+		host := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		monitors[i] = Monitor{Description: host, Logfile: "https://" + host + WellKnownCheckpointsPath}
+	}
+	return monitors, nil
+}
+
+// HTTPDiscovery finds monitors in a monitor_list JSON document served at
+// URL. Relative logfile URLs are resolved against URL.
+type HTTPDiscovery struct {
+	URL    string
+	Client *http.Client
+}
+
+// Discover implements Discoverer.
+func (d HTTPDiscovery) Discover(ctx context.Context) ([]Monitor, error) {
+	base, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", d.URL, resp.Status)
+	}
+
+	var list monitorList
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDiscoveryResponse)).Decode(&list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", d.URL, err)
+	}
+	for i, m := range list.Monitors {
+		u, err := base.Parse(m.Logfile)
+		if err != nil {
+			return nil, err
+		}
+		list.Monitors[i].Logfile = u.String()
+		if !isRemote(list.Monitors[i].Logfile) {
+			return nil, fmt.Errorf("%s: logfile %q is not an HTTP(S) URL", d.URL, m.Logfile)
+		}
+	}
+	return list.Monitors, nil
+}
+
+func resolver(r *net.Resolver) *net.Resolver {
+	if r == nil {
+		return net.DefaultResolver
+	}
+	return r
+}
+
+// ParseDiscoverer parses a discovery source: "dns:<name>" for TXT records,
+// "srv:<domain>" for SRV records, "mdns:<allow file>" for confirmed instances
+// advertised over mDNS or an HTTPS URL of a monitor_list document.
+func ParseDiscoverer(spec string) (Discoverer, error) {
+	switch {
+	case strings.HasPrefix(spec, "mdns:"):
+		return MDNSDiscovery{AllowFile: strings.TrimPrefix(spec, "mdns:")}, nil
+	case strings.HasPrefix(spec, "dns:"):
+		return DNSDiscovery{Name: strings.TrimPrefix(spec, "dns:")}, nil
+	case strings.HasPrefix(spec, "srv:"):
+		return SRVDiscovery{Domain: strings.TrimPrefix(spec, "srv:")}, nil
+	case isRemote(spec):
+		return HTTPDiscovery{URL: spec}, nil
+	}
+	return nil, fmt.Errorf("invalid discovery source %q, expected dns:<name>, srv:<domain>, mdns:<allow file> or a URL", spec)
+}
+
+// discovery caches the monitors found by a set of discoverers.
+type discovery struct {
+	sources  []Discoverer
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	monitors  [][]Monitor
+	refreshed time.Time
+}
+
+// get returns the discovered monitors, refreshing them if they are older
+// than the interval. A source that fails keeps its last known monitors.
+func (d *discovery) get(logf func(format string, args ...any)) []Monitor {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.monitors == nil || d.now().Sub(d.refreshed) >= d.interval {
+		if d.monitors == nil {
+			d.monitors = make([][]Monitor, len(d.sources))
+		}
+		for i, s := range d.sources {
+			ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+			ms, err := s.Discover(ctx)
+			cancel()
+			if err != nil {
+				logf("Discovering monitors: %v\n", err)
+				continue
+			}
+			d.monitors[i] = ms
+		}
+		d.refreshed = d.now()
+	}
+
+	var all []Monitor
+	for _, ms := range d.monitors {
+		all = append(all, ms...)
+	}
+	return all
+}
+
+// mergeMonitors appends the monitors in extra that are not in monitors.
+func mergeMonitors(monitors, extra []Monitor) []Monitor {
+	seen := make(map[string]bool, len(monitors))
+	for _, m := range monitors {
+		seen[m.Logfile] = true
+	}
+	for _, m := range extra {
+		if !seen[m.Logfile] {
+			seen[m.Logfile] = true
+			monitors = append(monitors, m)
+		}
+	}
+	return monitors
+}
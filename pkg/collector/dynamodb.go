@@ -0,0 +1,437 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterCapability(CapabilityStorage, "dynamodb")
+}
+
+// dynamoTimeout bounds every DynamoDB operation of a DynamoDBStorage, whose
+// methods do not take a context.
+const dynamoTimeout = 30 * time.Second
+
+// dynamoMaxTransact is the maximum number of items of a DynamoDB
+// transaction.
+const dynamoMaxTransact = 100
+
+// ErrConflict is returned when appending to a DynamoDBStorage another
+// collector appended to since its latest pointer was read.
+var ErrConflict = errors.New("accepted checkpoints were written by another collector")
+
+// DynamoDBStorage is a Storage keeping the accepted checkpoints of a
+// namespace in a DynamoDB table, for collectors running without a
+// persistent disk. The table has the partition key namespace (string) and
+// the sort key seq (number). Lines are stored as items with seq 1, 2, ...,
+// the item with seq 0 points to the latest one and the item with seq -1
+// holds the monitor registry, if any; appends update the
+// pointer with a conditional write in the same transaction, so concurrent
+// collectors cannot interleave lines. Pruned items are not deleted but get
+// an expires attribute for DynamoDB's time to live, which must be enabled
+// on that attribute.
+type DynamoDBStorage struct {
+	Table     string
+	Namespace string
+	Region    string
+	// Endpoint, if set, is the URL of a DynamoDB compatible service such
+	// as DynamoDB Local. Otherwise the regional AWS endpoint is used.
+	Endpoint                                   string
+	AccessKeyID, SecretAccessKey, SessionToken string
+	// Container, if set, provides the credentials when AccessKeyID and
+	// SecretAccessKey are not set.
+	Container *ContainerCredentials
+	// Cipher, if set, encrypts the lines.
+	Cipher *StateCipher
+	// Client sends the signed requests, http.DefaultClient if nil.
+	Client *http.Client
+
+	now func() time.Time
+}
+
+// dynamoDefaultNamespace stands for the empty namespace, as DynamoDB keys
+// cannot be empty. It is not a valid tenant name, so it cannot collide with
+// one.
+const dynamoDefaultNamespace = "_"
+
+// DynamoDBStorageFromEnv returns a DynamoDBStorage for a table configured by
+// the standard AWS environment variables, such as those set in AWS Lambda,
+// or the container credentials of an ECS or Fargate task. The empty
+// namespace is stored as dynamoDefaultNamespace.
+func DynamoDBStorageFromEnv(table, namespace string, sc *StateCipher) *DynamoDBStorage {
+	env := S3FetcherFromEnv()
+	if namespace == "" {
+		namespace = dynamoDefaultNamespace
+	}
+	s := &DynamoDBStorage{
+		Table:           table,
+		Namespace:       namespace,
+		Region:          env.Region,
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL_DYNAMODB"),
+		AccessKeyID:     env.AccessKeyID,
+		SecretAccessKey: env.SecretAccessKey,
+		SessionToken:    env.SessionToken,
+		Container:       env.Container,
+		Cipher:          sc,
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return s
+}
+
+// dynamoRegistrySeq is the sort key of the item holding the monitor
+// registry of a namespace.
+const dynamoRegistrySeq = -1
+
+// dynamoValue is a DynamoDB attribute value of type string or number.
+type dynamoValue struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+type dynamoItem map[string]dynamoValue
+
+func dynamoNumber(n int64) dynamoValue {
+	return dynamoValue{N: strconv.FormatInt(n, 10)}
+}
+
+// key returns the primary key of the item with sequence number seq.
+func (s *DynamoDBStorage) key(seq int64) dynamoItem {
+	return dynamoItem{"namespace": {S: s.Namespace}, "seq": dynamoNumber(seq)}
+}
+
+// dynamoError is an error response of DynamoDB.
+type dynamoError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *dynamoError) Error() string {
+	name := e.Type[strings.LastIndex(e.Type, "#")+1:]
+	return fmt.Sprintf("DynamoDB: %s: %s", name, e.Message)
+}
+
+// call sends a DynamoDB API request and decodes its response into out.
+func (s *DynamoDBStorage) call(ctx context.Context, op string, in, out any) error {
+	creds, err := resolveAWSCredentials(ctx, awsCredentials{s.AccessKeyID, s.SecretAccessKey, s.SessionToken}, s.Container)
+	if err != nil {
+		return fmt.Errorf("DynamoDB: %w", err)
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://dynamodb." + s.Region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	sum := sha256.Sum256(body)
+	creds.sign(req, now().UTC(), s.Region, "dynamodb", hex.EncodeToString(sum[:]))
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		de := &dynamoError{}
+		if json.Unmarshal(b, de) != nil || de.Type == "" {
+			return fmt.Errorf("DynamoDB %s: %s", op, resp.Status)
+		}
+		return de
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// last returns the sequence number of the latest line, 0 if none was ever
+// stored.
+func (s *DynamoDBStorage) last(ctx context.Context) (int64, error) {
+	var out struct {
+		Item dynamoItem
+	}
+	err := s.call(ctx, "GetItem", map[string]any{
+		"TableName":      s.Table,
+		"Key":            s.key(0),
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil || out.Item == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(out.Item["last"].N, 10, 64)
+}
+
+// Append implements Storage.
+func (s *DynamoDBStorage) Append(lines []string) error {
+	sealed := make([]string, len(lines))
+	for i, l := range lines {
+		var err error
+		if sealed[i], err = s.Cipher.Seal(l); err != nil {
+			return err
+		}
+	}
+	return s.appendSealed(sealed)
+}
+
+// appendSealed appends lines in transactions of up to dynamoMaxTransact
+// items, each also moving the latest pointer on if nobody else moved it.
+func (s *DynamoDBStorage) appendSealed(lines []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	last, err := s.last(ctx)
+	if err != nil {
+		return err
+	}
+	for len(lines) > 0 {
+		chunk := lines
+		if len(chunk) > dynamoMaxTransact-1 {
+			chunk = chunk[:dynamoMaxTransact-1]
+		}
+		lines = lines[len(chunk):]
+
+		pointer := map[string]any{
+			"TableName":                 s.Table,
+			"Key":                       s.key(0),
+			"UpdateExpression":          "SET #last = :next",
+			"ConditionExpression":       "attribute_not_exists(#last) OR #last = :last",
+			"ExpressionAttributeNames":  map[string]string{"#last": "last"},
+			"ExpressionAttributeValues": dynamoItem{":next": dynamoNumber(last + int64(len(chunk))), ":last": dynamoNumber(last)},
+		}
+		if last == 0 {
+			pointer["ConditionExpression"] = "attribute_not_exists(#last)"
+			delete(pointer["ExpressionAttributeValues"].(dynamoItem), ":last")
+		}
+		items := []map[string]any{{"Update": pointer}}
+		for _, l := range chunk {
+			last++
+			item := s.key(last)
+			item["line"] = dynamoValue{S: l}
+			items = append(items, map[string]any{"Put": map[string]any{"TableName": s.Table, "Item": item}})
+		}
+		err := s.call(ctx, "TransactWriteItems", map[string]any{"TransactItems": items}, nil)
+		var de *dynamoError
+		if errors.As(err, &de) && strings.HasSuffix(de.Type, "TransactionCanceledException") {
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query returns the items of the namespace with a sequence number of at
+// least 1 and at most upTo, newest first, stopping after limit items if
+// limit is positive. If unpruned is set, only the sequence numbers of items
+// without an expiry are returned.
+func (s *DynamoDBStorage) query(ctx context.Context, upTo int64, limit int, unpruned bool) ([]dynamoItem, error) {
+	names := map[string]string{"#ns": "namespace", "#seq": "seq"}
+	in := map[string]any{
+		"TableName":                s.Table,
+		"KeyConditionExpression":   "#ns = :ns AND #seq BETWEEN :first AND :upTo",
+		"ExpressionAttributeNames": names,
+		"ExpressionAttributeValues": dynamoItem{
+			":ns":    {S: s.Namespace},
+			":first": dynamoNumber(1),
+			":upTo":  dynamoNumber(upTo),
+		},
+		"ScanIndexForward": false,
+		"ConsistentRead":   true,
+	}
+	if unpruned {
+		names["#expires"] = "expires"
+		in["FilterExpression"] = "attribute_not_exists(#expires)"
+		in["ProjectionExpression"] = "#seq"
+	}
+	var items []dynamoItem
+	for {
+		if limit > 0 {
+			in["Limit"] = limit - len(items)
+		}
+		var out struct {
+			Items            []dynamoItem
+			LastEvaluatedKey dynamoItem
+		}
+		if err := s.call(ctx, "Query", in, &out); err != nil {
+			return nil, err
+		}
+		items = append(items, out.Items...)
+		if out.LastEvaluatedKey == nil || limit > 0 && len(items) >= limit {
+			return items, nil
+		}
+		in["ExclusiveStartKey"] = out.LastEvaluatedKey
+	}
+}
+
+// Latest implements Storage.
+func (s *DynamoDBStorage) Latest(n int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	last, err := s.last(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if last == 0 {
+		return nil, fmt.Errorf("DynamoDB table %s: %w", s.Table, fs.ErrNotExist)
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	items, err := s.query(ctx, last, n, false)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(items))
+	for i, item := range items {
+		line, err := s.Cipher.Open(item["line"].S)
+		if err != nil {
+			return nil, fmt.Errorf("DynamoDB table %s: %w", s.Table, err)
+		}
+		lines[len(items)-1-i] = line
+	}
+	return lines, nil
+}
+
+// Prune implements Storage. Lines before the latest keep are marked to
+// expire now and deleted by DynamoDB's time to live in the background.
+func (s *DynamoDBStorage) Prune(keep int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	last, err := s.last(ctx)
+	if err != nil || last <= int64(keep) {
+		return err
+	}
+	items, err := s.query(ctx, last-int64(keep), 0, true)
+	if err != nil {
+		return err
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	expires := dynamoNumber(now().Unix())
+	for _, item := range items {
+		seq, err := strconv.ParseInt(item["seq"].N, 10, 64)
+		if err != nil {
+			return err
+		}
+		err = s.call(ctx, "UpdateItem", map[string]any{
+			"TableName":                 s.Table,
+			"Key":                       s.key(seq),
+			"UpdateExpression":          "SET #expires = :expires",
+			"ExpressionAttributeNames":  map[string]string{"#expires": "expires"},
+			"ExpressionAttributeValues": dynamoItem{":expires": expires},
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadRegistry implements RegistryStorage.
+func (s *DynamoDBStorage) LoadRegistry() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	var out struct {
+		Item dynamoItem
+	}
+	err := s.call(ctx, "GetItem", map[string]any{
+		"TableName":      s.Table,
+		"Key":            s.key(dynamoRegistrySeq),
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	registry, _, err := s.Cipher.openLine(sealRegistry, out.Item["registry"].S)
+	if err != nil {
+		return nil, fmt.Errorf("DynamoDB table %s: %w", s.Table, err)
+	}
+	return []byte(registry), nil
+}
+
+// SaveRegistry implements RegistryStorage.
+func (s *DynamoDBStorage) SaveRegistry(b []byte) error {
+	sealed, err := s.Cipher.sealLine(sealRegistry, "", string(b))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	item := s.key(dynamoRegistrySeq)
+	item["registry"] = dynamoValue{S: sealed}
+	return s.call(ctx, "PutItem", map[string]any{"TableName": s.Table, "Item": item}, nil)
+}
+
+// Close implements Storage.
+func (s *DynamoDBStorage) Close() error {
+	return nil
+}
+
+// Migrate copies the lines of a legacy accepted file into the namespace if
+// it is still empty, returning the number of lines copied. Lines are copied
+// as stored, so the file must be encrypted with the same StateCipher as the
+// storage, if any. A missing file is not an error.
+func (s *DynamoDBStorage) Migrate(filename string) (int, error) {
+	if _, err := s.Latest(0); !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	lines, err := ReadLegacyLines(filename)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.appendSealed(lines); err != nil {
+		return 0, fmt.Errorf("migrating %s: %w", filename, err)
+	}
+	return len(lines), nil
+}
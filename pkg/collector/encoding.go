@@ -0,0 +1,450 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Encodings of the records the collector serves and streams. The Go types of
+// the records, such as Provenance, StreamEvent and MonitorStatus, are the
+// canonical model: their json tags name the fields in JSON and CBOR, and
+// their proto tags number them in protobuf, as described by collector.proto.
+const (
+	EncodingJSON     = "json"
+	EncodingCBOR     = "cbor"
+	EncodingProtobuf = "protobuf"
+)
+
+// Media types of the encodings.
+const (
+	mediaJSON     = "application/json"
+	mediaCBOR     = "application/cbor"
+	mediaProtobuf = "application/x-protobuf"
+)
+
+// ValidEncoding returns an error if encoding is not an encoding of records.
+func ValidEncoding(encoding string) error {
+	switch encoding {
+	case EncodingJSON, EncodingCBOR, EncodingProtobuf:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q, expected json, cbor or protobuf", encoding)
+}
+
+// Marshal encodes a record, or a slice of records, in the given encoding.
+// In protobuf, a slice is encoded as a message whose field 1 repeats the
+// records.
+func Marshal(encoding string, v any) ([]byte, error) {
+	switch encoding {
+	case EncodingJSON:
+		return json.Marshal(v)
+	case EncodingCBOR:
+		return appendCBOR(nil, reflect.ValueOf(v))
+	case EncodingProtobuf:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Slice {
+			var b []byte
+			for i := 0; i < rv.Len(); i++ {
+				m, err := appendProtoMessage(nil, rv.Index(i))
+				if err != nil {
+					return nil, err
+				}
+				b = protowire.AppendTag(b, 1, protowire.BytesType)
+				b = protowire.AppendBytes(b, m)
+			}
+			return b, nil
+		}
+		return appendProtoMessage(nil, rv)
+	}
+	return nil, ValidEncoding(encoding)
+}
+
+// negotiateEncoding returns the encoding of the first media type of the
+// request's Accept header the collector supports, JSON by default.
+func negotiateEncoding(r *http.Request) (string, string) {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case mediaJSON, "application/*", "*/*":
+			return EncodingJSON, mediaJSON
+		case mediaCBOR:
+			return EncodingCBOR, mediaCBOR
+		case mediaProtobuf, "application/protobuf":
+			return EncodingProtobuf, mediaProtobuf
+		}
+	}
+	return EncodingJSON, mediaJSON
+}
+
+// writeEncoded writes v in the encoding negotiated with the client. The
+// response carries an ETag derived from its body, and a client that already
+// has the same representation is answered with 304 Not Modified.
+func writeEncoded(w http.ResponseWriter, r *http.Request, v any) {
+	encoding, media := negotiateEncoding(r)
+	w.Header().Add("Vary", "Accept")
+	var b []byte
+	var err error
+	if encoding == EncodingJSON {
+		if b, err = json.MarshalIndent(v, "", "  "); err == nil {
+			b = append(b, '\n')
+		}
+	} else {
+		b, err = Marshal(encoding, v)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", media)
+	w.Write(b)
+}
+
+// etagMatch reports whether an If-None-Match header matches etag, using the
+// weak comparison of RFC 9110.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// structField is an exported field of a record with its names.
+type structField struct {
+	index     int
+	name      string
+	omitEmpty bool
+	number    protowire.Number
+}
+
+// structFields returns the fields of a record type that have a json tag.
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("json")
+		if !ok || tag == "-" || !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		sf := structField{index: i, name: name, omitEmpty: strings.Contains(opts, "omitempty")}
+		if n, err := strconv.Atoi(f.Tag.Get("proto")); err == nil {
+			sf.number = protowire.Number(n)
+		}
+		fields = append(fields, sf)
+	}
+	return fields
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// appendCBORHead appends the head of a CBOR data item of the given major
+// type and argument.
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
+
+// appendCBOR appends the CBOR encoding of v. Records are encoded as maps
+// keyed by their JSON field names, in field order, and times as RFC 3339
+// strings tagged 0.
+func appendCBOR(b []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0xf6), nil
+		}
+		return appendCBOR(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 0xf5), nil
+		}
+		return append(b, 0xf4), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n < 0 {
+			return appendCBORHead(b, 1, uint64(-1-n)), nil
+		}
+		return appendCBORHead(b, 0, uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendCBORHead(b, 0, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return append(appendCBORHead(b, 3, uint64(v.Len())), v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(appendCBORHead(b, 2, uint64(v.Len())), v.Bytes()...), nil
+		}
+		b = appendCBORHead(b, 4, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = appendCBOR(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		if v.Type() == timeType {
+			s := v.Interface().(time.Time).UTC().Format(time.RFC3339Nano)
+			return append(appendCBORHead(appendCBORHead(b, 6, 0), 3, uint64(len(s))), s...), nil
+		}
+		var entries []byte
+		n := 0
+		for _, f := range structFields(v.Type()) {
+			fv := v.Field(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			entries = appendCBORHead(entries, 3, uint64(len(f.name)))
+			entries = append(entries, f.name...)
+			var err error
+			if entries, err = appendCBOR(entries, fv); err != nil {
+				return nil, err
+			}
+			n++
+		}
+		return append(appendCBORHead(b, 5, uint64(n)), entries...), nil
+	}
+	return nil, fmt.Errorf("cannot encode %s in CBOR", v.Type())
+}
+
+// appendProtoMessage appends the protobuf encoding of a record. Fields
+// without a proto tag and fields with their zero value are left out, times
+// are encoded as google.protobuf.Timestamp messages.
+func appendProtoMessage(b []byte, v reflect.Value) ([]byte, error) {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return b, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot encode %s as a protobuf message", v.Type())
+	}
+	for _, f := range structFields(v.Type()) {
+		if f.number == 0 {
+			continue
+		}
+		var err error
+		if b, err = appendProtoField(b, f.number, v.Field(f.index)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendProtoField(b []byte, num protowire.Number, v reflect.Value) ([]byte, error) {
+	if v.IsZero() {
+		return b, nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		return appendProtoField(b, num, v.Elem())
+	case reflect.Bool:
+		return protowire.AppendVarint(protowire.AppendTag(b, num, protowire.VarintType), 1), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return protowire.AppendVarint(protowire.AppendTag(b, num, protowire.VarintType), uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return protowire.AppendVarint(protowire.AppendTag(b, num, protowire.VarintType), v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return protowire.AppendFixed64(protowire.AppendTag(b, num, protowire.Fixed64Type), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return protowire.AppendString(protowire.AppendTag(b, num, protowire.BytesType), v.String()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return protowire.AppendBytes(protowire.AppendTag(b, num, protowire.BytesType), v.Bytes()), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			m, err := appendProtoMessage(nil, v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			b = protowire.AppendBytes(protowire.AppendTag(b, num, protowire.BytesType), m)
+		}
+		return b, nil
+	case reflect.Struct:
+		var m []byte
+		if v.Type() == timeType {
+			t := v.Interface().(time.Time)
+			m = protowire.AppendVarint(protowire.AppendTag(m, 1, protowire.VarintType), uint64(t.Unix()))
+			if t.Nanosecond() != 0 {
+				m = protowire.AppendVarint(protowire.AppendTag(m, 2, protowire.VarintType), uint64(t.Nanosecond()))
+			}
+		} else {
+			var err error
+			if m, err = appendProtoMessage(nil, v); err != nil {
+				return nil, err
+			}
+		}
+		return protowire.AppendBytes(protowire.AppendTag(b, num, protowire.BytesType), m), nil
+	}
+	return nil, fmt.Errorf("cannot encode %s in protobuf", v.Type())
+}
+
+// unmarshalProto decodes the protobuf encoding of a record into the struct v
+// points to. Unknown fields are skipped, so that records written by newer
+// versions can be read.
+func unmarshalProto(b []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cannot decode protobuf into %T", v)
+	}
+	return consumeProtoMessage(b, rv.Elem())
+}
+
+func consumeProtoMessage(b []byte, v reflect.Value) error {
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode a protobuf message into %s", v.Type())
+	}
+	fields := make(map[protowire.Number]int)
+	for _, f := range structFields(v.Type()) {
+		if f.number != 0 {
+			fields[f.number] = f.index
+		}
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		i, known := fields[num]
+		if !known {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		var err error
+		if b, err = consumeProtoField(b, typ, v.Field(i)); err != nil {
+			return fmt.Errorf("field %d: %w", num, err)
+		}
+	}
+	return nil
+}
+
+func consumeProtoField(b []byte, typ protowire.Type, v reflect.Value) ([]byte, error) {
+	switch {
+	case typ == protowire.VarintType:
+		x, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(x != 0)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(int64(x))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(x)
+		default:
+			return nil, fmt.Errorf("unexpected varint for %s", v.Type())
+		}
+		return b[n:], nil
+	case typ == protowire.Fixed64Type && (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64):
+		x, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		v.SetFloat(math.Float64frombits(x))
+		return b[n:], nil
+	case typ != protowire.BytesType:
+		return nil, fmt.Errorf("unexpected wire type %d for %s", typ, v.Type())
+	}
+
+	m, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	return b[n:], setProtoBytes(m, v)
+}
+
+// setProtoBytes sets v from the value of a length-delimited field.
+func setProtoBytes(m []byte, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(m))
+	case reflect.Pointer:
+		e := reflect.New(v.Type().Elem())
+		if err := setProtoBytes(m, e.Elem()); err != nil {
+			return err
+		}
+		v.Set(e)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), m...))
+			break
+		}
+		e := reflect.New(v.Type().Elem()).Elem()
+		if err := consumeProtoMessage(m, e); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, e))
+	case reflect.Struct:
+		if v.Type() != timeType {
+			return consumeProtoMessage(m, v)
+		}
+		var ts struct {
+			Seconds int64 `json:"seconds" proto:"1"`
+			Nanos   int64 `json:"nanos" proto:"2"`
+		}
+		if err := consumeProtoMessage(m, reflect.ValueOf(&ts).Elem()); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(time.Unix(ts.Seconds, ts.Nanos).UTC()))
+	default:
+		return fmt.Errorf("unexpected length-delimited field for %s", v.Type())
+	}
+	return nil
+}
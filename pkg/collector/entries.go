@@ -0,0 +1,118 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+// LogEntry is an entry of a log read from its API.
+type LogEntry struct {
+	Index int64
+	// Body is the canonicalized entry whose leaf hash is in the tree.
+	Body           []byte
+	IntegratedTime int64
+	// Proof is the entry's inclusion proof, if the log returned one. Its
+	// leaf hash is computed from Body rather than taken from the log.
+	Proof *InclusionRequest
+}
+
+// LeafHash returns the RFC 6962 leaf hash of the entry.
+func (e LogEntry) LeafHash() []byte {
+	return rfc6962.DefaultHasher.HashLeaf(e.Body)
+}
+
+// EntrySource reads entries of a log by index.
+type EntrySource interface {
+	Entry(ctx context.Context, index int64) (LogEntry, error)
+}
+
+// RekorEntries reads entries from the Rekor API at URL, such as
+// https://rekor.sigstore.dev.
+type RekorEntries struct {
+	URL    string
+	Client *http.Client
+}
+
+// rekorEntry is an entry as returned by the Rekor API.
+type rekorEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	Verification   struct {
+		InclusionProof *struct {
+			Hashes   []string `json:"hashes"`
+			LogIndex int64    `json:"logIndex"`
+			RootHash string   `json:"rootHash"`
+			TreeSize int64    `json:"treeSize"`
+		} `json:"inclusionProof"`
+	} `json:"verification"`
+}
+
+// Entry implements EntrySource.
+func (r *RekorEntries) Entry(ctx context.Context, index int64) (LogEntry, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	q := url.Values{"logIndex": {fmt.Sprint(index)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.URL, "/")+"/api/v1/log/entries?"+q.Encode(), nil)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return LogEntry{}, fmt.Errorf("fetching entry %d: %s", index, resp.Status)
+	}
+
+	var body map[string]rekorEntry
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return LogEntry{}, fmt.Errorf("decoding entry %d: %w", index, err)
+	}
+	for _, re := range body {
+		e := LogEntry{Index: re.LogIndex, IntegratedTime: re.IntegratedTime}
+		if e.Body, err = base64.StdEncoding.DecodeString(re.Body); err != nil {
+			return LogEntry{}, fmt.Errorf("decoding entry %d: %w", index, err)
+		}
+		if e.Index != index {
+			return LogEntry{}, fmt.Errorf("fetching entry %d: got entry %d", index, e.Index)
+		}
+		if p := re.Verification.InclusionProof; p != nil {
+			e.Proof = &InclusionRequest{
+				LeafHash: hex.EncodeToString(e.LeafHash()),
+				LogIndex: p.LogIndex,
+				TreeSize: p.TreeSize,
+				RootHash: p.RootHash,
+				Hashes:   p.Hashes,
+			}
+		}
+		return e, nil
+	}
+	return LogEntry{}, fmt.Errorf("fetching entry %d: no entry returned", index)
+}
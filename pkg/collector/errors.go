@@ -0,0 +1,141 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Classes of failures. Errors returned by the collector wrap at most one of
+// them, so that automation can branch on errors.Is, ErrorCode or ExitCode
+// rather than on messages.
+var (
+	// ErrNoQuorum is returned when no tree size reached quorum.
+	ErrNoQuorum = errors.New("no quorum")
+	// ErrSignatureInvalid is returned when a checkpoint is unsigned or a
+	// signature does not verify with a known log key.
+	ErrSignatureInvalid = errors.New("invalid signature")
+	// ErrStaleObservation is returned when a monitor reports a tree size
+	// smaller than one it reported before.
+	ErrStaleObservation = errors.New("stale observation")
+	// ErrStorage is returned when reading or writing accepted checkpoints
+	// fails.
+	ErrStorage = errors.New("storage failure")
+	// ErrUntrustedTime is returned when a round holds because no
+	// TrustedTime source answered for longer than TrustedTime.MaxAge.
+	ErrUntrustedTime = errors.New("untrusted time")
+)
+
+// Error codes returned by ErrorCode.
+const (
+	CodeNoQuorum         = "no_quorum"
+	CodeSignatureInvalid = "signature_invalid"
+	CodeStaleObservation = "stale_observation"
+	CodeStorage          = "storage"
+	CodeTimeout          = "timeout"
+	CodeUntrustedTime    = "untrusted_time"
+	CodeInternal         = "internal"
+)
+
+// ErrorCodeHeader is the header of API error responses carrying the
+// ErrorCode of the failure.
+const ErrorCodeHeader = "X-Collector-Error-Code"
+
+// errorClasses maps the classes of failures to their codes and exit codes,
+// most specific first. Exit code 2 is left to usage errors.
+var errorClasses = []struct {
+	err  error
+	code string
+	exit int
+}{
+	{ErrNoQuorum, CodeNoQuorum, 3},
+	{ErrSignatureInvalid, CodeSignatureInvalid, 4},
+	{ErrStaleObservation, CodeStaleObservation, 5},
+	{ErrStorage, CodeStorage, 6},
+	{context.DeadlineExceeded, CodeTimeout, 7},
+	{ErrReadTimeout, CodeTimeout, 7},
+	{ErrUntrustedTime, CodeUntrustedTime, 8},
+}
+
+// ErrorCode returns the machine-readable code of the class of err, or
+// CodeInternal if it has none. It returns "" for a nil error.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
+
+// ExitCode returns the process exit code for err: 0 for nil, 1 for errors
+// without a class and 3 or above per class.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.exit
+		}
+	}
+	return 1
+}
+
+// classError is an error of a class of failures, keeping the message and
+// chain of the underlying error.
+type classError struct {
+	class error
+	err   error
+}
+
+func (e *classError) Error() string        { return e.err.Error() }
+func (e *classError) Unwrap() error        { return e.err }
+func (e *classError) Is(target error) bool { return target == e.class }
+
+// withClass marks err as of the given class. It returns nil for a nil err.
+func withClass(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classError{class: class, err: err}
+}
+
+// noQuorumError describes a round of origin in which no tree size reached
+// quorum.
+func noQuorumError(origin string, quorum int) error {
+	return withClass(ErrNoQuorum, errors.New(noQuorumMessage(origin, quorum)))
+}
+
+// coded formats err for the log followed by its ErrorCode.
+func coded(err error) string {
+	return fmt.Sprintf("%v (code=%s)", err, ErrorCode(err))
+}
+
+// writeError writes err as an HTTP error response, with its ErrorCode in
+// ErrorCodeHeader. Client errors without a class carry no code.
+func writeError(w http.ResponseWriter, err error, status int) {
+	if code := ErrorCode(err); code != CodeInternal || status >= http.StatusInternalServerError {
+		w.Header().Set(ErrorCodeHeader, code)
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,133 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"time"
+)
+
+// MonitorObservation is the latest checkpoint read from a monitor in a round.
+type MonitorObservation struct {
+	Monitor   string
+	Origin    string
+	TreeSize  int64
+	Timestamp int64
+	// Agrees reports whether the monitor saw the accepted tree size.
+	Agrees bool
+}
+
+// RoundReport describes a collection round.
+type RoundReport struct {
+	Round     string
+	Namespace string
+	Time      time.Time
+	Quorum    int
+	// Accepted is the accepted checkpoint, or nil if no tree size reached
+	// quorum.
+	Accepted *Checkpoint
+	// Degraded is set if Accepted did not reach quorum, see
+	// QuorumDegrade.
+	Degraded bool
+	// Resolution is the rule that selected Accepted among several tree
+	// sizes that reached quorum, empty if only one did.
+	Resolution   string
+	Observations []MonitorObservation
+	// Conflicts lists the tree sizes monitors read different root hashes
+	// for.
+	Conflicts []Conflict
+	// Sampling describes how the monitors of the round were chosen, nil
+	// if every monitor was read.
+	Sampling *SampleReport
+	// Urgent is set for rounds run right away on a conflict hint.
+	Urgent bool
+	// Peers are the latest checkpoints attested by peer collectors, with
+	// Monitor naming the peer.
+	Peers []MonitorObservation
+}
+
+// Exporter writes round reports to an external system, such as a time
+// series database.
+type Exporter interface {
+	Export(ctx context.Context, r RoundReport) error
+}
+
+// roundReport builds the report of a round from the checkpoints read from
+// each monitor.
+func (c *Collector) roundReport(round string, monitors []string, observations [][]string, conflicts []Conflict, accepted *Checkpoint, rule string, degraded bool, sample *SampleReport, urgent bool) RoundReport {
+	r := RoundReport{Round: round, Namespace: c.cfg.Namespace, Time: c.now().UTC(), Quorum: c.cfg.Quorum, Accepted: accepted, Degraded: degraded, Resolution: rule, Conflicts: conflicts, Sampling: sample, Urgent: urgent}
+	r.Observations = observationsOf(monitors, observations, accepted)
+	return r
+}
+
+// withPeers adds the checkpoints attested by peers to a round report.
+func withPeers(r RoundReport, peers []string, observations [][]string) RoundReport {
+	r.Peers = observationsOf(peers, observations, r.Accepted)
+	return r
+}
+
+// observationsOf returns the latest checkpoint read from each monitor, and
+// whether it read the accepted one.
+func observationsOf(monitors []string, observations [][]string, accepted *Checkpoint) []MonitorObservation {
+	var obs []MonitorObservation
+	for i, chpts := range observations {
+		var latest *Checkpoint
+		agrees := false
+		for _, line := range chpts {
+			chpt, err := ParseCheckpoint(line)
+			if err != nil {
+				continue
+			}
+			if latest == nil || chpt.Size > latest.Size {
+				latest = &chpt
+			}
+			if accepted != nil && chpt.Key() == accepted.Key() {
+				agrees = true
+			}
+		}
+		if latest == nil {
+			continue
+		}
+		obs = append(obs, MonitorObservation{
+			Monitor:   monitors[i],
+			Origin:    latest.Origin,
+			TreeSize:  latest.Size,
+			Timestamp: latest.Timestamp,
+			Agrees:    agrees,
+		})
+	}
+	return obs
+}
+
+// export sends the report of a round to every exporter and to the report
+// archive. Failures are logged so that an unavailable database does not stop
+// collection.
+func (c *Collector) export(ctx context.Context, r RoundReport) {
+	exporters := c.cfg.Exporters
+	if c.cfg.Reports != nil {
+		exporters = append(exporters[:len(exporters):len(exporters)], c.cfg.Reports)
+	}
+	if len(exporters) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Export)
+	defer cancel()
+	for _, e := range exporters {
+		if err := e.Export(ctx, r); err != nil {
+			c.logf("Exporting round %s: %v\n", r.Round, err)
+		}
+	}
+}
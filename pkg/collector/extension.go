@@ -0,0 +1,188 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Extension policy actions, see ExtensionRule.
+const (
+	ExtensionRequire  = "require"
+	ExtensionValidate = "validate"
+	ExtensionReject   = "reject"
+	ExtensionStrip    = "strip"
+)
+
+// ExtensionRule is a rule of the extension policy applied to the checkpoints
+// read from monitors. It concerns the extension lines, between the root
+// hash and the signatures, whose key, the text before the first colon, is
+// Key. ExtensionRequire needs at least one such line, ExtensionReject none,
+// and ExtensionValidate checks those present. If Pattern is set, the value
+// after the colon of every such line must match it. ExtensionStrip removes
+// the lines from the collector's cosigned note, see Strip. Accepted
+// checkpoints are stored with them, as signed by the log.
+type ExtensionRule struct {
+	Action  string
+	Key     string
+	Pattern *regexp.Regexp
+}
+
+// ExtensionPolicy is the set of rules every checkpoint read from a monitor
+// must satisfy. Checkpoints violating it are left out of the round.
+type ExtensionPolicy []ExtensionRule
+
+// ParseExtensionRule parses a rule given as "<action>:<key>" or, for
+// ExtensionRequire and ExtensionValidate, "<action>:<key>=<pattern>", such
+// as "require:Shard=^[0-9]+$".
+func ParseExtensionRule(spec string) (ExtensionRule, error) {
+	action, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return ExtensionRule{}, fmt.Errorf("malformed extension rule %q, expected <action>:<key>[=<pattern>]", spec)
+	}
+	key, pattern, hasPattern := strings.Cut(rest, "=")
+	r := ExtensionRule{Action: action, Key: strings.TrimSpace(key)}
+	if r.Key == "" {
+		return ExtensionRule{}, fmt.Errorf("extension rule %q has no key", spec)
+	}
+	switch action {
+	case ExtensionRequire, ExtensionValidate:
+	case ExtensionReject, ExtensionStrip:
+		if hasPattern {
+			return ExtensionRule{}, fmt.Errorf("extension rule %q: %s takes no pattern", spec, action)
+		}
+	default:
+		return ExtensionRule{}, fmt.Errorf("extension rule %q: unknown action %q, expected %s, %s, %s or %s", spec, action, ExtensionRequire, ExtensionValidate, ExtensionReject, ExtensionStrip)
+	}
+	if action == ExtensionValidate && !hasPattern {
+		return ExtensionRule{}, fmt.Errorf("extension rule %q: %s needs a pattern", spec, action)
+	}
+	if hasPattern {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return ExtensionRule{}, fmt.Errorf("extension rule %q: %w", spec, err)
+		}
+		r.Pattern = re
+	}
+	return r, nil
+}
+
+// extensionKey returns the key and the value of an extension line.
+func extensionKey(line string) (string, string) {
+	key, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.TrimSpace(key), strings.TrimSpace(value)
+}
+
+// extensionLines splits a flattened checkpoint into its fields and returns
+// the end of its extension lines, which start at the fourth field and end
+// at the blank line before the signatures.
+func extensionLines(line string) ([]string, int) {
+	fields := strings.Split(line, lineSeparator)
+	if len(fields) < 3 {
+		return fields, len(fields)
+	}
+	end := 3
+	for end < len(fields) && strings.TrimSpace(fields[end]) != "" {
+		end++
+	}
+	return fields, end
+}
+
+// Check checks a flattened checkpoint against the policy.
+func (p ExtensionPolicy) Check(line string) error {
+	fields, end := extensionLines(line)
+	for _, r := range p {
+		n := 0
+		for i := 3; i < end; i++ {
+			key, value := extensionKey(fields[i])
+			if key != r.Key {
+				continue
+			}
+			n++
+			if r.Pattern != nil && !r.Pattern.MatchString(value) {
+				return fmt.Errorf("extension %s value %q does not match %s", r.Key, value, r.Pattern)
+			}
+		}
+		switch {
+		case r.Action == ExtensionRequire && n == 0:
+			return fmt.Errorf("missing required extension %s", r.Key)
+		case r.Action == ExtensionReject && n > 0:
+			return fmt.Errorf("rejected extension %s", r.Key)
+		}
+	}
+	return nil
+}
+
+// Strip returns a flattened checkpoint with the extension lines of
+// ExtensionStrip rules removed. The log's signatures cover those lines, so
+// they are dropped from a checkpoint that had any and the result must be
+// signed again, like the result of ExtendNote. Other checkpoints are
+// returned unchanged.
+func (p ExtensionPolicy) Strip(line string) string {
+	fields, end := extensionLines(line)
+	var kept []string
+	stripped := false
+	for i, f := range fields[:end] {
+		if i >= 3 && p.strips(f) {
+			stripped = true
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if !stripped {
+		return line
+	}
+	return strings.Join(append(kept, "", ""), lineSeparator)
+}
+
+// strips reports whether an ExtensionStrip rule removes an extension line.
+func (p ExtensionPolicy) strips(line string) bool {
+	key, _ := extensionKey(line)
+	for _, r := range p {
+		if r.Action == ExtensionStrip && r.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// filter checks the checkpoints read from a monitor against the policy. It
+// returns those satisfying it, unchanged, and an error describing the first
+// violation.
+func (p ExtensionPolicy) filter(chpts []string) ([]string, error) {
+	if len(p) == 0 {
+		return chpts, nil
+	}
+	kept := make([]string, 0, len(chpts))
+	var first error
+	violations := 0
+	for _, line := range chpts {
+		if err := p.Check(line); err != nil {
+			violations++
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if first != nil {
+		return kept, fmt.Errorf("%d of %d checkpoints violate the extension policy, e.g. %w", violations, len(chpts), first)
+	}
+	return kept, nil
+}
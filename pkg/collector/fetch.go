@@ -0,0 +1,158 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fetcher reads the latest checkpoints of monitor logfiles with a URI
+// scheme, such as "https" or "ssh". Logfiles without a scheme are local
+// paths, read by the "file" fetcher.
+type Fetcher interface {
+	// Fetch returns the latest n checkpoints of logfile. maxSize, if
+	// positive, is the size above which the logfile is rejected with
+	// ErrFileTooLarge. Fetch returns once ctx is done.
+	Fetch(ctx context.Context, logfile string, n int, maxSize int64) ([]string, error)
+}
+
+// logfileScheme returns the URI scheme of a monitor logfile, or "file" for
+// paths.
+func logfileScheme(logfile string) string {
+	i := strings.Index(logfile, "://")
+	if i <= 0 || strings.ContainsAny(logfile[:i], `/\`) {
+		return "file"
+	}
+	return strings.ToLower(logfile[:i])
+}
+
+// ErrOffline is returned for monitor logfiles that can only be read over the
+// network when Config.Offline is set.
+var ErrOffline = errors.New("network access is disabled in offline mode")
+
+// fetchers returns the fetchers of a collector by scheme: the built-in ones
+// overridden or extended by Config.Fetchers. In offline mode only local
+// files are read.
+func (c *Collector) fetchers() map[string]Fetcher {
+	if c.cfg.Offline {
+		f := map[string]Fetcher{"file": fileFetcher{}}
+		for scheme, fetcher := range c.cfg.Fetchers {
+			f[scheme] = fetcher
+		}
+		return f
+	}
+	client := c.cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s3 := S3FetcherFromEnv()
+	s3.Client = client
+	f := map[string]Fetcher{
+		"file":   fileFetcher{},
+		"http":   httpFetcher{client: client},
+		"https":  httpFetcher{client: client},
+		"s3":     s3,
+		"spiffe": &c.inbox,
+	}
+	if c.ssh != nil {
+		f["ssh"] = c.ssh
+	}
+	for scheme, fetcher := range c.cfg.Fetchers {
+		f[scheme] = fetcher
+	}
+	return f
+}
+
+// fetcher returns the fetcher for a monitor logfile.
+func (c *Collector) fetcher(logfile string) (Fetcher, error) {
+	scheme := logfileScheme(logfile)
+	if f, ok := c.fetch[scheme]; ok {
+		return f, nil
+	}
+	if c.cfg.Offline {
+		return nil, fmt.Errorf("reading %s: %w", logfile, ErrOffline)
+	}
+	if scheme == "ssh" {
+		return nil, fmt.Errorf("reading %s: SSH is not configured", logfile)
+	}
+	return nil, fmt.Errorf("reading %s: no fetcher for scheme %q", logfile, scheme)
+}
+
+// isLocal reports whether a monitor logfile is a path rather than a URI.
+func isLocal(logfile string) bool {
+	return logfileScheme(logfile) == "file" && !strings.HasPrefix(logfile, "file://")
+}
+
+// fileFetcher reads local logfiles, given as paths or file:// URLs.
+type fileFetcher struct{}
+
+// Fetch implements Fetcher. A read that outlasts ctx is abandoned; its
+// goroutine finishes in the background.
+func (fileFetcher) Fetch(ctx context.Context, logfile string, n int, maxSize int64) ([]string, error) {
+	if strings.HasPrefix(logfile, "file://") {
+		u, err := url.Parse(logfile)
+		if err != nil {
+			return nil, err
+		}
+		logfile = filepath.FromSlash(u.Path)
+	}
+
+	if maxSize > 0 {
+		fi, err := os.Stat(logfile)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() > maxSize {
+			return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrFileTooLarge, fi.Size(), maxSize)
+		}
+	}
+
+	if ctx.Done() == nil {
+		return ReadLatestCheckpoints(logfile, n)
+	}
+	type result struct {
+		chpts []string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		chpts, err := ReadLatestCheckpoints(logfile, n)
+		done <- result{chpts, err}
+	}()
+	select {
+	case r := <-done:
+		return r.chpts, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// httpFetcher reads logfiles served over HTTP(S).
+type httpFetcher struct {
+	client *http.Client
+}
+
+// Fetch implements Fetcher.
+func (f httpFetcher) Fetch(ctx context.Context, logfile string, n int, maxSize int64) ([]string, error) {
+	return readRemoteCheckpoints(ctx, f.client, logfile, n, maxSize)
+}
@@ -0,0 +1,121 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AcceptedAtHeader is the header of API responses carrying the time the
+// collector accepted the checkpoint served, in RFC 3339 format.
+const AcceptedAtHeader = "X-Accepted-At"
+
+// acceptTimes holds the time each checkpoint was last accepted. Its zero
+// value is ready to use.
+type acceptTimes struct {
+	mu sync.Mutex
+	at map[CheckpointKey]time.Time
+}
+
+func (a *acceptTimes) record(k CheckpointKey, t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.at == nil {
+		a.at = make(map[CheckpointKey]time.Time)
+	}
+	if t.After(a.at[k]) {
+		a.at[k] = t
+	}
+}
+
+func (a *acceptTimes) get(k CheckpointKey) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.at[k]
+	return t, ok
+}
+
+// AcceptedAt returns the time the collector last accepted chpt, which it does
+// again every round the log does not grow. It is known for checkpoints
+// accepted since the collector started and, if provenance is recorded, for
+// those with a provenance record.
+func (c *Collector) AcceptedAt(chpt Checkpoint) (time.Time, bool, error) {
+	if t, ok := c.acceptTimes.get(chpt.Key()); ok {
+		return t, true, nil
+	}
+	if c.cfg.ProvenanceFile == "" {
+		return time.Time{}, false, nil
+	}
+	records, err := c.Provenance()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, false, err
+	}
+	for _, r := range records {
+		if r.Origin == chpt.Origin && r.TreeSize == chpt.Size && r.RootHash == chpt.Hash {
+			c.acceptTimes.record(chpt.Key(), r.AcceptedAt)
+		}
+	}
+	t, ok := c.acceptTimes.get(chpt.Key())
+	return t, ok, nil
+}
+
+// LatestAccepted returns the retained accepted checkpoint with the largest
+// tree size of an origin matching origin, or of any origin if it is empty.
+// It reports false if there is none.
+func (c *Collector) LatestAccepted(origin string) (Checkpoint, bool, error) {
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+	var latest Checkpoint
+	found := false
+	for _, l := range lines {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil || (origin != "" && !MatchOrigin(origin, chpt.Origin)) {
+			continue
+		}
+		if !found || chpt.Size >= latest.Size {
+			latest, found = chpt, true
+		}
+	}
+	return latest, found, nil
+}
+
+// tooOld reports whether a checkpoint last accepted at, or at an unknown
+// time if at is nil, is older than the max_age query parameter of r, if set.
+func tooOld(r *http.Request, at *time.Time, now time.Time) bool {
+	n, _ := strconv.Atoi(r.URL.Query().Get("max_age"))
+	if n <= 0 {
+		return false
+	}
+	return at == nil || now.Sub(*at) > time.Duration(n)*time.Second
+}
+
+// setAcceptedAt sets the AcceptedAtHeader of a response serving chpt and
+// returns the time it was last accepted, or nil if unknown.
+func (c *Collector) setAcceptedAt(w http.ResponseWriter, chpt Checkpoint) (*time.Time, error) {
+	at, ok, err := c.AcceptedAt(chpt)
+	if err != nil || !ok {
+		return nil, err
+	}
+	w.Header().Set(AcceptedAtHeader, at.UTC().Format(time.RFC3339))
+	return &at, nil
+}
@@ -0,0 +1,137 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fuzzSeeds are checkpoint lines seeding the fuzz targets: well-formed ones
+// and truncated notes, odd unicode and giant numbers.
+var fuzzSeeds = []string{
+	testCheckpoint(10, 1000),
+	testCheckpoint(0, 0),
+	`rekor.sigstore.dev - 2605736670972794746\n10\nhash10`,
+	`rekor.sigstore.dev - 2605736670972794746\n10`,
+	`rekor.sigstore.dev - 2605736670972794746\n99999999999999999999\nhash\n`,
+	`rekor.sigstore.dev - 2605736670972794746\n-1\nhash\n`,
+	`rekor.sigstore.dev - 2605736670972794746\n+10\nhash10\nTimestamp: -9223372036854775808\n`,
+	"rékor​.sigstore.dev\\n10\\nhash10\\nTimestamp: 1\\n\\n— sig\\n",
+	"\xff\xfe\\n\\n\\n",
+	` \n 10 \r\n hash10 \r\nTimestamp: 12\n\n`,
+}
+
+func FuzzParseCheckpoint(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		c, err := ParseCheckpoint(line)
+		if err != nil {
+			return
+		}
+		if c.Raw != line {
+			t.Errorf("Raw = %q, expected the parsed line %q", c.Raw, line)
+		}
+		if c.Size < 0 {
+			t.Errorf("accepted negative tree size %d", c.Size)
+		}
+		again, err := ParseCheckpoint(c.Raw)
+		if err != nil || again.Key() != c.Key() || again.Timestamp != c.Timestamp {
+			t.Errorf("parsing %q again gave %+v (%v), expected %+v", line, again, err, c)
+		}
+	})
+}
+
+func FuzzReadLastLines(f *testing.F) {
+	f.Add([]byte(testCheckpoint(1, 1)+"\n"+testCheckpoint(2, 2)+"\n"), 1)
+	f.Add([]byte("a\r\nb\n\nc"), 3)
+	f.Add([]byte("\n"), 2)
+	f.Add(bytes.Repeat([]byte("x"), readBlockSize+10), 1)
+	f.Add(append(bytes.Repeat([]byte("y\n"), readBlockSize/2+1), 'z'), 5)
+	f.Fuzz(func(t *testing.T, data []byte, n int) {
+		if n < 0 || n > 100 {
+			return
+		}
+		got, err := readLastLines(bytes.NewReader(data), int64(len(data)), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Reading every line from the start must agree.
+		var want []string
+		if len(data) > 0 {
+			for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+				want = append(want, dropCR([]byte(l)))
+			}
+		}
+		if len(want) > n {
+			want = want[len(want)-n:]
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") || len(got) != len(want) {
+			t.Errorf("readLastLines(%q, %d) = %q, expected %q", data, n, got, want)
+		}
+	})
+}
+
+func FuzzPolicy(f *testing.F) {
+	f.Add(fuzzSeeds[0], fuzzSeeds[0], fuzzSeeds[1], uint8(2), uint8(0))
+	f.Add(testCheckpoint(10, 1)+"\n"+testCheckpoint(11, 2), testCheckpoint(11, 3), testCheckpoint(11, 1)+"\n"+testCheckpoint(11, 1), uint8(2), uint8(1))
+	f.Add(fuzzSeeds[6], fuzzSeeds[7], fuzzSeeds[9], uint8(1), uint8(0))
+	f.Fuzz(func(t *testing.T, a, b, c string, quorum, minNetworks uint8) {
+		var observations [][]string
+		for _, obs := range []string{a, b, c} {
+			observations = append(observations, strings.Split(obs, "\n"))
+		}
+		networks := []string{"net-a", "net-b", "net-a"}
+		p := Policy{Quorum: int(quorum%4) + 1, MinNetworks: int(minNetworks % 3)}
+		candidates, err := p.Candidates(observations, networks)
+		if err != nil {
+			return
+		}
+
+		// Every candidate must be supported by as many distinct monitors as
+		// it has votes, at least a quorum of them.
+		for _, cand := range candidates {
+			votes := 0
+			for _, chpts := range observations {
+				for _, l := range chpts {
+					if parsed, err := ParseCheckpoint(l); err == nil && parsed.Key() == cand.Key() {
+						votes++
+						break
+					}
+				}
+			}
+			if cand.Votes != votes || votes < p.Quorum {
+				t.Errorf("candidate %+v has %d votes from %d monitors with quorum %d", cand.Key(), cand.Votes, votes, p.Quorum)
+			}
+		}
+		if !sort.SliceIsSorted(candidates, func(i, j int) bool { return candidates[i].Size < candidates[j].Size }) {
+			t.Errorf("candidates are not sorted by tree size: %+v", candidates)
+		}
+
+		accepted, ok, err := p.Select(observations, networks)
+		if err != nil || ok != (len(candidates) > 0) {
+			t.Fatalf("Select = %v, %v, expected to agree with %d candidates", ok, err, len(candidates))
+		}
+		if ok && accepted.Key() != Resolve(candidates, ResolveLargest).Key() {
+			t.Errorf("Select accepted %+v, expected the largest candidate", accepted.Key())
+		}
+	})
+}
@@ -0,0 +1,336 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb" // registers google/protobuf/timestamp.proto
+)
+
+// GRPCServiceName is the full name of the collector's gRPC service.
+const GRPCServiceName = "dev.sigstore.rekor.collector.v1.Collector"
+
+// ListProvenanceRequest selects the provenance records listed by the
+// ListProvenance method.
+type ListProvenanceRequest struct {
+	Namespace string `json:"namespace,omitempty" proto:"1"`
+	// Origin is an origin or origin pattern, all origins if empty.
+	Origin string `json:"origin,omitempty" proto:"2"`
+	// TreeSize selects a tree size, all tree sizes if zero.
+	TreeSize int64 `json:"tree_size,omitempty" proto:"3"`
+}
+
+// ListMonitorsRequest selects the tenant whose monitors are listed by the
+// ListMonitors method.
+type ListMonitorsRequest struct {
+	Namespace string `json:"namespace,omitempty" proto:"1"`
+}
+
+// ProvenanceList is the response of the ListProvenance method.
+type ProvenanceList struct {
+	Records []Provenance `json:"records" proto:"1"`
+}
+
+// MonitorStatusList is the response of the ListMonitors method.
+type MonitorStatusList struct {
+	Records []MonitorStatus `json:"records" proto:"1"`
+}
+
+// grpcCodec encodes the collector's records with the same protobuf encoding
+// as Marshal, and generated messages, such as those of the reflection
+// service, with the protobuf runtime.
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	return appendProtoMessage(nil, reflect.ValueOf(v))
+}
+
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	return unmarshalProto(data, v)
+}
+
+func (grpcCodec) Name() string { return "proto" }
+
+// protoFile describes collector.proto. It is registered with the protobuf
+// runtime so that the reflection service can serve it.
+var protoFile protoreflect.FileDescriptor
+
+func init() {
+	fd, err := protodesc.NewFile(collectorProto(), protoregistry.GlobalFiles)
+	if err != nil {
+		panic(fmt.Sprintf("building descriptor of collector.proto: %v", err))
+	}
+	if err := protoregistry.GlobalFiles.RegisterFile(fd); err != nil {
+		panic(fmt.Sprintf("registering collector.proto: %v", err))
+	}
+	protoFile = fd
+}
+
+// collectorProto returns the descriptor of collector.proto. It must be kept
+// in sync with the file.
+func collectorProto() *descriptorpb.FileDescriptorProto {
+	const pkg = ".dev.sigstore.rekor.collector.v1."
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(jsonCamelCase(name)),
+			Number:   proto.Int32(num),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	str := func(name string, num int32) *descriptorpb.FieldDescriptorProto {
+		return field(name, num, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")
+	}
+	i64 := func(name string, num int32) *descriptorpb.FieldDescriptorProto {
+		return field(name, num, descriptorpb.FieldDescriptorProto_TYPE_INT64, "")
+	}
+	boolean := func(name string, num int32) *descriptorpb.FieldDescriptorProto {
+		return field(name, num, descriptorpb.FieldDescriptorProto_TYPE_BOOL, "")
+	}
+	msg := func(name string, num int32, typeName string) *descriptorpb.FieldDescriptorProto {
+		return field(name, num, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, typeName)
+	}
+	ts := func(name string, num int32) *descriptorpb.FieldDescriptorProto {
+		return msg(name, num, ".google.protobuf.Timestamp")
+	}
+	repeated := func(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	method := func(name, in, out string) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String(name),
+			InputType:  proto.String(pkg + in),
+			OutputType: proto.String(pkg + out),
+		}
+	}
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("collector.proto"),
+		Package:    proto.String("dev.sigstore.rekor.collector.v1"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		Syntax:     proto.String("proto3"),
+		Options:    &descriptorpb.FileOptions{GoPackage: proto.String("github.com/sigstore/rekor-monitor/pkg/collector")},
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("Supporter", str("monitor", 1), str("network", 2), str("observation_hash", 3),
+				str("root_hash", 4), i64("timestamp", 5), ts("observed_at", 6)),
+			message("Provenance", str("origin", 1), i64("tree_size", 2), str("root_hash", 3),
+				str("checkpoint", 4), str("round", 5), ts("accepted_at", 6), i64("quorum", 7),
+				repeated(msg("supporters", 8, pkg+"Supporter")), boolean("degraded", 9)),
+			message("StreamEvent", str("namespace", 1), str("origin", 2), i64("tree_size", 3),
+				str("root_hash", 4), i64("timestamp", 5), str("round", 6), ts("accepted_at", 7),
+				str("checkpoint", 8), boolean("degraded", 9)),
+			message("MonitorStatus", str("monitor", 1), str("status", 2), ts("last_heartbeat", 3),
+				i64("tree_size", 4), ts("last_growth", 5), str("state", 6)),
+			message("AcceptedStatus", str("origin", 1), i64("tree_size", 2), str("root_hash", 3),
+				ts("signed_at", 4), str("checkpoint", 5)),
+			message("OpenAlert", str("kind", 1), str("subject", 2)),
+			message("ConflictingRoot", str("root_hash", 1), repeated(str("monitors", 2))),
+			message("RecentConflict", str("origin", 1), i64("tree_size", 2),
+				repeated(msg("root_hashes", 3, pkg+"ConflictingRoot")), ts("detected_at", 4)),
+			message("LogStatus", str("origin", 1), boolean("healthy", 2), msg("accepted", 3, pkg+"AcceptedStatus"),
+				repeated(msg("monitors", 4, pkg+"MonitorStatus")), repeated(msg("alerts", 5, pkg+"OpenAlert")),
+				repeated(msg("conflicts", 6, pkg+"RecentConflict"))),
+			message("ProvenanceList", repeated(msg("records", 1, pkg+"Provenance"))),
+			message("MonitorStatusList", repeated(msg("records", 1, pkg+"MonitorStatus"))),
+			message("ListProvenanceRequest", str("namespace", 1), str("origin", 2), i64("tree_size", 3)),
+			message("ListMonitorsRequest", str("namespace", 1)),
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Collector"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("ListProvenance", "ListProvenanceRequest", "ProvenanceList"),
+				method("ListMonitors", "ListMonitorsRequest", "MonitorStatusList"),
+			},
+		}},
+	}
+}
+
+// jsonCamelCase returns the JSON name protoc derives from a field name.
+func jsonCamelCase(name string) string {
+	var b []byte
+	upper := false
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '_':
+			upper = true
+		case upper && 'a' <= c && c <= 'z':
+			b = append(b, c-'a'+'A')
+			upper = false
+		default:
+			b = append(b, c)
+			upper = false
+		}
+	}
+	return string(b)
+}
+
+// grpcService implements the Collector service for one or more collectors.
+type grpcService struct {
+	cs []*Collector
+}
+
+func (s *grpcService) collector(ctx context.Context, ns string) (*Collector, error) {
+	c := findCollector(s.cs, ns)
+	if c == nil {
+		return nil, status.Errorf(codes.NotFound, "unknown namespace %q", ns)
+	}
+	var auth string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		auth = md.Get("authorization")[0]
+	}
+	if !c.authorized(auth) {
+		return nil, status.Errorf(codes.Unauthenticated, "missing or invalid API token for namespace %q", ns)
+	}
+	return c, nil
+}
+
+func (s *grpcService) listProvenance(ctx context.Context, req *ListProvenanceRequest) (*ProvenanceList, error) {
+	c, err := s.collector(ctx, req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.Provenance()
+	if err != nil {
+		return nil, grpcError(ctx, codes.Unavailable, err)
+	}
+	f := provenanceFilter{origin: req.Origin, size: req.TreeSize}
+	if f.size == 0 {
+		f.size = -1
+	}
+	return &ProvenanceList{Records: f.apply(records)}, nil
+}
+
+func (s *grpcService) listMonitors(ctx context.Context, req *ListMonitorsRequest) (*MonitorStatusList, error) {
+	c, err := s.collector(ctx, req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := c.MonitorStatuses()
+	if err != nil {
+		return nil, grpcError(ctx, codes.Unavailable, err)
+	}
+	return &MonitorStatusList{Records: statuses}, nil
+}
+
+// grpcError returns err as a status with the given code, sending its
+// ErrorCode in the trailer named like ErrorCodeHeader.
+func grpcError(ctx context.Context, code codes.Code, err error) error {
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(strings.ToLower(ErrorCodeHeader), ErrorCode(err)))
+	return status.Error(code, err.Error())
+}
+
+// unaryHandler adapts a method of grpcService to a grpc.MethodDesc handler.
+func unaryHandler[Req, Resp any](name string, fn func(*grpcService, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			s := srv.(*grpcService)
+			if interceptor == nil {
+				return fn(s, ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GRPCServiceName + "/" + name}
+			return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+				return fn(s, ctx, req.(*Req))
+			})
+		},
+	}
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: GRPCServiceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("ListProvenance", (*grpcService).listProvenance),
+		unaryHandler("ListMonitors", (*grpcService).listMonitors),
+	},
+	Metadata: "collector.proto",
+}
+
+// NewGRPCServer returns a gRPC server serving the read API of the given
+// collectors as the Collector service of collector.proto, with server
+// reflection enabled so that tools such as grpcurl can discover it.
+func NewGRPCServer(cs []*Collector, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append([]grpc.ServerOption{grpc.ForceServerCodec(grpcCodec{})}, opts...)...)
+	s.RegisterService(&grpcServiceDesc, &grpcService{cs: cs})
+	reflection.Register(s)
+	return s
+}
+
+// CollectorClient is a client of the collector's gRPC service.
+type CollectorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewCollectorClient returns a client using the connection cc.
+func NewCollectorClient(cc grpc.ClientConnInterface) *CollectorClient {
+	return &CollectorClient{cc: cc}
+}
+
+// ListProvenance lists the provenance of retained accepted checkpoints.
+func (c *CollectorClient) ListProvenance(ctx context.Context, req *ListProvenanceRequest, opts ...grpc.CallOption) ([]Provenance, error) {
+	var resp ProvenanceList
+	if err := c.invoke(ctx, "ListProvenance", req, &resp, opts); err != nil {
+		return nil, err
+	}
+	return resp.Records, nil
+}
+
+// ListMonitors lists the status of every monitor.
+func (c *CollectorClient) ListMonitors(ctx context.Context, req *ListMonitorsRequest, opts ...grpc.CallOption) ([]MonitorStatus, error) {
+	var resp MonitorStatusList
+	if err := c.invoke(ctx, "ListMonitors", req, &resp, opts); err != nil {
+		return nil, err
+	}
+	return resp.Records, nil
+}
+
+func (c *CollectorClient) invoke(ctx context.Context, method string, req, resp any, opts []grpc.CallOption) error {
+	opts = append([]grpc.CallOption{grpc.ForceCodec(grpcCodec{})}, opts...)
+	return c.cc.Invoke(ctx, "/"+GRPCServiceName+"/"+method, req, resp, opts...)
+}
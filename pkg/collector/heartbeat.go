@@ -0,0 +1,206 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Monitor statuses, distinguishing monitors that are down from monitors
+// that are alive but read a log that has not grown.
+const (
+	MonitorAlive = "alive"
+	MonitorIdle  = "idle"
+	MonitorDown  = "down"
+)
+
+// DefaultHeartbeatRounds is the number of collection intervals after which
+// a monitor is considered down or idle unless Config.HeartbeatTimeout is
+// set.
+const DefaultHeartbeatRounds = 3
+
+// MonitorStatus is the liveness of a monitor.
+type MonitorStatus struct {
+	Monitor string `json:"monitor" proto:"1"`
+	Status  string `json:"status" proto:"2"`
+	// LastHeartbeat is the time of the monitor's latest heartbeat, if it
+	// sends them.
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty" proto:"3"`
+	// TreeSize is the largest tree size read from the monitor and
+	// LastGrowth when it was first read.
+	TreeSize   int64      `json:"tree_size,omitempty" proto:"4"`
+	LastGrowth *time.Time `json:"last_growth,omitempty" proto:"5"`
+	// State is the lifecycle state of the monitor if Config.Registry is
+	// set.
+	State string `json:"state,omitempty" proto:"6"`
+}
+
+// growth is the largest tree size read from a monitor.
+type growth struct {
+	size int64
+	at   time.Time
+}
+
+// heartbeats tracks the heartbeats and tree sizes of monitors.
+type heartbeats struct {
+	mu     sync.Mutex
+	beats  map[string]time.Time
+	growth map[string]growth
+}
+
+func (h *heartbeats) beat(monitor string, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.beats == nil {
+		h.beats = make(map[string]time.Time)
+	}
+	h.beats[monitor] = at
+}
+
+// observe records the checkpoints read from a monitor in a round.
+func (h *heartbeats) observe(monitor string, chpts []string, at time.Time) {
+	var size int64
+	for _, l := range chpts {
+		if c, err := ParseCheckpoint(l); err == nil && c.Size > size {
+			size = c.Size
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.growth == nil {
+		h.growth = make(map[string]growth)
+	}
+	if g, ok := h.growth[monitor]; !ok || size > g.size {
+		h.growth[monitor] = growth{size: size, at: at}
+	}
+}
+
+func (h *heartbeats) get(monitor string) (time.Time, growth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.beats[monitor], h.growth[monitor]
+}
+
+// heartbeatTimeout returns the time after which a monitor without a
+// heartbeat is down and a monitor whose tree size has not grown is idle.
+func (c *Collector) heartbeatTimeout() time.Duration {
+	if c.cfg.HeartbeatTimeout > 0 {
+		return c.cfg.HeartbeatTimeout
+	}
+	if c.cfg.AdaptiveInterval.Enabled() && c.cfg.AdaptiveInterval.Max > c.cfg.Interval {
+		return DefaultHeartbeatRounds * c.cfg.AdaptiveInterval.Max
+	}
+	return DefaultHeartbeatRounds * c.cfg.Interval
+}
+
+// MonitorStatuses returns the status of every monitor. A monitor sending
+// heartbeats, by touching its heartbeat file or with HeartbeatHandler, is
+// down if it has not sent one within the heartbeat timeout. Other monitors
+// are down while their last read failed. A monitor that is not down is idle
+// if its tree size has not grown within the timeout.
+func (c *Collector) MonitorStatuses() ([]MonitorStatus, error) {
+	monitors, err := c.Monitors()
+	if err != nil {
+		return nil, err
+	}
+	failures := c.breakers.failureCounts()
+	now := c.now()
+	timeout := c.heartbeatTimeout()
+
+	statuses := make([]MonitorStatus, 0, len(monitors))
+	for _, m := range monitors {
+		beat, g := c.beats.get(m.Logfile)
+		if m.HeartbeatFile != "" {
+			if fi, err := os.Stat(m.HeartbeatFile); err == nil && fi.ModTime().After(beat) {
+				beat = fi.ModTime()
+			}
+		}
+
+		s := MonitorStatus{Monitor: m.Logfile, Status: MonitorAlive, TreeSize: g.size, State: c.monitorState(m.Logfile)}
+		if !beat.IsZero() {
+			s.LastHeartbeat = &beat
+		}
+		if !g.at.IsZero() {
+			s.LastGrowth = &g.at
+		}
+		switch {
+		case m.HeartbeatFile != "" || m.SPIFFEID != "" || !beat.IsZero():
+			if beat.IsZero() || now.Sub(beat) > timeout {
+				s.Status = MonitorDown
+			}
+		case failures[m.Logfile] > 0 || g.at.IsZero():
+			s.Status = MonitorDown
+		}
+		if s.Status == MonitorAlive && (g.at.IsZero() || now.Sub(g.at) > timeout) {
+			s.Status = MonitorIdle
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// Heartbeat records a heartbeat of the monitor with the given SPIFFE ID. It
+// reports false if no monitor of the collector has that ID.
+func (c *Collector) Heartbeat(id string) (bool, error) {
+	monitors, err := c.Monitors()
+	if err != nil {
+		return false, err
+	}
+	for _, m := range monitors {
+		if m.SPIFFEID == id {
+			c.beats.beat(m.Logfile, c.now())
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HeartbeatHandler returns an http.Handler accepting heartbeats POSTed by
+// monitors identified by their X.509-SVID, telling the collector they are
+// alive even if the log has not grown. Like PushHandler, it must be served
+// over TLS requiring client certificates.
+func HeartbeatHandler(cs ...*Collector) http.Handler {
+	return validated(apiOperationByID("heartbeat"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client SVID required", http.StatusUnauthorized)
+			return
+		}
+		id, err := SPIFFEID(r.TLS.PeerCertificates[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		known := false
+		for _, c := range cs {
+			ok, err := c.Heartbeat(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			known = known || ok
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("%s is not a configured monitor", id), http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
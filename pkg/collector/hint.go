@@ -0,0 +1,211 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// maxPendingHints is the number of conflict hints waiting for an urgent
+// round beyond which further hints are dropped.
+const maxPendingHints = 16
+
+// conflictHint is a conflict a monitor reported out of band: checkpoints of
+// the same tree size of a log with different root hashes.
+type conflictHint struct {
+	monitor string
+	chpts   []Checkpoint
+}
+
+// parseConflictHint parses the checkpoints of a conflict hint, which must
+// share their origin and tree size and have at least two root hashes.
+func parseConflictHint(monitor string, lines []string) (conflictHint, error) {
+	h := conflictHint{monitor: monitor}
+	roots := make(map[string]bool)
+	for _, l := range lines {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			return h, err
+		}
+		if len(h.chpts) > 0 && (chpt.Origin != h.chpts[0].Origin || chpt.Size != h.chpts[0].Size) {
+			return h, errors.New("the checkpoints of a conflict hint must have the same origin and tree size")
+		}
+		if !roots[chpt.Hash] {
+			roots[chpt.Hash] = true
+			h.chpts = append(h.chpts, chpt)
+		}
+	}
+	if len(roots) < 2 {
+		return h, errors.New("a conflict hint needs checkpoints with at least two root hashes")
+	}
+	return h, nil
+}
+
+// Hint queues an urgent round for a conflict hint of the monitor with the
+// given SPIFFE ID, checkpoints of the same tree size with different root
+// hashes, one per line. It reports false if no monitor of the collector has
+// that ID.
+func (c *Collector) Hint(id string, lines []string) (bool, error) {
+	monitors, err := c.Monitors()
+	if err != nil {
+		return false, err
+	}
+	monitor := ""
+	for _, m := range monitors {
+		if m.Logfile == id || m.SPIFFEID == id {
+			monitor = m.Logfile
+		}
+	}
+	if monitor == "" {
+		return false, nil
+	}
+	h, err := parseConflictHint(monitor, lines)
+	if err != nil {
+		return true, err
+	}
+	select {
+	case c.hints <- h:
+	default:
+		c.logf("Dropping the conflict hint of monitor %s at tree size %d of %s, %d hints are waiting\n", monitor, h.chpts[0].Size, h.chpts[0].Origin, maxPendingHints)
+	}
+	return true, nil
+}
+
+// runUrgent runs an urgent round for every conflict hint until ctx is
+// cancelled or a round fails. The round reads every monitor without
+// waiting for the schedule, and the hinted checkpoints are then checked
+// against the tree head of the log itself.
+func (c *Collector) runUrgent(ctx context.Context) error {
+	for {
+		var h conflictHint
+		select {
+		case <-ctx.Done():
+			return nil
+		case h = <-c.hints:
+		}
+
+		chpt := h.chpts[0]
+		c.logf("Monitor %s hinted at a conflict at tree size %d of %s, starting an urgent round\n", h.monitor, chpt.Size, chpt.Origin)
+		if _, _, err := c.runRound(ctx, c.scheduledOrigin(chpt.Origin), true); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		c.checkHint(ctx, h)
+	}
+}
+
+// checkHint checks the hinted checkpoints against the tree head of their log,
+// read from Baseline.Source: a checkpoint of the same tree size must have
+// its root hash, and a smaller one must be proven consistent with it by
+// Prover. Checkpoints failing the check are alerted as inconsistent.
+// Failures to read the tree head are logged.
+func (c *Collector) checkHint(ctx context.Context, h conflictHint) {
+	chpt := h.chpts[0]
+	if c.cfg.Baseline.Source == nil || c.cfg.Offline {
+		c.logf("Not checking the conflict hint at tree size %d of %s against the log, no tree head source is configured\n", chpt.Size, chpt.Origin)
+		return
+	}
+	vctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Verify)
+	head, err := c.cfg.Baseline.Source.TreeHead(vctx)
+	cancel()
+	if err != nil {
+		c.logf("Reading the tree head of %s to check a conflict hint: %v\n", chpt.Origin, err)
+		return
+	}
+	if head.Origin != chpt.Origin || head.Size < chpt.Size {
+		c.logf("Not checking the conflict hint at tree size %d of %s against the log, it reports tree size %d of %s\n", chpt.Size, chpt.Origin, head.Size, head.Origin)
+		return
+	}
+	if head.Size > chpt.Size && c.cfg.Prover == nil {
+		c.logf("Not checking the conflict hint at tree size %d of %s against tree size %d of the log, no consistency prover is configured\n", chpt.Size, chpt.Origin, head.Size)
+		return
+	}
+
+	var consistent, inconsistent []string
+	for _, hinted := range h.chpts {
+		var err error
+		switch {
+		case head.Size == hinted.Size && head.Hash != hinted.Hash:
+			err = fmt.Errorf("the log reports root hash %s", head.Hash)
+		case head.Size > hinted.Size:
+			err = c.proveConsistent(ctx, hinted, head)
+		}
+		if err == nil {
+			consistent = append(consistent, hinted.Hash)
+			continue
+		}
+		inconsistent = append(inconsistent, hinted.Hash)
+		c.anoms.record(AnomalyInconsistent, hinted.Origin)
+		c.alert(Alert{
+			Kind:     AnomalyInconsistent,
+			Origin:   hinted.Origin,
+			Size:     head.Size,
+			Previous: hinted.Size,
+			Roots:    []string{head.Hash, hinted.Hash},
+			Monitors: []string{h.monitor},
+			Message:  fmt.Sprintf("root hash %s of tree size %d of %s, hinted at by monitor %s, is not consistent with the tree head of the log at tree size %d: %v", hinted.Hash, hinted.Size, hinted.Origin, h.monitor, head.Size, err),
+		})
+	}
+	sort.Strings(consistent)
+	c.logf("Checked the conflict hint at tree size %d of %s against tree size %d of the log: consistent root hashes [%s], inconsistent [%s]\n", chpt.Size, chpt.Origin, head.Size, strings.Join(consistent, " "), strings.Join(inconsistent, " "))
+}
+
+// ConflictHintHandler returns an http.Handler accepting conflict hints from
+// monitors identified by their X.509-SVID: checkpoints of the same tree
+// size with different root hashes, one per line. Each hint starts an
+// urgent round in the collectors with a monitor of the client's SPIFFE ID
+// and is acknowledged with 202 Accepted. Like PushHandler, it must be
+// served over TLS requiring client certificates.
+func ConflictHintHandler(cs ...*Collector) http.Handler {
+	return validated(apiOperationByID("conflictHint"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client SVID required", http.StatusUnauthorized)
+			return
+		}
+		id, err := SPIFFEID(r.TLS.PeerCertificates[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		lines, err := readPush(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		known := false
+		for _, c := range cs {
+			ok, err := c.Hint(id, lines)
+			if err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+			known = known || ok
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("%s is not a configured monitor", id), http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+}
@@ -0,0 +1,223 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each line of a monitor history file has the form
+//
+//	<RFC 3339 time the checkpoint was first read> <checkpoint>
+//
+// or, if Config.DedupHistory is set, references the checkpoint stored in the
+// note store of the history directory with @<key>, see noteStore.
+
+// Observation is a checkpoint read from a monitor.
+type Observation struct {
+	Time       time.Time
+	Checkpoint string
+}
+
+// history appends the checkpoints read from each monitor to a history file
+// per monitor, skipping those already recorded.
+type history struct {
+	dir string
+	sc  *StateCipher
+	// dedup stores the checkpoints content-addressed in notes.
+	dedup bool
+
+	mu sync.Mutex
+	// last is the last checkpoint recorded for each monitor logfile.
+	last map[string]string
+	// notes is the note store of dir, opened when first needed.
+	notes *noteStore
+	logf  func(format string, args ...any)
+	now   func() time.Time
+}
+
+// openNotes returns the note store of the history directory, opening it
+// when first needed. The caller holds h.mu.
+func (h *history) openNotes() (*noteStore, error) {
+	if h.notes == nil {
+		notes, err := openNoteStore(h.dir, h.sc, h.logf)
+		if err != nil {
+			return nil, fmt.Errorf("opening checkpoint notes: %w", err)
+		}
+		h.notes = notes
+	}
+	return h.notes, nil
+}
+
+// noteStore is openNotes for callers not holding h.mu.
+func (h *history) noteStore() (*noteStore, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.openNotes()
+}
+
+// resolve returns the checkpoint a history entry holds or references. The
+// caller holds h.mu.
+func (h *history) resolve(entry string) (string, error) {
+	if !strings.HasPrefix(entry, noteRefPrefix) {
+		return entry, nil
+	}
+	notes, err := h.openNotes()
+	if err != nil {
+		return "", err
+	}
+	return notes.get(entry)
+}
+
+// HistoryFile returns the name of the history file of a monitor logfile
+// within dir. It includes a hash of the logfile path so that monitors with
+// the same file name in different directories do not collide.
+func HistoryFile(dir, logfile string) string {
+	sum := sha256.Sum256([]byte(logfile))
+	base := strings.TrimSuffix(filepath.Base(logfile), filepath.Ext(logfile))
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.history", base, hex.EncodeToString(sum[:4])))
+}
+
+// record appends the checkpoints in chpts that were not recorded yet.
+// Checkpoints that cannot be parsed are not recorded.
+func (h *history) record(logfile string, chpts []string) error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	filename := HistoryFile(h.dir, logfile)
+	last, ok := h.last[logfile]
+	if !ok {
+		if err := os.MkdirAll(h.dir, 0750); err != nil {
+			return err
+		}
+		lines, err := readLines(filename, sealHistory, 1, h.sc)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if len(lines) == 1 {
+			if o, err := parseObservation(lines[0]); err == nil {
+				if last, err = h.resolve(o.Checkpoint); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	start := 0
+	for i, c := range chpts {
+		if c == last {
+			start = i + 1
+		}
+	}
+	now := h.now().UTC().Format(time.RFC3339Nano)
+	var recorded []string
+	for _, c := range chpts[start:] {
+		if _, err := ParseCheckpoint(c); err != nil {
+			continue
+		}
+		recorded = append(recorded, c)
+		last = c
+	}
+	if h.dedup && len(recorded) > 0 {
+		notes, err := h.openNotes()
+		if err != nil {
+			return err
+		}
+		refs, err := notes.put(recorded)
+		if err != nil {
+			return fmt.Errorf("storing checkpoint notes: %w", err)
+		}
+		recorded = refs
+	}
+	lines := make([]string, len(recorded))
+	for i, c := range recorded {
+		lines[i] = now + " " + c
+	}
+	if len(lines) > 0 {
+		if err := appendLines(filename, sealHistory, lines, h.sc); err != nil {
+			return err
+		}
+	}
+	h.last[logfile] = last
+	return nil
+}
+
+func parseObservation(line string) (Observation, error) {
+	ts, chpt, ok := strings.Cut(line, " ")
+	if !ok {
+		return Observation{}, errors.New("invalid history line")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return Observation{}, err
+	}
+	return Observation{Time: t, Checkpoint: chpt}, nil
+}
+
+// ReadHistory returns every observation recorded in a monitor history file,
+// decrypting it with sc if set. Checkpoints stored content-addressed are
+// read from the note store of the file's directory.
+func ReadHistory(filename string, sc *StateCipher) ([]Observation, error) {
+	return readHistory(filename, sc, nil)
+}
+
+// readHistory is ReadHistory reading stored checkpoints from notes, opened
+// when first needed if nil.
+func readHistory(filename string, sc *StateCipher, notes *noteStore) ([]Observation, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var observations []Observation
+	opener := lineOpener{sc: sc, kind: sealHistory}
+	for i, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if line, err = opener.open(line); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", filename, i+1, err)
+		}
+		o, err := parseObservation(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", filename, i+1, err)
+		}
+		if strings.HasPrefix(o.Checkpoint, noteRefPrefix) {
+			if notes == nil {
+				if notes, err = openNoteStore(filepath.Dir(filename), sc, nil); err != nil {
+					return nil, fmt.Errorf("opening checkpoint notes: %w", err)
+				}
+			}
+			if o.Checkpoint, err = notes.get(o.Checkpoint); err != nil {
+				return nil, fmt.Errorf("%s: line %d: %w", filename, i+1, err)
+			}
+		}
+		observations = append(observations, o)
+	}
+	return observations, nil
+}
@@ -0,0 +1,181 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IdentityWatch scans the entries added to a log between accepted
+// checkpoints for certificates and public keys of watched identities.
+type IdentityWatch struct {
+	// Emails are matched against the email addresses of certificates.
+	Emails []string
+	// SANs are matched against the URI, DNS and email subject alternative
+	// names of certificates, e.g. the workflow URI of a Fulcio certificate.
+	SANs []string
+	// Fingerprints are hex SHA-256 digests of the DER-encoded public keys
+	// of certificates and of bare public keys.
+	Fingerprints []string
+	// Origin, if set, restricts the scan to checkpoints of this log, the
+	// one Entries reads from, matched with MatchOrigin.
+	Origin string
+	// Entries reads the entries that are scanned.
+	Entries EntrySource
+	// Workers is the number of entries read in parallel,
+	// DefaultPipelineWorkers if not positive.
+	Workers int
+}
+
+// IdentityMatch is a watched identity found in a log entry.
+type IdentityMatch struct {
+	Index int64
+	// Kind is "email", "san" or "fingerprint".
+	Kind     string
+	Identity string
+}
+
+// String returns a description of the match for alerts.
+func (m IdentityMatch) String() string {
+	return fmt.Sprintf("watched %s %s found in entry %d", m.Kind, m.Identity, m.Index)
+}
+
+// Match returns the watched identities found in entry.
+func (w *IdentityWatch) Match(entry LogEntry) []IdentityMatch {
+	var matches []IdentityMatch
+	seen := make(map[IdentityMatch]bool)
+	add := func(kind, identity string, watched []string) {
+		for _, id := range watched {
+			m := IdentityMatch{Index: entry.Index, Kind: kind, Identity: identity}
+			if strings.EqualFold(id, identity) && !seen[m] {
+				seen[m] = true
+				matches = append(matches, m)
+			}
+		}
+	}
+	for _, block := range entryPEMBlocks(entry.Body) {
+		var spki []byte
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				continue
+			}
+			spki = cert.RawSubjectPublicKeyInfo
+			for _, e := range cert.EmailAddresses {
+				add("email", e, w.Emails)
+				add("san", e, w.SANs)
+			}
+			for _, u := range cert.URIs {
+				add("san", u.String(), w.SANs)
+			}
+			for _, d := range cert.DNSNames {
+				add("san", d, w.SANs)
+			}
+		case "PUBLIC KEY":
+			spki = block.Bytes
+		default:
+			continue
+		}
+		sum := sha256.Sum256(spki)
+		add("fingerprint", hex.EncodeToString(sum[:]), w.Fingerprints)
+	}
+	return matches
+}
+
+// entryPEMBlocks returns the PEM blocks found in the string values of a JSON
+// entry body, either verbatim or base64 encoded, as Rekor stores the
+// certificates and public keys of most entry kinds.
+func entryPEMBlocks(body []byte) []*pem.Block {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	var blocks []*pem.Block
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(v[k])
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case string:
+			rest := []byte(v)
+			if !strings.Contains(v, "-----BEGIN") {
+				var err error
+				if rest, err = base64.StdEncoding.DecodeString(v); err != nil {
+					return
+				}
+			}
+			for {
+				var block *pem.Block
+				if block, rest = pem.Decode(rest); block == nil {
+					break
+				}
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	walk(v)
+	return blocks
+}
+
+// scanIdentities scans the entries of accepted's log in [from, accepted.Size)
+// for watched identities, alerting on every match. The round waits for the
+// scan. Entries that cannot be read are logged and not retried. The scan is
+// optional and stops when the log API's request budget runs low.
+func (c *Collector) scanIdentities(from int64, accepted Checkpoint) {
+	w := c.cfg.Identities
+	if w == nil || w.Entries == nil || from >= accepted.Size || (w.Origin != "" && !MatchOrigin(w.Origin, accepted.Origin)) {
+		return
+	}
+	report, err := runOptional(Pipeline{Workers: w.Workers}, from, accepted.Size, func(ctx context.Context, index int64) error {
+		entry, err := w.Entries.Entry(ctx, index)
+		if err != nil {
+			return err
+		}
+		for _, m := range w.Match(entry) {
+			c.anoms.record(AnomalyIdentity, accepted.Origin)
+			c.alert(Alert{Kind: AnomalyIdentity, Origin: accepted.Origin, Size: accepted.Size, Message: fmt.Sprintf("%s of %s", m, accepted.Origin)})
+		}
+		return nil
+	})
+	if err != nil {
+		c.logf("Skipping the identity scan of entries %d to %d of %s: %v\n", report.Next, accepted.Size-1, accepted.Origin, err)
+		return
+	}
+	for _, f := range report.Failures {
+		c.logf("Scanning entry %d of %s for identities: %s\n", f.Index, accepted.Origin, f.Error)
+	}
+}
@@ -0,0 +1,184 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+// inclusionVerdictHeader is the first line of a signed inclusion verdict.
+const inclusionVerdictHeader = "rekor-collector inclusion/v1"
+
+// InclusionRequest is an inclusion proof of an entry, as returned by Rekor,
+// to be verified against the collector's accepted checkpoints. Hashes are
+// hex encoded.
+type InclusionRequest struct {
+	// Origin is the origin of the log, any accepted origin if empty.
+	Origin   string   `json:"origin,omitempty"`
+	LeafHash string   `json:"leaf_hash"`
+	LogIndex int64    `json:"log_index"`
+	TreeSize int64    `json:"tree_size"`
+	RootHash string   `json:"root_hash"`
+	Hashes   []string `json:"hashes"`
+}
+
+// InclusionVerdict is the result of verifying an InclusionRequest.
+type InclusionVerdict struct {
+	Included bool `json:"included"`
+	// Reason explains why inclusion could not be verified.
+	Reason string `json:"reason,omitempty"`
+	// Checkpoint is the accepted checkpoint, as a signed note, that the
+	// entry was proven to be included in.
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// Verdict is a note stating the inclusion, signed by the collector's
+	// cosigning key if it has one. Its lines are inclusionVerdictHeader,
+	// the origin, the log index, the base64 leaf hash, and the tree size
+	// and base64 root hash of Checkpoint.
+	Verdict string `json:"verdict,omitempty"`
+}
+
+// VerifyInclusion verifies an inclusion proof and checks that its root is
+// that of an accepted checkpoint. If the proof is for a tree size the
+// collector did not accept, the proven root is bridged to the smallest larger
+// accepted checkpoint with a consistency proof from Config.Prover. An entry
+// that is not proven to be included is reported in the verdict; errors are
+// returned for failures of the collector itself.
+func (c *Collector) VerifyInclusion(ctx context.Context, req InclusionRequest) (InclusionVerdict, error) {
+	notIncluded := func(format string, args ...any) (InclusionVerdict, error) {
+		return InclusionVerdict{Reason: fmt.Sprintf(format, args...)}, nil
+	}
+
+	leaf, err := hex.DecodeString(req.LeafHash)
+	if err != nil || len(leaf) != rfc6962.DefaultHasher.Size() {
+		return notIncluded("invalid leaf hash %q", req.LeafHash)
+	}
+	root, err := hex.DecodeString(req.RootHash)
+	if err != nil || len(root) != rfc6962.DefaultHasher.Size() {
+		return notIncluded("invalid root hash %q", req.RootHash)
+	}
+	hashes := make([][]byte, len(req.Hashes))
+	for i, h := range req.Hashes {
+		if hashes[i], err = hex.DecodeString(h); err != nil {
+			return notIncluded("invalid proof hash %q", h)
+		}
+	}
+	if req.LogIndex < 0 || req.TreeSize <= req.LogIndex {
+		return notIncluded("log index %d is not in a tree of size %d", req.LogIndex, req.TreeSize)
+	}
+	if err := proof.VerifyInclusion(rfc6962.DefaultHasher, uint64(req.LogIndex), uint64(req.TreeSize), leaf, hashes, root); err != nil {
+		return notIncluded("inclusion proof does not verify: %v", err)
+	}
+
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return InclusionVerdict{}, err
+	}
+	var bridge *Checkpoint
+	proven := base64.StdEncoding.EncodeToString(root)
+	for _, l := range lines {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil || (req.Origin != "" && !MatchOrigin(req.Origin, chpt.Origin)) || chpt.Size < req.TreeSize {
+			continue
+		}
+		if chpt.Size == req.TreeSize {
+			if chpt.Hash != proven {
+				return notIncluded("root hash of tree size %d is not the accepted root hash %s", req.TreeSize, chpt.Hash)
+			}
+			return c.inclusionVerdict(req, chpt)
+		}
+		if bridge == nil || chpt.Size < bridge.Size {
+			bridge = &chpt
+		}
+	}
+	if bridge == nil {
+		return notIncluded("no checkpoint covering tree size %d has been accepted yet", req.TreeSize)
+	}
+	first := Checkpoint{Origin: bridge.Origin, Size: req.TreeSize, Hash: proven}
+	if err := c.proveConsistent(ctx, first, *bridge); err != nil {
+		return notIncluded("tree size %d is not proven consistent with accepted tree size %d: %v", req.TreeSize, bridge.Size, err)
+	}
+	return c.inclusionVerdict(req, *bridge)
+}
+
+// inclusionVerdict returns the verdict that the entry of req is included in
+// the accepted checkpoint chpt, signed with the collector's cosigning key.
+func (c *Collector) inclusionVerdict(req InclusionRequest, chpt Checkpoint) (InclusionVerdict, error) {
+	leaf, _ := hex.DecodeString(req.LeafHash)
+	text := strings.Join([]string{
+		inclusionVerdictHeader,
+		chpt.Origin,
+		strconv.FormatInt(req.LogIndex, 10),
+		base64.StdEncoding.EncodeToString(leaf),
+		strconv.FormatInt(chpt.Size, 10),
+		chpt.Hash,
+	}, "\n") + "\n"
+	v := InclusionVerdict{Included: true, Checkpoint: checkpointNote(chpt.Raw), Verdict: text}
+	if c.cfg.Cosigner != nil {
+		signed, err := cosignNote(strings.ReplaceAll(text+"\n", "\n", lineSeparator), c.cfg.Cosigner, CosignNoteFormat, time.Time{})
+		if err != nil {
+			return InclusionVerdict{}, fmt.Errorf("signing inclusion verdict: %w", err)
+		}
+		v.Verdict = signed
+	}
+	return v, nil
+}
+
+// AuditInclusion verifies the inclusion of the entries in [start, end) of
+// the log read from src against the accepted checkpoints, running p. Entries
+// whose inclusion cannot be verified are reported as failures.
+func (c *Collector) AuditInclusion(ctx context.Context, src EntrySource, start, end int64, p Pipeline) (PipelineReport, error) {
+	return p.Run(ctx, start, end, func(ctx context.Context, index int64) error {
+		e, err := src.Entry(ctx, index)
+		if err != nil {
+			return err
+		}
+		if e.Proof == nil {
+			return errors.New("the log returned no inclusion proof")
+		}
+		return c.verifyIncluded(ctx, *e.Proof)
+	})
+}
+
+// verifyIncluded returns an error with the reason if req does not prove
+// inclusion.
+func (c *Collector) verifyIncluded(ctx context.Context, req InclusionRequest) error {
+	v, err := c.VerifyInclusion(ctx, req)
+	if err != nil {
+		return err
+	}
+	if !v.Included {
+		return errors.New(v.Reason)
+	}
+	return nil
+}
+
+// AuditInclusionRequests verifies the inclusion proofs of reqs against the
+// accepted checkpoints, running p over their indices in reqs.
+func (c *Collector) AuditInclusionRequests(ctx context.Context, reqs []InclusionRequest, p Pipeline) (PipelineReport, error) {
+	return p.Run(ctx, 0, int64(len(reqs)), func(ctx context.Context, i int64) error {
+		return c.verifyIncluded(ctx, reqs[i])
+	})
+}
@@ -0,0 +1,186 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// intent is the write-ahead record of the acceptance decided in a round. It
+// is written to Config.IntentFile before the accepted checkpoints are
+// persisted, marked persisted once they are, and removed once they are
+// published. A collector that crashed in between completes or abandons the
+// round on restart, see resumeIntent, so that an acceptance is persisted and
+// published at most once.
+type intent struct {
+	// Key is the idempotency key of the round, which identifies its
+	// acceptance in the audit log.
+	Key         string    `json:"key"`
+	Round       string    `json:"round"`
+	Time        time.Time `json:"time"`
+	Checkpoints []string  `json:"checkpoints"`
+	Degraded    bool      `json:"degraded,omitempty"`
+	// Supporters is the number of monitors that read the last checkpoint,
+	// for the extensions of its cosignature.
+	Supporters int `json:"supporters"`
+	// After is the tree size accepted before, if identities are scanned or
+	// the log mirrored.
+	After     int64 `json:"after,omitempty"`
+	Persisted bool  `json:"persisted,omitempty"`
+	// Provenance holds the provenance records of the checkpoints, if
+	// signed statements are emitted.
+	Provenance []Provenance `json:"provenance,omitempty"`
+
+	batch []Checkpoint
+}
+
+func newIntent(namespace, round string, now time.Time, batch []Checkpoint, degraded bool, supporters int, after int64) *intent {
+	in := &intent{Round: round, Time: now.UTC(), Degraded: degraded, Supporters: supporters, After: after, batch: batch}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", namespace, round)
+	for _, a := range batch {
+		in.Checkpoints = append(in.Checkpoints, a.Raw)
+		fmt.Fprintln(h, a.Raw)
+	}
+	in.Key = hex.EncodeToString(h.Sum(nil))
+	return in
+}
+
+// last returns the checkpoint accepted by the round.
+func (in *intent) last() Checkpoint {
+	return in.batch[len(in.batch)-1]
+}
+
+// writeIntent replaces the intent file with in.
+func (c *Collector) writeIntent(in *intent) error {
+	if c.cfg.IntentFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(c.cfg.IntentFile, []string{string(b)}); err != nil {
+		return fmt.Errorf("writing intent of round %s: %w", in.Round, err)
+	}
+	return nil
+}
+
+// clearIntent removes the intent file once a round is published.
+func (c *Collector) clearIntent() {
+	if c.cfg.IntentFile == "" {
+		return
+	}
+	if err := os.Remove(c.cfg.IntentFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.logf("Removing intent file: %v\n", err)
+	}
+}
+
+// readIntent returns the intent left by a round that did not complete, or
+// nil if there is none.
+func readIntent(filename string) (*intent, error) {
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var in intent
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, l := range in.Checkpoints {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		in.batch = append(in.batch, chpt)
+	}
+	if len(in.batch) == 0 {
+		return nil, fmt.Errorf("%s: no accepted checkpoints", filename)
+	}
+	return &in, nil
+}
+
+// complete publishes the checkpoints accepted in a round once they are
+// persisted, and removes the intent of the round. The caller holds the write
+// lock.
+func (c *Collector) complete(ctx context.Context, in *intent) {
+	c.cosign(ctx, in.last(), in.Round, in.Supporters)
+	c.emitStatements(ctx, in)
+	c.publish(in.batch)
+	c.stream(in.Round, in.batch, in.Degraded)
+	c.accepts.broadcast()
+	if in.After > 0 {
+		c.scanIdentities(in.After, in.last())
+		c.mirror(in.After, in.batch)
+	}
+	c.clearIntent()
+}
+
+// resumeIntent finishes a round interrupted by a crash between deciding its
+// acceptance and publishing it. A round whose accepted checkpoint reached
+// the storage is completed by publishing it, which is idempotent: the
+// published tree and the cosigned checkpoint are replaced, and the stream
+// may repeat the checkpoint. Any other round is abandoned, so that the next
+// round decides again from fresh observations. It reports whether an
+// interrupted round was completed or abandoned.
+func (c *Collector) resumeIntent(ctx context.Context) (completed, abandoned bool, err error) {
+	if c.cfg.IntentFile == "" || c.cfg.ReadOnly {
+		return false, false, nil
+	}
+	in, err := readIntent(c.cfg.IntentFile)
+	if err != nil || in == nil {
+		return false, false, err
+	}
+	last := in.last()
+	if !in.Persisted {
+		lines, err := c.acceptedCheckpoints()
+		if err != nil {
+			return false, false, fmt.Errorf("reading accepted checkpoints: %w", err)
+		}
+		for _, l := range lines {
+			if l == last.Raw {
+				in.Persisted = true
+			}
+		}
+	}
+	if !in.Persisted {
+		c.logf("Abandoning round %s, interrupted before tree size %d of %s was persisted\n", in.Round, last.Size, last.Origin)
+		c.clearIntent()
+		return false, true, nil
+	}
+
+	c.logf("Completing round %s, interrupted after tree size %d of %s was persisted\n", in.Round, last.Size, last.Origin)
+	if err := c.writes.lock(ctx); err != nil {
+		return false, false, fmt.Errorf("waiting to publish accepted checkpoints: %w", err)
+	}
+	defer c.writes.unlock()
+	for _, a := range in.batch {
+		c.sizes.record(a.Origin, a.Size)
+	}
+	c.complete(ctx, in)
+	return true, false, nil
+}
@@ -0,0 +1,297 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterCapability(CapabilityAlertSink, "github")
+	RegisterCapability(CapabilityAlertSink, "gitlab")
+}
+
+// Default API endpoints of the issue trackers
+const (
+	DefaultGitHubAPI = "https://api.github.com"
+	DefaultGitLabAPI = "https://gitlab.com/api/v4"
+)
+
+// IssueLabel labels the issues opened by IssueSink. Only open issues with
+// this label are considered when looking for the issue of an incident.
+const IssueLabel = "rekor-monitor"
+
+// Issue is an issue of an IssueTracker.
+type Issue struct {
+	// ID is the number of the issue within its repository.
+	ID    int64
+	Title string
+}
+
+// IssueTracker opens, comments on and closes the issues of a repository.
+type IssueTracker interface {
+	// OpenIssues lists the open issues labeled IssueLabel.
+	OpenIssues(ctx context.Context) ([]Issue, error)
+	OpenIssue(ctx context.Context, title, body string) (Issue, error)
+	CommentIssue(ctx context.Context, id int64, body string) error
+	// CloseIssue comments on the issue and closes it.
+	CloseIssue(ctx context.Context, id int64, body string) error
+}
+
+// IssueSink tracks every incident, the alerts of one kind for one log, in
+// an issue. The first alert opens the issue, later alerts with a different
+// body are added to it as comments and the resolved alert closes it. Open
+// issues are found again by their title after a restart, so an incident
+// never has more than one issue.
+type IssueSink struct {
+	Tracker IssueTracker
+
+	mu sync.Mutex
+	// issues holds the issue and the last body posted, by title.
+	issues map[string]*trackedIssue
+}
+
+type trackedIssue struct {
+	id   int64
+	last string
+}
+
+// issueTitle returns the title of the issue tracking the incident of a.
+func issueTitle(a Alert) string {
+	title := fmt.Sprintf("rekor-monitor: %s", a.Kind)
+	if a.Origin != "" {
+		title += " of " + a.Origin
+	}
+	if a.Namespace != "" {
+		title = "[" + a.Namespace + "] " + title
+	}
+	return title
+}
+
+// issueBody returns the body followed by the fields of a as evidence.
+func issueBody(a Alert, body string) string {
+	fields, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return body
+	}
+	return body + "\n\n```json\n" + string(fields) + "\n```\n"
+}
+
+// Send implements AlertSink.
+func (s *IssueSink) Send(ctx context.Context, a Alert, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	title := issueTitle(a)
+	issue, err := s.find(ctx, title)
+	if err != nil {
+		return fmt.Errorf("finding issue %q: %w", title, err)
+	}
+	switch {
+	case a.Resolved:
+		if issue == nil {
+			return nil
+		}
+		if err := s.Tracker.CloseIssue(ctx, issue.id, issueBody(a, body)); err != nil {
+			return fmt.Errorf("closing issue %d: %w", issue.id, err)
+		}
+		delete(s.issues, title)
+	case issue == nil:
+		opened, err := s.Tracker.OpenIssue(ctx, title, issueBody(a, body))
+		if err != nil {
+			return fmt.Errorf("opening issue %q: %w", title, err)
+		}
+		s.issues[title] = &trackedIssue{id: opened.ID, last: body}
+	case body != issue.last:
+		if err := s.Tracker.CommentIssue(ctx, issue.id, issueBody(a, body)); err != nil {
+			return fmt.Errorf("commenting on issue %d: %w", issue.id, err)
+		}
+		issue.last = body
+	}
+	return nil
+}
+
+// find returns the open issue titled title, or nil if there is none.
+func (s *IssueSink) find(ctx context.Context, title string) (*trackedIssue, error) {
+	if s.issues == nil {
+		s.issues = make(map[string]*trackedIssue)
+	}
+	if issue, ok := s.issues[title]; ok {
+		return issue, nil
+	}
+	open, err := s.Tracker.OpenIssues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range open {
+		if i.Title == title {
+			s.issues[title] = &trackedIssue{id: i.ID}
+			return s.issues[title], nil
+		}
+	}
+	return nil, nil
+}
+
+// GitHubIssues tracks issues in the GitHub repository Repo, "owner/name".
+type GitHubIssues struct {
+	Repo  string
+	Token string
+	// API defaults to DefaultGitHubAPI.
+	API    string
+	Client *http.Client
+}
+
+func (g *GitHubIssues) url(path string) string {
+	api := g.API
+	if api == "" {
+		api = DefaultGitHubAPI
+	}
+	return strings.TrimSuffix(api, "/") + "/repos/" + g.Repo + "/issues" + path
+}
+
+// OpenIssues implements IssueTracker.
+func (g *GitHubIssues) OpenIssues(ctx context.Context) ([]Issue, error) {
+	var issues []struct {
+		Number      int64           `json:"number"`
+		Title       string          `json:"title"`
+		PullRequest json.RawMessage `json:"pull_request"`
+	}
+	q := url.Values{"state": {"open"}, "labels": {IssueLabel}, "per_page": {"100"}}
+	if err := sendAlert(ctx, g.Client, http.MethodGet, g.url("?"+q.Encode()), g.Token, nil, &issues); err != nil {
+		return nil, err
+	}
+	var open []Issue
+	for _, i := range issues {
+		if i.PullRequest == nil {
+			open = append(open, Issue{ID: i.Number, Title: i.Title})
+		}
+	}
+	return open, nil
+}
+
+// OpenIssue implements IssueTracker.
+func (g *GitHubIssues) OpenIssue(ctx context.Context, title, body string) (Issue, error) {
+	var created struct {
+		Number int64 `json:"number"`
+	}
+	in := map[string]any{"title": title, "body": body, "labels": []string{IssueLabel}}
+	if err := sendAlert(ctx, g.Client, http.MethodPost, g.url(""), g.Token, in, &created); err != nil {
+		return Issue{}, err
+	}
+	return Issue{ID: created.Number, Title: title}, nil
+}
+
+// CommentIssue implements IssueTracker.
+func (g *GitHubIssues) CommentIssue(ctx context.Context, id int64, body string) error {
+	return sendAlert(ctx, g.Client, http.MethodPost, g.url(fmt.Sprintf("/%d/comments", id)), g.Token, map[string]string{"body": body}, nil)
+}
+
+// CloseIssue implements IssueTracker.
+func (g *GitHubIssues) CloseIssue(ctx context.Context, id int64, body string) error {
+	if err := g.CommentIssue(ctx, id, body); err != nil {
+		return err
+	}
+	return sendAlert(ctx, g.Client, http.MethodPatch, g.url(fmt.Sprintf("/%d", id)), g.Token, map[string]string{"state": "closed"}, nil)
+}
+
+// GitLabIssues tracks issues in the GitLab project Project, its path such
+// as "group/name" or its numeric ID.
+type GitLabIssues struct {
+	Project string
+	Token   string
+	// API defaults to DefaultGitLabAPI.
+	API    string
+	Client *http.Client
+}
+
+func (g *GitLabIssues) url(path string) string {
+	api := g.API
+	if api == "" {
+		api = DefaultGitLabAPI
+	}
+	return strings.TrimSuffix(api, "/") + "/projects/" + url.PathEscape(g.Project) + "/issues" + path
+}
+
+// OpenIssues implements IssueTracker.
+func (g *GitLabIssues) OpenIssues(ctx context.Context) ([]Issue, error) {
+	var issues []struct {
+		IID   int64  `json:"iid"`
+		Title string `json:"title"`
+	}
+	q := url.Values{"state": {"opened"}, "labels": {IssueLabel}, "per_page": {"100"}}
+	if err := sendAlert(ctx, g.Client, http.MethodGet, g.url("?"+q.Encode()), g.Token, nil, &issues); err != nil {
+		return nil, err
+	}
+	open := make([]Issue, len(issues))
+	for i, is := range issues {
+		open[i] = Issue{ID: is.IID, Title: is.Title}
+	}
+	return open, nil
+}
+
+// OpenIssue implements IssueTracker.
+func (g *GitLabIssues) OpenIssue(ctx context.Context, title, body string) (Issue, error) {
+	var created struct {
+		IID int64 `json:"iid"`
+	}
+	in := map[string]string{"title": title, "description": body, "labels": IssueLabel}
+	if err := sendAlert(ctx, g.Client, http.MethodPost, g.url(""), g.Token, in, &created); err != nil {
+		return Issue{}, err
+	}
+	return Issue{ID: created.IID, Title: title}, nil
+}
+
+// CommentIssue implements IssueTracker.
+func (g *GitLabIssues) CommentIssue(ctx context.Context, id int64, body string) error {
+	return sendAlert(ctx, g.Client, http.MethodPost, g.url(fmt.Sprintf("/%d/notes", id)), g.Token, map[string]string{"body": body}, nil)
+}
+
+// CloseIssue implements IssueTracker.
+func (g *GitLabIssues) CloseIssue(ctx context.Context, id int64, body string) error {
+	if err := g.CommentIssue(ctx, id, body); err != nil {
+		return err
+	}
+	return sendAlert(ctx, g.Client, http.MethodPut, g.url(fmt.Sprintf("/%d", id)), g.Token, map[string]string{"state_event": "close"}, nil)
+}
+
+// parseIssueSink parses the argument of a "github:" or "gitlab:" alert sink,
+// "<repository>,<token file>[,<api url>]".
+func parseIssueSink(kind, arg string, client *http.Client) (AlertSink, error) {
+	parts := strings.Split(arg, ",")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || (len(parts) == 3 && !isRemote(parts[2])) {
+		return nil, fmt.Errorf("invalid %s alert sink %q, expected %s:<repository>,<token file>[,<api url>]", kind, arg, kind)
+	}
+	token, err := os.ReadFile(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("reading %s token: %w", kind, err)
+	}
+	var api string
+	if len(parts) == 3 {
+		api = parts[2]
+	}
+	t := strings.TrimSpace(string(token))
+	if kind == "github" {
+		return &IssueSink{Tracker: &GitHubIssues{Repo: parts[0], Token: t, API: api, Client: client}}, nil
+	}
+	return &IssueSink{Tracker: &GitLabIssues{Project: parts[0], Token: t, API: api, Client: client}}, nil
+}
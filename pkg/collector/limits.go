@@ -0,0 +1,129 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default read limits
+const (
+	DefaultMaxFileSize = 1 << 30
+	DefaultReadTimeout = 30 * time.Second
+)
+
+// Limit names, used as the limit label of
+// rekor_collector_monitor_limit_exceeded_total
+const (
+	LimitFileSize    = "file_size"
+	LimitReadTimeout = "read_timeout"
+)
+
+var (
+	// ErrFileTooLarge is returned when a monitor logfile is larger than the
+	// configured maximum.
+	ErrFileTooLarge = errors.New("monitor logfile exceeds maximum size")
+	// ErrReadTimeout is returned when reading a monitor logfile takes longer
+	// than the configured timeout.
+	ErrReadTimeout = errors.New("reading monitor logfile timed out")
+)
+
+// limitCounts counts the rounds each monitor was skipped for exceeding a
+// limit.
+type limitCounts struct {
+	mu sync.Mutex
+	m  map[[2]string]int
+}
+
+func (l *limitCounts) inc(monitor, limit string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = make(map[[2]string]int)
+	}
+	l.m[[2]string{monitor, limit}]++
+}
+
+func (l *limitCounts) counts() map[[2]string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make(map[[2]string]int, len(l.m))
+	for k, n := range l.m {
+		counts[k] = n
+	}
+	return counts
+}
+
+// monitorLimits returns the limits for m, which override the collector's.
+func (c *Collector) monitorLimits(m Monitor) (maxSize int64, timeout time.Duration) {
+	maxSize, timeout = c.cfg.MaxFileSize, c.cfg.ReadTimeout
+	if m.MaxFileSize > 0 {
+		maxSize = m.MaxFileSize
+	}
+	if m.ReadTimeout > 0 {
+		timeout = time.Duration(m.ReadTimeout)
+	}
+	return maxSize, timeout
+}
+
+// readMonitor reads the latest n checkpoints of m within its limits, using
+// the fetcher for the scheme of its logfile. If ctx is done first, its
+// error is returned rather than ErrReadTimeout, since the monitor is not
+// at fault.
+func (c *Collector) readMonitor(ctx context.Context, m Monitor, n int) ([]string, error) {
+	f, err := c.fetcher(m.Logfile)
+	if err != nil {
+		return nil, err
+	}
+	maxSize, timeout := c.monitorLimits(m)
+
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	chpts, err := f.Fetch(ctx, m.Logfile, n, maxSize)
+	if err != nil && parent.Err() != nil {
+		return nil, parent.Err()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded && !errors.Is(err, ErrReadTimeout) {
+		return nil, fmt.Errorf("%w after %s", ErrReadTimeout, timeout)
+	}
+	return chpts, err
+}
+
+// limitExceeded alerts that m was skipped this round because it exceeded a
+// limit and returns the name of the limit, or the empty string if err is not
+// a limit error.
+func (c *Collector) limitExceeded(m Monitor, err error) string {
+	var limit string
+	switch {
+	case errors.Is(err, ErrFileTooLarge):
+		limit = LimitFileSize
+	case errors.Is(err, ErrReadTimeout):
+		limit = LimitReadTimeout
+	default:
+		return ""
+	}
+	c.limits.inc(m.Logfile, limit)
+	c.alert(Alert{Kind: AlertLimit, Monitors: []string{m.Logfile}, Message: fmt.Sprintf("skipping monitor %s this round: %v", m.Logfile, err)})
+	return limit
+}
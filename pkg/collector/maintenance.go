@@ -0,0 +1,104 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Compacter is implemented by storages that do not return the space of
+// pruned lines to the file system or database by themselves.
+type Compacter interface {
+	// Compact reclaims the space freed by Prune and returns the number of
+	// bytes reclaimed.
+	Compact() (int64, error)
+}
+
+// MaintenanceReport is the result of Maintain.
+type MaintenanceReport struct {
+	Keep int
+	// Compacted is set if the storage is a Compacter, in which case
+	// Reclaimed is the number of bytes compaction reclaimed.
+	Compacted bool
+	Reclaimed int64
+	Duration  time.Duration
+}
+
+// String summarizes the report for logs and the prune command.
+func (r MaintenanceReport) String() string {
+	s := fmt.Sprintf("pruned to the latest %d accepted checkpoints", r.Keep)
+	if r.Compacted {
+		s += fmt.Sprintf(", reclaimed %d bytes", r.Reclaimed)
+	}
+	return fmt.Sprintf("%s in %v", s, r.Duration.Round(time.Millisecond))
+}
+
+// Maintain applies the retention policy of keep accepted checkpoints to s
+// and compacts it if it is a Compacter, the same way for every backend.
+func Maintain(s Storage, keep int) (MaintenanceReport, error) {
+	start := time.Now()
+	report := MaintenanceReport{Keep: keep}
+	if err := s.Prune(keep); err != nil {
+		return report, withClass(ErrStorage, fmt.Errorf("deleting old checkpoints: %w", err))
+	}
+	if cs, ok := s.(Compacter); ok {
+		n, err := cs.Compact()
+		if err != nil {
+			return report, withClass(ErrStorage, fmt.Errorf("compacting storage: %w", err))
+		}
+		report.Compacted, report.Reclaimed = true, n
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// Maintain prunes the collector's storage to Keep accepted checkpoints and
+// compacts it, see Maintain. Collection rounds wait for it to finish.
+func (c *Collector) Maintain() (MaintenanceReport, error) {
+	// Waiting for the lock cannot fail without a deadline.
+	_ = c.writes.lock(context.Background())
+	defer c.writes.unlock()
+	report, err := Maintain(c.cfg.Storage, c.cfg.Keep)
+	c.reclaimed.Add(report.Reclaimed)
+	return report, err
+}
+
+// RunMaintenance runs Maintain every MaintenanceInterval until ctx is done.
+// Failures are logged and retried at the next interval. It returns at once
+// if MaintenanceInterval is not set, in which case the storage is pruned
+// after every accepted checkpoint instead.
+func (c *Collector) RunMaintenance(ctx context.Context) {
+	if c.cfg.MaintenanceInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.MaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := c.Maintain()
+		if err != nil {
+			c.logf("Maintenance failed: %s\n", coded(err))
+			continue
+		}
+		c.logf("Maintenance %s\n", report)
+	}
+}
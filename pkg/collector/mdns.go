@@ -0,0 +1,241 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MDNSService is the DNS-SD service type monitors advertise over mDNS.
+const MDNSService = "_rekor-monitor._tcp.local."
+
+// DefaultMDNSTimeout is how long responses to an mDNS query are collected.
+const DefaultMDNSTimeout = 3 * time.Second
+
+// mdnsAddr is the IPv4 mDNS multicast group.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSInstance is a monitor instance advertised over mDNS.
+type MDNSInstance struct {
+	// Name is the instance name without the service type, e.g. "monitor-a".
+	Name string
+	Host string
+	Port int
+	// Text holds the key=value pairs of the instance's TXT record.
+	Text map[string]string
+}
+
+// URL returns the URL the instance serves its checkpoints at: the url key of
+// its TXT record or WellKnownCheckpointsPath on the advertised host and port.
+func (i MDNSInstance) URL() string {
+	if u := i.Text["url"]; u != "" {
+		return u
+	}
+	return "https://" + net.JoinHostPort(strings.TrimSuffix(i.Host, "."), strconv.Itoa(i.Port)) + WellKnownCheckpointsPath
+}
+
+// BrowseMDNS queries the local network for monitor instances and collects
+// the answers until timeout. The query is sent from an ephemeral port, so
+// responders answer directly instead of to the multicast group.
+func BrowseMDNS(ctx context.Context, timeout time.Duration) ([]MDNSInstance, error) {
+	service := dnsmessage.MustNewName(MDNSService)
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(packet, mdnsAddr); err != nil {
+		return nil, err
+	}
+
+	r := newMDNSRecords()
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		r.add(msg)
+	}
+	return r.instances(), nil
+}
+
+// mdnsRecords collects the records of mDNS responses.
+type mdnsRecords struct {
+	ptr map[string]bool
+	srv map[string]dnsmessage.SRVResource
+	txt map[string][]string
+}
+
+func newMDNSRecords() *mdnsRecords {
+	return &mdnsRecords{
+		ptr: make(map[string]bool),
+		srv: make(map[string]dnsmessage.SRVResource),
+		txt: make(map[string][]string),
+	}
+}
+
+func (r *mdnsRecords) add(msg dnsmessage.Message) {
+	records := append(append([]dnsmessage.Resource{}, msg.Answers...), msg.Additionals...)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header.Name.String())
+		switch b := rr.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == MDNSService {
+				r.ptr[strings.ToLower(b.PTR.String())] = true
+			}
+		case *dnsmessage.SRVResource:
+			r.srv[name] = *b
+		case *dnsmessage.TXTResource:
+			r.txt[name] = b.TXT
+		}
+	}
+}
+
+// instances returns the advertised instances with an SRV record, sorted by
+// name.
+func (r *mdnsRecords) instances() []MDNSInstance {
+	var instances []MDNSInstance
+	for name := range r.ptr {
+		srv, ok := r.srv[name]
+		if !ok {
+			continue
+		}
+		inst := MDNSInstance{
+			Name: strings.TrimSuffix(name, "."+MDNSService),
+			Host: srv.Target.String(),
+			Port: int(srv.Port),
+			Text: make(map[string]string),
+		}
+		for _, t := range r.txt[name] {
+			if k, v, ok := strings.Cut(t, "="); ok {
+				inst.Text[k] = v
+			}
+		}
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances
+}
+
+// MDNSDiscovery finds monitors advertised over mDNS on the local network.
+// Only instances whose names are listed in AllowFile count as monitors;
+// others are logged so an operator can confirm them, e.g. with the mdns
+// command.
+type MDNSDiscovery struct {
+	AllowFile string
+	Timeout   time.Duration
+}
+
+// Discover implements Discoverer.
+func (d MDNSDiscovery) Discover(ctx context.Context) ([]Monitor, error) {
+	allowed, err := ReadAllowList(d.AllowFile)
+	if err != nil {
+		return nil, err
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DefaultMDNSTimeout
+	}
+	instances, err := BrowseMDNS(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var monitors []Monitor
+	for _, inst := range instances {
+		if !allowed[inst.Name] {
+			log.Printf("Discovered monitor %s at %s over mDNS; it does not count towards quorum until it is added to %s\n", inst.Name, inst.URL(), d.AllowFile)
+			continue
+		}
+		monitors = append(monitors, Monitor{Description: inst.Name, Logfile: inst.URL(), Network: inst.Text["network"]})
+	}
+	return monitors, nil
+}
+
+// ReadAllowList reads the confirmed mDNS instance names, one per line. A
+// missing file allows no instances.
+func ReadAllowList(filename string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return allowed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" && !strings.HasPrefix(name, "#") {
+			allowed[name] = true
+		}
+	}
+	return allowed, scanner.Err()
+}
+
+// AllowInstance adds an mDNS instance name to the allow list.
+func AllowInstance(filename, name string) error {
+	if name == "" || strings.ContainsAny(name, "\n\r") {
+		return fmt.Errorf("invalid instance name %q", name)
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, name); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
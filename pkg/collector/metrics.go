@@ -0,0 +1,220 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sample is a single value of a metric with its label pairs.
+type sample struct {
+	// suffix is appended to the metric name, e.g. "_bucket" for histograms.
+	suffix   string
+	labels   []string
+	value    float64
+	exemplar *exemplar
+}
+
+// withPod returns s labelled with the pod, unless pod is empty.
+func (s sample) withPod(pod string) sample {
+	if pod != "" {
+		s.labels = append([]string{"pod", pod}, s.labels...)
+	}
+	return s
+}
+
+// seriesKey identifies the series a sample belongs to, ignoring the bucket
+// label of histograms.
+func (s sample) seriesKey() string {
+	var key []string
+	for i := 0; i+1 < len(s.labels); i += 2 {
+		if s.labels[i] != "le" {
+			key = append(key, s.labels[i], s.labels[i+1])
+		}
+	}
+	return strings.Join(key, ",")
+}
+
+// writeMetric writes a metric in the Prometheus text exposition format, or
+// in the OpenMetrics format including exemplars if openMetrics is set.
+// Samples are sorted by series so the output is stable; the samples of one
+// series keep their order.
+func writeMetric(w io.Writer, name, typ, help string, samples []sample, openMetrics bool) {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].seriesKey() < samples[j].seriesKey()
+	})
+
+	family := name
+	if openMetrics && typ == "counter" {
+		family = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, help, family, typ)
+	for _, s := range samples {
+		var pairs []string
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", s.labels[i], s.labels[i+1]))
+		}
+		line := name + s.suffix
+		if len(pairs) > 0 {
+			line += "{" + strings.Join(pairs, ",") + "}"
+		}
+		line += " " + strconv.FormatFloat(s.value, 'g', -1, 64)
+		if openMetrics && s.exemplar != nil {
+			line += " " + s.exemplar.String()
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// metricDesc describes a metric exported by the collector.
+type metricDesc struct {
+	name, typ, help string
+}
+
+// metricDescs lists the exported metrics in the order they are written.
+var metricDescs = []metricDesc{
+	{"rekor_collector_monitor_circuit_open", "gauge", "Whether the circuit breaker of a monitor is open (1) or closed (0)."},
+	{"rekor_collector_monitor_consecutive_failures", "gauge", "Number of consecutive failed reads of a monitor."},
+	{"rekor_collector_monitor_limit_exceeded_total", "counter", "Number of rounds a monitor was skipped for exceeding a read limit."},
+	{"rekor_collector_monitor_status", "gauge", "Status of a monitor: 1 for its current status of alive, idle or down, 0 for the others."},
+	{"rekor_collector_monitor_heartbeat_age_seconds", "gauge", "Seconds since the latest heartbeat of a monitor sending heartbeats."},
+	{"rekor_collector_tree_size", "gauge", "Tree size of the latest accepted checkpoint of a log."},
+	{"rekor_collector_tree_growth_rate", "gauge", "Entries per second added to a log between the last two accepted tree sizes."},
+	{"rekor_collector_monitor_lag_entries", "gauge", "Number of entries the latest checkpoint of a monitor is behind the accepted tree size."},
+	{"rekor_collector_monitor_lag_seconds", "gauge", "Seconds since the first accepted tree size a monitor has not reached yet."},
+	{"rekor_collector_anomalies_total", "counter", "Number of anomalies detected by kind, for a log origin or a monitor."},
+	{"rekor_collector_storage_reclaimed_bytes_total", "counter", "Number of bytes reclaimed by compacting the storage of accepted checkpoints."},
+	{"rekor_collector_baseline_divergence_entries", "gauge", "Tree size reported by the log minus the accepted tree size, as of the last accepted checkpoint."},
+	{"rekor_collector_round_interval_seconds", "gauge", "Current adaptive interval between the rounds of a target, labelled with its origin or empty for the default target."},
+	{"rekor_collector_push_queue_depth", "gauge", "Number of pushes from monitors waiting in the push queue."},
+	{"rekor_collector_round_duration_seconds", "histogram", "Duration of collection rounds, with the round ID as exemplar."},
+}
+
+// collectMetrics adds the collector's current samples, keyed by metric name.
+// Samples are labelled with the pod if set and the namespace in multi-tenant
+// mode.
+func (c *Collector) collectMetrics(add func(name string, s sample)) {
+	addNS := func(name string, s sample) {
+		if c.cfg.Namespace != "" {
+			s.labels = append([]string{"namespace", c.cfg.Namespace}, s.labels...)
+		}
+		add(name, s.withPod(c.cfg.Pod))
+	}
+
+	for m, st := range c.breakers.states() {
+		v := 0.0
+		if st != BreakerClosed {
+			v = 1
+		}
+		addNS("rekor_collector_monitor_circuit_open", sample{labels: []string{"monitor", m, "state", st.String()}, value: v})
+	}
+	for m, n := range c.breakers.failureCounts() {
+		addNS("rekor_collector_monitor_consecutive_failures", sample{labels: []string{"monitor", m}, value: float64(n)})
+	}
+	for k, n := range c.limits.counts() {
+		addNS("rekor_collector_monitor_limit_exceeded_total", sample{labels: []string{"monitor", k[0], "limit", k[1]}, value: float64(n)})
+	}
+	for k, n := range c.anoms.anomalyCounts() {
+		subject := "origin"
+		switch k[0] {
+		case AnomalyDivergence, AnomalyStaleMonitor, AnomalyOriginMismatch, AnomalyInvalidInput:
+			subject = "monitor"
+		}
+		addNS("rekor_collector_anomalies_total", sample{labels: []string{"kind", k[0], subject, k[1]}, value: float64(n)})
+	}
+	if statuses, err := c.MonitorStatuses(); err == nil {
+		now := time.Now()
+		for _, s := range statuses {
+			for _, st := range []string{MonitorAlive, MonitorIdle, MonitorDown} {
+				v := 0.0
+				if s.Status == st {
+					v = 1
+				}
+				addNS("rekor_collector_monitor_status", sample{labels: []string{"monitor", s.Monitor, "status", st}, value: v})
+			}
+			if s.LastHeartbeat != nil {
+				addNS("rekor_collector_monitor_heartbeat_age_seconds", sample{labels: []string{"monitor", s.Monitor}, value: now.Sub(*s.LastHeartbeat).Seconds()})
+			}
+		}
+	}
+	for o, d := range c.adaptive.intervals() {
+		addNS("rekor_collector_round_interval_seconds", sample{labels: []string{"target", o}, value: d.Seconds()})
+	}
+	for o, n := range c.anoms.baselineDivergences() {
+		addNS("rekor_collector_baseline_divergence_entries", sample{labels: []string{"origin", o}, value: float64(n)})
+	}
+	if n := c.reclaimed.Load(); n > 0 {
+		addNS("rekor_collector_storage_reclaimed_bytes_total", sample{value: float64(n)})
+	}
+	c.stats.collectMetrics(addNS)
+}
+
+// WriteMetrics writes the metrics of one or more collectors in the Prometheus
+// text format.
+func WriteMetrics(w io.Writer, cs ...*Collector) error {
+	return writeMetrics(w, false, cs)
+}
+
+// WriteOpenMetrics writes the metrics of one or more collectors in the
+// OpenMetrics text format, which includes exemplars.
+func WriteOpenMetrics(w io.Writer, cs ...*Collector) error {
+	return writeMetrics(w, true, cs)
+}
+
+func writeMetrics(w io.Writer, openMetrics bool, cs []*Collector) error {
+	samples := make(map[string][]sample)
+	for _, c := range cs {
+		c.collectMetrics(func(name string, s sample) {
+			samples[name] = append(samples[name], s)
+		})
+	}
+	if q := pushQueue(cs); q != nil {
+		samples["rekor_collector_push_queue_depth"] = []sample{sample{value: float64(q.Depth())}.withPod(cs[0].cfg.Pod)}
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, d := range metricDescs {
+		writeMetric(bw, d.name, d.typ, d.help, samples[d.name], openMetrics)
+	}
+	if openMetrics {
+		fmt.Fprintln(bw, "# EOF")
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler returns an http.Handler serving the metrics of the given
+// collectors. Clients accepting OpenMetrics are served exemplars.
+func MetricsHandler(cs ...*Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write := WriteMetrics
+		if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			write = WriteOpenMetrics
+		} else {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		}
+		if err := write(w, cs...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MigratedRound is the round recorded in the provenance records recovered
+// by MigrateObservations.
+const MigratedRound = "migrated"
+
+// ValidateAccepted checks every line of a legacy accepted file before it is
+// migrated to another Storage: each line must decrypt with sc and hold a
+// checkpoint, and in chained mode the file must pass VerifyChain. It returns
+// the accepted checkpoints, oldest first, and the problems found. A missing
+// file holds no checkpoints.
+func ValidateAccepted(filename string, sc *StateCipher, chained bool) ([]Checkpoint, []string, error) {
+	var problems []string
+	if chained {
+		report, err := VerifyChainFile(filename, sc)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		problems = report.Problems
+	}
+
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var accepted []Checkpoint
+	o := lineOpener{sc: sc, kind: sealAccepted}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		// VerifyChain already reported the lines of a chained file that
+		// cannot be read.
+		line, err := o.open(scanner.Text())
+		if err != nil {
+			if !chained {
+				problems = append(problems, fmt.Sprintf("line %d: %v", n, err))
+			}
+			continue
+		}
+		if chained {
+			cl, err := ParseChainedLine(line)
+			if err != nil {
+				continue
+			}
+			line = cl.Checkpoint
+		}
+		chpt, err := ParseCheckpoint(line)
+		if err != nil {
+			if !chained {
+				problems = append(problems, fmt.Sprintf("line %d: %v", n, err))
+			}
+			continue
+		}
+		accepted = append(accepted, chpt)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", filename, err)
+	}
+	return accepted, problems, nil
+}
+
+// MigrateObservations recovers the state a collector keeps besides its
+// accepted checkpoints from the logfiles of its local monitors, for
+// collectors that ran without HistoryDir or ProvenanceFile. The checkpoints
+// of each logfile are merged into its history file, observed at their
+// Timestamp since the time they were first read is not known. If the
+// provenance file holds no records, the provenance of each of accepted is
+// recovered from the monitors whose logfiles hold it, in round
+// MigratedRound; checkpoints no logfile holds any more get no record. It
+// returns the number of observations and provenance records written.
+func (c *Collector) MigrateObservations(accepted []Checkpoint) (int, int, error) {
+	if c.cfg.HistoryDir == "" && c.cfg.ProvenanceFile == "" {
+		return 0, 0, nil
+	}
+	monitors, err := c.Monitors()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var reads []monitorRead
+	observations := 0
+	for _, m := range monitors {
+		// Remote and pushing monitors have no logfile to recover from.
+		if m.SPIFFEID != "" || strings.Contains(m.Logfile, "://") {
+			continue
+		}
+		b, err := os.ReadFile(m.Logfile)
+		if errors.Is(err, fs.ErrNotExist) {
+			c.logf("Skipping missing logfile %s\n", m.Logfile)
+			continue
+		}
+		if err != nil {
+			return observations, 0, err
+		}
+		chpts := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		reads = append(reads, monitorRead{monitor: m.Logfile, network: m.Network, chpts: chpts})
+		if c.cfg.HistoryDir == "" {
+			continue
+		}
+		n, err := importHistory(HistoryFile(c.cfg.HistoryDir, m.Logfile), chpts, c.cfg.StateCipher)
+		if err != nil {
+			return observations, 0, fmt.Errorf("importing history of %s: %w", m.Logfile, err)
+		}
+		observations += n
+	}
+
+	if c.cfg.ProvenanceFile == "" {
+		return observations, 0, nil
+	}
+	existing, err := ReadProvenance(c.cfg.ProvenanceFile, c.cfg.StateCipher)
+	if err != nil {
+		return observations, 0, err
+	}
+	if len(existing) > 0 {
+		c.logf("Provenance file %s already holds records, not recovering provenance\n", c.cfg.ProvenanceFile)
+		return observations, 0, nil
+	}
+	var records []Provenance
+	for _, chpt := range accepted {
+		p := provenance(chpt, MigratedRound, c.cfg.Quorum, reads, c.now())
+		if len(p.Supporters) == 0 {
+			continue
+		}
+		p.AcceptedAt = time.Time{}
+		for i, s := range p.Supporters {
+			p.Supporters[i].ObservedAt = checkpointTime(s.Timestamp)
+			if p.Supporters[i].ObservedAt.After(p.AcceptedAt) {
+				p.AcceptedAt = p.Supporters[i].ObservedAt
+			}
+		}
+		records = append(records, p)
+	}
+	if len(records) == 0 {
+		return observations, 0, nil
+	}
+	if err := appendProvenance(c.cfg.ProvenanceFile, records, c.cfg.Keep, c.cfg.StateCipher); err != nil {
+		return observations, 0, err
+	}
+	return observations, len(records), nil
+}
+
+// importHistory merges the checkpoints of a monitor logfile that are not
+// recorded yet into its history file, keeping it ordered by observation
+// time, and returns the number of observations added.
+func importHistory(filename string, chpts []string, sc *StateCipher) (int, error) {
+	observations, err := ReadHistory(filename, sc)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	recorded := make(map[string]bool, len(observations))
+	for _, o := range observations {
+		recorded[o.Checkpoint] = true
+	}
+	added := 0
+	for _, line := range chpts {
+		chpt, err := ParseCheckpoint(line)
+		if err != nil || recorded[line] {
+			continue
+		}
+		recorded[line] = true
+		observations = append(observations, Observation{Time: checkpointTime(chpt.Timestamp), Checkpoint: line})
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+
+	sort.SliceStable(observations, func(i, j int) bool {
+		return observations[i].Time.Before(observations[j].Time)
+	})
+	lines := make([]string, len(observations))
+	var prev string
+	for i, o := range observations {
+		line, err := sc.sealLine(sealHistory, prev, o.Time.UTC().Format(time.RFC3339Nano)+" "+o.Checkpoint)
+		if err != nil {
+			return 0, err
+		}
+		lines[i], prev = line, line
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return 0, err
+	}
+	return added, replaceFile(filename, lines)
+}
+
+// checkpointTime returns the time of a checkpoint Timestamp, or the zero
+// time if the checkpoint has none.
+func checkpointTime(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ts).UTC()
+}
@@ -0,0 +1,378 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+// Mirror stores the entries of a log between consecutive accepted
+// checkpoints, verified against the accepted root hashes, in Dir. The
+// segments stored form a partial mirror of the log starting at the first
+// tree size accepted with the mirror configured.
+type Mirror struct {
+	Dir string
+	// Entries reads the entries that are mirrored.
+	Entries EntrySource
+	// Origin, if set, restricts mirroring to checkpoints of this log, the
+	// one Entries reads from, matched with MatchOrigin.
+	Origin string
+	// Workers is the number of entries read in parallel,
+	// DefaultPipelineWorkers if not positive.
+	Workers int
+}
+
+// MirrorSegment is the first line of a segment file, describing the entries
+// in [Start, End) that follow it.
+type MirrorSegment struct {
+	Origin string `json:"origin"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	// RootHash is the base64 root hash of the accepted checkpoint of tree
+	// size End.
+	RootHash string `json:"root_hash"`
+	// Left holds the hashes of the compact range [0, Start), taken from
+	// the inclusion proof of entry Start. With the leaf hashes of the
+	// segment's entries they hash to RootHash.
+	Left [][]byte `json:"left"`
+}
+
+// MirrorEntry is an entry line of a segment file.
+type MirrorEntry struct {
+	Index          int64  `json:"index"`
+	Body           []byte `json:"body"`
+	IntegratedTime int64  `json:"integrated_time,omitempty"`
+}
+
+// mirrorSegmentFile returns the name of the file of the segment [start, end).
+func mirrorSegmentFile(dir string, start, end int64) string {
+	return filepath.Join(dir, fmt.Sprintf("entries-%d-%d.jsonl", start, end))
+}
+
+// mirror mirrors the entries between every checkpoint of batch and the one
+// before it, starting with tree size from. Failures are logged; ranges that
+// could not be mirrored are reported by AuditMirror.
+func (c *Collector) mirror(from int64, batch []Checkpoint) {
+	m := c.cfg.Mirror
+	if m == nil || m.Entries == nil {
+		return
+	}
+	for _, chpt := range batch {
+		if chpt.Size <= from || (m.Origin != "" && !MatchOrigin(m.Origin, chpt.Origin)) {
+			continue
+		}
+		err := m.store(from, chpt)
+		switch {
+		case errors.Is(err, ErrQuotaExceeded):
+			c.logf("Skipping mirroring of entries %d to %d of %s: %v\n", from, batch[len(batch)-1].Size-1, chpt.Origin, err)
+			return
+		case errors.Is(err, errRootMismatch):
+			c.anoms.record(AnomalyMirror, chpt.Origin)
+			c.alert(Alert{Kind: AnomalyMirror, Origin: chpt.Origin, Size: chpt.Size, Previous: from, Roots: []string{chpt.Hash}, Message: fmt.Sprintf("mirroring entries %d to %d of %s: %v", from, chpt.Size-1, chpt.Origin, err)})
+		case err != nil:
+			c.logf("Mirroring entries %d to %d of %s: %v\n", from, chpt.Size-1, chpt.Origin, err)
+		}
+		from = chpt.Size
+	}
+}
+
+// errRootMismatch is returned when mirrored entries do not hash to the
+// accepted root hash.
+var errRootMismatch = errors.New("entries do not hash to the accepted root hash")
+
+// store fetches the entries in [from, chpt.Size), verifies them against the
+// root hash of chpt and writes them to a segment file. Mirroring is optional
+// and stops when the log API's request budget runs low.
+func (m *Mirror) store(from int64, chpt Checkpoint) error {
+	entries := make([]LogEntry, chpt.Size-from)
+	report, err := runOptional(Pipeline{Workers: m.Workers}, from, chpt.Size, func(ctx context.Context, index int64) error {
+		e, err := m.Entries.Entry(ctx, index)
+		if err != nil {
+			return err
+		}
+		entries[index-from] = e
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(report.Failures) > 0 {
+		f := report.Failures[0]
+		return fmt.Errorf("fetching entry %d and %d others: %s", f.Index, len(report.Failures)-1, f.Error)
+	}
+
+	seg := MirrorSegment{Origin: chpt.Origin, Start: from, End: chpt.Size, RootHash: chpt.Hash}
+	if from > 0 {
+		p := entries[0].Proof
+		if p == nil {
+			return fmt.Errorf("the log returned no inclusion proof for entry %d", from)
+		}
+		if seg.Left, err = leftHashes(from, p.TreeSize, p.Hashes); err != nil {
+			return fmt.Errorf("inclusion proof of entry %d: %w", from, err)
+		}
+	}
+	if _, err := seg.verify(entries); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(seg)
+	if err != nil {
+		return err
+	}
+	lines := []string{string(b)}
+	for _, e := range entries {
+		b, err := json.Marshal(MirrorEntry{Index: e.Index, Body: e.Body, IntegratedTime: e.IntegratedTime})
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(b))
+	}
+	return replaceFile(mirrorSegmentFile(m.Dir, from, chpt.Size), lines)
+}
+
+// leftHashes returns the hashes of the compact range [0, index) from the hex
+// encoded inclusion proof of the entry at index in a tree of size: the
+// siblings to the left of its path, ordered from the largest subtree.
+func leftHashes(index, size int64, proof []string) ([][]byte, error) {
+	if index >= size {
+		return nil, fmt.Errorf("log index %d is not in a tree of size %d", index, size)
+	}
+	inner := bits.Len64(uint64(index) ^ uint64(size-1))
+	var left [][]byte
+	for i, h := range proof {
+		if i < inner && (index>>uint(i))&1 == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proof hash %q", h)
+		}
+		left = append([][]byte{b}, left...)
+	}
+	if n := compact.RangeSize(0, uint64(index)); len(left) != n {
+		return nil, fmt.Errorf("proof has %d hashes left of the entry, expected %d", len(left), n)
+	}
+	return left, nil
+}
+
+// verify checks that the compact range Left and the leaf hashes of entries,
+// which are the entries of the segment in order, hash to RootHash. A match
+// proves both the entries and Left. It returns the compact range [0, End).
+func (s MirrorSegment) verify(entries []LogEntry) (*compact.Range, error) {
+	if int64(len(entries)) != s.End-s.Start {
+		return nil, fmt.Errorf("segment has %d entries, expected %d", len(entries), s.End-s.Start)
+	}
+	rf := compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}
+	// The range reuses the slice it is given for its own hashes.
+	r, err := rf.NewRange(0, uint64(s.Start), append([][]byte(nil), s.Left...))
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if e.Index != s.Start+int64(i) {
+			return nil, fmt.Errorf("got entry %d in place of entry %d", e.Index, s.Start+int64(i))
+		}
+		if err := r.Append(e.LeafHash(), nil); err != nil {
+			return nil, err
+		}
+	}
+	root, err := r.GetRootHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	want, err := base64.StdEncoding.DecodeString(s.RootHash)
+	if err != nil {
+		return nil, fmt.Errorf("decoding root hash: %w", err)
+	}
+	if !bytes.Equal(root, want) {
+		return nil, fmt.Errorf("%w of tree size %d", errRootMismatch, s.End)
+	}
+	return r, nil
+}
+
+// MirrorReport is the result of AuditMirror.
+type MirrorReport struct {
+	Segments int
+	Entries  int64
+	// Confirmed is the number of segments whose root hash is that of an
+	// accepted checkpoint still in the accepted file.
+	Confirmed int
+	// Problems lists every corrupted or missing range found. The mirror
+	// is intact if it is empty.
+	Problems []string
+}
+
+// AuditMirror recomputes the root hash of every segment stored in dir by a
+// Mirror from its entries and checks it against the accepted checkpoint of
+// the same tree size, if still retained. It also checks that the segments of
+// each log follow each other without gaps up to the largest accepted tree
+// size, and that each extends the tree of the one before it.
+func (c *Collector) AuditMirror(dir string) (MirrorReport, error) {
+	var report MirrorReport
+	problem := func(format string, args ...any) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return report, fmt.Errorf("reading accepted checkpoints: %w", err)
+	}
+	accepted := make(map[string]map[int64]string)
+	for _, l := range lines {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			return report, fmt.Errorf("reading accepted checkpoints: %w", err)
+		}
+		if accepted[chpt.Origin] == nil {
+			accepted[chpt.Origin] = make(map[int64]string)
+		}
+		accepted[chpt.Origin][chpt.Size] = chpt.Hash
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "entries-*-*.jsonl"))
+	if err != nil {
+		return report, err
+	}
+	type segment struct {
+		MirrorSegment
+		file string
+		// tree is the compact range [0, End), nil if the segment is
+		// corrupted.
+		tree *compact.Range
+	}
+	byOrigin := make(map[string][]segment)
+	for _, f := range files {
+		seg, entries, err := readMirrorSegment(f)
+		if err != nil {
+			problem("%s: %v", f, err)
+			continue
+		}
+		report.Segments++
+		report.Entries += int64(len(entries))
+		s := segment{MirrorSegment: seg, file: f}
+		if s.tree, err = seg.verify(entries); err != nil {
+			problem("%s: entries %d to %d of %s are corrupted: %v", f, seg.Start, seg.End-1, seg.Origin, err)
+		}
+		if hash, ok := accepted[seg.Origin][seg.End]; ok {
+			if hash != seg.RootHash {
+				problem("%s: root hash %s of tree size %d is not the accepted root hash %s", f, seg.RootHash, seg.End, hash)
+			} else if s.tree != nil {
+				report.Confirmed++
+			}
+		}
+		byOrigin[seg.Origin] = append(byOrigin[seg.Origin], s)
+	}
+
+	origins := make([]string, 0, len(byOrigin))
+	for o := range byOrigin {
+		origins = append(origins, o)
+	}
+	sort.Strings(origins)
+	for _, origin := range origins {
+		segs := byOrigin[origin]
+		sort.Slice(segs, func(i, j int) bool { return segs[i].Start < segs[j].Start })
+		for i := 1; i < len(segs); i++ {
+			prev, s := segs[i-1], segs[i]
+			switch {
+			case s.Start > prev.End:
+				problem("entries %d to %d of %s are missing", prev.End, s.Start-1, origin)
+			case s.Start < prev.End:
+				problem("%s: entries %d to %d of %s overlap %s", s.file, s.Start, prev.End-1, origin, prev.file)
+			case prev.tree != nil && s.tree != nil && !equalHashes(prev.tree.Hashes(), s.Left):
+				problem("%s: the tree of entries %d to %d of %s does not extend %s", s.file, s.Start, s.End-1, origin, prev.file)
+			}
+		}
+		last := segs[len(segs)-1].End
+		var largest int64
+		for size := range accepted[origin] {
+			if size > largest {
+				largest = size
+			}
+		}
+		if largest > last {
+			problem("entries %d to %d of %s are missing", last, largest-1, origin)
+		}
+	}
+	return report, nil
+}
+
+// readMirrorSegment reads a segment file written by Mirror.
+func readMirrorSegment(filename string) (MirrorSegment, []LogEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return MirrorSegment{}, nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var seg MirrorSegment
+	var entries []LogEntry
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			if n == 1 {
+				return seg, nil, errors.New("empty segment file")
+			}
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return seg, nil, err
+		}
+		if n == 1 {
+			if err := json.Unmarshal(line, &seg); err != nil {
+				return seg, nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		}
+		var e MirrorEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return seg, nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		entries = append(entries, LogEntry{Index: e.Index, Body: e.Body, IntegratedTime: e.IntegratedTime})
+	}
+	return seg, entries, nil
+}
+
+// equalHashes reports whether two lists of hashes are equal.
+func equalHashes(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Monitor is a single rekor-monitor instance whose logfile is read by the collector.
+type Monitor struct {
+	Description string `json:"description"`
+	Logfile     string `json:"logfile"`
+	// Network identifies the network the monitor observes the log from,
+	// such as its autonomous system, e.g. "AS15169". See
+	// Config.MinNetworks.
+	Network string `json:"network,omitempty"`
+	// Origin, if set, is the origin of the log the monitor observes,
+	// matched with MatchOrigin. Checkpoints of other origins are rejected.
+	Origin string `json:"origin,omitempty"`
+	// SPIFFEID, if set, identifies a monitor pushing its checkpoints to
+	// the collector over mTLS with an X.509-SVID instead of being read.
+	// Its Logfile is set to the ID.
+	SPIFFEID string `json:"spiffe_id,omitempty"`
+	// HeartbeatFile, if set, is a local file the monitor touches
+	// periodically to show it is alive, even if the log has not grown.
+	HeartbeatFile string `json:"heartbeat_file,omitempty"`
+	// MaxFileSize and ReadTimeout, if set, override the collector's limits
+	// for this monitor.
+	MaxFileSize int64    `json:"max_file_size,omitempty"`
+	ReadTimeout Duration `json:"read_timeout,omitempty"`
+}
+
+// Duration is a time.Duration encoded in JSON as a string such as "10s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ImportedMonitorList is the monitor list in Config.ImportDir.
+const ImportedMonitorList = "monitor_list.json"
+
+// monitorList represents the monitor_list JSON data.
+type monitorList struct {
+	Monitors []Monitor `json:"monitors"`
+}
+
+// LoadMonitorList reads the monitors from a monitor_list JSON file. Relative
+// logfile paths are resolved against the directory containing the list.
+// Logfiles may also be URIs read by the Fetcher for their scheme, such as
+// file://, https://, ssh:// or s3://.
+func LoadMonitorList(path string) ([]Monitor, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list monitorList
+	if err := json.Unmarshal(contents, &list); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	for i, m := range list.Monitors {
+		if m.SPIFFEID != "" {
+			list.Monitors[i].Logfile = m.SPIFFEID
+			continue
+		}
+		if isLocal(m.Logfile) && !filepath.IsAbs(m.Logfile) {
+			list.Monitors[i].Logfile = filepath.Join(dir, filepath.FromSlash(m.Logfile))
+		}
+		if m.HeartbeatFile != "" && !filepath.IsAbs(m.HeartbeatFile) {
+			list.Monitors[i].HeartbeatFile = filepath.Join(dir, filepath.FromSlash(m.HeartbeatFile))
+		}
+	}
+
+	return list.Monitors, nil
+}
+
+// GlobMonitors returns a monitor for every logfile matching pattern.
+func GlobMonitors(pattern string) ([]Monitor, error) {
+	files, err := filepath.Glob(filepath.FromSlash(pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	monitors := make([]Monitor, len(files))
+	for i, f := range files {
+		monitors[i] = Monitor{Description: filepath.Base(f), Logfile: f}
+	}
+
+	return monitors, nil
+}
+
+// readBlockSize is the size of the blocks ReadLatestCheckpoints reads from
+// the end of a file.
+const readBlockSize = 4096
+
+// ReadLatestCheckpoints reads the latest n checkpoints from the given file.
+// The file is read backwards from its end, so the cost depends on the size of
+// the last n lines rather than of the whole file.
+func ReadLatestCheckpoints(filename string, n int) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readLastLines(file, fi.Size(), n)
+}
+
+// readLastLines returns the last n lines of the first size bytes of r in
+// order. Like bufio.ScanLines, it drops a trailing newline and carriage
+// returns before newlines.
+func readLastLines(r io.ReaderAt, size int64, n int) ([]string, error) {
+	var lines []string
+	if n <= 0 || size == 0 {
+		return lines, nil
+	}
+
+	buf := make([]byte, readBlockSize)
+	// partial holds the end of a line whose start is in an earlier block.
+	var partial []byte
+	end := size
+	for end > 0 && len(lines) < n {
+		start := end - readBlockSize
+		if start < 0 {
+			start = 0
+		}
+		b := buf[:end-start]
+		if _, err := r.ReadAt(b, start); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if end == size && b[len(b)-1] == '\n' {
+			b = b[:len(b)-1]
+		}
+		for len(lines) < n {
+			i := bytes.LastIndexByte(b, '\n')
+			if i < 0 {
+				partial = append(append([]byte{}, b...), partial...)
+				break
+			}
+			lines = append(lines, dropCR(append(append([]byte{}, b[i+1:]...), partial...)))
+			partial = nil
+			b = b[:i]
+		}
+		end = start
+	}
+	if end == 0 && len(lines) < n {
+		lines = append(lines, dropCR(partial))
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, nil
+}
+
+func dropCR(line []byte) string {
+	return string(bytes.TrimSuffix(line, []byte{'\r'}))
+}
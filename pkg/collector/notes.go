@@ -0,0 +1,330 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content-addressed checkpoint notes are stored in a directory of the
+// history directory. Its pack file holds a record per note: the uvarint
+// encoded length of the rest of the record, then the SHA-256 of the note and
+// its zstd frame, encrypted like the history files. Its dict-<ID> files hold
+// the zstd dictionaries the frames reference by ID, encrypted likewise.
+const (
+	notesDir        = "notes"
+	notesPack       = "pack"
+	notesDictPrefix = "dict-"
+	// noteRefPrefix marks a history line referencing a stored note
+	// instead of holding the checkpoint, which never starts with it.
+	noteRefPrefix = "@"
+	// shortRefLen is the length of the references to notes: a prefix of
+	// the unpadded base64url encoded SHA-256 of the note, or all of it if
+	// the prefix already references another note.
+	shortRefLen = 16
+)
+
+const (
+	// dictSamples is the number of latest notes a dictionary is trained
+	// on, enough for the sequence statistics of the dictionary.
+	dictSamples = 256
+	// notesPerDict is the number of notes stored with a dictionary before
+	// a new one is trained on the latest notes, following changes of the
+	// logs' keys or origins.
+	notesPerDict = 10000
+	// maxDictSize is the size of the dictionaries' history, a few
+	// checkpoints, which is all they repeat.
+	maxDictSize = 4096
+	// firstDictID is the first dictionary ID outside the range reserved
+	// by the zstd format.
+	firstDictID = 32768
+)
+
+// noteSpan locates a record of the pack file.
+type noteSpan struct {
+	off int64
+	n   int
+}
+
+// noteStore stores checkpoint notes content-addressed by their SHA-256, so
+// that a note read from several monitors is stored once, compressed with
+// zstd dictionaries trained on the notes stored before.
+type noteStore struct {
+	dir string
+	sc  *StateCipher
+
+	mu sync.Mutex
+	// index holds the record of each note by its key, and refs the key
+	// of each short reference.
+	index map[string]noteSpan
+	refs  map[string]string
+	size  int64
+	// recent holds the latest notes stored, to train dictionaries on,
+	// and nextDict the number of notes stored when the next dictionary is
+	// trained.
+	recent   [][]byte
+	nextDict int
+	dicts    map[uint32][]byte
+	enc      *zstd.Encoder
+	dec      *zstd.Decoder
+	logf     func(format string, args ...any)
+}
+
+// noteKey returns the key a note is stored under.
+func noteKey(note []byte) string {
+	sum := sha256.Sum256(note)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// openNoteStore opens the note store of a history directory, reading its
+// dictionaries and indexing its pack file.
+func openNoteStore(historyDir string, sc *StateCipher, logf func(format string, args ...any)) (*noteStore, error) {
+	s := &noteStore{dir: filepath.Join(historyDir, notesDir), sc: sc, index: make(map[string]noteSpan), refs: make(map[string]string), dicts: make(map[uint32][]byte), logf: logf}
+	files, err := os.ReadDir(s.dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var latest uint32
+	for _, f := range files {
+		id, err := strconv.ParseUint(strings.TrimPrefix(f.Name(), notesDictPrefix), 10, 32)
+		if !strings.HasPrefix(f.Name(), notesDictPrefix) || err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if b, err = sc.openBlob(sealNoteDict, b); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		s.dicts[uint32(id)] = b
+		if uint32(id) > latest {
+			latest = uint32(id)
+		}
+	}
+	if err := s.setCoders(latest); err != nil {
+		return nil, err
+	}
+	s.nextDict = dictSamples + len(s.dicts)*notesPerDict
+
+	f, err := os.Open(filepath.Join(s.dir, notesPack))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		if b, err = s.sc.openBlob(sealNote, b); err != nil || len(b) < sha256.Size {
+			return nil, fmt.Errorf("%s: invalid record at offset %d", f.Name(), s.size)
+		}
+		off := s.size + int64(uvarintLen(n))
+		s.add(base64.RawURLEncoding.EncodeToString(b[:sha256.Size]), noteSpan{off: off, n: int(n)})
+		s.size = off + int64(n)
+	}
+	return s, nil
+}
+
+func uvarintLen(n uint64) int {
+	return len(binary.AppendUvarint(nil, n))
+}
+
+// add indexes a record and returns the reference to it.
+func (s *noteStore) add(key string, span noteSpan) string {
+	s.index[key] = span
+	short := key[:shortRefLen]
+	if k, ok := s.refs[short]; ok && k != key {
+		return key
+	}
+	s.refs[short] = key
+	return short
+}
+
+// ref returns the reference to a stored note.
+func (s *noteStore) ref(key string) string {
+	if short := key[:shortRefLen]; s.refs[short] == key {
+		return short
+	}
+	return key
+}
+
+// setCoders sets up the encoder with dictionary id, none if zero, and the
+// decoder with every dictionary.
+func (s *noteStore) setCoders(id uint32) error {
+	opts := []zstd.EOption{zstd.WithEncoderCRC(false)}
+	if id != 0 {
+		opts = append(opts, zstd.WithEncoderDict(s.dicts[id]))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return err
+	}
+	var dicts [][]byte
+	for _, d := range s.dicts {
+		dicts = append(dicts, d)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return err
+	}
+	if s.dec != nil {
+		s.dec.Close()
+	}
+	s.enc, s.dec = enc, dec
+	return nil
+}
+
+// put stores the notes not stored yet and returns the references to them.
+func (s *noteStore) put(notes []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs := make([]string, len(notes))
+	var records []byte
+	for i, note := range notes {
+		key := noteKey([]byte(note))
+		if _, ok := s.index[key]; ok {
+			refs[i] = noteRefPrefix + s.ref(key)
+			continue
+		}
+		sum := sha256.Sum256([]byte(note))
+		record, err := s.sc.sealBlob(sealNote, s.enc.EncodeAll([]byte(note), sum[:]))
+		if err != nil {
+			return nil, err
+		}
+		records = binary.AppendUvarint(records, uint64(len(record)))
+		off := s.size + int64(len(records))
+		records = append(records, record...)
+		refs[i] = noteRefPrefix + s.add(key, noteSpan{off: off, n: len(record)})
+
+		s.recent = append(s.recent, []byte(note))
+		if len(s.recent) > dictSamples {
+			s.recent = s.recent[1:]
+		}
+	}
+	if len(records) == 0 {
+		return refs, nil
+	}
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, notesPack), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(records); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	s.size += int64(len(records))
+	if len(s.recent) == dictSamples && len(s.index) >= s.nextDict {
+		// Without a new dictionary, notes are compressed with the
+		// previous one.
+		if err := s.train(); err != nil && s.logf != nil {
+			s.logf("Training a dictionary for checkpoint notes: %v\n", err)
+		}
+		s.nextDict = len(s.index) + notesPerDict
+	}
+	return refs, nil
+}
+
+// train trains a dictionary on the latest notes, once dictSamples notes are
+// stored and every notesPerDict notes after.
+func (s *noteStore) train() (err error) {
+	// The dictionary builder panics on inputs it cannot find enough
+	// repetitions in.
+	defer recoverPanic(&err)
+	id := uint32(firstDictID + len(s.dicts))
+	d, err := dict.BuildZstdDict(s.recent, dict.Options{MaxDictSize: maxDictSize, HashBytes: 6, ZstdDictID: id})
+	if err != nil {
+		return err
+	}
+	sealed, err := s.sc.sealBlob(sealNoteDict, d)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, notesDictPrefix+strconv.FormatUint(uint64(id), 10)), sealed, 0600); err != nil {
+		return err
+	}
+	s.dicts[id] = d
+	return s.setCoders(id)
+}
+
+// get returns the note a reference refers to.
+func (s *noteStore) get(ref string) (string, error) {
+	key := strings.TrimPrefix(ref, noteRefPrefix)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(key) == shortRefLen {
+		key = s.refs[key]
+	}
+	span, ok := s.index[key]
+	if !ok {
+		return "", fmt.Errorf("unknown checkpoint note %s", ref)
+	}
+	f, err := os.Open(filepath.Join(s.dir, notesPack))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b := make([]byte, span.n)
+	if _, err := f.ReadAt(b, span.off); err != nil {
+		return "", err
+	}
+	if b, err = s.sc.openBlob(sealNote, b); err != nil {
+		return "", err
+	}
+	note, err := s.dec.DecodeAll(b[sha256.Size:], nil)
+	if err != nil {
+		return "", fmt.Errorf("checkpoint note %s: %w", ref, err)
+	}
+	if noteKey(note) != key {
+		return "", fmt.Errorf("checkpoint note %s does not match its hash", ref)
+	}
+	return string(note), nil
+}
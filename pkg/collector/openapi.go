@@ -0,0 +1,461 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiParam is a query or path parameter of an HTTP API operation.
+type apiParam struct {
+	Name string
+	Type string // "string" or "integer"
+	// Format is "date-time" for RFC 3339 times.
+	Format           string
+	Minimum, Maximum int64
+	// Pattern is a regular expression string values must match.
+	Pattern     string
+	Description string
+	// InPath is set for the parameter named in braces at the end of the
+	// operation's path.
+	InPath bool
+}
+
+// bounds describes the range of an integer parameter.
+func (p apiParam) bounds() string {
+	if p.Maximum > 0 {
+		return fmt.Sprintf("from %d to %d", p.Minimum, p.Maximum)
+	}
+	return fmt.Sprintf("of at least %d", p.Minimum)
+}
+
+// apiOperation describes an operation of the HTTP API. The OpenAPI document
+// is generated from these descriptions and requests are validated against
+// them before they reach a handler, so the two cannot drift apart.
+type apiOperation struct {
+	ID      string
+	Method  string
+	Path    string
+	Summary string
+	Params  []apiParam
+	// Body is the media type of the request body, if the operation has one,
+	// and Request the type of a JSON body.
+	Body    string
+	Request reflect.Type
+	// Response is the type of a successful response body, served in every
+	// encoding unless Produces names its media type. Produces alone is the
+	// media type of a successful response that is not a record. If neither
+	// is set the operation answers with 204 No Content.
+	Response reflect.Type
+	Produces string
+}
+
+// maxPageSize is the largest page_size of list operations.
+const maxPageSize = 1000
+
+// maxWaitSeconds is the longest timeout of the waitForTreeSize operation.
+const maxWaitSeconds = 300
+
+var namespaceParam = apiParam{Name: "namespace", Type: "string", Description: "The tenant in multi-tenant mode."}
+
+var maxAgeParam = apiParam{Name: "max_age", Type: "integer", Minimum: 1, Description: "Seconds since the latest checkpoint was accepted beyond which it is stale."}
+
+// apiOperations lists the operations of the read API and of the push
+// endpoints.
+var apiOperations = []apiOperation{
+	{
+		ID:      "listProvenance",
+		Method:  http.MethodGet,
+		Path:    "/api/v1/provenance",
+		Summary: "Lists the provenance of retained accepted checkpoints.",
+		Params: []apiParam{
+			namespaceParam,
+			{Name: "origin", Type: "string", Description: "An origin or origin pattern."},
+			{Name: "tree_size", Type: "integer", Description: "A tree size."},
+			{Name: "since", Type: "string", Format: "date-time", Description: "Only checkpoints accepted at or after this time."},
+			{Name: "until", Type: "string", Format: "date-time", Description: "Only checkpoints accepted before this time."},
+			{Name: "page_size", Type: "integer", Minimum: 1, Maximum: maxPageSize, Description: "The maximum number of records to return. The Link header holds the URL of the next page, if there is one."},
+			{Name: "page_token", Type: "string", Description: "The token of the page to return, taken from the Link header of the previous page."},
+		},
+		Response: reflect.TypeOf([]Provenance{}),
+	},
+	{
+		ID:       "listMonitors",
+		Method:   http.MethodGet,
+		Path:     "/api/v1/monitors",
+		Summary:  "Lists the status of every monitor.",
+		Params:   []apiParam{namespaceParam},
+		Response: reflect.TypeOf([]MonitorStatus{}),
+	},
+	{
+		ID:      "checkpointByHash",
+		Method:  http.MethodGet,
+		Path:    "/api/v1/checkpoint/by-hash/{sha256}",
+		Summary: "Returns the exact bytes of an accepted checkpoint, as a signed note or a flattened line, whose SHA-256 is given.",
+		Params: []apiParam{
+			{Name: "sha256", Type: "string", Pattern: "^[0-9a-f]{64}$", InPath: true, Description: "The hex encoded SHA-256 of the checkpoint."},
+			namespaceParam,
+		},
+		Produces: "text/plain",
+	},
+	{
+		ID:      "waitForTreeSize",
+		Method:  http.MethodGet,
+		Path:    "/api/v1/checkpoint/wait",
+		Summary: "Waits until a checkpoint of at least the given tree size is accepted and returns it as a signed note. Answers with 204 No Content if none is accepted before the timeout.",
+		Params: []apiParam{
+			{Name: "tree_size", Type: "integer", Minimum: 1, Description: "The tree size the checkpoint must cover."},
+			{Name: "origin", Type: "string", Description: "An origin or origin pattern."},
+			{Name: "timeout", Type: "integer", Minimum: 1, Maximum: maxWaitSeconds, Description: "Seconds to wait, 30 by default."},
+			namespaceParam,
+		},
+		Produces: "text/plain",
+	},
+	{
+		ID:      "latestCheckpoint",
+		Method:  http.MethodGet,
+		Path:    "/api/v1/checkpoint/latest",
+		Summary: "Returns the accepted checkpoint with the largest tree size as a signed note, with the time it was last accepted in the X-Accepted-At header. Answers with 404 Not Found if none was accepted, and with 412 Precondition Failed if it was accepted longer than max_age ago.",
+		Params: []apiParam{
+			{Name: "origin", Type: "string", Description: "An origin or origin pattern."},
+			maxAgeParam,
+			namespaceParam,
+		},
+		Produces: "text/plain",
+	},
+	{
+		ID:       "attestation",
+		Method:   http.MethodGet,
+		Path:     "/api/v1/attestation",
+		Summary:  "Returns a signed note attesting the latest accepted checkpoint of every log, for peer collectors. Answers with 404 Not Found if the collector has no signing key.",
+		Params:   []apiParam{namespaceParam},
+		Produces: "text/plain",
+	},
+	{
+		ID:      "readTable",
+		Method:  http.MethodGet,
+		Path:    "/api/v1/tables/{table}",
+		Summary: "Returns the rows of a table of the collector's history as CSV with a header line, oldest first, for BI tools and PostgreSQL foreign tables.",
+		Params: []apiParam{
+			{Name: "table", Type: "string", Pattern: "^(" + strings.Join(tableNames(), "|") + ")$", InPath: true, Description: "The table: observations read from monitors, which needs a history directory, acceptances of checkpoints or the supporters of each, which need a provenance file."},
+			{Name: "since", Type: "string", Format: "date-time", Description: "Only rows at or after this time."},
+			{Name: "until", Type: "string", Format: "date-time", Description: "Only rows before this time."},
+			namespaceParam,
+		},
+		Produces: "text/csv",
+	},
+	{
+		ID:      "roundReportByCheckpoint",
+		Method:  http.MethodGet,
+		Path:    "/api/v1/reports/by-checkpoint",
+		Summary: "Returns the archived report of the latest round that accepted a checkpoint, with the observations of every monitor. Answers with 404 Not Found if no archived round accepted it.",
+		Params: []apiParam{
+			{Name: "origin", Type: "string", Description: "An origin or origin pattern."},
+			{Name: "tree_size", Type: "integer", Minimum: 1, Description: "The tree size of the checkpoint."},
+			namespaceParam,
+		},
+		Response: reflect.TypeOf(RoundReport{}),
+		Produces: mediaJSON,
+	},
+	{
+		ID:       "verifyInclusion",
+		Method:   http.MethodPost,
+		Path:     "/api/v1/verify-inclusion",
+		Summary:  "Verifies an inclusion proof against the accepted checkpoints and returns a verdict signed by the collector.",
+		Params:   []apiParam{namespaceParam},
+		Body:     mediaJSON,
+		Request:  reflect.TypeOf(InclusionRequest{}),
+		Response: reflect.TypeOf(InclusionVerdict{}),
+		Produces: mediaJSON,
+	},
+	{
+		ID:      "logStatus",
+		Method:  http.MethodGet,
+		Path:    "/status/{origin}",
+		Summary: "Returns the health of a log: its latest accepted checkpoint, the status of every monitor, open alerts and recent conflicts. Answers with 412 Precondition Failed if the latest checkpoint was accepted longer than max_age ago.",
+		Params: []apiParam{
+			{Name: "origin", Type: "string", Pattern: "^[^/]+$", InPath: true, Description: "An origin or origin pattern."},
+			maxAgeParam,
+			namespaceParam,
+		},
+		Response: reflect.TypeOf(LogStatus{}),
+	},
+	{
+		ID:      "push",
+		Method:  http.MethodPost,
+		Path:    "/push",
+		Summary: "Pushes checkpoints read by a monitor authenticated with its X.509-SVID, one per line.",
+		Body:    "text/plain",
+	},
+	{
+		ID:      "conflictHint",
+		Method:  http.MethodPost,
+		Path:    "/hint/conflict",
+		Summary: "Starts an urgent round on a conflict seen by a monitor authenticated with its X.509-SVID: checkpoints of the same tree size with different root hashes, one per line. Answers with 202 Accepted.",
+		Body:    "text/plain",
+	},
+	{
+		ID:      "heartbeat",
+		Method:  http.MethodPost,
+		Path:    "/heartbeat",
+		Summary: "Records a heartbeat of a monitor authenticated with its X.509-SVID.",
+	},
+}
+
+// apiOperationByID returns the operation with the given ID. It panics if
+// there is none, which is a programming error.
+func apiOperationByID(id string) apiOperation {
+	for _, op := range apiOperations {
+		if op.ID == id {
+			return op
+		}
+	}
+	panic(fmt.Sprintf("unknown API operation %q", id))
+}
+
+// validate checks the method, query parameters and body media type of r
+// against the operation, returning the status code to reply with if it does
+// not conform.
+func (op apiOperation) validate(r *http.Request) (int, error) {
+	if r.Method != op.Method && !(op.Method == http.MethodGet && r.Method == http.MethodHead) {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	for _, p := range op.Params {
+		if !p.InPath {
+			continue
+		}
+		prefix := strings.TrimSuffix(op.Path, "{"+p.Name+"}")
+		if v := strings.TrimPrefix(r.URL.Path, prefix); !strings.HasPrefix(r.URL.Path, prefix) || !regexp.MustCompile(p.Pattern).MatchString(v) {
+			return http.StatusBadRequest, fmt.Errorf("invalid %s %q, expected to match %s", p.Name, v, p.Pattern)
+		}
+	}
+
+	for name, values := range r.URL.Query() {
+		var param *apiParam
+		for i := range op.Params {
+			if op.Params[i].Name == name && !op.Params[i].InPath {
+				param = &op.Params[i]
+			}
+		}
+		if param == nil {
+			return http.StatusBadRequest, fmt.Errorf("unknown query parameter %q", name)
+		}
+		if len(values) > 1 {
+			return http.StatusBadRequest, fmt.Errorf("query parameter %q given more than once", name)
+		}
+		switch {
+		case param.Type == "integer":
+			n, err := strconv.ParseInt(values[0], 10, 64)
+			if err != nil || n < param.Minimum || (param.Maximum > 0 && n > param.Maximum) {
+				return http.StatusBadRequest, fmt.Errorf("invalid %s %q, expected an integer %s", name, values[0], param.bounds())
+			}
+		case param.Pattern != "" && !regexp.MustCompile(param.Pattern).MatchString(values[0]):
+			return http.StatusBadRequest, fmt.Errorf("invalid %s %q, expected to match %s", name, values[0], param.Pattern)
+		case param.Format == "date-time":
+			if _, err := time.Parse(time.RFC3339, values[0]); err != nil {
+				return http.StatusBadRequest, fmt.Errorf("invalid %s %q, expected an RFC 3339 time", name, values[0])
+			}
+		}
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != "" && op.Body != "" {
+		media, _, err := mime.ParseMediaType(ct)
+		if err != nil || media != op.Body {
+			return http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q, expected %s", ct, op.Body)
+		}
+	}
+	return 0, nil
+}
+
+// validated wraps h so that requests not conforming to op are rejected
+// before reaching it.
+func validated(op apiOperation, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code, err := op.validate(r); err != nil {
+			if code == http.StatusMethodNotAllowed {
+				allow := op.Method
+				if op.Method == http.MethodGet {
+					allow = "GET, HEAD"
+				}
+				w.Header().Set("Allow", allow)
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// OpenAPI returns the OpenAPI 3 document describing the HTTP API. Schemas
+// are generated from the Go types of the responses.
+func OpenAPI() map[string]any {
+	schemas := make(map[string]any)
+	paths := make(map[string]any)
+	for _, op := range apiOperations {
+		o := map[string]any{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+		}
+		if len(op.Params) > 0 {
+			var params []any
+			for _, p := range op.Params {
+				schema := map[string]any{"type": p.Type}
+				if p.Format != "" {
+					schema["format"] = p.Format
+				}
+				if p.Pattern != "" {
+					schema["pattern"] = p.Pattern
+				}
+				if p.Type == "integer" {
+					schema["format"] = "int64"
+					schema["minimum"] = p.Minimum
+					if p.Maximum > 0 {
+						schema["maximum"] = p.Maximum
+					}
+				}
+				param := map[string]any{
+					"name":        p.Name,
+					"in":          "query",
+					"description": p.Description,
+					"schema":      schema,
+				}
+				if p.InPath {
+					param["in"] = "path"
+					param["required"] = true
+				}
+				if p == namespaceParam {
+					// Tenants with a token file require it.
+					o["security"] = []any{map[string]any{}, map[string]any{"tenantToken": []any{}}}
+				}
+				params = append(params, param)
+			}
+			o["parameters"] = params
+		}
+		if op.Body != "" {
+			schema := map[string]any{"type": "string"}
+			if op.Request != nil {
+				schema = jsonSchema(op.Request, schemas)
+			}
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{op.Body: map[string]any{"schema": schema}},
+			}
+		}
+		responses := map[string]any{"default": map[string]any{"description": "An error, described in plain text."}}
+		switch {
+		case op.Response != nil:
+			media := []string{mediaJSON, mediaCBOR, mediaProtobuf}
+			if op.Produces != "" {
+				media = []string{op.Produces}
+			}
+			content := make(map[string]any)
+			for _, m := range media {
+				content[m] = map[string]any{"schema": jsonSchema(op.Response, schemas)}
+			}
+			responses["200"] = map[string]any{"description": "OK", "content": content}
+		case op.Produces != "":
+			responses["200"] = map[string]any{
+				"description": "OK",
+				"content":     map[string]any{op.Produces: map[string]any{"schema": map[string]any{"type": "string"}}},
+			}
+		default:
+			responses["204"] = map[string]any{"description": "No Content"}
+		}
+		o["responses"] = responses
+		paths[op.Path] = map[string]any{strings.ToLower(op.Method): o}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Rekor monitor collector API",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"tenantToken": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// OpenAPIHandler returns an http.Handler serving the OpenAPI document.
+func OpenAPIHandler() http.Handler {
+	doc := OpenAPI()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, doc)
+	})
+}
+
+// jsonSchema returns the schema of the JSON encoding of t. Structs are added
+// to defs and referenced by name.
+func jsonSchema(t reflect.Type, defs map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem(), defs)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := defs[t.Name()]; ok {
+			return ref
+		}
+		schema := map[string]any{"type": "object"}
+		defs[t.Name()] = schema
+		props := make(map[string]any)
+		var required []string
+		for _, f := range structFields(t) {
+			props[f.name] = jsonSchema(t.Field(f.index).Type, defs)
+			if !f.omitEmpty {
+				required = append(required, f.name)
+			}
+		}
+		schema["properties"] = props
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return ref
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,255 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+// attestationHeader is the first line of the text of an attestation.
+const attestationHeader = "rekor-monitor-collector/attestation/v1"
+
+// maxAttestationSize bounds the attestations read from peers.
+const maxAttestationSize = 1 << 20
+
+// peerPrefix prefixes the names of peers among the monitors of conflicts
+// and round reports.
+const peerPrefix = "peer:"
+
+// Attestation is a statement signed by a collector of the latest checkpoint
+// it accepted of every log. It is a signed note whose text is
+// attestationHeader, a "time <unix seconds>" line and one flattened
+// checkpoint per line.
+type Attestation struct {
+	// Signer is the key name of the collector.
+	Signer      string
+	Time        time.Time
+	Checkpoints []Checkpoint
+}
+
+// Peer is another collector exchanging attestations with the collector.
+type Peer struct {
+	// URL is the base URL of the peer's API, e.g.
+	// https://collector-b.example.com.
+	URL string
+	// Verifier checks the signature of the peer's attestations.
+	Verifier note.Verifier
+}
+
+// ParsePeer parses a peer of the form <url>,<note verifier key>.
+func ParsePeer(spec string) (Peer, error) {
+	i := strings.LastIndex(spec, ",")
+	if i < 0 {
+		return Peer{}, fmt.Errorf("peer %q is not of the form <url>,<verifier key>", spec)
+	}
+	u, err := url.Parse(spec[:i])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return Peer{}, fmt.Errorf("peer %q has no HTTP(S) URL", spec)
+	}
+	v, err := note.NewVerifier(spec[i+1:])
+	if err != nil {
+		return Peer{}, fmt.Errorf("peer %q: %w", spec, err)
+	}
+	return Peer{URL: spec[:i], Verifier: v}, nil
+}
+
+// Attest returns the collector's attestation of its latest accepted
+// checkpoint of every log, signed by Cosigner.
+func (c *Collector) Attest(now time.Time) ([]byte, error) {
+	if c.cfg.Cosigner == nil {
+		return nil, errors.New("no cosigner is configured to sign attestations")
+	}
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]Checkpoint)
+	for _, l := range lines {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			continue
+		}
+		if prev, ok := latest[chpt.Origin]; !ok || chpt.Size >= prev.Size {
+			latest[chpt.Origin] = chpt
+		}
+	}
+	origins := make([]string, 0, len(latest))
+	for o := range latest {
+		origins = append(origins, o)
+	}
+	sort.Strings(origins)
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s\ntime %d\n", attestationHeader, now.Unix())
+	for _, o := range origins {
+		text.WriteString(latest[o].Raw + "\n")
+	}
+	return note.Sign(&note.Note{Text: text.String()}, c.cfg.Cosigner)
+}
+
+// ParseAttestation verifies the signature of an attestation by v and parses
+// it.
+func ParseAttestation(msg []byte, v note.Verifier) (Attestation, error) {
+	n, err := note.Open(msg, note.VerifierList(v))
+	if err != nil {
+		return Attestation{}, fmt.Errorf("verifying attestation: %w", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(n.Text, "\n"), "\n")
+	if len(lines) < 2 || lines[0] != attestationHeader || !strings.HasPrefix(lines[1], "time ") {
+		return Attestation{}, errors.New("malformed attestation")
+	}
+	secs, err := strconv.ParseInt(strings.TrimPrefix(lines[1], "time "), 10, 64)
+	if err != nil {
+		return Attestation{}, fmt.Errorf("malformed attestation time: %w", err)
+	}
+	a := Attestation{Signer: v.Name(), Time: time.Unix(secs, 0).UTC()}
+	for _, l := range lines[2:] {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			return Attestation{}, fmt.Errorf("malformed attested checkpoint: %w", err)
+		}
+		a.Checkpoints = append(a.Checkpoints, chpt)
+	}
+	return a, nil
+}
+
+// fetchAttestation reads and verifies the latest attestation of a peer.
+func fetchAttestation(ctx context.Context, p Peer) (Attestation, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return Attestation{}, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/attestation"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Attestation{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Attestation{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Attestation{}, fmt.Errorf("fetching attestation: %s", resp.Status)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, maxAttestationSize))
+	if err != nil {
+		return Attestation{}, err
+	}
+	return ParseAttestation(msg, p.Verifier)
+}
+
+// peerConflicts records the cross-collector conflicts already alerted, so
+// each is alerted once.
+type peerConflicts struct {
+	mu      sync.Mutex
+	alerted map[string]bool
+}
+
+// first reports whether key is alerted for the first time.
+func (p *peerConflicts) first(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.alerted[key] {
+		return false
+	}
+	if p.alerted == nil {
+		p.alerted = make(map[string]bool)
+	}
+	p.alerted[key] = true
+	return true
+}
+
+// checkPeers fetches the attestations of every peer, bounded by the Verify
+// timeout, and returns their checkpoints of origin as advisory
+// observations named after the peers: they take part in finding conflicts
+// but not in the quorum. An attested checkpoint whose tree size the
+// collector accepted with another root hash is alerted once as a
+// cross-collector conflict. Peers that cannot be read are logged.
+func (c *Collector) checkPeers(ctx context.Context, origin string) ([]string, [][]string) {
+	if len(c.cfg.Peers) == 0 || c.cfg.Offline {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Verify)
+	defer cancel()
+	atts := make([]*Attestation, len(c.cfg.Peers))
+	var wg sync.WaitGroup
+	for i, p := range c.cfg.Peers {
+		wg.Add(1)
+		go func(i int, p Peer) {
+			defer wg.Done()
+			a, err := fetchAttestation(ctx, p)
+			if err != nil {
+				c.logf("Reading the attestation of peer %s: %v\n", p.URL, err)
+				return
+			}
+			atts[i] = &a
+		}(i, p)
+	}
+	wg.Wait()
+
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		c.logf("Reading accepted checkpoints to check peer attestations: %v\n", err)
+	}
+	accepted := make(map[string]Checkpoint)
+	for _, l := range lines {
+		if chpt, err := ParseCheckpoint(l); err == nil {
+			accepted[fmt.Sprintf("%s/%d", chpt.Origin, chpt.Size)] = chpt
+		}
+	}
+
+	var names []string
+	var observations [][]string
+	for _, a := range atts {
+		if a == nil {
+			continue
+		}
+		name := peerPrefix + a.Signer
+		var chpts []string
+		for _, chpt := range a.Checkpoints {
+			chpts = append(chpts, chpt.Raw)
+			own, ok := accepted[fmt.Sprintf("%s/%d", chpt.Origin, chpt.Size)]
+			if !ok || own.Hash == chpt.Hash || !c.peerConflicts.first(fmt.Sprintf("%s/%s/%d", a.Signer, chpt.Origin, chpt.Size)) {
+				continue
+			}
+			c.anoms.record(AnomalyPeerConflict, chpt.Origin)
+			c.alert(Alert{
+				Kind:     AnomalyPeerConflict,
+				Origin:   chpt.Origin,
+				Size:     chpt.Size,
+				Roots:    []string{own.Hash, chpt.Hash},
+				Monitors: []string{name},
+				Message:  fmt.Sprintf("peer collector %s attested root hash %s of tree size %d of %s at %s, but this collector accepted root hash %s", a.Signer, chpt.Hash, chpt.Size, chpt.Origin, a.Time.Format(time.RFC3339), own.Hash),
+			})
+		}
+		names = append(names, name)
+		observations = append(observations, c.filterOrigin(origin, chpts))
+	}
+	return names, observations
+}
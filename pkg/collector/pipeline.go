@@ -0,0 +1,214 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultPipelineWorkers is the number of workers of a Pipeline by default.
+const DefaultPipelineWorkers = 8
+
+// Pipeline processes a range of log indices with a bounded pool of workers,
+// such as to verify the inclusion of every entry of a range. Its progress is
+// saved to StateFile, if set, so that an interrupted run resumes where it
+// stopped instead of starting over.
+type Pipeline struct {
+	// Workers is the number of indices processed concurrently,
+	// DefaultPipelineWorkers if not positive.
+	Workers   int
+	StateFile string
+	// Progress, if set, is called every ProgressInterval, every second by
+	// default, and once the range is done.
+	Progress         func(PipelineProgress)
+	ProgressInterval time.Duration
+}
+
+// PipelineProgress reports how far a pipeline got.
+type PipelineProgress struct {
+	Done, Total, Failed int64
+	Elapsed             time.Duration
+}
+
+// PipelineFailure is an index that could not be processed.
+type PipelineFailure struct {
+	Index int64  `json:"index"`
+	Error string `json:"error"`
+}
+
+// PipelineReport is the result of a pipeline run, also saved as its state.
+type PipelineReport struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Next is the index up to which, excluded, every index was processed.
+	Next     int64             `json:"next"`
+	Failures []PipelineFailure `json:"failures"`
+}
+
+// loadState returns the saved state of a run over the same range, or a new
+// one.
+func (p Pipeline) loadState(start, end int64) (PipelineReport, error) {
+	report := PipelineReport{Start: start, End: end, Next: start, Failures: []PipelineFailure{}}
+	if p.StateFile == "" {
+		return report, nil
+	}
+	b, err := os.ReadFile(p.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+	var saved PipelineReport
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return report, fmt.Errorf("reading pipeline state %q: %w", p.StateFile, err)
+	}
+	if saved.Start != start || saved.End != end {
+		return report, fmt.Errorf("pipeline state %q is of range [%d, %d), not [%d, %d)", p.StateFile, saved.Start, saved.End, start, end)
+	}
+	// Indices from Next on are processed again, with their failures.
+	for _, f := range saved.Failures {
+		if f.Index < saved.Next {
+			report.Failures = append(report.Failures, f)
+		}
+	}
+	report.Next = saved.Next
+	return report, nil
+}
+
+func (p Pipeline) saveState(report PipelineReport) error {
+	if p.StateFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return replaceFile(p.StateFile, []string{string(b)})
+}
+
+// Run calls fn for every index in [start, end) not processed by a previous
+// run with the same state file. Errors returned by fn are recorded as
+// failures of their index and do not stop the run. Run returns early with
+// the context's error if it is cancelled, after saving its state.
+func (p Pipeline) Run(ctx context.Context, start, end int64, fn func(ctx context.Context, index int64) error) (PipelineReport, error) {
+	report, err := p.loadState(start, end)
+	if err != nil {
+		return report, err
+	}
+	workers := p.Workers
+	if workers <= 0 {
+		workers = DefaultPipelineWorkers
+	}
+	interval := p.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	type result struct {
+		index int64
+		err   error
+	}
+	indices := make(chan int64)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(indices <-chan int64) {
+			defer wg.Done()
+			for index := range indices {
+				results <- result{index, fn(ctx, index)}
+			}
+		}(indices)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// At most window indices are in flight beyond Next, which bounds the
+	// memory of results completed out of order.
+	window := int64(workers * 4)
+	begun := time.Now()
+	done := make(map[int64]bool)
+	next := report.Next
+	lastProgress := begun
+	progress := func() {
+		if p.Progress != nil {
+			p.Progress(PipelineProgress{
+				Done:    report.Next - start + int64(len(done)),
+				Total:   end - start,
+				Failed:  int64(len(report.Failures)),
+				Elapsed: time.Since(begun),
+			})
+		}
+	}
+
+	for {
+		if indices != nil && (next >= end || ctx.Err() != nil) {
+			close(indices)
+			indices = nil
+		}
+		feed, cancelled := indices, ctx.Done()
+		if next >= report.Next+window {
+			feed = nil
+		}
+		if indices == nil {
+			cancelled = nil
+		}
+		select {
+		case feed <- next:
+			next++
+			continue
+		case <-cancelled:
+			continue
+		case r, ok := <-results:
+			if !ok {
+				if err := p.saveState(report); err != nil {
+					return report, fmt.Errorf("saving pipeline state: %w", err)
+				}
+				progress()
+				if report.Next < end {
+					return report, ctx.Err()
+				}
+				return report, nil
+			}
+			if r.err != nil {
+				report.Failures = append(report.Failures, PipelineFailure{Index: r.index, Error: r.err.Error()})
+			}
+			done[r.index] = true
+			for done[report.Next] {
+				delete(done, report.Next)
+				report.Next++
+			}
+		}
+
+		if time.Since(lastProgress) >= interval {
+			lastProgress = time.Now()
+			if err := p.saveState(report); err != nil {
+				return report, fmt.Errorf("saving pipeline state: %w", err)
+			}
+			progress()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultProofCacheSize is the number of proofs a CachingProver keeps by
+// default.
+const DefaultProofCacheSize = 1024
+
+// proofKey identifies a consistency proof.
+type proofKey struct {
+	Origin string `json:"origin"`
+	First  int64  `json:"first"`
+	Second int64  `json:"second"`
+}
+
+// cachedProof is an entry of the proof cache, as persisted one per line.
+type cachedProof struct {
+	proofKey
+	Hashes    [][]byte  `json:"hashes"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// CachingProver is a ConsistencyProver keeping the proofs fetched by another
+// one, so that the many verifications spanning the same pair of tree sizes
+// do not each fetch the proof from the log. The least recently used proofs
+// are evicted once the cache is full, and proofs older than the TTL are
+// fetched again.
+type CachingProver struct {
+	prover ConsistencyProver
+	size   int
+	ttl    time.Duration
+	file   string
+	now    func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // of *cachedProof, most recently used first
+	entries map[proofKey]*list.Element
+}
+
+// NewCachingProver returns a CachingProver for p keeping up to size proofs,
+// DefaultProofCacheSize if size is not positive, for at most ttl, or until
+// evicted if ttl is zero. If file is set, the cache is persisted to it so
+// that it survives restarts.
+func NewCachingProver(p ConsistencyProver, size int, ttl time.Duration, file string) (*CachingProver, error) {
+	if size <= 0 {
+		size = DefaultProofCacheSize
+	}
+	cp := &CachingProver{prover: p, size: size, ttl: ttl, file: file, now: time.Now, order: list.New(), entries: make(map[proofKey]*list.Element)}
+	if file == "" {
+		return cp, nil
+	}
+
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var e cachedProof
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("reading proof cache %q: line %d: %w", file, n, err)
+		}
+		// The file lists the most recently used proofs first.
+		if !cp.expired(&e) && len(cp.entries) < size {
+			cp.entries[e.proofKey] = cp.order.PushBack(&e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading proof cache %q: %w", file, err)
+	}
+	return cp, nil
+}
+
+func (cp *CachingProver) expired(e *cachedProof) bool {
+	return cp.ttl > 0 && cp.now().Sub(e.FetchedAt) > cp.ttl
+}
+
+// ConsistencyProof implements ConsistencyProver.
+func (cp *CachingProver) ConsistencyProof(ctx context.Context, origin string, first, second int64) ([][]byte, error) {
+	key := proofKey{Origin: origin, First: first, Second: second}
+
+	cp.mu.Lock()
+	if el, ok := cp.entries[key]; ok {
+		e := el.Value.(*cachedProof)
+		if !cp.expired(e) {
+			cp.order.MoveToFront(el)
+			cp.mu.Unlock()
+			return e.Hashes, nil
+		}
+		cp.order.Remove(el)
+		delete(cp.entries, key)
+	}
+	cp.mu.Unlock()
+
+	hashes, err := cp.prover.ConsistencyProof(ctx, origin, first, second)
+	if err != nil {
+		return nil, err
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if el, ok := cp.entries[key]; ok {
+		cp.order.Remove(el)
+	}
+	cp.entries[key] = cp.order.PushFront(&cachedProof{proofKey: key, Hashes: hashes, FetchedAt: cp.now()})
+	for cp.order.Len() > cp.size {
+		el := cp.order.Back()
+		cp.order.Remove(el)
+		delete(cp.entries, el.Value.(*cachedProof).proofKey)
+	}
+	if err := cp.save(); err != nil {
+		// The proof is valid whether or not it could be persisted.
+		log.Printf("Persisting proof cache %q: %v\n", cp.file, err)
+	}
+	return hashes, nil
+}
+
+// save writes the cache to its file, most recently used proofs first.
+func (cp *CachingProver) save() error {
+	if cp.file == "" {
+		return nil
+	}
+	lines := make([]string, 0, cp.order.Len())
+	for el := cp.order.Front(); el != nil; el = el.Next() {
+		b, err := json.Marshal(el.Value)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(b))
+	}
+	return replaceFile(cp.file, lines)
+}
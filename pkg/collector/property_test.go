@@ -0,0 +1,189 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+)
+
+// scenario is a random run of an honest, growing log observed by monitors
+// that each append the tree head to their logfile or lag behind in every
+// round.
+type scenario struct {
+	monitors int
+	quorum   int
+	// rounds holds the tree size of the log in each round and which
+	// monitors observed it.
+	rounds []scenarioRound
+}
+
+type scenarioRound struct {
+	size     int64
+	observed []bool
+}
+
+func newScenario(rnd *rand.Rand) scenario {
+	s := scenario{monitors: 2 + rnd.Intn(6)}
+	s.quorum = 1 + rnd.Intn(s.monitors)
+	// Some monitors lag behind more often than others.
+	lag := make([]int, s.monitors)
+	for m := range lag {
+		lag[m] = rnd.Intn(4)
+	}
+	size := int64(rnd.Intn(10))
+	for i := 0; i < 3+rnd.Intn(20); i++ {
+		size += int64(rnd.Intn(5))
+		r := scenarioRound{size: size, observed: make([]bool, s.monitors)}
+		for m := range r.observed {
+			r.observed[m] = rnd.Intn(4) >= lag[m]
+		}
+		s.rounds = append(s.rounds, r)
+	}
+	return s
+}
+
+// checkProperty runs prop for random seeds, reporting the failing seed.
+func checkProperty(t *testing.T, prop func(rnd *rand.Rand) error) {
+	t.Helper()
+	err := quick.Check(func(seed int64) bool {
+		if err := prop(rand.New(rand.NewSource(seed))); err != nil {
+			t.Logf("seed %d: %v", seed, err)
+			return false
+		}
+		return true
+	}, &quick.Config{MaxCount: 200})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropertyAcceptedSizeNeverDecreases(t *testing.T) {
+	checkProperty(t, func(rnd *rand.Rand) error {
+		s := newScenario(rnd)
+		dir, err := os.MkdirTemp(t.TempDir(), "")
+		if err != nil {
+			return err
+		}
+		c := New(Config{MonitorGlob: filepath.Join(dir, "logInfo*.txt"), AcceptedFile: filepath.Join(dir, "accepted.txt"), Quorum: s.quorum})
+		var last int64
+		for i, r := range s.rounds {
+			for m, observed := range r.observed {
+				if observed {
+					if err := appendLine(filepath.Join(dir, fmt.Sprintf("logInfo%d.txt", m)), testCheckpoint(r.size, int64(i))); err != nil {
+						return err
+					}
+				}
+			}
+			accepted, ok, err := c.Collect("")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if accepted.Size < last {
+				return fmt.Errorf("round %d accepted tree size %d after %d", i, accepted.Size, last)
+			}
+			last = accepted.Size
+		}
+		return nil
+	})
+}
+
+func TestPropertyAcceptanceNeedsQuorum(t *testing.T) {
+	checkProperty(t, func(rnd *rand.Rand) error {
+		s := newScenario(rnd)
+		observations := make([][]string, s.monitors)
+		for i, r := range s.rounds {
+			for m, observed := range r.observed {
+				if observed {
+					observations[m] = append(observations[m], testCheckpoint(r.size, int64(i)))
+				}
+			}
+			accepted, ok, err := Policy{Quorum: s.quorum}.Select(observations, nil)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			supporters := 0
+			for _, chpts := range observations {
+				for _, l := range chpts {
+					if chpt, _ := ParseCheckpoint(l); chpt.Key() == accepted.Key() {
+						supporters++
+						break
+					}
+				}
+			}
+			if supporters < s.quorum {
+				return fmt.Errorf("round %d accepted tree size %d supported by %d monitors, below the quorum of %d", i, accepted.Size, supporters, s.quorum)
+			}
+		}
+		return nil
+	})
+}
+
+func TestPropertyByzantineMonitorBelowQuorum(t *testing.T) {
+	checkProperty(t, func(rnd *rand.Rand) error {
+		s := newScenario(rnd)
+		if s.quorum < 2 {
+			s.quorum = 2
+		}
+		// The last monitor is byzantine: besides copying honest tree heads
+		// it reports forged ones, ahead of the log or with another root
+		// hash.
+		byzantine := s.monitors
+		observations := make([][]string, s.monitors+1)
+		for i, r := range s.rounds {
+			for m, observed := range r.observed {
+				if observed {
+					observations[m] = append(observations[m], testCheckpoint(r.size, int64(i)))
+				}
+			}
+			forged := testCheckpoint(r.size+int64(rnd.Intn(100)), int64(i))
+			if rnd.Intn(2) == 0 {
+				forged = fmt.Sprintf("rekor.sigstore.dev - 2605736670972794746\\n%d\\nforged%d\\nTimestamp: %d\\n\\n— rekor.sigstore.dev sig\\n", r.size, r.size, i)
+			}
+			observations[byzantine] = append(observations[byzantine], forged, testCheckpoint(r.size, int64(i)))
+
+			accepted, ok, err := Policy{Quorum: s.quorum}.Select(observations, nil)
+			if err != nil {
+				return err
+			}
+			if ok && (accepted.Size > r.size || accepted.Hash != fmt.Sprintf("hash%d", accepted.Size)) {
+				return fmt.Errorf("round %d accepted forged tree size %d with root hash %s", i, accepted.Size, accepted.Hash)
+			}
+		}
+		return nil
+	})
+}
+
+// appendLine appends a line to the file at path.
+func appendLine(path, line string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
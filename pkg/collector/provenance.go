@@ -0,0 +1,159 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Supporter is a monitor whose observation supported an accepted tree size.
+type Supporter struct {
+	Monitor string `json:"monitor" proto:"1"`
+	Network string `json:"network,omitempty" proto:"2"`
+	// ObservationHash is the hex encoded SHA-256 of the checkpoint line
+	// read from the monitor.
+	ObservationHash string `json:"observation_hash" proto:"3"`
+	// RootHash and Timestamp are those of the monitor's checkpoint.
+	RootHash  string `json:"root_hash" proto:"4"`
+	Timestamp int64  `json:"timestamp" proto:"5"`
+	// ObservedAt is when the collector read the checkpoint.
+	ObservedAt time.Time `json:"observed_at" proto:"6"`
+}
+
+// Provenance records the basis of the decision to accept a checkpoint.
+type Provenance struct {
+	Origin     string      `json:"origin" proto:"1"`
+	TreeSize   int64       `json:"tree_size" proto:"2"`
+	RootHash   string      `json:"root_hash" proto:"3"`
+	Checkpoint string      `json:"checkpoint" proto:"4"`
+	Round      string      `json:"round" proto:"5"`
+	AcceptedAt time.Time   `json:"accepted_at" proto:"6"`
+	Quorum     int         `json:"quorum" proto:"7"`
+	Supporters []Supporter `json:"supporters" proto:"8"`
+	// Degraded is set if the tree size was accepted without reaching
+	// quorum, see QuorumDegrade.
+	Degraded bool `json:"degraded,omitempty" proto:"9"`
+}
+
+// monitorRead is what the collector read from a monitor in a round.
+type monitorRead struct {
+	monitor, network string
+	at               time.Time
+	chpts            []string
+}
+
+// provenance returns the provenance of accepted from the monitors read in a
+// round, accepted at now. Each supporting monitor is represented by its
+// newest checkpoint of the accepted tree size.
+func provenance(accepted Checkpoint, round string, quorum int, reads []monitorRead, now time.Time) Provenance {
+	p := Provenance{
+		Origin:     accepted.Origin,
+		TreeSize:   accepted.Size,
+		RootHash:   accepted.Hash,
+		Checkpoint: accepted.Raw,
+		Round:      round,
+		AcceptedAt: now.UTC(),
+		Quorum:     quorum,
+		Supporters: []Supporter{},
+	}
+	for _, r := range reads {
+		var match *Checkpoint
+		for _, line := range r.chpts {
+			chpt, err := ParseCheckpoint(line)
+			if err != nil || chpt.Key() != accepted.Key() {
+				continue
+			}
+			if match == nil || chpt.Timestamp > match.Timestamp {
+				match = &chpt
+			}
+		}
+		if match == nil {
+			continue
+		}
+		p.Supporters = append(p.Supporters, Supporter{
+			Monitor:         r.monitor,
+			Network:         r.network,
+			ObservationHash: lineHash(match.Raw),
+			RootHash:        match.Hash,
+			Timestamp:       match.Timestamp,
+			ObservedAt:      r.at,
+		})
+	}
+	return p
+}
+
+// appendProvenance appends the provenance of accepted checkpoints to
+// filename, keeping the latest keep records.
+func appendProvenance(filename string, records []Provenance, keep int, sc *StateCipher) error {
+	lines := make([]string, len(records))
+	for i, p := range records {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		lines[i] = string(b)
+	}
+	if err := appendLines(filename, sealProvenance, lines, sc); err != nil {
+		return err
+	}
+	return PruneCheckpoints(filename, keep)
+}
+
+// ReadProvenance reads the provenance records of a file written by a
+// collector with Config.ProvenanceFile set, decrypting them with sc if set.
+// A missing file holds no records.
+func ReadProvenance(filename string, sc *StateCipher) ([]Provenance, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Provenance
+	o := lineOpener{sc: sc, kind: sealProvenance}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line, err := o.open(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		var p Provenance
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		records = append(records, p)
+	}
+	return records, scanner.Err()
+}
+
+// Provenance returns the retained provenance records of the collector's
+// accepted checkpoints, oldest first.
+func (c *Collector) Provenance() ([]Provenance, error) {
+	if c.cfg.ProvenanceFile == "" {
+		return nil, errors.New("provenance is not recorded")
+	}
+	return ReadProvenance(c.cfg.ProvenanceFile, c.cfg.StateCipher)
+}
@@ -0,0 +1,204 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The static tree written to Config.PublishDir has the layout
+//
+//	index.json                      origins and their latest tree sizes
+//	<origin>/latest                 the newest accepted checkpoint
+//	<origin>/by-size/<tree size>    the checkpoint accepted at a tree size
+//	<origin>/by-date/<YYYY-MM-DD>   the checkpoints whose timestamp is on
+//	                                that day (UTC), by increasing tree size
+//
+// Checkpoints are stored as signed notes. The contents of every file depend
+// only on the accepted checkpoints, and files are only rewritten when their
+// contents change, so collectors accepting the same checkpoints publish
+// identical trees and syncing them to a CDN transfers only new files.
+// Published checkpoints are not pruned.
+
+// PublishedOrigin is an entry of the index of a published tree.
+type PublishedOrigin struct {
+	// Path is the directory of the origin relative to the tree.
+	Path     string `json:"path"`
+	TreeSize int64  `json:"tree_size"`
+}
+
+// PublishedIndex is the index.json file of a published tree.
+type PublishedIndex struct {
+	Origins map[string]PublishedOrigin `json:"origins"`
+}
+
+// originDir returns the directory name of origin in a published tree. Any
+// character other than letters, digits, dots, dashes and underscores is
+// replaced by a dash and runs of dashes collapse into one.
+func originDir(origin string) string {
+	var b strings.Builder
+	for _, r := range origin {
+		allowed := r == '.' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		switch {
+		case allowed:
+			b.WriteRune(r)
+		case !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	dir := strings.Trim(b.String(), "-")
+	if dir == "" || strings.HasPrefix(dir, ".") {
+		dir = "_" + dir
+	}
+	return dir
+}
+
+// checkpointNote returns a flattened checkpoint as a signed note.
+func checkpointNote(raw string) string {
+	return strings.TrimSuffix(strings.ReplaceAll(raw, lineSeparator, "\n"), "\n") + "\n"
+}
+
+// checkpointDay returns the UTC day of the checkpoint's timestamp, which
+// rekor writes in nanoseconds since the epoch.
+func checkpointDay(c Checkpoint) string {
+	return time.Unix(0, c.Timestamp).UTC().Format("2006-01-02")
+}
+
+// writeIfChanged atomically replaces filename with data, readable by
+// everyone, unless it already holds it.
+func writeIfChanged(filename string, data []byte) error {
+	if old, err := os.ReadFile(filename); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// Remove is a no-op once the rename has succeeded.
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Publish adds accepted checkpoints to the static tree in dir.
+func Publish(dir string, accepted []Checkpoint) error {
+	indexFile := filepath.Join(dir, "index.json")
+	index := PublishedIndex{Origins: map[string]PublishedOrigin{}}
+	b, err := os.ReadFile(indexFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &index); err != nil {
+			return err
+		}
+		if index.Origins == nil {
+			index.Origins = map[string]PublishedOrigin{}
+		}
+	}
+
+	byDay := map[string][]Checkpoint{}
+	for _, c := range accepted {
+		od := originDir(c.Origin)
+		note := []byte(checkpointNote(c.Raw))
+		if err := writeIfChanged(filepath.Join(dir, od, "by-size", strconv.FormatInt(c.Size, 10)), note); err != nil {
+			return err
+		}
+		if prev, ok := index.Origins[c.Origin]; !ok || c.Size >= prev.TreeSize {
+			if err := writeIfChanged(filepath.Join(dir, od, "latest"), note); err != nil {
+				return err
+			}
+			index.Origins[c.Origin] = PublishedOrigin{Path: od + "/", TreeSize: c.Size}
+		}
+		day := filepath.Join(od, "by-date", checkpointDay(c))
+		byDay[day] = append(byDay[day], c)
+	}
+
+	for day, chpts := range byDay {
+		if err := publishDay(filepath.Join(dir, day), chpts); err != nil {
+			return err
+		}
+	}
+
+	if b, err = json.MarshalIndent(index, "", "  "); err != nil {
+		return err
+	}
+	return writeIfChanged(indexFile, append(b, '\n'))
+}
+
+// publishDay merges checkpoints into a by-date file, which holds one
+// flattened checkpoint per line ordered by tree size.
+func publishDay(filename string, chpts []Checkpoint) error {
+	bySize := map[int64]string{}
+	b, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if c, err := ParseCheckpoint(line); err == nil {
+			bySize[c.Size] = line
+		}
+	}
+	for _, c := range chpts {
+		bySize[c.Size] = c.Raw
+	}
+
+	sizes := make([]int64, 0, len(bySize))
+	for s := range bySize {
+		sizes = append(sizes, s)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	var out bytes.Buffer
+	for _, s := range sizes {
+		out.WriteString(bySize[s] + "\n")
+	}
+	return writeIfChanged(filename, out.Bytes())
+}
+
+// publish adds checkpoints accepted in a round to PublishDir. Failures are
+// logged so that an unavailable publication target does not stop
+// collection.
+func (c *Collector) publish(batch []Checkpoint) {
+	if c.cfg.PublishDir == "" {
+		return
+	}
+	if err := Publish(c.cfg.PublishDir, batch); err != nil {
+		c.logf("Publishing accepted checkpoints to %s: %v\n", c.cfg.PublishDir, err)
+	}
+}
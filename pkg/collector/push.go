@@ -0,0 +1,214 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Limits of pushed checkpoints.
+const (
+	// pushKeep is the number of checkpoints kept per pushing monitor.
+	pushKeep = 100
+	// maxPushSize is the maximum size of a push request body.
+	maxPushSize = 1 << 20
+)
+
+// ErrNotPushed is returned when reading a pushing monitor that has not
+// pushed any checkpoints yet.
+var ErrNotPushed = errors.New("monitor has not pushed any checkpoints")
+
+// inbox holds the latest checkpoints pushed by each monitor, keyed by SPIFFE
+// ID.
+type inbox struct {
+	mu     sync.Mutex
+	pushed map[string][]string
+}
+
+func (in *inbox) add(id string, chpts []string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.pushed == nil {
+		in.pushed = make(map[string][]string)
+	}
+	all := append(in.pushed[id], chpts...)
+	if len(all) > pushKeep {
+		all = append([]string(nil), all[len(all)-pushKeep:]...)
+	}
+	in.pushed[id] = all
+}
+
+// largest returns the largest tree size of each origin among the
+// checkpoints pushed by the monitor with the SPIFFE ID id.
+func (in *inbox) largest(id string) map[string]int64 {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	sizes := make(map[string]int64)
+	for _, l := range in.pushed[id] {
+		if chpt, err := ParseCheckpoint(l); err == nil && chpt.Size > sizes[chpt.Origin] {
+			sizes[chpt.Origin] = chpt.Size
+		}
+	}
+	return sizes
+}
+
+// Fetch implements Fetcher, returning the latest n checkpoints pushed by
+// the monitor with the SPIFFE ID id.
+func (in *inbox) Fetch(_ context.Context, id string, n int, _ int64) ([]string, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	all, ok := in.pushed[id]
+	if !ok {
+		return nil, ErrNotPushed
+	}
+	if len(all) > n {
+		all = all[len(all)-n:]
+	}
+	return append([]string(nil), all...), nil
+}
+
+// Push records checkpoints pushed by the monitor with the given SPIFFE ID.
+// It reports false if no monitor of the collector has that ID.
+func (c *Collector) Push(id string, chpts []string) (bool, error) {
+	known, err := c.checkPush(id, chpts)
+	if !known || err != nil {
+		return known, err
+	}
+	c.inbox.add(id, chpts)
+	c.beats.beat(id, c.now())
+	return true, nil
+}
+
+// checkPush reports whether a monitor of the collector has the SPIFFE ID
+// id, and if so whether chpts are valid checkpoints. Checkpoints smaller than
+// one the monitor pushed before for the same log are ErrStaleObservation.
+func (c *Collector) checkPush(id string, chpts []string) (bool, error) {
+	monitors, err := c.Monitors()
+	if err != nil {
+		return false, err
+	}
+	known := false
+	for _, m := range monitors {
+		known = known || m.Logfile == id
+	}
+	if !known {
+		return false, nil
+	}
+	pushed := c.inbox.largest(id)
+	for _, l := range chpts {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			return true, err
+		}
+		if chpt.Size < pushed[chpt.Origin] {
+			return true, withClass(ErrStaleObservation, fmt.Errorf("tree size %d of %s is smaller than the tree size %d pushed before", chpt.Size, chpt.Origin, pushed[chpt.Origin]))
+		}
+	}
+	return true, nil
+}
+
+// PushHandler returns an http.Handler accepting checkpoints from monitors
+// identified by their X.509-SVID, one checkpoint per line as in a monitor
+// logfile. It must be served over TLS requiring client certificates, see
+// SVIDFiles. Checkpoints are passed to the collectors with a monitor of the
+// client's SPIFFE ID. If the collectors have a PushQueue, valid pushes are
+// queued and acknowledged with 202 Accepted, or refused with 503 Service
+// Unavailable while the queue is full. Stale pushes are refused with 409
+// Conflict.
+func PushHandler(cs ...*Collector) http.Handler {
+	return validated(apiOperationByID("push"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client SVID required", http.StatusUnauthorized)
+			return
+		}
+		id, err := SPIFFEID(r.TLS.PeerCertificates[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		chpts, err := readPush(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q := pushQueue(cs)
+		accepted := false
+		for _, c := range cs {
+			push := c.Push
+			if q != nil {
+				push = c.checkPush
+			}
+			ok, err := push(id, chpts)
+			switch {
+			case errors.Is(err, ErrStaleObservation):
+				writeError(w, err, http.StatusConflict)
+				return
+			case err != nil:
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+			accepted = accepted || ok
+		}
+		if !accepted {
+			http.Error(w, fmt.Sprintf("%s is not a configured monitor", id), http.StatusForbidden)
+			return
+		}
+		if q == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		switch err := q.Enqueue(id, chpts); {
+		case errors.Is(err, ErrQueueFull):
+			w.Header().Set("Retry-After", strconv.Itoa(int(pushQueueRetry.Seconds())))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case err != nil:
+			writeError(w, err, http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+}
+
+// pushQueue returns the PushQueue of the collectors, if any.
+func pushQueue(cs []*Collector) *PushQueue {
+	for _, c := range cs {
+		if c.cfg.PushQueue != nil {
+			return c.cfg.PushQueue
+		}
+	}
+	return nil
+}
+
+// readPush reads the non-empty lines of a push request body.
+func readPush(body io.Reader) ([]string, error) {
+	var chpts []string
+	scanner := bufio.NewScanner(io.LimitReader(body, maxPushSize))
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			chpts = append(chpts, line)
+		}
+	}
+	return chpts, scanner.Err()
+}
@@ -0,0 +1,216 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultPushQueueSize is the default number of pushes a PushQueue holds
+// before pushes are refused.
+const DefaultPushQueueSize = 10000
+
+// pushQueueRetry is the delay before a push that could not be delivered is
+// delivered again.
+const pushQueueRetry = time.Second
+
+// ErrQueueFull is returned when enqueueing a push to a full PushQueue.
+var ErrQueueFull = errors.New("push queue is full")
+
+// pushQueueBucket is the bbolt bucket holding queued pushes, keyed by a big
+// endian sequence number so that cursors return them in arrival order.
+var pushQueueBucket = []byte("pushes")
+
+// queuedPush is a push request stored in a PushQueue.
+type queuedPush struct {
+	ID          string    `json:"id"`
+	Checkpoints []string  `json:"checkpoints"`
+	Received    time.Time `json:"received"`
+}
+
+// PushQueue buffers checkpoints pushed by monitors in a bbolt database
+// until they are delivered to the collectors, so that bursts of pushes or
+// slow storage do not block monitors and queued pushes survive restarts.
+// Once the queue holds its maximum number of pushes, further pushes are
+// refused with ErrQueueFull and monitors are asked to retry later.
+type PushQueue struct {
+	db    *bolt.DB
+	max   int64
+	depth int64
+	ready chan struct{}
+}
+
+// OpenPushQueue opens the push queue persisted at path, creating it if
+// needed, holding at most max pushes. Pushes left over from a previous run
+// are delivered first.
+func OpenPushQueue(path string, max int) (*PushQueue, error) {
+	if max <= 0 {
+		max = DefaultPushQueueSize
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening push queue: %w", err)
+	}
+	q := &PushQueue{db: db, max: int64(max), ready: make(chan struct{}, 1)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(pushQueueBucket)
+		if err != nil {
+			return err
+		}
+		q.depth = int64(b.Stats().KeyN)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening push queue: %w", err)
+	}
+	return q, nil
+}
+
+// Close closes the queue's database.
+func (q *PushQueue) Close() error {
+	return q.db.Close()
+}
+
+// Depth returns the number of pushes waiting to be delivered.
+func (q *PushQueue) Depth() int {
+	return int(atomic.LoadInt64(&q.depth))
+}
+
+// Enqueue stores checkpoints pushed by the monitor with the given SPIFFE ID.
+// The push is persisted when Enqueue returns.
+func (q *PushQueue) Enqueue(id string, chpts []string) error {
+	value, err := json.Marshal(queuedPush{ID: id, Checkpoints: chpts, Received: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		if atomic.LoadInt64(&q.depth) >= q.max {
+			return ErrQueueFull
+		}
+		b := tx.Bucket(pushQueueBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&q.depth, 1)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the oldest queued push and its key, or a nil key if the queue
+// is empty.
+func (q *PushQueue) peek() ([]byte, queuedPush, error) {
+	var key []byte
+	var p queuedPush
+	err := q.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(pushQueueBucket).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		key = append([]byte(nil), k...)
+		return json.Unmarshal(v, &p)
+	})
+	return key, p, err
+}
+
+// remove deletes a delivered push.
+func (q *PushQueue) remove(key []byte) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pushQueueBucket).Delete(key)
+	})
+	if err == nil {
+		atomic.AddInt64(&q.depth, -1)
+	}
+	return err
+}
+
+// Run delivers queued pushes in arrival order to the collectors until ctx is
+// done. A push is removed from the queue once every collector with a
+// monitor of its SPIFFE ID has recorded it; if one of them fails, the push
+// is delivered again after a delay. Pushes that cannot be decoded or have
+// become stale are dropped.
+func (q *PushQueue) Run(ctx context.Context, cs ...*Collector) error {
+	for {
+		key, p, err := q.peek()
+		switch {
+		case key != nil && err != nil:
+			log.Printf("Dropping undecodable push from the push queue: %v\n", err)
+			err = q.remove(key)
+		case key != nil:
+			err = deliverPush(cs, p)
+			if errors.Is(err, ErrStaleObservation) {
+				log.Printf("Dropping stale push from the push queue: %v\n", err)
+				err = nil
+			}
+			if err == nil {
+				err = q.remove(key)
+			}
+		}
+		wait := (<-chan struct{})(q.ready)
+		if err != nil {
+			log.Printf("Delivering queued push: %v\n", err)
+			wait = nil
+		} else if key != nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		case <-time.After(pushQueueRetry):
+		}
+	}
+}
+
+// deliverPush passes a queued push to every collector with a monitor of its
+// SPIFFE ID. Checkpoints are validated before they are queued, but only
+// against the pushes delivered so far: a push queued behind a larger one of
+// the same monitor is stale once that one is delivered. Collectors that
+// find the push stale skip it and the error wraps ErrStaleObservation. Any
+// other error comes from reading a collector's monitor list.
+func deliverPush(cs []*Collector, p queuedPush) error {
+	var stale error
+	for _, c := range cs {
+		_, err := c.Push(p.ID, p.Checkpoints)
+		switch {
+		case errors.Is(err, ErrStaleObservation):
+			stale = fmt.Errorf("%s: %w", p.ID, err)
+		case err != nil:
+			return fmt.Errorf("%s: %w", p.ID, err)
+		}
+	}
+	return stale
+}
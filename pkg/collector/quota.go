@@ -0,0 +1,169 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQuotaExceeded is returned for requests to a log API beyond the daily
+// budget of a QuotaTransport.
+var ErrQuotaExceeded = errors.New("log API request budget exhausted")
+
+// DefaultQuotaReserve is the part of a daily budget, in percent, reserved
+// for requests that are not optional when Quota.Reserve is not set.
+const DefaultQuotaReserve = 10
+
+// Quota limits the requests sent to a log API such as Rekor's.
+type Quota struct {
+	// Rate is the sustained number of requests per second, with bursts of
+	// up to Burst requests. Rate is unlimited if not positive.
+	Rate  float64
+	Burst int
+	// Daily is the number of requests allowed per UTC day, unlimited if
+	// not positive.
+	Daily int64
+	// Reserve is the number of requests of Daily that optional requests,
+	// see OptionalRequests, may not use, so that the consistency proofs
+	// needed to accept checkpoints are still fetched once the optional
+	// audits have used up their share. It defaults to DefaultQuotaReserve
+	// percent of Daily.
+	Reserve int64
+}
+
+// QuotaTransport is an http.RoundTripper enforcing a Quota. Requests wait
+// for the rate limit and fail with ErrQuotaExceeded beyond the daily budget.
+// Retries of a request by Base do not count.
+type QuotaTransport struct {
+	// Base sends the requests, http.DefaultTransport if nil.
+	Base  http.RoundTripper
+	Quota Quota
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	day    string
+	used   int64
+	now    func() time.Time
+}
+
+// NewQuotaTransport returns a transport sending requests with base within q,
+// filling in defaults for unset fields.
+func NewQuotaTransport(base http.RoundTripper, q Quota) *QuotaTransport {
+	if q.Burst <= 0 {
+		q.Burst = 1
+	}
+	if q.Reserve <= 0 {
+		q.Reserve = q.Daily * DefaultQuotaReserve / 100
+	}
+	return &QuotaTransport{Base: base, Quota: q, tokens: float64(q.Burst), now: time.Now}
+}
+
+type optionalKey struct{}
+
+// OptionalRequests marks the requests sent with ctx as optional: they fail
+// with ErrQuotaExceeded once only the reserve of a daily budget is left.
+func OptionalRequests(ctx context.Context) context.Context {
+	return context.WithValue(ctx, optionalKey{}, true)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *QuotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	optional, _ := req.Context().Value(optionalKey{}).(bool)
+	if err := t.take(req.Context(), optional); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), err)
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// take counts a request against the daily budget and waits until the rate
+// limit allows it.
+func (t *QuotaTransport) take(ctx context.Context, optional bool) error {
+	t.mu.Lock()
+	now := t.now()
+	if day := now.UTC().Format("2006-01-02"); day != t.day {
+		t.day, t.used = day, 0
+	}
+	if q := t.Quota; q.Daily > 0 {
+		limit := q.Daily
+		if optional {
+			limit -= q.Reserve
+		}
+		if t.used >= limit {
+			t.mu.Unlock()
+			return ErrQuotaExceeded
+		}
+	}
+	t.used++
+
+	var wait time.Duration
+	if rate := t.Quota.Rate; rate > 0 {
+		t.tokens += now.Sub(t.last).Seconds() * rate
+		if burst := float64(t.Quota.Burst); t.tokens > burst || t.last.IsZero() {
+			t.tokens = burst
+		}
+		t.last = now
+		// Tokens go negative to reserve the slots of waiting requests.
+		t.tokens--
+		if t.tokens < 0 {
+			wait = time.Duration(-t.tokens / rate * float64(time.Second))
+		}
+	}
+	t.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runOptional runs p over [start, end) with the requests of fn marked
+// optional. It stops at the first ErrQuotaExceeded returned by fn and then
+// returns that error.
+func runOptional(p Pipeline, start, end int64, fn func(ctx context.Context, index int64) error) (PipelineReport, error) {
+	ctx, cancel := context.WithCancel(OptionalRequests(context.Background()))
+	defer cancel()
+	var exhausted atomic.Bool
+	report, err := p.Run(ctx, start, end, func(ctx context.Context, index int64) error {
+		err := fn(ctx, index)
+		if errors.Is(err, ErrQuotaExceeded) {
+			exhausted.Store(true)
+			cancel()
+		}
+		return err
+	})
+	if exhausted.Load() {
+		return report, ErrQuotaExceeded
+	}
+	return report, err
+}
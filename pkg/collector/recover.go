@@ -0,0 +1,290 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// acceptedSizes holds the largest tree size accepted of each origin. It
+// outlives the retained accepted checkpoints, so that a log whose
+// checkpoints were pruned by those of other logs cannot go back either. Its
+// zero value is ready to use.
+type acceptedSizes struct {
+	mu   sync.Mutex
+	size map[string]int64
+}
+
+func (a *acceptedSizes) record(origin string, size int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.size == nil {
+		a.size = make(map[string]int64)
+	}
+	if size > a.size[origin] {
+		a.size[origin] = size
+	}
+}
+
+// max returns the largest tree size accepted of the origins matching match.
+func (a *acceptedSizes) max(match func(origin string) bool) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var size int64
+	for o, s := range a.size {
+		if s > size && match(o) {
+			size = s
+		}
+	}
+	return size
+}
+
+// Recovery summarizes the state rebuilt by Recover.
+type Recovery struct {
+	// Origins is the number of logs whose latest accepted checkpoint was
+	// recovered.
+	Origins int
+	// Monitors is the number of monitors whose latest checkpoints were
+	// recovered from the history directory.
+	Monitors int
+	// Conflicts is the number of open conflicts recovered.
+	Conflicts int
+	// Completed is set if a round interrupted after persisting its
+	// acceptance was completed, and Abandoned if one interrupted before
+	// was abandoned.
+	Completed, Abandoned bool
+}
+
+// Recover rebuilds the in-memory state of a restarted collector from durable
+// storage instead of assuming a clean slate. The latest accepted checkpoint
+// of each log is recovered from the storage and the provenance, with the
+// time it was accepted and the round numbering, so that no older checkpoint
+// is accepted after a restart and anomaly detection continues where it
+// stopped. The latest checkpoints read from each monitor are recovered from
+// the history directory, and the conflicts among them and those of the last
+// archived round report are reopened without alerting them again, so that
+// they are resolved once they clear. A round interrupted between deciding
+// and publishing its acceptance is completed or abandoned first, see
+// Config.IntentFile. Recover is called once, before the first round.
+func (c *Collector) Recover(ctx context.Context) (Recovery, error) {
+	var rec Recovery
+	var err error
+	if rec.Completed, rec.Abandoned, err = c.resumeIntent(ctx); err != nil {
+		return rec, fmt.Errorf("resuming interrupted round: %w", err)
+	}
+	latest := make(map[string]int64)
+
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return rec, fmt.Errorf("reading accepted checkpoints: %w", err)
+	}
+	for _, l := range lines {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil {
+			return rec, fmt.Errorf("reading accepted checkpoints: %w", err)
+		}
+		if chpt.Size > latest[chpt.Origin] {
+			latest[chpt.Origin] = chpt.Size
+		}
+	}
+
+	// grown holds the time each origin was first accepted at its latest
+	// tree size.
+	grown := make(map[string]time.Time)
+	if c.cfg.ProvenanceFile != "" {
+		records, err := c.Provenance()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return rec, fmt.Errorf("reading provenance: %w", err)
+		}
+		var rounds uint64
+		for _, r := range records {
+			c.acceptTimes.record(CheckpointKey{Origin: r.Origin, Size: r.TreeSize, Hash: r.RootHash}, r.AcceptedAt)
+			if n, err := strconv.ParseUint(r.Round, 10, 64); err == nil && n > rounds {
+				rounds = n
+			}
+			switch {
+			case r.TreeSize > latest[r.Origin]:
+				latest[r.Origin] = r.TreeSize
+				grown[r.Origin] = r.AcceptedAt
+			case r.TreeSize == latest[r.Origin] && (grown[r.Origin].IsZero() || r.AcceptedAt.Before(grown[r.Origin])):
+				grown[r.Origin] = r.AcceptedAt
+			}
+		}
+		c.stats.resume(rounds)
+	}
+	now := time.Now()
+	for o, size := range latest {
+		c.sizes.record(o, size)
+		at, ok := grown[o]
+		if !ok {
+			at = now
+		}
+		c.anoms.resume(o, size, at)
+	}
+	rec.Origins = len(latest)
+
+	var conflicts []Conflict
+	var detected time.Time
+	if c.history != nil {
+		monitors, err := c.Monitors()
+		if err != nil {
+			return rec, fmt.Errorf("finding monitors: %w", err)
+		}
+		var observed []string
+		var observations [][]string
+		for _, m := range monitors {
+			chpts, at, err := c.history.resume(m.Logfile, c.readCount())
+			if err != nil {
+				return rec, fmt.Errorf("reading history of monitor %s: %w", m.Logfile, err)
+			}
+			if len(chpts) == 0 {
+				continue
+			}
+			c.beats.observe(m.Logfile, chpts, at)
+			observed = append(observed, m.Logfile)
+			observations = append(observations, chpts)
+			if at.After(detected) {
+				detected = at
+			}
+		}
+		rec.Monitors = len(observed)
+		conflicts = FindConflicts(observed, observations)
+	}
+	n := c.anoms.resumeConflicts(conflicts, detected)
+	if c.cfg.Reports != nil {
+		r, err := c.cfg.Reports.latest()
+		if err != nil {
+			return rec, fmt.Errorf("reading the last round report: %w", err)
+		}
+		if r != nil {
+			n += c.anoms.resumeConflicts(r.Conflicts, r.Time)
+		}
+	}
+	rec.Conflicts = n
+	c.logf("Recovered the latest accepted checkpoints of %d logs, the latest checkpoints of %d monitors and %d open conflicts\n", rec.Origins, rec.Monitors, rec.Conflicts)
+	return rec, nil
+}
+
+// resume records the tree size a log was last accepted at, and when it grew
+// to it, if no round of this collector has yet.
+func (a *anomalies) resume(origin string, size int64, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.logs[origin]; !ok {
+		a.logs[origin] = &growthHistory{size: size, lastGrowth: at}
+	}
+}
+
+// resumeConflicts reopens conflicts found before a restart without alerting
+// them again. It returns the number of conflicts not open already.
+func (a *anomalies) resumeConflicts(conflicts []Conflict, detected time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var n int
+	for _, c := range conflicts {
+		a.incidents[[2]string{AnomalyConflict, c.Origin}] = true
+		if a.conflicted[c.Origin][c.Size] {
+			continue
+		}
+		if a.conflicted[c.Origin] == nil {
+			a.conflicted[c.Origin] = make(map[int64]bool)
+		}
+		a.conflicted[c.Origin][c.Size] = true
+		recent := append(a.recentConflicts[c.Origin], recentConflict(c, detected))
+		if len(recent) > maxRecentConflicts {
+			recent = recent[len(recent)-maxRecentConflicts:]
+		}
+		a.recentConflicts[c.Origin] = recent
+		n++
+	}
+	return n
+}
+
+// resume continues the numbering of rounds after the given round.
+func (s *roundStats) resume(rounds uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rounds > s.rounds {
+		s.rounds = rounds
+	}
+}
+
+// resume returns the latest n checkpoints recorded for a monitor logfile,
+// oldest first, and the time the newest was read, and remembers the newest
+// so that it is not recorded again.
+func (h *history) resume(logfile string, n int) ([]string, time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lines, err := readLines(HistoryFile(h.dir, logfile), sealHistory, n, h.sc)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var chpts []string
+	var at time.Time
+	for _, l := range lines {
+		o, err := parseObservation(l)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if o.Checkpoint, err = h.resolve(o.Checkpoint); err != nil {
+			return nil, time.Time{}, err
+		}
+		chpts = append(chpts, o.Checkpoint)
+		at = o.Time
+	}
+	if len(chpts) > 0 {
+		h.last[logfile] = chpts[len(chpts)-1]
+	}
+	return chpts, at, nil
+}
+
+// latest returns the newest archived round report, or nil if there is none.
+func (a *ReportArchive) latest() (*RoundReport, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	files, err := os.ReadDir(a.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var newest string
+	var newestTime time.Time
+	for _, f := range files {
+		if t, ok := reportTime(f.Name()); ok && t.After(newestTime) {
+			newest, newestTime = f.Name(), t
+		}
+	}
+	if newest == "" {
+		return nil, nil
+	}
+	return ReadReport(filepath.Join(a.Dir, newest))
+}
@@ -0,0 +1,394 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lifecycle states of monitors in the registry. Pending monitors are read
+// for the probation period before they vote, quarantined ones are read but
+// do not vote, and retired ones are no longer read.
+const (
+	MonitorPending     = "pending"
+	MonitorActive      = "active"
+	MonitorQuarantined = "quarantined"
+	MonitorRetired     = "retired"
+)
+
+// DefaultProbation is how long a registered monitor is read before it
+// votes unless Registry.Probation is set.
+const DefaultProbation = 24 * time.Hour
+
+var (
+	// ErrUnknownMonitor is returned for a monitor not in the registry.
+	ErrUnknownMonitor = errors.New("unknown monitor")
+	// ErrMonitorState is returned for a change of lifecycle state that is
+	// not allowed, such as activating a monitor still on probation.
+	ErrMonitorState = errors.New("invalid monitor state change")
+)
+
+// Registry keeps the monitors of a collector in its Storage, which must be
+// a RegistryStorage, with a lifecycle state each, instead of reading them
+// from MonitorList or MonitorGlob. Those seed the registry with active
+// monitors when it is first used; imported and discovered monitors, and
+// those registered with RegisterMonitor, start pending.
+type Registry struct {
+	// Probation is how long a pending monitor is read, its checkpoints
+	// only checked for conflicts, before it becomes active and votes.
+	// DefaultProbation if zero.
+	Probation time.Duration
+}
+
+// RegistryStorage is implemented by storages that can hold the monitor
+// registry.
+type RegistryStorage interface {
+	// LoadRegistry returns the stored registry, nil if none was stored.
+	LoadRegistry() ([]byte, error)
+	// SaveRegistry replaces the stored registry.
+	SaveRegistry(b []byte) error
+}
+
+// RegisteredMonitor is a monitor in the registry.
+type RegisteredMonitor struct {
+	Monitor
+	State      string    `json:"state"`
+	Registered time.Time `json:"registered"`
+	Changed    time.Time `json:"changed"`
+	// Reason is the reason given for the last change of state.
+	Reason string `json:"reason,omitempty"`
+}
+
+// registry is the loaded monitor registry of a collector.
+type registry struct {
+	cfg   Registry
+	store RegistryStorage
+
+	mu       sync.Mutex
+	loaded   bool
+	monitors map[string]*RegisteredMonitor
+}
+
+func newRegistry(cfg *Registry, s Storage) *registry {
+	if cfg == nil {
+		return nil
+	}
+	r := &registry{cfg: *cfg, monitors: make(map[string]*RegisteredMonitor)}
+	if r.cfg.Probation <= 0 {
+		r.cfg.Probation = DefaultProbation
+	}
+	r.store, _ = s.(RegistryStorage)
+	return r
+}
+
+// load reads the registry from the storage once, seeding it with the
+// monitors returned by seed if none was stored. r.mu must be held.
+func (r *registry) load(seed func() ([]Monitor, error), now time.Time, persist bool) error {
+	if r.loaded {
+		return nil
+	}
+	if r.store == nil {
+		return errors.New("the storage cannot hold a monitor registry")
+	}
+	b, err := r.store.LoadRegistry()
+	if err != nil {
+		return fmt.Errorf("loading monitor registry: %w", err)
+	}
+	if b != nil {
+		var list []RegisteredMonitor
+		if err := json.Unmarshal(b, &list); err != nil {
+			return fmt.Errorf("loading monitor registry: %w", err)
+		}
+		for i := range list {
+			r.monitors[list[i].Logfile] = &list[i]
+		}
+		r.loaded = true
+		return nil
+	}
+	monitors, err := seed()
+	if err != nil {
+		return err
+	}
+	for _, m := range monitors {
+		r.monitors[m.Logfile] = &RegisteredMonitor{Monitor: m, State: MonitorActive, Registered: now, Changed: now, Reason: "seeded from the monitor list"}
+	}
+	if persist {
+		if err := r.save(); err != nil {
+			return err
+		}
+	}
+	r.loaded = true
+	return nil
+}
+
+// list returns the registered monitors sorted by logfile. r.mu must be held.
+func (r *registry) list() []RegisteredMonitor {
+	list := make([]RegisteredMonitor, 0, len(r.monitors))
+	for _, m := range r.monitors {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Logfile < list[j].Logfile })
+	return list
+}
+
+// save writes the registry to the storage. r.mu must be held.
+func (r *registry) save() error {
+	b, err := json.Marshal(r.list())
+	if err != nil {
+		return err
+	}
+	if err := r.store.SaveRegistry(b); err != nil {
+		return fmt.Errorf("saving monitor registry: %w", err)
+	}
+	return nil
+}
+
+// promote activates the pending monitors whose probation has passed. It
+// reports whether any was. r.mu must be held.
+func (r *registry) promote(now time.Time) bool {
+	promoted := false
+	for _, m := range r.monitors {
+		if m.State == MonitorPending && now.Sub(m.Changed) >= r.cfg.Probation {
+			m.State, m.Changed, m.Reason = MonitorActive, now, "probation passed"
+			promoted = true
+		}
+	}
+	return promoted
+}
+
+// registryMonitors returns the monitors of the registry that are not
+// retired, registering new imported or discovered ones as pending and
+// activating those whose probation has passed.
+func (c *Collector) registryMonitors(listed func() ([]Monitor, error), extra []Monitor) ([]Monitor, error) {
+	r := c.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := c.now()
+	persist := !c.cfg.ReadOnly
+	if err := r.load(listed, now, persist); err != nil {
+		return nil, err
+	}
+	changed := r.promote(now)
+	for _, m := range extra {
+		if _, ok := r.monitors[m.Logfile]; !ok {
+			r.monitors[m.Logfile] = &RegisteredMonitor{Monitor: m, State: MonitorPending, Registered: now, Changed: now, Reason: "discovered"}
+			changed = true
+		}
+	}
+	if changed && persist {
+		if err := r.save(); err != nil {
+			return nil, err
+		}
+	}
+	var monitors []Monitor
+	for _, m := range r.list() {
+		if m.State != MonitorRetired {
+			monitors = append(monitors, m.Monitor)
+		}
+	}
+	return monitors, nil
+}
+
+// monitorState returns the lifecycle state of a monitor, "" without a
+// registry.
+func (c *Collector) monitorState(logfile string) string {
+	if c.registry == nil {
+		return ""
+	}
+	c.registry.mu.Lock()
+	defer c.registry.mu.Unlock()
+	if m, ok := c.registry.monitors[logfile]; ok {
+		return m.State
+	}
+	return ""
+}
+
+// votes reports whether the checkpoints of a monitor count towards the
+// quorum. Without a registry every monitor votes.
+func (c *Collector) votes(logfile string) bool {
+	s := c.monitorState(logfile)
+	return s == "" || s == MonitorActive
+}
+
+// editRegistry loads the registry and applies fn to it, saving it unless fn
+// fails.
+func (c *Collector) editRegistry(fn func(r *registry, now time.Time) error) error {
+	if c.registry == nil {
+		return errors.New("the collector has no monitor registry")
+	}
+	if c.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+	if _, err := c.Monitors(); err != nil {
+		return err
+	}
+	r := c.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := fn(r, c.now()); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+// RegisteredMonitors returns the monitors in the registry, including
+// retired ones.
+func (c *Collector) RegisteredMonitors() ([]RegisteredMonitor, error) {
+	if c.registry == nil {
+		return nil, errors.New("the collector has no monitor registry")
+	}
+	if _, err := c.Monitors(); err != nil {
+		return nil, err
+	}
+	c.registry.mu.Lock()
+	defer c.registry.mu.Unlock()
+	return c.registry.list(), nil
+}
+
+// RegisterMonitor adds a monitor to the registry as pending. A retired
+// monitor can be registered again. Monitors with a SPIFFE ID are identified
+// by it; other logfiles must be absolute paths or URIs.
+func (c *Collector) RegisterMonitor(m Monitor) (RegisteredMonitor, error) {
+	if m.SPIFFEID != "" {
+		m.Logfile = m.SPIFFEID
+	}
+	if m.Logfile == "" || (isLocal(m.Logfile) && !filepath.IsAbs(m.Logfile)) {
+		return RegisteredMonitor{}, fmt.Errorf("%w: the logfile must be an absolute path or a URI", ErrMonitorState)
+	}
+	var rm RegisteredMonitor
+	err := c.editRegistry(func(r *registry, now time.Time) error {
+		if old, ok := r.monitors[m.Logfile]; ok && old.State != MonitorRetired {
+			return fmt.Errorf("%w: monitor %s is already registered", ErrMonitorState, m.Logfile)
+		}
+		r.monitors[m.Logfile] = &RegisteredMonitor{Monitor: m, State: MonitorPending, Registered: now, Changed: now, Reason: "registered"}
+		rm = *r.monitors[m.Logfile]
+		return nil
+	})
+	return rm, err
+}
+
+// SetMonitorState changes the lifecycle state of a registered monitor.
+// Active monitors can be quarantined, quarantined ones put on probation
+// again, and pending ones activated once their probation has passed; any
+// monitor can be retired.
+func (c *Collector) SetMonitorState(logfile, state, reason string) (RegisteredMonitor, error) {
+	var rm RegisteredMonitor
+	err := c.editRegistry(func(r *registry, now time.Time) error {
+		m, ok := r.monitors[logfile]
+		if !ok {
+			return fmt.Errorf("%w %s", ErrUnknownMonitor, logfile)
+		}
+		allowed := false
+		switch state {
+		case MonitorActive:
+			allowed = m.State == MonitorPending && now.Sub(m.Changed) >= r.cfg.Probation
+		case MonitorQuarantined:
+			allowed = m.State == MonitorActive || m.State == MonitorPending
+		case MonitorPending:
+			allowed = m.State == MonitorQuarantined
+		case MonitorRetired:
+			allowed = m.State != MonitorRetired
+		}
+		if !allowed {
+			return fmt.Errorf("%w: monitor %s cannot change from %s to %q", ErrMonitorState, logfile, m.State, state)
+		}
+		m.State, m.Changed, m.Reason = state, now, reason
+		rm = *m
+		return nil
+	})
+	if err == nil {
+		c.logf("Monitor %s is %s: %s\n", logfile, state, reason)
+	}
+	return rm, err
+}
+
+// RegistryHandler serves the monitor registry of the collectors for the
+// admin listener at /admin/v1/monitors: GET lists the registered monitors,
+// POST registers the monitor in the JSON body, PUT changes the state of the
+// monitor given by the logfile query parameter to the "state" of the JSON
+// body, with its "reason", and DELETE retires it.
+func RegistryHandler(cs ...*Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := apiCollector(w, r, cs)
+		if !ok {
+			return
+		}
+		var rm RegisteredMonitor
+		var err error
+		status := http.StatusOK
+		switch r.Method {
+		case http.MethodGet:
+			list, err := c.RegisteredMonitors()
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, list)
+			return
+		case http.MethodPost:
+			var m Monitor
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+			rm, err = c.RegisterMonitor(m)
+			status = http.StatusCreated
+		case http.MethodPut:
+			var change struct {
+				State  string `json:"state"`
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+			rm, err = c.SetMonitorState(r.URL.Query().Get("logfile"), change.State, change.Reason)
+		case http.MethodDelete:
+			rm, err = c.SetMonitorState(r.URL.Query().Get("logfile"), MonitorRetired, r.URL.Query().Get("reason"))
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			writeError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		switch {
+		case errors.Is(err, ErrUnknownMonitor):
+			writeError(w, err, http.StatusNotFound)
+		case errors.Is(err, ErrMonitorState), errors.Is(err, ErrReadOnly):
+			writeError(w, err, http.StatusConflict)
+		case err != nil:
+			writeError(w, err, http.StatusInternalServerError)
+		default:
+			details := map[string]string{"method": r.Method, "logfile": rm.Logfile, "state": rm.State, "reason": rm.Reason}
+			if c.cfg.Namespace != "" {
+				details["namespace"] = c.cfg.Namespace
+			}
+			if err := c.cfg.Audit.Record(AuditMonitorChange, r.RemoteAddr, details); err != nil {
+				writeError(w, fmt.Errorf("monitor %s is %s, but recording the audit entry failed: %w", rm.Logfile, rm.State, err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			writeJSON(w, rm)
+		}
+	})
+}
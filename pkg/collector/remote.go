@@ -0,0 +1,90 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// remoteTailSize is the number of bytes requested from the end of a remote
+// monitor logfile, enough for the latest checkpoints.
+const remoteTailSize = 64 * 1024
+
+// isRemote reports whether a monitor logfile is an HTTP(S) URL.
+func isRemote(logfile string) bool {
+	scheme := logfileScheme(logfile)
+	return scheme == "https" || scheme == "http"
+}
+
+// readRemoteCheckpoints reads the latest n checkpoints of a monitor logfile
+// served over HTTP(S). Only the end of the file is requested from servers
+// supporting range requests. maxSize, if positive, limits the size of a
+// complete file.
+func readRemoteCheckpoints(ctx context.Context, client *http.Client, url string, n int, maxSize int64) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=-%d", remoteTailSize))
+
+	resp, err := client.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %v", ErrReadTimeout, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		body = io.LimitReader(resp.Body, remoteTailSize)
+	case http.StatusOK:
+		if maxSize > 0 {
+			if resp.ContentLength > maxSize {
+				return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrFileTooLarge, resp.ContentLength, maxSize)
+			}
+			body = io.LimitReader(resp.Body, maxSize+1)
+		}
+	default:
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	b, err := io.ReadAll(body)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %v", ErrReadTimeout, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK && maxSize > 0 && int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, maxSize)
+	}
+	// A partial response may start in the middle of a line.
+	if resp.StatusCode == http.StatusPartialContent && !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes 0-") {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+	return readLastLines(bytes.NewReader(b), int64(len(b)), n)
+}
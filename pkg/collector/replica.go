@@ -0,0 +1,69 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// ErrReadOnly is returned when a collector in read-only mode is asked to
+// collect or to write to its storage.
+var ErrReadOnly = errors.New("collector is read-only")
+
+// readOnlyStorage refuses writes to a Storage shared with the collector
+// writing it, so that a replica cannot become a second writer.
+type readOnlyStorage struct {
+	Storage
+}
+
+// Append implements Storage.
+func (readOnlyStorage) Append([]string) error {
+	return ErrReadOnly
+}
+
+// Prune implements Storage.
+func (readOnlyStorage) Prune(int) error {
+	return ErrReadOnly
+}
+
+// runReplica follows the storage of a read-only collector until ctx is
+// done, reading its latest accepted checkpoint every Interval and waking up
+// the requests waiting for a tree size when it changed. Read failures are
+// logged and retried, so a replica keeps serving while the storage is
+// unavailable.
+func (c *Collector) runReplica(ctx context.Context) error {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	var last string
+	for {
+		lines, err := c.cfg.Storage.Latest(1)
+		switch {
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			c.logf("Reading accepted checkpoints: %s\n", coded(withClass(ErrStorage, err)))
+		case len(lines) == 1 && lines[0] != last:
+			last = lines[0]
+			c.accepts.broadcast()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,248 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultReportRetention is how long round reports are archived by default.
+const DefaultReportRetention = 30 * 24 * time.Hour
+
+// reportPruneInterval is the minimum time between two prunings of a
+// ReportArchive.
+const reportPruneInterval = time.Hour
+
+// Files of a ReportArchive
+const (
+	reportIndexFile = "index.jsonl"
+	reportSuffix    = ".json.zst"
+)
+
+var (
+	reportEncoder, _ = zstd.NewWriter(nil)
+	reportDecoder, _ = zstd.NewReader(nil)
+)
+
+// ReportArchive keeps the report of every round as zstd compressed JSON in
+// Dir, one file per round named after the time and ID of the round, and
+// deletes reports older than Retention. An index of the checkpoint accepted
+// in each round finds the report of the round that accepted a checkpoint,
+// see ReportFor, for audits after the fact. A ReportArchive is an Exporter.
+type ReportArchive struct {
+	Dir       string
+	Retention time.Duration
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// reportIndexEntry is a line of the index of a ReportArchive.
+type reportIndexEntry struct {
+	File     string    `json:"file"`
+	Time     time.Time `json:"time"`
+	Round    string    `json:"round"`
+	Origin   string    `json:"origin"`
+	TreeSize int64     `json:"tree_size"`
+	RootHash string    `json:"root_hash"`
+}
+
+// Export implements Exporter. Reports past the retention are pruned at most
+// once an hour.
+func (a *ReportArchive) Export(ctx context.Context, r RoundReport) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := os.MkdirAll(a.Dir, 0750); err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s%s", r.Time.UnixNano(), r.Round, reportSuffix)
+	if err := os.WriteFile(filepath.Join(a.Dir, name), reportEncoder.EncodeAll(b, nil), 0600); err != nil {
+		return fmt.Errorf("archiving round report: %w", err)
+	}
+	if r.Accepted != nil {
+		e := reportIndexEntry{File: name, Time: r.Time, Round: r.Round, Origin: r.Accepted.Origin, TreeSize: r.Accepted.Size, RootHash: r.Accepted.Hash}
+		if err := appendReportIndex(filepath.Join(a.Dir, reportIndexFile), e); err != nil {
+			return fmt.Errorf("indexing round report: %w", err)
+		}
+	}
+	if a.Retention > 0 && r.Time.Sub(a.pruned) >= reportPruneInterval {
+		if err := a.prune(r.Time.Add(-a.Retention)); err != nil {
+			return fmt.Errorf("pruning round reports: %w", err)
+		}
+		a.pruned = r.Time
+	}
+	return nil
+}
+
+func appendReportIndex(filename string, e reportIndexEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reportTime returns the time of a round from the name of its report file.
+func reportTime(name string) (time.Time, bool) {
+	if !strings.HasSuffix(name, reportSuffix) {
+		return time.Time{}, false
+	}
+	ns, _, _ := strings.Cut(name, "-")
+	n, err := strconv.ParseInt(ns, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// prune deletes the reports of rounds before cutoff and their index
+// entries.
+func (a *ReportArchive) prune(cutoff time.Time) error {
+	files, err := os.ReadDir(a.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if t, ok := reportTime(f.Name()); ok && t.Before(cutoff) {
+			if err := os.Remove(filepath.Join(a.Dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	entries, err := a.index()
+	if err != nil {
+		return err
+	}
+	var lines []byte
+	for _, e := range entries {
+		if e.Time.Before(cutoff) {
+			continue
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, b...), '\n')
+	}
+	tmp := filepath.Join(a.Dir, reportIndexFile+".tmp")
+	if err := os.WriteFile(tmp, lines, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(a.Dir, reportIndexFile))
+}
+
+// index reads the index of the archive, oldest first.
+func (a *ReportArchive) index() ([]reportIndexEntry, error) {
+	f, err := os.Open(filepath.Join(a.Dir, reportIndexFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []reportIndexEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e reportIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// ReportFor returns the archived report of the latest round that accepted
+// a checkpoint of the given tree size of origin, which may omit the tree ID
+// and matches every log if empty, or nil if there is none. In batch mode only the newest
+// checkpoint accepted by a round is indexed.
+func (a *ReportArchive) ReportFor(origin string, size int64) (*RoundReport, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries, err := a.index()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.TreeSize != size || (origin != "" && !MatchOrigin(origin, e.Origin)) {
+			continue
+		}
+		r, err := ReadReport(filepath.Join(a.Dir, e.File))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Pruned since the index was read.
+			return nil, nil
+		}
+		return r, err
+	}
+	return nil, nil
+}
+
+// ReadReport reads a round report archived by a ReportArchive.
+func ReadReport(filename string) (*RoundReport, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = reportDecoder.DecodeAll(b, nil); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	var r RoundReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &r, nil
+}
+
+// RoundReportFor returns the archived report of the latest round that
+// accepted a checkpoint of the given tree size of origin, or nil if there is
+// none, see ReportArchive.ReportFor.
+func (c *Collector) RoundReportFor(origin string, size int64) (*RoundReport, error) {
+	if c.cfg.Reports == nil {
+		return nil, errors.New("round reports are not archived")
+	}
+	return c.cfg.Reports.ReportFor(origin, size)
+}
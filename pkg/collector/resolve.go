@@ -0,0 +1,159 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+// ConsistencyProver fetches proofs that the tree of a log at size first is a
+// prefix of its tree at size second.
+type ConsistencyProver interface {
+	ConsistencyProof(ctx context.Context, origin string, first, second int64) ([][]byte, error)
+}
+
+// RekorProver fetches consistency proofs from the Rekor API at URL, such as
+// https://rekor.sigstore.dev.
+type RekorProver struct {
+	URL    string
+	Client *http.Client
+}
+
+// ConsistencyProof implements ConsistencyProver. The origin is not sent:
+// Rekor serves proofs for its active shard.
+func (p *RekorProver) ConsistencyProof(ctx context.Context, origin string, first, second int64) ([][]byte, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	q := url.Values{"firstSize": {fmt.Sprint(first)}, "lastSize": {fmt.Sprint(second)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.URL, "/")+"/api/v1/log/proof?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching consistency proof from %d to %d: %s", first, second, resp.Status)
+	}
+
+	var body struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding consistency proof: %w", err)
+	}
+	hashes := make([][]byte, len(body.Hashes))
+	for i, h := range body.Hashes {
+		if hashes[i], err = hex.DecodeString(h); err != nil {
+			return nil, fmt.Errorf("decoding consistency proof: %w", err)
+		}
+	}
+	return hashes, nil
+}
+
+// VerifyConsistency checks a consistency proof from checkpoint first to the
+// larger checkpoint second of the same log.
+func VerifyConsistency(first, second Checkpoint, hashes [][]byte) error {
+	if first.Origin != second.Origin {
+		return fmt.Errorf("checkpoints of %s and %s are of different logs", first.Origin, second.Origin)
+	}
+	root1, err := base64.StdEncoding.DecodeString(first.Hash)
+	if err != nil {
+		return fmt.Errorf("decoding root hash of tree size %d: %w", first.Size, err)
+	}
+	root2, err := base64.StdEncoding.DecodeString(second.Hash)
+	if err != nil {
+		return fmt.Errorf("decoding root hash of tree size %d: %w", second.Size, err)
+	}
+	return proof.VerifyConsistency(rfc6962.DefaultHasher, uint64(first.Size), uint64(second.Size), hashes, root1, root2)
+}
+
+// resolve selects the checkpoint to accept among the candidates that reached
+// quorum with the configured resolution rule, and returns the rule, or an
+// empty rule if there was only one candidate.
+func (c *Collector) resolve(ctx context.Context, candidates []Candidate) (Checkpoint, string) {
+	if len(candidates) == 1 {
+		return candidates[0].Checkpoint, ""
+	}
+	rule := c.cfg.Resolution
+	if rule == "" {
+		rule = ResolveLargest
+	}
+	if rule != ResolveConsistent {
+		return Resolve(candidates, rule), rule
+	}
+
+	// Walk the candidates of the log of the largest one from the smallest
+	// tree size up, stopping at the first that cannot be proven to extend
+	// the ones before it.
+	origin := Resolve(candidates, ResolveLargest).Origin
+	var accepted Checkpoint
+	for _, cand := range candidates {
+		if cand.Origin != origin {
+			continue
+		}
+		if accepted.Origin == "" {
+			accepted = cand.Checkpoint
+			continue
+		}
+		if err := c.proveConsistent(ctx, accepted, cand.Checkpoint); err != nil {
+			c.anoms.record(AnomalyInconsistent, origin)
+			c.alert(Alert{
+				Kind:     AnomalyInconsistent,
+				Origin:   origin,
+				Size:     cand.Size,
+				Previous: accepted.Size,
+				Roots:    []string{cand.Hash, accepted.Hash},
+				Message:  fmt.Sprintf("tree size %d of %s reached quorum but is not consistent with tree size %d, accepting %d: %v", cand.Size, origin, accepted.Size, accepted.Size, err),
+			})
+			break
+		}
+		accepted = cand.Checkpoint
+	}
+	return accepted, rule
+}
+
+// proveConsistent fetches and verifies a consistency proof between two
+// checkpoints, bounded by the Verify timeout.
+func (c *Collector) proveConsistent(ctx context.Context, first, second Checkpoint) error {
+	if first.Size == second.Size {
+		return fmt.Errorf("root hashes %s and %s differ", first.Hash, second.Hash)
+	}
+	if c.cfg.Prover == nil {
+		return fmt.Errorf("no consistency prover is configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Verify)
+	defer cancel()
+	hashes, err := c.cfg.Prover.ConsistencyProof(ctx, first.Origin, first.Size, second.Size)
+	if err != nil {
+		return err
+	}
+	return VerifyConsistency(first, second, hashes)
+}
@@ -0,0 +1,230 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roughtime message tags, the little-endian encoding of their names.
+const (
+	rtSIG  = 0x00474953
+	rtNONC = 0x434e4f4e
+	rtDELE = 0x454c4544
+	rtPATH = 0x48544150
+	rtRADI = 0x49444152
+	rtPUBK = 0x4b425550
+	rtMIDP = 0x5044494d
+	rtSREP = 0x50455253
+	rtMINT = 0x544e494d
+	rtROOT = 0x544f4f52
+	rtCERT = 0x54524543
+	rtMAXT = 0x5458414d
+	rtINDX = 0x58444e49
+	rtPAD  = 0xff444150
+)
+
+// Roughtime signature contexts.
+const (
+	rtDelegationContext = "RoughTime v1 delegation signature--\x00"
+	rtResponseContext   = "RoughTime v1 response signature\x00"
+)
+
+// rtRequestSize is the size requests are padded to, so that a response is
+// never larger than the request that caused it.
+const rtRequestSize = 1024
+
+// Roughtime is a TimeSource reading the time from a Roughtime server, which
+// signs it together with a nonce of the collector so that the response
+// cannot be forged or replayed.
+type Roughtime struct {
+	// Address is the UDP address of the server, such as
+	// roughtime.cloudflare.com:2002.
+	Address string
+	// PublicKey is the server's long-term Ed25519 public key.
+	PublicKey ed25519.PublicKey
+}
+
+// ParseRoughtime parses a Roughtime server given as "<address>,<key>", where
+// key is the base64 encoded Ed25519 public key of the server.
+func ParseRoughtime(spec string) (*Roughtime, error) {
+	addr, key, ok := strings.Cut(spec, ",")
+	if !ok || addr == "" {
+		return nil, fmt.Errorf("malformed Roughtime server %q, expected <address>,<public key>", spec)
+	}
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Roughtime server %q: public key is not a base64 encoded Ed25519 key", spec)
+	}
+	return &Roughtime{Address: addr, PublicKey: ed25519.PublicKey(b)}, nil
+}
+
+// Now queries the server and returns the midpoint of its time and the
+// radius of its uncertainty.
+func (r *Roughtime) Now(ctx context.Context) (time.Time, time.Duration, error) {
+	var nonce [64]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return time.Time{}, 0, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.Address)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := encodeRoughtime(map[uint32][]byte{rtNONC: nonce[:], rtPAD: nil})
+	req = encodeRoughtime(map[uint32][]byte{rtNONC: nonce[:], rtPAD: make([]byte, rtRequestSize-len(req))})
+	if _, err := conn.Write(req); err != nil {
+		return time.Time{}, 0, err
+	}
+	buf := make([]byte, 2*rtRequestSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	midp, radi, err := verifyRoughtime(buf[:n], nonce[:], r.PublicKey)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("Roughtime server %s: %w", r.Address, err)
+	}
+	return midp, radi, nil
+}
+
+// encodeRoughtime encodes a Roughtime message. Values must be multiples of
+// four bytes long.
+func encodeRoughtime(msg map[uint32][]byte) []byte {
+	tags := make([]uint32, 0, len(msg))
+	for t := range msg {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 0
+	for _, t := range tags[:len(tags)-1] {
+		offset += len(msg[t])
+		b = binary.LittleEndian.AppendUint32(b, uint32(offset))
+	}
+	for _, t := range tags {
+		b = binary.LittleEndian.AppendUint32(b, t)
+	}
+	for _, t := range tags {
+		b = append(b, msg[t]...)
+	}
+	return b
+}
+
+// decodeRoughtime decodes a Roughtime message.
+func decodeRoughtime(b []byte) (map[uint32][]byte, error) {
+	if len(b) < 4 {
+		return nil, errors.New("truncated Roughtime message")
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n == 0 || n > len(b)/8 {
+		return nil, fmt.Errorf("malformed Roughtime message with %d tags", n)
+	}
+	header := 4 * 2 * n
+	offsets, tags, values := b[4:4*n], b[4*n:header], b[header:]
+	msg := make(map[uint32][]byte, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		end := len(values)
+		if i < n-1 {
+			end = int(binary.LittleEndian.Uint32(offsets[4*i:]))
+		}
+		tag := binary.LittleEndian.Uint32(tags[4*i:])
+		if end < start || end > len(values) || end%4 != 0 {
+			return nil, errors.New("malformed Roughtime message offsets")
+		}
+		if i > 0 && tag <= binary.LittleEndian.Uint32(tags[4*(i-1):]) {
+			return nil, errors.New("unsorted Roughtime message tags")
+		}
+		msg[tag] = values[start:end]
+		start = end
+	}
+	return msg, nil
+}
+
+// verifyRoughtime verifies a Roughtime response to nonce with the server's
+// long-term key and returns its midpoint and radius.
+func verifyRoughtime(resp, nonce []byte, key ed25519.PublicKey) (time.Time, time.Duration, error) {
+	msg, err := decodeRoughtime(resp)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	cert, err := decodeRoughtime(msg[rtCERT])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("certificate: %w", err)
+	}
+	if !ed25519.Verify(key, append([]byte(rtDelegationContext), cert[rtDELE]...), cert[rtSIG]) {
+		return time.Time{}, 0, errors.New("invalid delegation signature")
+	}
+	dele, err := decodeRoughtime(cert[rtDELE])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("delegation: %w", err)
+	}
+	if len(dele[rtPUBK]) != ed25519.PublicKeySize || len(dele[rtMINT]) != 8 || len(dele[rtMAXT]) != 8 {
+		return time.Time{}, 0, errors.New("malformed delegation")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(dele[rtPUBK]), append([]byte(rtResponseContext), msg[rtSREP]...), msg[rtSIG]) {
+		return time.Time{}, 0, errors.New("invalid response signature")
+	}
+	srep, err := decodeRoughtime(msg[rtSREP])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("signed response: %w", err)
+	}
+	if len(srep[rtMIDP]) != 8 || len(srep[rtRADI]) != 4 || len(msg[rtINDX]) != 4 || len(msg[rtPATH])%64 != 0 {
+		return time.Time{}, 0, errors.New("malformed signed response")
+	}
+
+	// The nonce is a leaf of the Merkle tree whose root the server signed.
+	h := sha512.Sum512(append([]byte{0}, nonce...))
+	hash := h[:]
+	index := binary.LittleEndian.Uint32(msg[rtINDX])
+	for path := msg[rtPATH]; len(path) > 0; path = path[64:] {
+		node := []byte{1}
+		if index&1 == 0 {
+			node = append(append(node, hash...), path[:64]...)
+		} else {
+			node = append(append(node, path[:64]...), hash...)
+		}
+		h = sha512.Sum512(node)
+		hash = h[:]
+		index >>= 1
+	}
+	if !bytes.Equal(hash, srep[rtROOT]) {
+		return time.Time{}, 0, errors.New("nonce is not in the signed response")
+	}
+
+	midp := binary.LittleEndian.Uint64(srep[rtMIDP])
+	if midp < binary.LittleEndian.Uint64(dele[rtMINT]) || midp > binary.LittleEndian.Uint64(dele[rtMAXT]) {
+		return time.Time{}, 0, errors.New("time is outside the validity of the delegated key")
+	}
+	return time.UnixMicro(int64(midp)), time.Duration(binary.LittleEndian.Uint32(srep[rtRADI])) * time.Microsecond, nil
+}
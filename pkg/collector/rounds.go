@@ -0,0 +1,176 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// roundDurationBuckets are the upper bounds of the round latency histogram
+// in seconds.
+var roundDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+// maxSizeHistory bounds the accepted tree sizes kept to compute lag.
+const maxSizeHistory = 1000
+
+// exemplar links a histogram observation to the round it was taken in.
+type exemplar struct {
+	round string
+	value float64
+	time  time.Time
+}
+
+// sizeSeen is the time a tree size was first accepted.
+type sizeSeen struct {
+	size int64
+	time time.Time
+}
+
+// treeStats tracks the accepted tree size of a log origin over time.
+type treeStats struct {
+	size   int64
+	growth float64
+	// seen lists the tree sizes accepted, in increasing order.
+	seen []sizeSeen
+}
+
+// monitorLag is how far a monitor is behind consensus.
+type monitorLag struct {
+	entries int64
+	seconds float64
+}
+
+// roundStats records statistics about collection rounds for metrics.
+type roundStats struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	rounds    uint64
+	buckets   []uint64
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+	trees     map[string]*treeStats
+	lags      map[string]monitorLag
+}
+
+func newRoundStats() *roundStats {
+	return &roundStats{
+		now:       time.Now,
+		buckets:   make([]uint64, len(roundDurationBuckets)),
+		exemplars: make([]*exemplar, len(roundDurationBuckets)+1),
+		trees:     make(map[string]*treeStats),
+		lags:      make(map[string]monitorLag),
+	}
+}
+
+// start begins a round and returns its ID and a function recording its
+// duration when it ends.
+func (s *roundStats) start() (string, func()) {
+	s.mu.Lock()
+	s.rounds++
+	id := strconv.FormatUint(s.rounds, 10)
+	s.mu.Unlock()
+
+	begin := s.now()
+	return id, func() {
+		end := s.now()
+		d := end.Sub(begin).Seconds()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		i := sort.SearchFloat64s(roundDurationBuckets, d)
+		if i < len(s.buckets) {
+			s.buckets[i]++
+		}
+		s.exemplars[i] = &exemplar{round: id, value: d, time: end}
+		s.sum += d
+		s.count++
+	}
+}
+
+// accepted records the accepted checkpoint of a round and the latest
+// checkpoint of the same origin read from each monitor.
+func (s *roundStats) accepted(chpt Checkpoint, latest map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	t, ok := s.trees[chpt.Origin]
+	if !ok {
+		t = &treeStats{}
+		s.trees[chpt.Origin] = t
+	}
+	if n := len(t.seen); n == 0 || chpt.Size > t.seen[n-1].size {
+		if n > 0 {
+			prev := t.seen[n-1]
+			if elapsed := now.Sub(prev.time).Seconds(); elapsed > 0 {
+				t.growth = float64(chpt.Size-prev.size) / elapsed
+			}
+		}
+		t.seen = append(t.seen, sizeSeen{size: chpt.Size, time: now})
+		if len(t.seen) > maxSizeHistory {
+			t.seen = t.seen[len(t.seen)-maxSizeHistory:]
+		}
+	}
+	t.size = chpt.Size
+
+	for m, size := range latest {
+		lag := monitorLag{}
+		if size < t.size {
+			lag.entries = t.size - size
+			// The monitor has been behind since the first accepted size
+			// it has not reached yet.
+			if i := sort.Search(len(t.seen), func(i int) bool { return t.seen[i].size > size }); i < len(t.seen) {
+				lag.seconds = now.Sub(t.seen[i].time).Seconds()
+			}
+		}
+		s.lags[m] = lag
+	}
+}
+
+// collectMetrics adds the round statistics to the collector's metrics.
+func (s *roundStats) collectMetrics(add func(name string, smp sample)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for origin, t := range s.trees {
+		add("rekor_collector_tree_size", sample{labels: []string{"origin", origin}, value: float64(t.size)})
+		add("rekor_collector_tree_growth_rate", sample{labels: []string{"origin", origin}, value: t.growth})
+	}
+	for m, lag := range s.lags {
+		add("rekor_collector_monitor_lag_entries", sample{labels: []string{"monitor", m}, value: float64(lag.entries)})
+		add("rekor_collector_monitor_lag_seconds", sample{labels: []string{"monitor", m}, value: lag.seconds})
+	}
+
+	var cumulative uint64
+	for i, le := range roundDurationBuckets {
+		cumulative += s.buckets[i]
+		add("rekor_collector_round_duration_seconds", sample{suffix: "_bucket", labels: []string{"le", strconv.FormatFloat(le, 'g', -1, 64)}, value: float64(cumulative), exemplar: s.exemplars[i]})
+	}
+	add("rekor_collector_round_duration_seconds", sample{suffix: "_bucket", labels: []string{"le", "+Inf"}, value: float64(s.count), exemplar: s.exemplars[len(roundDurationBuckets)]})
+	add("rekor_collector_round_duration_seconds", sample{suffix: "_sum", value: s.sum})
+	add("rekor_collector_round_duration_seconds", sample{suffix: "_count", value: float64(s.count)})
+}
+
+// String formats the exemplar in the OpenMetrics text format.
+func (e *exemplar) String() string {
+	return fmt.Sprintf("# {round_id=%q} %g %.3f", e.round, e.value, float64(e.time.UnixNano())/1e9)
+}
@@ -0,0 +1,218 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the hex encoded SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Fetcher reads monitor logfiles given as s3://bucket/key URLs, signing
+// requests with AWS Signature Version 4. Like HTTP(S) logfiles, only the end
+// of each object is requested.
+type S3Fetcher struct {
+	Region string
+	// Endpoint, if set, is the base URL of an S3 compatible service such
+	// as MinIO, addressed with path-style URLs. Otherwise objects are read
+	// from AWS.
+	Endpoint                                   string
+	AccessKeyID, SecretAccessKey, SessionToken string
+	// Container, if set, provides the credentials when AccessKeyID and
+	// SecretAccessKey are not set.
+	Container *ContainerCredentials
+	// Client sends the signed requests, http.DefaultClient if nil.
+	Client *http.Client
+
+	now func() time.Time
+}
+
+// S3FetcherFromEnv returns an S3Fetcher configured by the standard AWS
+// environment variables, falling back to the container credentials of an
+// ECS or Fargate task without static credentials.
+func S3FetcherFromEnv() *S3Fetcher {
+	f := &S3Fetcher{
+		Region:          os.Getenv("AWS_REGION"),
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL_S3"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Container:       ContainerCredentialsFromEnv(),
+	}
+	if f.Region == "" {
+		f.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if f.Region == "" {
+		f.Region = "us-east-1"
+	}
+	if f.Endpoint == "" {
+		f.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return f
+}
+
+// Fetch implements Fetcher.
+func (f *S3Fetcher) Fetch(ctx context.Context, logfile string, n int, maxSize int64) ([]string, error) {
+	if (f.AccessKeyID == "" || f.SecretAccessKey == "") && f.Container == nil {
+		return nil, fmt.Errorf("reading from S3: %w", errNoAWSCredentials)
+	}
+	objectURL, err := f.objectURL(logfile)
+	if err != nil {
+		return nil, err
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	signing := *client
+	signing.Transport = s3Signer{f: f, next: client.Transport}
+	return readRemoteCheckpoints(ctx, &signing, objectURL, n, maxSize)
+}
+
+// objectURL returns the HTTPS URL of the object of an s3://bucket/key URL.
+func (f *S3Fetcher) objectURL(logfile string) (string, error) {
+	u, err := url.Parse(logfile)
+	if err != nil {
+		return "", err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket/key", logfile)
+	}
+	if f.Endpoint != "" {
+		return strings.TrimSuffix(f.Endpoint, "/") + "/" + s3Escape(bucket) + "/" + s3Escape(key), nil
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, f.Region, s3Escape(key)), nil
+}
+
+// s3Escape URI-encodes every byte of a path except unreserved characters
+// and slashes, as Signature Version 4 requires.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Signer is an http.RoundTripper signing requests to S3.
+type s3Signer struct {
+	f    *S3Fetcher
+	next http.RoundTripper
+}
+
+func (s s3Signer) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	now := time.Now
+	if s.f.now != nil {
+		now = s.f.now
+	}
+	if err := s.f.sign(req, now().UTC()); err != nil {
+		return nil, fmt.Errorf("reading from S3: %w", err)
+	}
+	next := s.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(req)
+}
+
+// sign adds the Signature Version 4 authorization header to a request
+// without a body.
+func (f *S3Fetcher) sign(req *http.Request, t time.Time) error {
+	creds, err := resolveAWSCredentials(req.Context(), awsCredentials{f.AccessKeyID, f.SecretAccessKey, f.SessionToken}, f.Container)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	creds.sign(req, t, f.Region, "s3", emptyPayloadHash)
+	return nil
+}
+
+// awsCredentials are the credentials AWS requests are signed with.
+type awsCredentials struct {
+	AccessKeyID, SecretAccessKey, SessionToken string
+}
+
+// sign adds the Signature Version 4 authorization header for service to a
+// request whose body has the hex encoded SHA-256 payloadHash. The host, the
+// range and every X-Amz- header are signed.
+func (c awsCredentials) sign(req *http.Request, t time.Time, region, service, payloadHash string) {
+	amzDate := t.Format("20060102T150405Z")
+	scope := t.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + c.SecretAccessKey)
+	for _, part := range []string{t.Format("20060102"), region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
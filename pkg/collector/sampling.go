@@ -0,0 +1,211 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SamplingScheme names the way Sampling chooses monitors in round reports.
+const SamplingScheme = "random-rotating"
+
+// Sampling bounds the latency of rounds over large monitor fleets by reading
+// a random subset of the monitors in each round. Monitors left out of the
+// sample for MaxSkip consecutive rounds are read in the next one, and every
+// network is represented by at least one monitor, so a split view shown to
+// any monitor is seen within MaxSkip+1 rounds even if the random part of
+// the samples keeps missing it. The quorum is counted over the monitors of
+// the sample.
+type Sampling struct {
+	// Size is the number of monitors read in a round, raised to the
+	// quorum. Monitors forced in by MaxSkip or by their network may exceed
+	// it. Zero disables sampling.
+	Size int
+	// MaxSkip is the number of consecutive rounds a monitor may be left
+	// out of the sample. Zero defaults to twice the number of rounds it
+	// takes to read every monitor once. Heartbeat timeouts should exceed
+	// MaxSkip+1 intervals, or monitors left out will appear idle.
+	MaxSkip int
+}
+
+// Enabled reports whether rounds read a sample of the monitors.
+func (s Sampling) Enabled() bool {
+	return s.Size > 0
+}
+
+// ValidSampling checks the settings of s.
+func ValidSampling(s Sampling) error {
+	if s.Size < 0 {
+		return errors.New("the sample size must not be negative")
+	}
+	if s.MaxSkip < 0 {
+		return errors.New("the maximum number of skipped rounds must not be negative")
+	}
+	return nil
+}
+
+// SampleReport records how the monitors of a round were sampled.
+type SampleReport struct {
+	Scheme string
+	// Seed seeds the random choice of the round.
+	Seed int64
+	// Population is the number of monitors the sample was drawn from,
+	// leaving out those with an open circuit.
+	Population int
+	Size       int
+	// Forced is the number of monitors read to honor MaxSkip or to
+	// represent their network rather than drawn at random.
+	Forced  int
+	MaxSkip int
+	// Detection is the probability that a view shown to only a quorum of
+	// the population is read by at least one monitor of the sample.
+	Detection float64
+}
+
+// sampler chooses the monitors of each round and tracks the number of
+// consecutive rounds each monitor was left out.
+type sampler struct {
+	cfg     Sampling
+	quorum  int
+	mu      sync.Mutex
+	skipped map[string]int
+	rnd     *rand.Rand
+}
+
+func newSampler(cfg Sampling, quorum int) *sampler {
+	if cfg.Size < quorum {
+		cfg.Size = quorum
+	}
+	// #nosec G404 -- the seed is recorded in the round report; the sample
+	// need not be unpredictable to monitors, which cannot tell it apart
+	// from a round they were not read in
+	return &sampler{cfg: cfg, quorum: quorum, skipped: make(map[string]int), rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// sample returns the monitors to read in a round and how they were chosen.
+// Monitors for which blocked reports true, such as those with an open
+// circuit, are left out of the population. A nil sampler reads every
+// monitor.
+func (s *sampler) sample(monitors []Monitor, blocked func(string) bool) ([]Monitor, *SampleReport) {
+	if s == nil {
+		return monitors, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var population []Monitor
+	present := make(map[string]bool, len(monitors))
+	for _, m := range monitors {
+		present[m.Logfile] = true
+		if !blocked(m.Logfile) {
+			population = append(population, m)
+		}
+	}
+	for m := range s.skipped {
+		if !present[m] {
+			delete(s.skipped, m)
+		}
+	}
+
+	maxSkip := s.cfg.MaxSkip
+	if maxSkip == 0 {
+		maxSkip = 2 * ((len(population) + s.cfg.Size - 1) / s.cfg.Size)
+	}
+	seed := s.rnd.Int63()
+	r := &SampleReport{Scheme: SamplingScheme, Seed: seed, Population: len(population), MaxSkip: maxSkip}
+	if len(population) <= s.cfg.Size {
+		for _, m := range population {
+			s.skipped[m.Logfile] = 0
+		}
+		r.Size, r.Detection = len(population), 1
+		return monitors, r
+	}
+
+	// #nosec G404 -- see newSampler
+	rnd := rand.New(rand.NewSource(seed))
+	rnd.Shuffle(len(population), func(i, j int) { population[i], population[j] = population[j], population[i] })
+	chosen := make([]bool, len(population))
+	size := 0
+	choose := func(i int) {
+		if !chosen[i] {
+			chosen[i] = true
+			size++
+		}
+	}
+	for i, m := range population {
+		if s.skipped[m.Logfile] >= maxSkip {
+			choose(i)
+		}
+	}
+	networks := make(map[string]bool)
+	for i, m := range population {
+		if chosen[i] {
+			networks[m.Network] = true
+		}
+	}
+	for i, m := range population {
+		if m.Network != "" && !networks[m.Network] {
+			networks[m.Network] = true
+			choose(i)
+		}
+	}
+	r.Forced = size
+	for i := range population {
+		if size >= s.cfg.Size {
+			break
+		}
+		choose(i)
+	}
+
+	var sampled []Monitor
+	for i, m := range population {
+		if chosen[i] {
+			sampled = append(sampled, m)
+			s.skipped[m.Logfile] = 0
+		} else {
+			s.skipped[m.Logfile]++
+		}
+	}
+	// Read monitors in their configured order, as without sampling.
+	order := make(map[string]int, len(monitors))
+	for i, m := range monitors {
+		order[m.Logfile] = i
+	}
+	sort.Slice(sampled, func(i, j int) bool { return order[sampled[i].Logfile] < order[sampled[j].Logfile] })
+	r.Size = len(sampled)
+	r.Detection = detection(len(population), s.quorum, len(sampled))
+	return sampled, r
+}
+
+// detection returns the probability that a uniform sample of size monitors
+// out of population includes at least one of a given k.
+func detection(population, k, size int) float64 {
+	if k <= 0 {
+		return 0
+	}
+	miss := 1.0
+	for i := 0; i < size; i++ {
+		if population-k-i <= 0 {
+			return 1
+		}
+		miss *= float64(population-k-i) / float64(population-i)
+	}
+	return 1 - miss
+}
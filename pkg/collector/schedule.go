@@ -0,0 +1,230 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// DefaultInterval is the time between collection rounds.
+const DefaultInterval = 1 * time.Minute
+
+// target is a set of checkpoints collected on its own schedule. The empty
+// origin is the default target covering every unscheduled origin.
+type target struct {
+	origin   string
+	schedule Schedule
+}
+
+// targets returns the default target followed by one target per entry in
+// OriginIntervals, sorted by origin.
+func (c *Collector) targets() []target {
+	sched := c.cfg.Schedule
+	if sched == nil {
+		sched = c.intervalSchedule("", c.cfg.Interval)
+	}
+	ts := []target{{schedule: sched}}
+	for o, i := range c.cfg.OriginIntervals {
+		ts = append(ts, target{origin: o, schedule: c.intervalSchedule(o, i)})
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].origin < ts[j].origin })
+	return ts
+}
+
+// intervalSchedule returns the schedule of a target collected every
+// interval, adapting it to the log if Config.AdaptiveInterval is enabled.
+func (c *Collector) intervalSchedule(origin string, interval time.Duration) Schedule {
+	if !c.cfg.AdaptiveInterval.Enabled() {
+		return intervalSchedule(interval)
+	}
+	s := newAdaptiveSchedule(c.cfg.AdaptiveInterval, interval)
+	c.adaptive.add(origin, s)
+	return s
+}
+
+// Run collects every target on its own schedule until ctx is cancelled or a
+// round fails. Targets on a fixed interval run their first round right away,
+// while cron scheduled targets wait for the next matching time. Each wait is
+// extended by a random delay of up to Jitter so that collectors started at
+// the same time do not read from monitors in lockstep. Conflict hints run an
+// urgent round right away, see Hint. A read-only collector follows its
+// storage instead.
+func (c *Collector) Run(ctx context.Context) error {
+	if c.cfg.ReadOnly {
+		return c.runReplica(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ts := c.targets()
+	errs := make(chan error, len(ts)+1)
+	for _, t := range ts {
+		go func(t target) {
+			errs <- c.runTarget(ctx, t)
+		}(t)
+	}
+	go func() {
+		errs <- c.runUrgent(ctx)
+	}()
+
+	var err error
+	for i := 0; i < len(ts)+1; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	return err
+}
+
+// runTarget runs collection rounds for a single target.
+func (c *Collector) runTarget(ctx context.Context, t target) error {
+	// #nosec G404 -- jitter does not need to be cryptographically secure
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var wait time.Duration
+	adaptive, _ := t.schedule.(*adaptiveSchedule)
+	if _, ok := t.schedule.(intervalSchedule); !ok && adaptive == nil {
+		wait = time.Until(t.schedule.Next(time.Now()))
+	}
+	wait += jitter(rnd, c.cfg.Jitter)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		accepted, ok, err := c.runRound(ctx, t.origin, false)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if adaptive != nil {
+			prev := adaptive.current()
+			if d := adaptive.observe(accepted, ok, time.Now()); d > prev+prev/10 || d < prev-prev/10 {
+				c.logf("Adjusting the interval between rounds%s to %v\n", targetSuffix(t.origin), d)
+			}
+		}
+		wait = time.Until(t.schedule.Next(time.Now())) + jitter(rnd, c.cfg.Jitter)
+	}
+}
+
+// targetSuffix names the target of origin in log messages, empty for the
+// default target.
+func targetSuffix(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	return " of " + origin
+}
+
+// runRound runs a round of origin bounded by the round timeout, alerting
+// on panics and timeouts so that the next round can go ahead. It returns an
+// error only if collection must stop.
+func (c *Collector) runRound(ctx context.Context, origin string, urgent bool) (Checkpoint, bool, error) {
+	rctx, cancel := ctx, context.CancelFunc(func() {})
+	if c.cfg.Timeouts.Round > 0 {
+		rctx, cancel = context.WithTimeout(ctx, c.cfg.Timeouts.Round)
+	}
+	accepted, ok, err := c.collectRecovered(rctx, origin, urgent)
+	cancel()
+	var perr *PanicError
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return Checkpoint{}, false, nil
+	case errors.As(err, &perr):
+		c.anoms.record(AnomalyPanic, origin)
+		c.alert(Alert{Kind: AnomalyPanic, Origin: origin, Message: "round panicked, continuing with the next round: " + coded(roundError(origin, err))})
+		c.logf("%s", perr.Stack)
+		return Checkpoint{}, false, nil
+	case errors.Is(err, context.DeadlineExceeded):
+		// A round that timed out is retried on schedule.
+		c.alert(Alert{Kind: AlertRoundTimeout, Origin: origin, Message: "round timed out: " + coded(roundError(origin, err))})
+		return Checkpoint{}, false, nil
+	case errors.Is(err, ErrUntrustedTime):
+		// Freshness cannot be judged, so the round holds until a
+		// trusted time source answers again.
+		c.alert(Alert{Kind: AlertUntrustedTime, Origin: origin, Message: "holding the last accepted checkpoint: " + coded(roundError(origin, err))})
+		return Checkpoint{}, false, nil
+	case err != nil:
+		return Checkpoint{}, false, roundError(origin, err)
+	case ok:
+		c.logf("Accepted checkpoint - Origin: %s Tree Size: %d Root Hash: %s\n", accepted.Origin, accepted.Size, accepted.Hash)
+	case c.cfg.QuorumFailure != QuorumAlert:
+		c.logf("Holding the last accepted checkpoint: %s\n", coded(noQuorumError(origin, c.cfg.Quorum)))
+	}
+	return accepted, ok, nil
+}
+
+// PanicError is a panic recovered from a collection round.
+type PanicError struct {
+	Value any
+	// Stack is the stack of the goroutine that panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// recoverPanic stores a panic of the calling goroutine in err as a
+// *PanicError. It must be deferred.
+func recoverPanic(err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{Value: v, Stack: debug.Stack()}
+	}
+}
+
+// collectRecovered runs a round, returning a panic in it as a *PanicError
+// so that a bug triggered by one input does not stop collection.
+func (c *Collector) collectRecovered(ctx context.Context, origin string, urgent bool) (accepted Checkpoint, ok bool, err error) {
+	defer recoverPanic(&err)
+	return c.collect(ctx, origin, urgent)
+}
+
+// roundError wraps the error of a round of origin.
+func roundError(origin string, err error) error {
+	if origin != "" {
+		return fmt.Errorf("collecting %s: %w", origin, err)
+	}
+	return err
+}
+
+// noQuorumMessage describes a round of origin in which no tree size reached
+// quorum.
+func noQuorumMessage(origin string, quorum int) string {
+	if origin != "" {
+		return fmt.Sprintf("No tree size for %s reached a quorum of %d monitors", origin, quorum)
+	}
+	return fmt.Sprintf("No tree size reached a quorum of %d monitors", quorum)
+}
+
+// jitter returns a random duration in [0, max).
+func jitter(rnd *rand.Rand, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(max)))
+}
@@ -0,0 +1,51 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"time"
+)
+
+// secondaryLogTimeout bounds the submission of a cosigned checkpoint to
+// Config.SecondaryLog.
+const secondaryLogTimeout = time.Minute
+
+// SecondaryLog records the checkpoints the collector cosigned in a
+// transparency log, so that its assertions are publicly append-only and
+// third parties can monitor the collector itself.
+type SecondaryLog interface {
+	// Submit records a cosigned note, as written to Config.CosignedFile,
+	// and returns a description of the entry, such as its log index.
+	Submit(ctx context.Context, cosigned []byte) (string, error)
+}
+
+// submit records the cosigned note of an accepted checkpoint in the
+// secondary log. Failures are logged so that collection continues; the
+// checkpoint cosigned next round is submitted as usual.
+func (c *Collector) submit(ctx context.Context, accepted Checkpoint, cosigned string) {
+	if c.cfg.SecondaryLog == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, secondaryLogTimeout)
+	defer cancel()
+	entry, err := c.cfg.SecondaryLog.Submit(ctx, []byte(cosigned))
+	if err != nil {
+		c.logf("Submitting cosigned checkpoint of %s at tree size %d to the secondary log: %v\n", accepted.Origin, accepted.Size, err)
+		return
+	}
+	c.logf("Submitted cosigned checkpoint of %s at tree size %d to the secondary log: %s\n", accepted.Origin, accepted.Size, entry)
+}
@@ -0,0 +1,343 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterCapability(CapabilityAlertSink, "webhook")
+	RegisterCapability(CapabilityAlertSink, "slack")
+	RegisterCapability(CapabilityAlertSink, "pagerduty")
+	RegisterCapability(CapabilityAlertSink, "matrix")
+	RegisterCapability(CapabilityAlertSink, "teams")
+}
+
+// DefaultPagerDutyURL is the PagerDuty Events API v2 endpoint.
+const DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// AlertSink delivers alerts, with their body rendered by Config.AlertTemplate,
+// to an external system.
+type AlertSink interface {
+	Send(ctx context.Context, a Alert, body string) error
+}
+
+// AlertRoute sends the alerts matching any of Match, a kind such as
+// AnomalyConflict, a severity or "*", to the named sinks.
+type AlertRoute struct {
+	Match []string
+	Sinks []string
+}
+
+// matches reports whether a is routed by r.
+func (r AlertRoute) matches(a Alert) bool {
+	for _, m := range r.Match {
+		if m == "*" || m == a.Kind || m == a.Severity {
+			return true
+		}
+	}
+	return false
+}
+
+// AlertRouting fans alerts out to sinks. Without routes every alert is sent
+// to every sink; with routes an alert is sent to the sinks of every route it
+// matches, and alerts matching no route are only logged.
+type AlertRouting struct {
+	// Sinks are the sinks alerts can be sent to, by name.
+	Sinks  map[string]AlertSink
+	Routes []AlertRoute
+}
+
+// route returns the sorted names of the sinks a is sent to.
+func (r AlertRouting) route(a Alert) []string {
+	names := make(map[string]bool)
+	for name := range r.Sinks {
+		names[name] = len(r.Routes) == 0
+	}
+	for _, rt := range r.Routes {
+		if rt.matches(a) {
+			for _, name := range rt.Sinks {
+				names[name] = true
+			}
+		}
+	}
+	var sinks []string
+	for name, ok := range names {
+		if ok {
+			sinks = append(sinks, name)
+		}
+	}
+	sort.Strings(sinks)
+	return sinks
+}
+
+// ValidAlertRouting returns an error if a route refers to an unknown sink.
+func ValidAlertRouting(r AlertRouting) error {
+	for _, rt := range r.Routes {
+		for _, name := range rt.Sinks {
+			if r.Sinks[name] == nil {
+				return fmt.Errorf("alert route %s refers to unknown sink %q", strings.Join(rt.Match, ","), name)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseAlertSink parses an alert sink: "webhook:<url>" posting every alert
+// as JSON, "slack:<incoming webhook url>", "teams:<incoming webhook url>",
+// "pagerduty:<routing key file>", "matrix:<homeserver url>#<room
+// id>,<access token file>", or "github:<owner>/<name>,<token file>[,<api
+// url>]" and "gitlab:<project>,<token file>[,<api url>]" tracking incidents
+// in issues, see IssueSink. The spec may be prefixed with "<name>=", the
+// name defaulting to the sink type. Sinks send their requests with client.
+func ParseAlertSink(spec string, client *http.Client) (string, AlertSink, error) {
+	name, target, named := strings.Cut(spec, "=")
+	if !named || strings.Contains(name, ":") {
+		name, target, named = "", spec, false
+	}
+	kind, arg, _ := strings.Cut(target, ":")
+	if !named {
+		name = kind
+	}
+	switch {
+	case name == "" || arg == "":
+	case kind == "webhook" && isRemote(arg):
+		return name, &WebhookSink{URL: arg, Client: client}, nil
+	case kind == "slack" && isRemote(arg):
+		return name, &SlackSink{URL: arg, Client: client}, nil
+	case kind == "teams" && isRemote(arg):
+		return name, &TeamsSink{URL: arg, Client: client}, nil
+	case kind == "github" || kind == "gitlab":
+		sink, err := parseIssueSink(kind, arg, client)
+		if err != nil {
+			return "", nil, err
+		}
+		return name, sink, nil
+	case kind == "matrix":
+		room, tokenFile, ok := strings.Cut(arg, ",")
+		homeserver, roomID, hasRoom := strings.Cut(room, "#")
+		if !ok || !hasRoom || roomID == "" || !isRemote(homeserver) {
+			break
+		}
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("reading Matrix access token: %w", err)
+		}
+		return name, &MatrixSink{Homeserver: homeserver, Room: roomID, AccessToken: strings.TrimSpace(string(token)), Client: client}, nil
+	case kind == "pagerduty":
+		key, err := os.ReadFile(arg)
+		if err != nil {
+			return "", nil, fmt.Errorf("reading PagerDuty routing key: %w", err)
+		}
+		return name, &PagerDutySink{RoutingKey: strings.TrimSpace(string(key)), Client: client}, nil
+	}
+	return "", nil, fmt.Errorf("invalid alert sink %q, expected [<name>=]webhook:<url>, slack:<url>, teams:<url>, pagerduty:<routing key file>, matrix:<homeserver url>#<room id>,<access token file>, github:<repository>,<token file> or gitlab:<project>,<token file>", spec)
+}
+
+// ParseAlertRoute parses an alert route "<match>,...=<sink>,...", where each
+// match is an alert kind, a severity or "*".
+func ParseAlertRoute(spec string) (AlertRoute, error) {
+	match, sinks, ok := strings.Cut(spec, "=")
+	if !ok || match == "" || sinks == "" {
+		return AlertRoute{}, fmt.Errorf("invalid alert route %q, expected <kind or severity>,...=<sink>,...", spec)
+	}
+	return AlertRoute{Match: strings.Split(match, ","), Sinks: strings.Split(sinks, ",")}, nil
+}
+
+// WebhookSink posts every alert as a JSON object of its fields and its
+// rendered body to URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send implements AlertSink.
+func (s *WebhookSink) Send(ctx context.Context, a Alert, body string) error {
+	return postAlert(ctx, s.Client, s.URL, struct {
+		Alert
+		Body string `json:"body"`
+	}{a, body})
+}
+
+// SlackSink posts the body of every alert to a Slack incoming webhook.
+type SlackSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send implements AlertSink.
+func (s *SlackSink) Send(ctx context.Context, a Alert, body string) error {
+	return postAlert(ctx, s.Client, s.URL, map[string]string{"text": body})
+}
+
+// TeamsSink posts the body of every alert to a Microsoft Teams incoming
+// webhook as a message card, colored by severity.
+type TeamsSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send implements AlertSink.
+func (s *TeamsSink) Send(ctx context.Context, a Alert, body string) error {
+	color := "FFA500"
+	if a.Severity == SeverityCritical {
+		color = "D40000"
+	}
+	title := fmt.Sprintf("%s %s alert", a.Severity, a.Kind)
+	if a.Origin != "" {
+		title += " for " + a.Origin
+	}
+	return postAlert(ctx, s.Client, s.URL, map[string]string{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    title,
+		"title":      title,
+		"themeColor": color,
+		// Teams renders the text as Markdown, where single newlines
+		// are ignored.
+		"text": strings.ReplaceAll(body, "\n", "\n\n"),
+	})
+}
+
+// MatrixSink sends the body of every alert as a text message to a Matrix
+// room, as the user of AccessToken, who must have joined it.
+type MatrixSink struct {
+	// Homeserver is the URL of the user's homeserver, such as
+	// https://matrix.org.
+	Homeserver  string
+	Room        string
+	AccessToken string
+	Client      *http.Client
+
+	// txn numbers the messages sent, making their transaction IDs
+	// unique.
+	txn atomic.Int64
+}
+
+// Send implements AlertSink.
+func (s *MatrixSink) Send(ctx context.Context, a Alert, body string) error {
+	txn := fmt.Sprintf("%d-%d", a.Time.UnixNano(), s.txn.Add(1))
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", strings.TrimSuffix(s.Homeserver, "/"), url.PathEscape(s.Room), txn)
+	return sendAlert(ctx, s.Client, http.MethodPut, u, s.AccessToken, map[string]string{"msgtype": "m.text", "body": body}, nil)
+}
+
+// PagerDutySink triggers a PagerDuty incident for every alert through the
+// Events API v2. Repeated alerts of the same kind and log are deduplicated
+// into one incident, which resolved alerts resolve.
+type PagerDutySink struct {
+	RoutingKey string
+	// URL defaults to DefaultPagerDutyURL.
+	URL    string
+	Client *http.Client
+}
+
+// pagerDutySummaryLimit is the maximum length of an incident summary.
+const pagerDutySummaryLimit = 1024
+
+// Send implements AlertSink.
+func (s *PagerDutySink) Send(ctx context.Context, a Alert, body string) error {
+	endpoint := s.URL
+	if endpoint == "" {
+		endpoint = DefaultPagerDutyURL
+	}
+	if len(body) > pagerDutySummaryLimit {
+		body = body[:pagerDutySummaryLimit]
+	}
+	source := a.Namespace
+	if source == "" {
+		source = "rekor-monitor-collector"
+	}
+	severity := "warning"
+	if a.Severity == SeverityCritical {
+		severity = "critical"
+	}
+	action := "trigger"
+	if a.Resolved {
+		action = "resolve"
+	}
+	return postAlert(ctx, s.Client, endpoint, map[string]any{
+		"routing_key":  s.RoutingKey,
+		"event_action": action,
+		"dedup_key":    fmt.Sprintf("%s/%s/%s", a.Namespace, a.Kind, a.Origin),
+		"payload": map[string]any{
+			"summary":        body,
+			"source":         source,
+			"severity":       severity,
+			"component":      a.Origin,
+			"class":          a.Kind,
+			"timestamp":      a.Time,
+			"custom_details": a,
+		},
+	})
+}
+
+// postAlert posts v as JSON to url, failing unless the response is
+// successful.
+func postAlert(ctx context.Context, client *http.Client, url string, v any) error {
+	return sendAlert(ctx, client, http.MethodPost, url, "", v, nil)
+}
+
+// sendAlert sends v as JSON to url with method, authorized by the bearer
+// token if set, failing unless the response is successful. The JSON
+// response is decoded into out unless it is nil.
+func sendAlert(ctx context.Context, client *http.Client, method, url, token string, v, out any) error {
+	var in io.Reader
+	if v != nil {
+		body, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending alert: %s", resp.Status)
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		return nil
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
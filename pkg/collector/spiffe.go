@@ -0,0 +1,111 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SPIFFEID returns the SPIFFE ID of an X.509-SVID, the single spiffe URI in
+// its subject alternative names.
+func SPIFFEID(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) != 1 {
+		return "", fmt.Errorf("certificate has %d URI SANs, an SVID has exactly one", len(cert.URIs))
+	}
+	id := cert.URIs[0]
+	if id.Scheme != "spiffe" || id.Host == "" || id.User != nil || id.RawQuery != "" || id.Fragment != "" {
+		return "", fmt.Errorf("invalid SPIFFE ID %q", id)
+	}
+	return id.String(), nil
+}
+
+// SVIDFiles serves TLS with an X.509-SVID and trust bundle kept on disk,
+// e.g. by spiffe-helper from a SPIRE agent. The files are read again when
+// they change, so rotated SVIDs are picked up without a restart.
+type SVIDFiles struct {
+	CertFile, KeyFile string
+	// BundleFile holds the PEM encoded CA certificates of the trust domain
+	// client SVIDs are verified against.
+	BundleFile string
+
+	mu      sync.Mutex
+	modTime time.Time
+	config  *tls.Config
+}
+
+// TLSConfig returns a server configuration requiring client SVIDs signed by
+// the trust bundle.
+func (s *SVIDFiles) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return s.load() },
+	}
+}
+
+// Load reads the files, reporting whether they hold a valid SVID and trust
+// bundle.
+func (s *SVIDFiles) Load() error {
+	_, err := s.load()
+	return err
+}
+
+// load returns the configuration for the current files, reloading them if
+// any was modified since they were last read.
+func (s *SVIDFiles) load() (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest time.Time
+	for _, f := range []string{s.CertFile, s.KeyFile, s.BundleFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	if s.config != nil && !latest.After(s.modTime) {
+		return s.config, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading SVID: %w", err)
+	}
+	bundle, err := os.ReadFile(s.BundleFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("trust bundle contains no certificates")
+	}
+	s.config = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	s.modTime = latest
+	return s.config, nil
+}
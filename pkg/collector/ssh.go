@@ -0,0 +1,192 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultSSHDialTimeout bounds establishing an SSH connection to a monitor
+// host.
+const DefaultSSHDialTimeout = 10 * time.Second
+
+// SSHConfig holds the credentials used to read monitor logfiles given as
+// ssh://[user@]host[:port]/path URLs over SFTP.
+type SSHConfig struct {
+	// User is the login name for URLs without one.
+	User string
+	// Signers are the private keys offered to hosts.
+	Signers []ssh.Signer
+	// HostKeyCallback verifies host keys, usually against a known_hosts
+	// file.
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// LoadSSHConfig reads unencrypted private keys and a known_hosts file.
+func LoadSSHConfig(user string, keyFiles []string, knownHostsFile string) (*SSHConfig, error) {
+	cfg := &SSHConfig{User: user}
+	for _, f := range keyFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing SSH key %q: %w", f, err)
+		}
+		cfg.Signers = append(cfg.Signers, signer)
+	}
+	if len(cfg.Signers) == 0 {
+		return nil, errors.New("no SSH keys configured")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %w", err)
+	}
+	cfg.HostKeyCallback = hostKeys
+	return cfg, nil
+}
+
+// sshConn is an SFTP session to a monitor host.
+type sshConn struct {
+	client *ssh.Client
+	sftp   *sftp.Client
+}
+
+func (c *sshConn) Close() error {
+	c.sftp.Close()
+	return c.client.Close()
+}
+
+// sshConns keeps one SFTP session per host and user, reconnecting after a
+// failed read.
+type sshConns struct {
+	cfg *SSHConfig
+
+	mu    sync.Mutex
+	conns map[string]*sshConn
+}
+
+func newSSHConns(cfg *SSHConfig) *sshConns {
+	return &sshConns{cfg: cfg, conns: make(map[string]*sshConn)}
+}
+
+// conn returns the session for user@host, dialing it if needed.
+func (s *sshConns) conn(user, host string) (*sshConn, error) {
+	key := user + "@" + host
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conns[key]; ok {
+		return c, nil
+	}
+
+	client, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(s.cfg.Signers...)},
+		HostKeyCallback: s.cfg.HostKeyCallback,
+		Timeout:         DefaultSSHDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	c := &sshConn{client: client, sftp: sc}
+	s.conns[key] = c
+	return c, nil
+}
+
+// drop closes the session for user@host so the next read reconnects.
+func (s *sshConns) drop(user, host string, c *sshConn) {
+	key := user + "@" + host
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[key] == c {
+		delete(s.conns, key)
+		c.Close()
+	}
+}
+
+// Fetch implements Fetcher for ssh:// URLs. Like local files, only the end
+// of the file is read. A read outlasting ctx closes the session.
+func (s *sshConns) Fetch(ctx context.Context, rawURL string, n int, maxSize int64) ([]string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = s.cfg.User
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	c, err := s.conn(user, host)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", host, err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.drop(user, host, c)
+		case <-stop:
+		}
+	}()
+	chpts, err := readSFTP(c.sftp, u.Path, n, maxSize)
+	switch {
+	case err == nil || errors.Is(err, ErrFileTooLarge):
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	default:
+		s.drop(user, host, c)
+	}
+	return chpts, err
+}
+
+func readSFTP(c *sftp.Client, path string, n int, maxSize int64) ([]string, error) {
+	f, err := c.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && fi.Size() > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrFileTooLarge, fi.Size(), maxSize)
+	}
+	return readLastLines(f, fi.Size(), n)
+}
@@ -0,0 +1,316 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mediaCOSE is the media type of signed statements and receipts.
+const mediaCOSE = "application/cose"
+
+// statementTimeout bounds the registration of a signed statement with
+// Statements.TransparencyURL.
+const statementTimeout = time.Minute
+
+// maxReceiptSize bounds the receipts read from a transparency service.
+const maxReceiptSize = 1 << 20
+
+// COSE header labels, algorithm and CWT claims used in signed statements.
+const (
+	coseAlg          = 1
+	coseContentType  = 3
+	coseKID          = 4
+	coseCWTClaims    = 15
+	coseAlgEdDSA     = -8
+	coseSign1Tag     = 18
+	cwtIssuer        = 1
+	cwtSubject       = 2
+	cwtIssuedAt      = 6
+	statementPayload = "application/json"
+)
+
+// Statements emits every acceptance decision as a SCITT signed statement: a
+// COSE_Sign1 message signed with EdDSA by the collector's Ed25519 cosigning
+// key, whose payload is the JSON provenance record of the accepted
+// checkpoint. The CWT claims name the collector as issuer and the log
+// origin as subject, so the statements about a log form a feed.
+type Statements struct {
+	// Dir is the directory statements are written to, named after the
+	// hex encoded SHA-256 of the checkpoint with the extension .cose.
+	Dir string
+	// Issuer is the issuer claim, such as the collector's URL. It defaults
+	// to the key name of the cosigner.
+	Issuer string
+	// TransparencyURL, if set, is the base URL of a SCITT transparency
+	// service every statement is registered with. Receipts returned right
+	// away are written next to the statement with the extension
+	// .receipt.cose; registrations still running are logged with the URL
+	// of their operation.
+	TransparencyURL string
+	Client          *http.Client
+}
+
+// statementID returns the name of the files of the statement about a
+// checkpoint.
+func statementID(chpt string) string {
+	sum := sha256.Sum256([]byte(chpt))
+	return hex.EncodeToString(sum[:])
+}
+
+// signStatement returns the signed statement of an acceptance decision.
+func signStatement(p Provenance, s Ed25519KeyCosigner, issuer string, now time.Time) ([]byte, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if issuer == "" {
+		issuer = s.Name()
+	}
+	kid := fmt.Sprintf("%s+%08x", s.Name(), s.KeyHash())
+
+	var claims []byte
+	claims = appendCBORHead(claims, 5, 3)
+	claims = appendCBORText(appendCBORHead(claims, 0, cwtIssuer), issuer)
+	claims = appendCBORText(appendCBORHead(claims, 0, cwtSubject), p.Origin)
+	claims = appendCBORHead(appendCBORHead(claims, 0, cwtIssuedAt), 0, uint64(now.Unix()))
+
+	var protected []byte
+	protected = appendCBORHead(protected, 5, 4)
+	protected = appendCBORHead(appendCBORHead(protected, 0, coseAlg), 1, -1-coseAlgEdDSA)
+	protected = appendCBORText(appendCBORHead(protected, 0, coseContentType), statementPayload)
+	protected = appendCBORBytes(appendCBORHead(protected, 0, coseKID), []byte(kid))
+	protected = append(appendCBORHead(protected, 0, coseCWTClaims), claims...)
+
+	sig, err := s.Sign(sigStructure(protected, payload))
+	if err != nil {
+		return nil, fmt.Errorf("signing statement: %w", err)
+	}
+	var msg []byte
+	msg = appendCBORHead(msg, 6, coseSign1Tag)
+	msg = appendCBORHead(msg, 4, 4)
+	msg = appendCBORBytes(msg, protected)
+	msg = appendCBORHead(msg, 5, 0)
+	msg = appendCBORBytes(msg, payload)
+	msg = appendCBORBytes(msg, sig)
+	return msg, nil
+}
+
+// sigStructure returns the COSE Sig_structure signed in a COSE_Sign1
+// message, without external data.
+func sigStructure(protected, payload []byte) []byte {
+	var b []byte
+	b = appendCBORHead(b, 4, 4)
+	b = appendCBORText(b, "Signature1")
+	b = appendCBORBytes(b, protected)
+	b = appendCBORBytes(b, nil)
+	return appendCBORBytes(b, payload)
+}
+
+func appendCBORText(b []byte, s string) []byte {
+	return append(appendCBORHead(b, 3, uint64(len(s))), s...)
+}
+
+func appendCBORBytes(b, v []byte) []byte {
+	return append(appendCBORHead(b, 2, uint64(len(v))), v...)
+}
+
+// readCBORHead reads the head of a CBOR data item, returning its major type,
+// its argument and the rest of b. Indefinite lengths are not supported.
+func readCBORHead(b []byte) (byte, uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	if info < 24 {
+		return major, uint64(info), b, nil
+	}
+	if info > 27 {
+		return 0, 0, nil, errors.New("unsupported CBOR item")
+	}
+	n := 1 << (info - 24)
+	if len(b) < n {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	var v uint64
+	for _, c := range b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	return major, v, b[n:], nil
+}
+
+// readCBORBytes reads a CBOR byte string.
+func readCBORBytes(b []byte) ([]byte, []byte, error) {
+	major, n, rest, err := readCBORHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if major != 2 || uint64(len(rest)) < n {
+		return nil, nil, errors.New("expected a CBOR byte string")
+	}
+	return rest[:n], rest[n:], nil
+}
+
+// skipCBOR returns b after its first data item.
+func skipCBOR(b []byte) ([]byte, error) {
+	major, n, rest, err := readCBORHead(b)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 2, 3:
+		if uint64(len(rest)) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return rest[n:], nil
+	case 4, 5:
+		items := n
+		if major == 5 {
+			items *= 2
+		}
+		for i := uint64(0); i < items; i++ {
+			if rest, err = skipCBOR(rest); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	case 6:
+		return skipCBOR(rest)
+	}
+	return rest, nil
+}
+
+// VerifyStatement verifies a signed statement of an acceptance decision
+// against the collector's Ed25519 public key and returns its provenance
+// record.
+func VerifyStatement(msg []byte, pub ed25519.PublicKey) (Provenance, error) {
+	major, n, rest, err := readCBORHead(msg)
+	if err == nil && major == 6 && n == coseSign1Tag {
+		major, n, rest, err = readCBORHead(rest)
+	}
+	if err != nil || major != 4 || n != 4 {
+		return Provenance{}, errors.New("not a COSE_Sign1 message")
+	}
+	protected, rest, err := readCBORBytes(rest)
+	if err != nil {
+		return Provenance{}, err
+	}
+	if rest, err = skipCBOR(rest); err != nil {
+		return Provenance{}, err
+	}
+	payload, rest, err := readCBORBytes(rest)
+	if err != nil {
+		return Provenance{}, err
+	}
+	sig, _, err := readCBORBytes(rest)
+	if err != nil {
+		return Provenance{}, err
+	}
+	if !ed25519.Verify(pub, sigStructure(protected, payload), sig) {
+		return Provenance{}, errors.New("invalid statement signature")
+	}
+	var p Provenance
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return Provenance{}, fmt.Errorf("decoding statement payload: %w", err)
+	}
+	return p, nil
+}
+
+// register registers a signed statement with the transparency service and
+// returns its receipt, or nil and the URL of the operation if registration
+// is still running.
+func (s *Statements) register(ctx context.Context, msg []byte) ([]byte, string, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.TransparencyURL, "/")+"/entries", bytes.NewReader(msg))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", mediaCOSE)
+	// Follow no redirects: 303 See Other points at the running operation.
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+		receipt, err := io.ReadAll(io.LimitReader(resp.Body, maxReceiptSize))
+		return receipt, "", err
+	case http.StatusAccepted, http.StatusSeeOther:
+		return nil, resp.Header.Get("Location"), nil
+	}
+	return nil, "", fmt.Errorf("registering statement: %s", resp.Status)
+}
+
+// emitStatements writes and registers the signed statements of the
+// checkpoints accepted in a round. Failures are logged so that collection
+// continues.
+func (c *Collector) emitStatements(ctx context.Context, in *intent) {
+	s := c.cfg.Statements
+	if s == nil {
+		return
+	}
+	signer, ok := c.cfg.Cosigner.(Ed25519KeyCosigner)
+	if !ok {
+		c.logf("Not emitting signed statements of round %s: no Ed25519 cosigning key is configured\n", in.Round)
+		return
+	}
+	for _, p := range in.Provenance {
+		id := statementID(p.Checkpoint)
+		msg, err := signStatement(p, signer, s.Issuer, c.now())
+		if err == nil {
+			err = writeIfChanged(filepath.Join(s.Dir, id+".cose"), msg)
+		}
+		if err != nil {
+			c.logf("Writing the signed statement of tree size %d of %s: %v\n", p.TreeSize, p.Origin, err)
+			continue
+		}
+		if s.TransparencyURL == "" {
+			continue
+		}
+		rctx, cancel := context.WithTimeout(ctx, statementTimeout)
+		receipt, pending, err := s.register(rctx, msg)
+		cancel()
+		switch {
+		case err != nil:
+			c.logf("Registering the signed statement of tree size %d of %s: %v\n", p.TreeSize, p.Origin, err)
+		case receipt == nil:
+			c.logf("Registration of the signed statement of tree size %d of %s is running at %s\n", p.TreeSize, p.Origin, pending)
+		default:
+			if err := writeIfChanged(filepath.Join(s.Dir, id+".receipt.cose"), receipt); err != nil {
+				c.logf("Writing the receipt of tree size %d of %s: %v\n", p.TreeSize, p.Origin, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"time"
+)
+
+// maxRecentConflicts is the number of conflicts of each log kept for
+// LogStatus.
+const maxRecentConflicts = 10
+
+// LogStatus is the health of a log as seen by the collector, for embedding
+// into status pages.
+type LogStatus struct {
+	Origin string `json:"origin" proto:"1"`
+	// Healthy is set if a checkpoint was accepted, no alert is open and
+	// at least a quorum of monitors is alive. Conflicts do not affect it,
+	// since they remain listed after the log recovered.
+	Healthy   bool             `json:"healthy" proto:"2"`
+	Accepted  *AcceptedStatus  `json:"accepted,omitempty" proto:"3"`
+	Monitors  []MonitorStatus  `json:"monitors" proto:"4"`
+	Alerts    []OpenAlert      `json:"alerts" proto:"5"`
+	Conflicts []RecentConflict `json:"conflicts" proto:"6"`
+}
+
+// AcceptedStatus is the latest accepted checkpoint of a log.
+type AcceptedStatus struct {
+	Origin   string `json:"origin" proto:"1"`
+	TreeSize int64  `json:"tree_size" proto:"2"`
+	RootHash string `json:"root_hash" proto:"3"`
+	// SignedAt is the time of the checkpoint's timestamp, if it has one.
+	SignedAt *time.Time `json:"signed_at,omitempty" proto:"4"`
+	// Checkpoint is the checkpoint as a signed note.
+	Checkpoint string `json:"checkpoint" proto:"5"`
+	// AcceptedAt is the time the collector last accepted the checkpoint,
+	// if known, see Collector.AcceptedAt.
+	AcceptedAt *time.Time `json:"accepted_at,omitempty" proto:"6"`
+}
+
+// OpenAlert is an alert whose condition persists: a stalled or frozen log, a
+// log diverging from its baseline, or a stale or diverging monitor.
+type OpenAlert struct {
+	// Kind is one of the anomaly kinds, e.g. AnomalyStall.
+	Kind string `json:"kind" proto:"1"`
+	// Subject is the origin of the log or the monitor alerted on.
+	Subject string `json:"subject" proto:"2"`
+}
+
+// RecentConflict is a tree size for which monitors read different root
+// hashes.
+type RecentConflict struct {
+	Origin     string            `json:"origin" proto:"1"`
+	TreeSize   int64             `json:"tree_size" proto:"2"`
+	RootHashes []ConflictingRoot `json:"root_hashes" proto:"3"`
+	DetectedAt time.Time         `json:"detected_at" proto:"4"`
+}
+
+// ConflictingRoot is one of the root hashes of a conflict and the monitors
+// that read it.
+type ConflictingRoot struct {
+	RootHash string   `json:"root_hash" proto:"1"`
+	Monitors []string `json:"monitors" proto:"2"`
+}
+
+// LogStatus returns the health of the log with the given origin or origin
+// pattern. It returns nil if no checkpoint of the log was accepted or
+// alerted on.
+func (c *Collector) LogStatus(origin string) (*LogStatus, error) {
+	lines, err := c.acceptedCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	s := &LogStatus{Origin: origin}
+	for _, l := range lines {
+		chpt, err := ParseCheckpoint(l)
+		if err != nil || !MatchOrigin(origin, chpt.Origin) || (s.Accepted != nil && chpt.Size < s.Accepted.TreeSize) {
+			continue
+		}
+		s.Accepted = &AcceptedStatus{Origin: chpt.Origin, TreeSize: chpt.Size, RootHash: chpt.Hash, Checkpoint: checkpointNote(chpt.Raw)}
+		if chpt.Timestamp != 0 {
+			t := time.Unix(0, chpt.Timestamp).UTC()
+			s.Accepted.SignedAt = &t
+		}
+	}
+	if s.Accepted != nil {
+		chpt := Checkpoint{Origin: s.Accepted.Origin, Size: s.Accepted.TreeSize, Hash: s.Accepted.RootHash}
+		at, ok, err := c.AcceptedAt(chpt)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			s.Accepted.AcceptedAt = &at
+		}
+	}
+	s.Alerts, s.Conflicts = c.anoms.status(origin)
+	if s.Accepted == nil && len(s.Alerts) == 0 && len(s.Conflicts) == 0 {
+		return nil, nil
+	}
+
+	if s.Monitors, err = c.MonitorStatuses(); err != nil {
+		return nil, err
+	}
+	alive := 0
+	for _, m := range s.Monitors {
+		if m.Status == MonitorAlive {
+			alive++
+		}
+	}
+	s.Healthy = s.Accepted != nil && len(s.Alerts) == 0 && alive >= c.cfg.Quorum
+	return s, nil
+}
+
+// status returns the alerts open for the logs matching origin and for
+// monitors, and the recent conflicts of those logs, oldest first.
+func (a *anomalies) status(origin string) ([]OpenAlert, []RecentConflict) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	alerts := []OpenAlert{}
+	for o, g := range a.logs {
+		if g.stalled && MatchOrigin(origin, o) {
+			alerts = append(alerts, OpenAlert{Kind: AnomalyStall, Subject: o})
+		}
+	}
+	for o := range a.frozen {
+		if MatchOrigin(origin, o) {
+			alerts = append(alerts, OpenAlert{Kind: AnomalyFreeze, Subject: o})
+		}
+	}
+	for o, d := range a.baseline {
+		if d.alerted && MatchOrigin(origin, o) {
+			alerts = append(alerts, OpenAlert{Kind: AnomalyBaseline, Subject: o})
+		}
+	}
+	for m, st := range a.stale {
+		if st.alerted {
+			alerts = append(alerts, OpenAlert{Kind: AnomalyStaleMonitor, Subject: m})
+		}
+	}
+	for m, d := range a.monitors {
+		if d.alerted {
+			alerts = append(alerts, OpenAlert{Kind: AnomalyDivergence, Subject: m})
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Kind != alerts[j].Kind {
+			return alerts[i].Kind < alerts[j].Kind
+		}
+		return alerts[i].Subject < alerts[j].Subject
+	})
+
+	conflicts := []RecentConflict{}
+	for o, rc := range a.recentConflicts {
+		if MatchOrigin(origin, o) {
+			conflicts = append(conflicts, rc...)
+		}
+	}
+	sort.SliceStable(conflicts, func(i, j int) bool { return conflicts[i].DetectedAt.Before(conflicts[j].DetectedAt) })
+	return alerts, conflicts
+}
+
+// recentConflict returns the RecentConflict of c detected at now.
+func recentConflict(c Conflict, now time.Time) RecentConflict {
+	rc := RecentConflict{Origin: c.Origin, TreeSize: c.Size, DetectedAt: now}
+	for hash, monitors := range c.Monitors {
+		rc.RootHashes = append(rc.RootHashes, ConflictingRoot{RootHash: hash, Monitors: monitors})
+	}
+	sort.Slice(rc.RootHashes, func(i, j int) bool { return rc.RootHashes[i].RootHash < rc.RootHashes[j].RootHash })
+	return rc
+}
@@ -0,0 +1,289 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DefaultKeep is the number of accepted checkpoints retained in the accepted file.
+const DefaultKeep = 20
+
+// Storage holds the accepted checkpoint lines of a collector. Lines are
+// passed and returned in plain text; implementations encrypt them at rest
+// if configured to.
+type Storage interface {
+	// Append appends lines after the stored ones.
+	Append(lines []string) error
+	// Latest returns the latest n lines, oldest first. It returns an error
+	// wrapping fs.ErrNotExist if no line was ever stored.
+	Latest(n int) ([]string, error)
+	// Prune deletes all but the latest keep lines.
+	Prune(keep int) error
+	// Close releases the resources held by the storage.
+	Close() error
+}
+
+// FileStorage is the default Storage, keeping one line per accepted
+// checkpoint in a file, encrypted with Cipher if set.
+type FileStorage struct {
+	File   string
+	Cipher *StateCipher
+	// Chained is set if the lines are chained, see VerifyChain. The
+	// storage then keeps the ChainAnchor of the file up to date.
+	Chained bool
+}
+
+// Append implements Storage.
+func (s *FileStorage) Append(lines []string) error {
+	if err := AppendAcceptedBatch(s.File, lines, s.Cipher); err != nil || !s.Chained || len(lines) == 0 {
+		return err
+	}
+	last, err := ParseChainedLine(lines[len(lines)-1])
+	if err != nil {
+		return fmt.Errorf("last appended line: %w", err)
+	}
+	a, err := readChainAnchorOrGenesis(s.File, s.Cipher)
+	if err != nil {
+		return err
+	}
+	a.LastSeq, a.LastHash = last.Seq, lineHash(lines[len(lines)-1])
+	return writeChainAnchor(s.File, a, s.Cipher)
+}
+
+// Latest implements Storage.
+func (s *FileStorage) Latest(n int) ([]string, error) {
+	return ReadAccepted(s.File, n, s.Cipher)
+}
+
+// Prune implements Storage. In chained mode the last pruned line is recorded
+// in the anchor before the file is pruned.
+func (s *FileStorage) Prune(keep int) error {
+	if s.Chained {
+		lines, err := s.Latest(keep + 1)
+		if err != nil {
+			return err
+		}
+		if len(lines) > keep {
+			pruned, err := ParseChainedLine(lines[0])
+			if err != nil {
+				return fmt.Errorf("last pruned line: %w", err)
+			}
+			a, err := readChainAnchorOrGenesis(s.File, s.Cipher)
+			if err != nil {
+				return err
+			}
+			a.PrunedSeq, a.PrunedHash = pruned.Seq, lineHash(lines[0])
+			if err := writeChainAnchor(s.File, a, s.Cipher); err != nil {
+				return err
+			}
+		}
+	}
+	return PruneCheckpoints(s.File, keep)
+}
+
+// Close implements Storage.
+func (s *FileStorage) Close() error {
+	return nil
+}
+
+// LoadRegistry implements RegistryStorage. The registry is kept next to
+// File, with the extension .registry.
+func (s *FileStorage) LoadRegistry() ([]byte, error) {
+	b, err := os.ReadFile(s.File + ".registry")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.Cipher.openBlob(sealRegistry, b)
+}
+
+// SaveRegistry implements RegistryStorage.
+func (s *FileStorage) SaveRegistry(b []byte) error {
+	sealed, err := s.Cipher.sealBlob(sealRegistry, b)
+	if err != nil {
+		return err
+	}
+	tmp := s.File + ".registry.tmp"
+	if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.File+".registry")
+}
+
+// ReadLegacyLines returns the non-empty lines of an accepted file as
+// stored, for migrating it to another Storage. A missing file has no lines.
+func ReadLegacyLines(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filename, err)
+	}
+	return lines, nil
+}
+
+// AppendAccepted appends a flattened checkpoint line to the accepted checkpoint
+// file, encrypting it with sc if set.
+func AppendAccepted(filename, line string, sc *StateCipher) error {
+	return AppendAcceptedBatch(filename, []string{line}, sc)
+}
+
+// AppendAcceptedBatch appends several checkpoint lines to the accepted
+// checkpoint file with a single write.
+func AppendAcceptedBatch(filename string, lines []string, sc *StateCipher) error {
+	return appendLines(filename, sealAccepted, lines, sc)
+}
+
+// appendLines appends lines of the given kind to filename with a single
+// write. If sc is set, each line is encrypted after the line before it.
+func appendLines(filename, kind string, lines []string, sc *StateCipher) error {
+	var prev string
+	if sc != nil {
+		last, err := ReadLatestCheckpoints(filename, 1)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if len(last) == 1 {
+			prev = last[0]
+		}
+	}
+	var buf bytes.Buffer
+	for _, l := range lines {
+		l, err := sc.sealLine(kind, prev, l)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(l + "\n")
+		prev = l
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// ReadAccepted returns the latest n lines of the accepted checkpoint file,
+// decrypted with sc if set.
+func ReadAccepted(filename string, n int, sc *StateCipher) ([]string, error) {
+	return readLines(filename, sealAccepted, n, sc)
+}
+
+// readLines returns the latest n lines of the given kind of filename,
+// decrypted with sc if set.
+func readLines(filename, kind string, n int, sc *StateCipher) ([]string, error) {
+	lines, err := ReadLatestCheckpoints(filename, n)
+	if err != nil {
+		return nil, err
+	}
+	o := lineOpener{sc: sc, kind: kind}
+	for i, l := range lines {
+		if lines[i], err = o.open(l); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	return lines, nil
+}
+
+// PruneCheckpoints persists only the latest keep lines of filename. The file is
+// rewritten to a temporary file in the same directory and renamed over the
+// original, so readers never observe a truncated file. This relies only on
+// os.Rename replacing the destination, which holds on both Unix and Windows.
+func PruneCheckpoints(filename string, keep int) error {
+	// read all lines from file
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// exit early if there aren't checkpoints to truncate
+	if len(lines) <= keep {
+		return nil
+	}
+
+	return replaceFile(filename, lines[len(lines)-keep:])
+}
+
+// replaceFile atomically replaces filename with the given lines.
+func replaceFile(filename string, lines []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// Remove is a no-op once the rename has succeeded.
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
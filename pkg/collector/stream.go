@@ -0,0 +1,101 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Stream formats. StreamCBOR writes a CBOR sequence and StreamProtobuf
+// writes each event prefixed with its length as a varint, the usual framing
+// of delimited protobuf messages.
+const (
+	StreamJSON     = "json"
+	StreamText     = "text"
+	StreamCBOR     = EncodingCBOR
+	StreamProtobuf = EncodingProtobuf
+)
+
+// streamMu serializes writes to streams shared by several collectors, such
+// as the tenants of a process writing to stdout.
+var streamMu sync.Mutex
+
+// StreamEvent is the JSON line written to Config.Stream for every accepted
+// checkpoint.
+type StreamEvent struct {
+	Namespace  string    `json:"namespace,omitempty" proto:"1"`
+	Origin     string    `json:"origin" proto:"2"`
+	TreeSize   int64     `json:"tree_size" proto:"3"`
+	RootHash   string    `json:"root_hash" proto:"4"`
+	Timestamp  int64     `json:"timestamp,omitempty" proto:"5"`
+	Round      string    `json:"round" proto:"6"`
+	AcceptedAt time.Time `json:"accepted_at" proto:"7"`
+	// Checkpoint is the signed checkpoint as a note.
+	Checkpoint string `json:"checkpoint" proto:"8"`
+	// Degraded is set if the checkpoint was accepted without quorum.
+	Degraded bool `json:"degraded,omitempty" proto:"9"`
+}
+
+// stream writes the checkpoints accepted in a round to Config.Stream, as
+// encoded events or as the flattened checkpoint lines of the accepted file.
+// Failures are logged, as a closed pipe must not stop collection.
+func (c *Collector) stream(round string, batch []Checkpoint, degraded bool) {
+	if c.cfg.Stream == nil {
+		return
+	}
+	var out []byte
+	for _, a := range batch {
+		if c.cfg.StreamFormat == StreamText {
+			out = append(out, a.Raw+"\n"...)
+			continue
+		}
+		format := c.cfg.StreamFormat
+		if format == "" {
+			format = StreamJSON
+		}
+		b, err := Marshal(format, StreamEvent{
+			Namespace:  c.cfg.Namespace,
+			Origin:     a.Origin,
+			TreeSize:   a.Size,
+			RootHash:   a.Hash,
+			Timestamp:  a.Timestamp,
+			Round:      round,
+			AcceptedAt: c.now().UTC(),
+			Checkpoint: checkpointNote(a.Raw),
+			Degraded:   degraded,
+		})
+		if err != nil {
+			c.logf("Streaming accepted checkpoint: %v\n", err)
+			return
+		}
+		switch format {
+		case StreamJSON:
+			b = append(b, '\n')
+		case StreamProtobuf:
+			out = protowire.AppendVarint(out, uint64(len(b)))
+		}
+		out = append(out, b...)
+	}
+
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	if _, err := c.cfg.Stream.Write(out); err != nil {
+		c.logf("Streaming accepted checkpoint: %v\n", err)
+	}
+}
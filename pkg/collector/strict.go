@@ -0,0 +1,128 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sigstore/rekor/pkg/util"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// LogKey is the public key of a log, identified in signed notes by the
+// first four bytes of the SHA-256 hash of its PKIX encoding.
+type LogKey struct {
+	Hash     uint32
+	Verifier signature.Verifier
+}
+
+// LoadLogKey reads a PEM encoded log public key, such as the one served by
+// Rekor at /api/v1/log/publicKey.
+func LoadLogKey(filename string) (LogKey, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return LogKey{}, err
+	}
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(b)
+	if err != nil {
+		return LogKey{}, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return LogKey{}, err
+	}
+	v, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return LogKey{}, fmt.Errorf("loading %s: %w", filename, err)
+	}
+	sum := sha256.Sum256(der)
+	return LogKey{Hash: binary.BigEndian.Uint32(sum[:]), Verifier: v}, nil
+}
+
+// ValidateCheckpoint checks that a flattened checkpoint line parses and
+// carries at least one signature. If keys are given, every signature must
+// be made by one of them and verify. Signature failures are
+// ErrSignatureInvalid.
+func ValidateCheckpoint(line string, keys []LogKey) error {
+	if _, err := ParseCheckpoint(line); err != nil {
+		return err
+	}
+	var sn util.SignedNote
+	if err := sn.UnmarshalText([]byte(checkpointNote(line))); err != nil {
+		return withClass(ErrSignatureInvalid, fmt.Errorf("checkpoint is not signed: %w", err))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, sig := range sn.Signatures {
+		var key *LogKey
+		for i := range keys {
+			if keys[i].Hash == sig.Hash {
+				key = &keys[i]
+			}
+		}
+		if key == nil {
+			return withClass(ErrSignatureInvalid, fmt.Errorf("checkpoint is signed by unknown key %s (%08x)", sig.Name, sig.Hash))
+		}
+		one := util.SignedNote{Note: sn.Note, Signatures: []note.Signature{sig}}
+		if !one.Verify(key.Verifier) {
+			return withClass(ErrSignatureInvalid, fmt.Errorf("signature of %s does not verify", sig.Name))
+		}
+	}
+	return nil
+}
+
+// validateStrict checks every line read from a monitor in strict mode.
+func (c *Collector) validateStrict(chpts []string) error {
+	if len(chpts) == 0 {
+		return errors.New("no checkpoints read")
+	}
+	for i, line := range chpts {
+		if err := ValidateCheckpoint(line, c.cfg.LogKeys); err != nil {
+			return fmt.Errorf("checkpoint %d of %d: %w", i+1, len(chpts), err)
+		}
+	}
+	return nil
+}
+
+// parseable returns the lines of chpts that parse as checkpoints. Outside
+// strict mode a malformed line only costs the checkpoint it holds, so the
+// error describing the dropped lines is for an alert, not for the round.
+func parseable(chpts []string) ([]string, error) {
+	kept := make([]string, 0, len(chpts))
+	var first error
+	for _, line := range chpts {
+		if _, err := ParseCheckpoint(line); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if first != nil {
+		return kept, fmt.Errorf("%d of %d checkpoints do not parse, e.g. %w", len(chpts)-len(kept), len(chpts), first)
+	}
+	return kept, nil
+}
@@ -0,0 +1,134 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// syntheticCheckpoint returns a flattened checkpoint line in the format
+// written by rekor-monitor.
+func syntheticCheckpoint(size, ts int64) string {
+	return fmt.Sprintf("rekor.sigstore.dev - 2605736670972794746\\n%d\\nhash%d\\nTimestamp: %d\\n\\n— rekor.sigstore.dev sig\\n", size, size, ts)
+}
+
+// SyntheticObservations returns the latest two checkpoints of a fleet of
+// monitors. Every monitor has seen the previous tree size and all but a
+// third of them the current one, so consensus has to count both.
+func SyntheticObservations(monitors int) [][]string {
+	observations := make([][]string, monitors)
+	for i := range observations {
+		size := int64(1000)
+		if i%3 == 0 {
+			size--
+		}
+		observations[i] = []string{syntheticCheckpoint(size-1, int64(i)), syntheticCheckpoint(size, int64(i)+1)}
+	}
+	return observations
+}
+
+// WriteSyntheticFleet writes a logfile with the SyntheticObservations of
+// each monitor to dir and returns a glob matching them.
+func WriteSyntheticFleet(dir string, monitors int) (string, error) {
+	for i, chpts := range SyntheticObservations(monitors) {
+		var b []byte
+		for _, c := range chpts {
+			b = append(b, c+"\n"...)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("logInfo%d.txt", i)), b, 0600); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "logInfo*.txt"), nil
+}
+
+// Benchmark is a benchmark of one step of a collection round for a
+// synthetic fleet of monitors.
+type Benchmark struct {
+	Name     string
+	Monitors int
+	F        func(b *testing.B)
+}
+
+// Benchmarks returns benchmarks of parsing, consensus, persistence and
+// complete collection rounds for fleets of each of the given sizes. Files
+// are written to dir.
+func Benchmarks(dir string, fleets []int) []Benchmark {
+	var bs []Benchmark
+	for _, n := range fleets {
+		n := n
+		observations := SyntheticObservations(n)
+		fleetDir := filepath.Join(dir, fmt.Sprintf("fleet%d", n))
+
+		bs = append(bs,
+			Benchmark{"parse", n, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					for _, chpts := range observations {
+						for _, line := range chpts {
+							if _, err := ParseCheckpoint(line); err != nil {
+								b.Fatal(err)
+							}
+						}
+					}
+				}
+			}},
+			Benchmark{"quorum", n, func(b *testing.B) {
+				b.ReportAllocs()
+				quorum := n / 2
+				for i := 0; i < b.N; i++ {
+					if _, ok, err := SelectAccepted(observations, quorum); err != nil || !ok {
+						b.Fatalf("no consensus: %v", err)
+					}
+				}
+			}},
+			Benchmark{"persist", n, func(b *testing.B) {
+				b.ReportAllocs()
+				accepted := filepath.Join(b.TempDir(), "accepted.txt")
+				line := observations[0][1]
+				for i := 0; i < b.N; i++ {
+					if err := AppendAccepted(accepted, line, nil); err != nil {
+						b.Fatal(err)
+					}
+					if err := PruneCheckpoints(accepted, DefaultKeep); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}},
+			Benchmark{"collect", n, func(b *testing.B) {
+				b.ReportAllocs()
+				if err := os.MkdirAll(fleetDir, 0750); err != nil {
+					b.Fatal(err)
+				}
+				glob, err := WriteSyntheticFleet(fleetDir, n)
+				if err != nil {
+					b.Fatal(err)
+				}
+				c := New(Config{MonitorGlob: glob, AcceptedFile: filepath.Join(b.TempDir(), "accepted.txt"), Quorum: n / 2})
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, ok, err := c.Collect(""); err != nil || !ok {
+						b.Fatalf("no consensus: %v", err)
+					}
+				}
+			}},
+		)
+	}
+	return bs
+}
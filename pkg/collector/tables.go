@@ -0,0 +1,253 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TableColumn is a column of a Table with its PostgreSQL type.
+type TableColumn struct {
+	Name string
+	Type string
+}
+
+// Table is a read-only view of the history of a collector, served as CSV
+// at /api/v1/tables/<name> for BI tools and PostgreSQL foreign tables, see
+// ForeignTableDDL. The first column is the time rows are filtered by.
+type Table struct {
+	Name    string
+	Columns []TableColumn
+	rows    func(c *Collector) ([][]string, error)
+}
+
+// Tables are the tables served by APIHandler.
+var Tables = []Table{
+	{
+		Name: "observations",
+		Columns: []TableColumn{
+			{"observed_at", "timestamptz"},
+			{"namespace", "text"},
+			{"monitor", "text"},
+			{"origin", "text"},
+			{"tree_size", "bigint"},
+			{"root_hash", "text"},
+			{"checkpoint_timestamp", "bigint"},
+		},
+		rows: (*Collector).observationRows,
+	},
+	{
+		Name: "acceptances",
+		Columns: []TableColumn{
+			{"accepted_at", "timestamptz"},
+			{"namespace", "text"},
+			{"round", "text"},
+			{"origin", "text"},
+			{"tree_size", "bigint"},
+			{"root_hash", "text"},
+			{"quorum", "integer"},
+			{"supporters", "integer"},
+			{"degraded", "boolean"},
+		},
+		rows: (*Collector).acceptanceRows,
+	},
+	{
+		Name: "supporters",
+		Columns: []TableColumn{
+			{"accepted_at", "timestamptz"},
+			{"namespace", "text"},
+			{"round", "text"},
+			{"origin", "text"},
+			{"tree_size", "bigint"},
+			{"monitor", "text"},
+			{"network", "text"},
+			{"observed_at", "timestamptz"},
+		},
+		rows: (*Collector).supporterRows,
+	},
+}
+
+// TableByName returns the table with the given name.
+func TableByName(name string) (Table, bool) {
+	for _, t := range Tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Table{}, false
+}
+
+// tableNames returns the names of Tables.
+func tableNames() []string {
+	names := make([]string, len(Tables))
+	for i, t := range Tables {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// TableRows returns the rows of the table whose time is in [since, until),
+// oldest first. Zero times leave the range open.
+func (c *Collector) TableRows(t Table, since, until time.Time) ([][]string, error) {
+	rows, err := t.rows(c)
+	if err != nil {
+		return nil, err
+	}
+	type timedRow struct {
+		at  time.Time
+		row []string
+	}
+	var timed []timedRow
+	for _, row := range rows {
+		at, err := time.Parse(time.RFC3339Nano, row[0])
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", t.Name, err)
+		}
+		if (since.IsZero() || !at.Before(since)) && (until.IsZero() || at.Before(until)) {
+			timed = append(timed, timedRow{at, row})
+		}
+	}
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].at.Before(timed[j].at) })
+	filtered := make([][]string, len(timed))
+	for i, r := range timed {
+		filtered[i] = r.row
+	}
+	return filtered, nil
+}
+
+// observationRows reads the history of every monitor. It needs HistoryDir.
+func (c *Collector) observationRows() ([][]string, error) {
+	if c.cfg.HistoryDir == "" {
+		return nil, errors.New("monitor history is not recorded")
+	}
+	monitors, err := c.Monitors()
+	if err != nil {
+		return nil, err
+	}
+	notes, err := c.history.noteStore()
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, m := range monitors {
+		observations, err := readHistory(HistoryFile(c.cfg.HistoryDir, m.Logfile), c.cfg.StateCipher, notes)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range observations {
+			chpt, err := ParseCheckpoint(o.Checkpoint)
+			if err != nil {
+				continue
+			}
+			rows = append(rows, []string{formatTableTime(o.Time), c.cfg.Namespace, m.Logfile, chpt.Origin, fmt.Sprint(chpt.Size), chpt.Hash, fmt.Sprint(chpt.Timestamp)})
+		}
+	}
+	return rows, nil
+}
+
+// acceptanceRows reads the provenance of the retained accepted checkpoints.
+func (c *Collector) acceptanceRows() ([][]string, error) {
+	records, err := c.Provenance()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([][]string, len(records))
+	for i, p := range records {
+		rows[i] = []string{formatTableTime(p.AcceptedAt), c.cfg.Namespace, p.Round, p.Origin, fmt.Sprint(p.TreeSize), p.RootHash, fmt.Sprint(p.Quorum), fmt.Sprint(len(p.Supporters)), strconv.FormatBool(p.Degraded)}
+	}
+	return rows, nil
+}
+
+// supporterRows lists the monitors supporting each retained accepted
+// checkpoint.
+func (c *Collector) supporterRows() ([][]string, error) {
+	records, err := c.Provenance()
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, p := range records {
+		for _, s := range p.Supporters {
+			rows = append(rows, []string{formatTableTime(p.AcceptedAt), c.cfg.Namespace, p.Round, p.Origin, fmt.Sprint(p.TreeSize), s.Monitor, s.Network, formatTableTime(s.ObservedAt)})
+		}
+	}
+	return rows, nil
+}
+
+func formatTableTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// WriteTableCSV writes the rows of t as CSV with a header line.
+func WriteTableCSV(w io.Writer, t Table, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(t.Columns))
+	for i, col := range t.Columns {
+		header[i] = col.Name
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// ForeignTableDDL returns the SQL statements creating a PostgreSQL foreign
+// table named rekor_<name> for each of Tables. The tables are backed by
+// file_fdw running curl against the API at apiURL, so every query reads
+// the current rows of the collector of the namespace.
+func ForeignTableDDL(apiURL, namespace string) string {
+	var b strings.Builder
+	b.WriteString("CREATE EXTENSION IF NOT EXISTS file_fdw;\n")
+	b.WriteString("CREATE SERVER IF NOT EXISTS rekor_collector FOREIGN DATA WRAPPER file_fdw;\n")
+	for _, t := range Tables {
+		u := strings.TrimSuffix(apiURL, "/") + "/api/v1/tables/" + t.Name
+		if namespace != "" {
+			u += "?" + url.Values{"namespace": {namespace}}.Encode()
+		}
+		cols := make([]string, len(t.Columns))
+		for i, col := range t.Columns {
+			cols[i] = "\t" + col.Name + " " + col.Type
+		}
+		program := "curl -sSf " + shellQuote(u)
+		fmt.Fprintf(&b, "\nCREATE FOREIGN TABLE IF NOT EXISTS rekor_%s (\n%s\n) SERVER rekor_collector\nOPTIONS (program %s, format 'csv', header 'true');\n", t.Name, strings.Join(cols, ",\n"), sqlQuote(program))
+	}
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sqlQuote quotes s as an SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
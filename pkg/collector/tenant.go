@@ -0,0 +1,252 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// tenantName restricts namespaces to names that are safe as directory names
+// and metric label values.
+var tenantName = regexp.MustCompile(`^[a-z0-9]([a-z0-9_.-]{0,61}[a-z0-9])?$`)
+
+// Tenant is an isolated namespace in multi-tenant mode. Each tenant has its
+// own monitors, accepted file, audit log, quorum and, optionally, cosigning
+// key and API token. Unset files default to a directory named after the
+// tenant.
+type Tenant struct {
+	Name        string `json:"name"`
+	MonitorGlob string `json:"monitors,omitempty"`
+	MonitorList string `json:"monitor_list,omitempty"`
+	Accepted    string `json:"accepted,omitempty"`
+	AuditLog    string `json:"audit_log,omitempty"`
+	Quorum      int    `json:"quorum,omitempty"`
+	MinNetworks int    `json:"min_networks,omitempty"`
+	// QuorumFailure overrides Config.QuorumFailure.
+	QuorumFailure string `json:"quorum_failure,omitempty"`
+	// Resolution overrides Config.Resolution.
+	Resolution string `json:"resolution,omitempty"`
+	// CosignKey is a file with the note signing key the tenant's
+	// checkpoints are cosigned with instead of Config.Cosigner.
+	CosignKey string `json:"cosign_key,omitempty"`
+	// TokenFile is a file with the bearer token required by API requests
+	// for the tenant's namespace.
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+// tenantList represents the tenants JSON data.
+type tenantList struct {
+	Tenants []Tenant `json:"tenants"`
+}
+
+// LoadTenants reads the tenants from a JSON file. Relative paths are
+// resolved against the directory containing the file.
+func LoadTenants(path string) ([]Tenant, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list tenantList
+	if err := json.Unmarshal(contents, &list); err != nil {
+		return nil, err
+	}
+	if len(list.Tenants) == 0 {
+		return nil, fmt.Errorf("%s: no tenants defined", path)
+	}
+
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, filepath.FromSlash(p))
+	}
+
+	seen := make(map[string]bool)
+	for i, t := range list.Tenants {
+		if !tenantName.MatchString(t.Name) {
+			return nil, fmt.Errorf("%s: invalid tenant name %q", path, t.Name)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("%s: duplicate tenant %q", path, t.Name)
+		}
+		seen[t.Name] = true
+		if t.MonitorGlob == "" && t.MonitorList == "" {
+			return nil, fmt.Errorf("%s: tenant %q has no monitors", path, t.Name)
+		}
+		if err := ValidQuorumFailure(t.QuorumFailure); err != nil {
+			return nil, fmt.Errorf("%s: tenant %q: %w", path, t.Name, err)
+		}
+		if err := ValidResolution(t.Resolution); err != nil {
+			return nil, fmt.Errorf("%s: tenant %q: %w", path, t.Name, err)
+		}
+
+		list.Tenants[i].MonitorGlob = resolve(t.MonitorGlob)
+		list.Tenants[i].MonitorList = resolve(t.MonitorList)
+		list.Tenants[i].Accepted = resolve(t.Accepted)
+		list.Tenants[i].AuditLog = resolve(t.AuditLog)
+		list.Tenants[i].CosignKey = resolve(t.CosignKey)
+		list.Tenants[i].TokenFile = resolve(t.TokenFile)
+	}
+
+	return list.Tenants, nil
+}
+
+// Config returns the configuration of the tenant's collector. Settings the
+// tenant does not override are taken from base; its accepted file and audit
+// log default to files named acceptedName and auditName in stateDir/<name>,
+// which is created if needed. The audit log is only enabled when set for the
+// tenant or when base has one. Every other state directory of base gets a
+// subdirectory per tenant. base must not have a Storage, which would be
+// shared; the caller sets a storage of the tenant's own instead.
+func (t Tenant) Config(base Config, stateDir, acceptedName, auditName string) (Config, error) {
+	if base.Storage != nil {
+		return Config{}, errors.New("a storage cannot be shared between tenants, each needs its own")
+	}
+	cfg := base
+	cfg.Namespace = t.Name
+	cfg.MonitorGlob = t.MonitorGlob
+	cfg.MonitorList = t.MonitorList
+	// Discovered monitors are not shared between tenants.
+	cfg.Discovery = nil
+	if t.Quorum > 0 {
+		cfg.Quorum = t.Quorum
+	}
+	if t.MinNetworks > 0 {
+		cfg.MinNetworks = t.MinNetworks
+	}
+	if t.QuorumFailure != "" {
+		cfg.QuorumFailure = t.QuorumFailure
+	}
+	if t.Resolution != "" {
+		cfg.Resolution = t.Resolution
+	}
+
+	dir := filepath.Join(stateDir, t.Name)
+	if base.HistoryDir != "" {
+		cfg.HistoryDir = filepath.Join(base.HistoryDir, t.Name)
+	}
+	if base.PublishDir != "" {
+		cfg.PublishDir = filepath.Join(base.PublishDir, t.Name)
+	}
+	if base.ImportDir != "" {
+		cfg.ImportDir = filepath.Join(base.ImportDir, t.Name)
+	}
+	if base.Reports != nil {
+		// The index of an archive is not namespaced, so sharing one would
+		// serve a tenant the round reports of another.
+		cfg.Reports = &ReportArchive{Dir: filepath.Join(base.Reports.Dir, t.Name), Retention: base.Reports.Retention}
+	}
+	if base.Statements != nil {
+		s := *base.Statements
+		s.Dir = filepath.Join(s.Dir, t.Name)
+		cfg.Statements = &s
+	}
+	if base.Mirror != nil {
+		m := *base.Mirror
+		m.Dir = filepath.Join(m.Dir, t.Name)
+		cfg.Mirror = &m
+	}
+	if base.Registry != nil {
+		// The registry itself is kept in the tenant's storage.
+		r := *base.Registry
+		cfg.Registry = &r
+	}
+	if t.CosignKey != "" {
+		skey, err := os.ReadFile(t.CosignKey)
+		if err != nil {
+			return Config{}, err
+		}
+		if cfg.Cosigner, err = NoteKeyCosigner(strings.TrimSpace(string(skey))); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", t.CosignKey, err)
+		}
+	}
+	cfg.APIToken = ""
+	if t.TokenFile != "" {
+		token, err := os.ReadFile(t.TokenFile)
+		if err != nil {
+			return Config{}, err
+		}
+		if cfg.APIToken = strings.TrimSpace(string(token)); cfg.APIToken == "" {
+			return Config{}, fmt.Errorf("%s: empty API token", t.TokenFile)
+		}
+	}
+	cfg.AcceptedFile = t.Accepted
+	if cfg.AcceptedFile == "" {
+		cfg.AcceptedFile = filepath.Join(dir, acceptedName)
+	}
+	if base.CosignedFile != "" {
+		cfg.CosignedFile = filepath.Join(dir, filepath.Base(base.CosignedFile))
+	}
+	if base.ProvenanceFile != "" {
+		cfg.ProvenanceFile = filepath.Join(dir, filepath.Base(base.ProvenanceFile))
+	}
+	if base.IntentFile != "" {
+		cfg.IntentFile = filepath.Join(dir, filepath.Base(base.IntentFile))
+	}
+	auditLog := t.AuditLog
+	if auditLog == "" && base.Audit != nil {
+		auditLog = filepath.Join(dir, auditName)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return Config{}, err
+	}
+
+	cfg.Audit = nil
+	if auditLog != "" {
+		a, err := OpenAuditLog(auditLog, base.StateCipher)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.Audit = a
+	}
+	return cfg, nil
+}
+
+// RunAll runs every collector until ctx is cancelled or one of them fails,
+// in which case the others are stopped and the error is returned.
+func RunAll(ctx context.Context, cs []*Collector) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(cs))
+	for _, c := range cs {
+		go func(c *Collector) {
+			err := c.Run(ctx)
+			if err != nil && c.cfg.Namespace != "" {
+				err = fmt.Errorf("tenant %s: %w", c.cfg.Namespace, err)
+			}
+			errs <- err
+		}(c)
+	}
+
+	var err error
+	for range cs {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Default stage timeouts, see Timeouts.
+const (
+	DefaultVerifyTimeout  = 30 * time.Second
+	DefaultPersistTimeout = 30 * time.Second
+	DefaultExportTimeout  = 10 * time.Second
+)
+
+// Timeouts bound the stages of a collection round, so that a wedged file
+// system or network call fails the round instead of hanging the collector.
+// Reading each monitor is bounded by Config.ReadTimeout. Zero fields take
+// their default, except Round.
+type Timeouts struct {
+	// Round bounds a whole round run by Run, including its stages. Zero
+	// leaves rounds unbounded.
+	Round time.Duration
+	// Verify bounds each consistency proof and witness distributor
+	// request.
+	Verify time.Duration
+	// Persist bounds writing the accepted checkpoints of a round with
+	// their provenance and audit records, including waiting for the
+	// writes of other rounds.
+	Persist time.Duration
+	// Export bounds exporting the report of a round and sending each
+	// alert.
+	Export time.Duration
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Verify <= 0 {
+		t.Verify = DefaultVerifyTimeout
+	}
+	if t.Persist <= 0 {
+		t.Persist = DefaultPersistTimeout
+	}
+	if t.Export <= 0 {
+		t.Export = DefaultExportTimeout
+	}
+	return t
+}
+
+// writeLock serializes the writes of rounds and maintenance. Unlike a
+// sync.Mutex, waiting for it ends when a context is done, so rounds do not
+// queue up behind a write that is wedged.
+type writeLock chan struct{}
+
+func (l writeLock) lock(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l writeLock) unlock() {
+	<-l
+}
+
+// persist runs write holding the write lock, bounded by the Persist
+// timeout. If the timeout expires first, persist returns an error while
+// write keeps the lock until it returns, so that no other write starts
+// before it.
+func (c *Collector) persist(ctx context.Context, write func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Persist)
+	defer cancel()
+	if err := c.writes.lock(ctx); err != nil {
+		return fmt.Errorf("waiting for an earlier write: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer c.writes.unlock()
+		var err error
+		defer func() { done <- err }()
+		defer recoverPanic(&err)
+		err = write()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("writing accepted checkpoints: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,152 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default trusted time parameters
+const (
+	DefaultTimeSyncInterval = 15 * time.Minute
+	DefaultTimeMaxAge       = time.Hour
+)
+
+// TimeSource is an authenticated source of the current time, such as a
+// Roughtime server.
+type TimeSource interface {
+	// Now returns the current time and the radius of its uncertainty.
+	Now(ctx context.Context) (time.Time, time.Duration, error)
+}
+
+// TrustedTime replaces the local clock of the host with authenticated time
+// for freshness checks and acceptance timestamps, so that a skewed or
+// attacker-controlled clock cannot make stale checkpoints look fresh.
+type TrustedTime struct {
+	// Sources are queried in order until one answers.
+	Sources []TimeSource
+	// Interval is how often the offset of the local clock is measured
+	// again, DefaultTimeSyncInterval if zero.
+	Interval time.Duration
+	// MaxAge is how long a measured offset is used while no source
+	// answers, DefaultTimeMaxAge if zero. Rounds hold, failing with
+	// ErrUntrustedTime, once it has passed.
+	MaxAge time.Duration
+	// MaxSkew, if positive, alerts on a clock_skew anomaly when the local
+	// clock is off by more than it.
+	MaxSkew time.Duration
+}
+
+// trustedClock is the local clock corrected by the offset last measured
+// against a TrustedTime source. A nil trustedClock is the local clock.
+type trustedClock struct {
+	cfg TrustedTime
+
+	mu     sync.Mutex
+	offset time.Duration
+	synced time.Time // local time of the last measurement
+	skewed bool
+}
+
+func newTrustedClock(cfg *TrustedTime) *trustedClock {
+	if cfg == nil || len(cfg.Sources) == 0 {
+		return nil
+	}
+	t := &trustedClock{cfg: *cfg}
+	if t.cfg.Interval <= 0 {
+		t.cfg.Interval = DefaultTimeSyncInterval
+	}
+	if t.cfg.MaxAge <= 0 {
+		t.cfg.MaxAge = DefaultTimeMaxAge
+	}
+	return t
+}
+
+// now returns the corrected current time.
+func (t *trustedClock) now() time.Time {
+	if t == nil {
+		return time.Now()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Add(t.offset)
+}
+
+// sync measures the offset of the local clock if the last measurement is
+// older than the interval. It fails with ErrUntrustedTime if no source
+// answers and the last measurement is older than MaxAge. It also reports
+// whether the local clock is off by more than MaxSkew and whether that
+// changed.
+func (t *trustedClock) sync(ctx context.Context) (offset time.Duration, skewed, changed bool, err error) {
+	t.mu.Lock()
+	synced, offset, skewed := t.synced, t.offset, t.skewed
+	t.mu.Unlock()
+	if !synced.IsZero() && time.Since(synced) < t.cfg.Interval {
+		return offset, skewed, false, nil
+	}
+
+	for _, src := range t.cfg.Sources {
+		before := time.Now()
+		var trusted time.Time
+		trusted, _, err = src.Now(ctx)
+		if err != nil {
+			continue
+		}
+		// The source's time is compared with the middle of the round
+		// trip.
+		offset = trusted.Sub(before.Add(time.Since(before) / 2))
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.offset, t.synced = offset, time.Now()
+		skewed = t.cfg.MaxSkew > 0 && (offset > t.cfg.MaxSkew || -offset > t.cfg.MaxSkew)
+		changed, t.skewed = skewed != t.skewed, skewed
+		return offset, skewed, changed, nil
+	}
+	if !synced.IsZero() && time.Since(synced) < t.cfg.MaxAge {
+		return offset, skewed, false, nil
+	}
+	return 0, skewed, false, withClass(ErrUntrustedTime, fmt.Errorf("reading trusted time: %w", err))
+}
+
+// now returns the current time, corrected against TrustedTime if set.
+func (c *Collector) now() time.Time {
+	return c.clock.now()
+}
+
+// syncTime measures the offset of the local clock against TrustedTime
+// before a round, within the verification timeout, and alerts when the
+// clock becomes skewed or recovers.
+func (c *Collector) syncTime(ctx context.Context) error {
+	if c.clock == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Verify)
+	defer cancel()
+	offset, skewed, changed, err := c.clock.sync(ctx)
+	switch {
+	case err != nil || !changed:
+		return err
+	case skewed:
+		c.anoms.record(AnomalyClockSkew, "")
+		c.alert(Alert{Kind: AnomalyClockSkew, Message: fmt.Sprintf("the local clock is off by %v from trusted time, which is used instead", offset)})
+	default:
+		c.alert(Alert{Kind: AnomalyClockSkew, Resolved: true, Message: fmt.Sprintf("the local clock is within %v of trusted time again", c.cfg.TrustedTime.MaxSkew)})
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"sync"
+)
+
+// acceptSignal wakes up the goroutines waiting for the collector to accept
+// checkpoints. Its zero value is ready to use.
+type acceptSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel that is closed when checkpoints are accepted next.
+func (s *acceptSignal) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+// broadcast wakes up every waiter.
+func (s *acceptSignal) broadcast() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
+
+// WaitForTreeSize blocks until the collector has accepted a checkpoint of an
+// origin matching origin, or of any origin if it is empty, whose tree size is
+// at least size. It returns the flattened checkpoint with the smallest such
+// tree size, or the context's error once it is done.
+func (c *Collector) WaitForTreeSize(ctx context.Context, origin string, size int64) (string, error) {
+	for {
+		// Take the channel before reading so that an acceptance between
+		// the read and the wait is not missed.
+		accepted := c.accepts.wait()
+		lines, err := c.acceptedCheckpoints()
+		if err != nil {
+			return "", err
+		}
+		var covering *Checkpoint
+		for _, l := range lines {
+			chpt, err := ParseCheckpoint(l)
+			if err != nil || (origin != "" && !MatchOrigin(origin, chpt.Origin)) || chpt.Size < size {
+				continue
+			}
+			if covering == nil || chpt.Size < covering.Size {
+				covering = &chpt
+			}
+		}
+		if covering != nil {
+			return covering.Raw, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-accepted:
+		}
+	}
+}
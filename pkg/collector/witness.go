@@ -0,0 +1,214 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxDistributorCheckpoint bounds the size of a checkpoint read from a
+// witness distributor.
+const maxDistributorCheckpoint = 64 * 1024
+
+// Witness is a witness whose cosignatures of checkpoints the collector
+// trusts.
+type Witness struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// ParseWitness parses the note verifier key of a witness, of the form
+// <name>+<hash>+<base64 key> as printed by note.GenerateKey.
+func ParseWitness(vkey string) (Witness, error) {
+	fields := strings.SplitN(vkey, "+", 3)
+	if len(fields) != 3 || fields[0] == "" {
+		return Witness{}, fmt.Errorf("malformed witness key %q", vkey)
+	}
+	b, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil || len(b) != 1+ed25519.PublicKeySize || b[0] != 1 {
+		return Witness{}, fmt.Errorf("witness key %q is not an Ed25519 key", vkey)
+	}
+	return Witness{Name: fields[0], Key: ed25519.PublicKey(b[1:])}, nil
+}
+
+// noteKeyHash returns the key hash of the witness in plain note signatures.
+func (w Witness) noteKeyHash() uint32 {
+	h := sha256.New()
+	h.Write([]byte(w.Name + "\n\x01"))
+	h.Write(w.Key)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// verify reports whether sig, a decoded signature line named after the
+// witness, is a valid cosignature/v1 or plain note signature of text.
+func (w Witness) verify(text string, sig []byte) bool {
+	switch {
+	case len(sig) == 4+8+ed25519.SignatureSize && binary.BigEndian.Uint32(sig) == cosignatureV1KeyHash(w.Name, w.Key):
+		ts := int64(binary.BigEndian.Uint64(sig[4:]))
+		return ed25519.Verify(w.Key, []byte(cosignatureV1Message(text, ts)), sig[12:])
+	case len(sig) == 4+ed25519.SignatureSize && binary.BigEndian.Uint32(sig) == w.noteKeyHash():
+		return ed25519.Verify(w.Key, []byte(text), sig[4:])
+	}
+	return false
+}
+
+// Witnessed returns the names of the witnesses with a valid cosignature of
+// the flattened checkpoint. Signatures by other keys are ignored.
+func Witnessed(raw string, witnesses []Witness) []string {
+	text, sigs, err := splitNote(raw)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, w := range witnesses {
+		for _, line := range sigs {
+			name, b64, ok := strings.Cut(strings.TrimPrefix(line, "— "), " ")
+			if !ok || name != w.Name {
+				continue
+			}
+			if sig, err := base64.StdEncoding.DecodeString(b64); err == nil && w.verify(text, sig) {
+				names = append(names, w.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// mergeSignatures returns the flattened checkpoint raw with the signature
+// lines of other, a flattened note of the same checkpoint text, that it does
+// not have yet.
+func mergeSignatures(raw, other string) string {
+	text, sigs, err := splitNote(raw)
+	if err != nil {
+		return raw
+	}
+	otherText, otherSigs, err := splitNote(other)
+	if err != nil || otherText != text {
+		return raw
+	}
+	have := make(map[string]bool, len(sigs))
+	for _, s := range sigs {
+		have[s] = true
+	}
+	for _, s := range otherSigs {
+		if !have[s] {
+			sigs = append(sigs, s)
+			have[s] = true
+		}
+	}
+	return strings.ReplaceAll(text+"\n"+strings.Join(sigs, "\n")+"\n", "\n", lineSeparator)
+}
+
+// Distributor is a client of a witness distributor, such as the one run
+// with omniwitness, which collects the cosignatures witnesses made of a
+// log's checkpoints.
+type Distributor struct {
+	URL string
+	// LogID identifies the log in the distributor's API.
+	LogID  string
+	Client *http.Client
+}
+
+// Checkpoint returns the newest checkpoint the distributor has with at
+// least n cosignatures, flattened, or an empty string if it has none.
+func (d *Distributor) Checkpoint(ctx context.Context, n int) (string, error) {
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u := fmt.Sprintf("%s/distributor/v0/logs/%s/checkpoint.%d", strings.TrimSuffix(d.URL, "/"), d.LogID, n)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDistributorCheckpoint))
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(string(b), "\n"), "\n", lineSeparator) + lineSeparator, nil
+}
+
+// witnessed holds back the candidates that do not have WitnessQuorum
+// cosignatures by trusted witnesses, counting those carried by the
+// checkpoints read from monitors and those the Distributor collected. The
+// cosignatures from the distributor are added to the candidates' checkpoints.
+func (c *Collector) witnessed(ctx context.Context, candidates []Candidate, observations [][]string) []Candidate {
+	if c.cfg.WitnessQuorum <= 0 {
+		return candidates
+	}
+
+	var distributed string
+	if c.cfg.Distributor != nil {
+		ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.Verify)
+		defer cancel()
+		var err error
+		if distributed, err = c.cfg.Distributor.Checkpoint(ctx, c.cfg.WitnessQuorum); err != nil {
+			c.logf("Fetching cosignatures from witness distributor: %v\n", err)
+		}
+	}
+	var dk CheckpointKey
+	if d, err := ParseCheckpoint(distributed); err == nil {
+		dk = d.Key()
+	}
+
+	var kept []Candidate
+	for _, cand := range candidates {
+		names := make(map[string]bool)
+		count := func(raw string) {
+			for _, n := range Witnessed(raw, c.cfg.Witnesses) {
+				names[n] = true
+			}
+		}
+		for _, chpts := range observations {
+			for _, line := range chpts {
+				if chpt, err := ParseCheckpoint(line); err == nil && chpt.Key() == cand.Key() {
+					count(line)
+				}
+			}
+		}
+		if distributed != "" && dk == cand.Key() {
+			count(distributed)
+			cand.Raw = mergeSignatures(cand.Raw, distributed)
+		}
+		if len(names) < c.cfg.WitnessQuorum {
+			c.logf("Holding back tree size %d of %s with %d of %d witness cosignatures\n", cand.Size, cand.Origin, len(names), c.cfg.WitnessQuorum)
+			continue
+		}
+		kept = append(kept, cand)
+	}
+	return kept
+}
@@ -0,0 +1,27 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package e2e holds end-to-end tests of the collector. They run a fake
+// Rekor serving signed tree heads and consistency proofs, synthetic monitors
+// writing the tree heads they read to logfiles as rekor-monitor does, and the
+// collector reading those logfiles, and compare the accepted checkpoints
+// byte for byte with golden files in testdata.
+//
+// Run
+//
+//	go test ./pkg/e2e -update
+//
+// to rewrite the golden files after an intended change of the output.
+package e2e
@@ -0,0 +1,250 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/merkle/testonly"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const (
+	// logKey signs the tree heads of the fake Rekor. Ed25519 signatures are
+	// deterministic, so the accepted checkpoints are the same every run.
+	logKey    = "PRIVATE+KEY+rekor.example.com+a81ec342+AZ9kFKeUJhIr8gNdxtDzlJr15iKqtB3+8cnRGrzW8b5C"
+	logOrigin = "rekor.example.com - 1193050959916656506"
+	// startTime is the timestamp of the first tree head, in nanoseconds
+	// since the epoch as Rekor writes it.
+	startTime = 1700000000000000000
+)
+
+// fakeRekor serves the tree heads and consistency proofs of an in-memory
+// log like the Rekor API.
+type fakeRekor struct {
+	mu     sync.Mutex
+	tree   *testonly.Tree
+	signer note.Signer
+	// prefix is prepended to the leaves, so that logs with different
+	// prefixes present a split view under the same origin and key.
+	prefix string
+	now    int64
+}
+
+func newFakeRekor(t *testing.T, prefix string) *fakeRekor {
+	signer, err := note.NewSigner(logKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeRekor{tree: testonly.New(rfc6962.DefaultHasher), signer: signer, prefix: prefix, now: startTime}
+}
+
+// grow appends leaves to the log until it has size entries, advancing its
+// clock by a second.
+func (f *fakeRekor) grow(size uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := f.tree.Size(); i < size; i++ {
+		f.tree.AppendData([]byte(fmt.Sprintf("%sentry %d", f.prefix, i)))
+	}
+	f.now += 1e9
+}
+
+func (f *fakeRekor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/v1/log":
+		body := fmt.Sprintf("%s\n%d\n%s\nTimestamp: %d\n", logOrigin, f.tree.Size(), base64.StdEncoding.EncodeToString(f.tree.Hash()), f.now)
+		signed, err := note.Sign(&note.Note{Text: body}, f.signer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]any{
+			"rootHash":       hex.EncodeToString(f.tree.Hash()),
+			"treeSize":       f.tree.Size(),
+			"signedTreeHead": string(signed),
+		})
+	case "/api/v1/log/proof":
+		first, _ := strconv.ParseUint(r.URL.Query().Get("firstSize"), 10, 64)
+		last, _ := strconv.ParseUint(r.URL.Query().Get("lastSize"), 10, 64)
+		proof, err := f.tree.ConsistencyProof(first, last)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hashes := make([]string, len(proof))
+		for i, h := range proof {
+			hashes[i] = hex.EncodeToString(h)
+		}
+		writeJSON(w, map[string]any{"hashes": hashes, "rootHash": hex.EncodeToString(f.tree.HashAt(last))})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// monitor is a synthetic monitor appending the tree heads it reads from a
+// Rekor to its logfile, one flattened signed note per line.
+type monitor struct {
+	logfile string
+	rekor   *httptest.Server
+}
+
+func (m monitor) observe(t *testing.T) {
+	t.Helper()
+	resp, err := m.rekor.Client().Get(m.rekor.URL + "/api/v1/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var head struct {
+		SignedTreeHead string `json:"signedTreeHead"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&head); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(m.logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, strings.ReplaceAll(head.SignedTreeHead, "\n", `\n`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// step grows the logs, lets the named monitors observe them and runs a
+// collection round.
+type step struct {
+	size     uint64
+	monitors []string
+}
+
+func TestGolden(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// monitors maps each monitor to the log it reads, the honest one
+		// or the fork.
+		monitors   map[string]string
+		quorum     int
+		resolution string
+		steps      []step
+	}{
+		{
+			name:     "agreement",
+			monitors: map[string]string{"a": "honest", "b": "honest", "c": "honest"},
+			quorum:   2,
+			steps: []step{
+				{size: 4, monitors: []string{"a", "b", "c"}},
+				{size: 9, monitors: []string{"a", "b", "c"}},
+				{size: 16, monitors: []string{"a", "b", "c"}},
+			},
+		},
+		{
+			name:     "split-view",
+			monitors: map[string]string{"a": "honest", "b": "honest", "c": "fork"},
+			quorum:   2,
+			steps: []step{
+				{size: 5, monitors: []string{"a", "b", "c"}},
+				{size: 11, monitors: []string{"a", "b", "c"}},
+			},
+		},
+		{
+			name:       "consistent",
+			monitors:   map[string]string{"a": "honest", "b": "honest", "c": "honest", "d": "honest"},
+			quorum:     2,
+			resolution: collector.ResolveConsistent,
+			steps: []step{
+				{size: 5, monitors: []string{"a", "b"}},
+				{size: 8, monitors: []string{"c", "d"}},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			honest, fork := newFakeRekor(t, ""), newFakeRekor(t, "fork ")
+			servers := map[string]*httptest.Server{"honest": httptest.NewServer(honest), "fork": httptest.NewServer(fork)}
+			for _, srv := range servers {
+				defer srv.Close()
+			}
+
+			dir := t.TempDir()
+			monitors := make(map[string]monitor)
+			for name, log := range tt.monitors {
+				monitors[name] = monitor{logfile: filepath.Join(dir, "logInfo-"+name+".txt"), rekor: servers[log]}
+			}
+			accepted := filepath.Join(dir, "accepted.txt")
+			c := collector.New(collector.Config{
+				MonitorGlob:  filepath.Join(dir, "logInfo-*.txt"),
+				AcceptedFile: accepted,
+				Quorum:       tt.quorum,
+				Resolution:   tt.resolution,
+				Prover:       &collector.RekorProver{URL: servers["honest"].URL},
+			})
+
+			for _, s := range tt.steps {
+				honest.grow(s.size)
+				fork.grow(s.size)
+				for _, name := range s.monitors {
+					monitors[name].observe(t)
+				}
+				if _, _, err := c.Collect(""); err != nil {
+					t.Fatalf("collecting at tree size %d: %v", s.size, err)
+				}
+			}
+
+			got, err := os.ReadFile(accepted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("accepted checkpoints differ from %s:\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcd implements the small part of the etcd v3 API the collector
+// needs to share state and elect a leader in a cluster, using etcd's JSON
+// gateway instead of depending on the gRPC client.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Client is a minimal etcd v3 client. Requests are sent to the first
+// endpoint that answers.
+type Client struct {
+	// Endpoints are the base URLs of the etcd members, e.g.
+	// https://etcd-0.etcd:2379.
+	Endpoints []string
+	// Username and Password authenticate to etcd if set.
+	Username, Password string
+	// HTTPClient sends the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+// kv is a key-value pair stored in etcd.
+type kv struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value,omitempty"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+	Version        int64  `json:"version,string,omitempty"`
+	Lease          int64  `json:"lease,string,omitempty"`
+}
+
+// rangeRequest reads the keys from Key up to, but excluding, RangeEnd, or
+// just Key if RangeEnd is empty.
+type rangeRequest struct {
+	Key        []byte `json:"key"`
+	RangeEnd   []byte `json:"range_end,omitempty"`
+	Limit      int64  `json:"limit,string,omitempty"`
+	SortOrder  string `json:"sort_order,omitempty"`
+	SortTarget string `json:"sort_target,omitempty"`
+	KeysOnly   bool   `json:"keys_only,omitempty"`
+}
+
+type rangeResponse struct {
+	Kvs   []kv  `json:"kvs"`
+	Count int64 `json:"count,string"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type deleteRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+// compare is a condition of a transaction on a single key. Target is one of
+// VALUE, VERSION or CREATE.
+type compare struct {
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value,omitempty"`
+	Version        int64  `json:"version,string,omitempty"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+}
+
+type requestOp struct {
+	RequestPut         *putRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare"`
+	Success []requestOp `json:"success"`
+	Failure []requestOp `json:"failure,omitempty"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// prefixEnd returns the range end matching every key with the given prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// The prefix is all 0xff, so every key from it onwards matches.
+	return []byte{0}
+}
+
+// get returns the key-value pair of key, or nil if it does not exist.
+func (c *Client) get(ctx context.Context, key string) (*kv, error) {
+	var resp rangeResponse
+	if err := c.call(ctx, "/v3/kv/range", rangeRequest{Key: []byte(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return &resp.Kvs[0], nil
+}
+
+// txn runs a transaction, reporting whether its comparisons succeeded.
+func (c *Client) txn(ctx context.Context, req txnRequest) (bool, error) {
+	var resp txnResponse
+	if err := c.call(ctx, "/v3/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// call sends a request to the JSON gateway and decodes the response into
+// out, if set. Unreachable endpoints are skipped.
+func (c *Client) call(ctx context.Context, path string, in, out any) error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("etcd: no endpoints configured")
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, endpoint := range c.Endpoints {
+		err := c.send(ctx, strings.TrimSuffix(endpoint, "/")+path, body, out)
+		var re *responseError
+		if err == nil || errors.As(err, &re) || ctx.Err() != nil {
+			return err
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("etcd: no endpoint reachable: %s", strings.Join(errs, "; "))
+}
+
+// responseError is an error returned by an etcd member.
+type responseError struct {
+	Status  string
+	Message string
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("etcd: %s: %s", e.Status, e.Message)
+}
+
+func (c *Client) send(ctx context.Context, url string, body []byte, out any) error {
+	token, err := c.authToken(ctx, url[:strings.Index(url, "/v3/")])
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		msg := strings.TrimSpace(string(b))
+		if json.Unmarshal(b, &e) == nil && (e.Message != "" || e.Error != "") {
+			msg = e.Message + e.Error
+		}
+		return &responseError{Status: resp.Status, Message: msg}
+	}
+	if out == nil {
+		return nil
+	}
+	// Streaming calls such as lease keep-alives wrap their first response
+	// in a result field.
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil && len(b) == 0 {
+		return err
+	}
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if dec.Decode(&result) == nil && len(result.Result) > 0 {
+		return json.Unmarshal(result.Result, out)
+	}
+	return json.NewDecoder(bytes.NewReader(b)).Decode(out)
+}
+
+// authToken returns the token authenticating requests to the member at
+// base, fetching one with the username and password if needed.
+func (c *Client) authToken(ctx context.Context, base string) (string, error) {
+	if c.Username == "" {
+		return "", nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		return c.token, nil
+	}
+	body, err := json.Marshal(map[string]string{"name": c.Username, "password": c.Password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/v3/auth/authenticate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &responseError{Status: resp.Status, Message: "authentication failed"}
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", err
+	}
+	c.token = auth.Token
+	return c.token, nil
+}
+
+// grantLease creates a lease expiring after ttl seconds without keep-alives.
+func (c *Client) grantLease(ctx context.Context, ttl int64) (int64, error) {
+	var resp struct {
+		ID int64 `json:"ID,string"`
+	}
+	if err := c.call(ctx, "/v3/lease/grant", map[string]string{"TTL": fmt.Sprint(ttl)}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+// keepAlive renews a lease, reporting false if it has expired.
+func (c *Client) keepAlive(ctx context.Context, id int64) (bool, error) {
+	var resp struct {
+		TTL int64 `json:"TTL,string"`
+	}
+	if err := c.call(ctx, "/v3/lease/keepalive", map[string]string{"ID": fmt.Sprint(id)}, &resp); err != nil {
+		return false, err
+	}
+	return resp.TTL > 0, nil
+}
+
+// revokeLease revokes a lease, deleting the keys attached to it.
+func (c *Client) revokeLease(ctx context.Context, id int64) error {
+	return c.call(ctx, "/v3/lease/revoke", map[string]string{"ID": fmt.Sprint(id)}, nil)
+}
@@ -0,0 +1,158 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Default election timings.
+const (
+	DefaultTTL         = 15 * time.Second
+	DefaultRetryPeriod = 2 * time.Second
+)
+
+// Election elects one leader among the collectors of a cluster. The leader
+// holds Key, attached to a lease that it keeps alive; when the leader stops
+// or loses its connection to etcd, the lease expires and another candidate
+// takes over.
+type Election struct {
+	Client *Client
+	// Key is the etcd key held by the leader.
+	Key string
+	// Identity is stored as the value of Key, usually the pod or host
+	// name.
+	Identity string
+	// TTL is how long other candidates wait before taking over from a
+	// leader that stopped keeping its lease alive.
+	TTL time.Duration
+	// RetryPeriod is the time between attempts to acquire the key and
+	// between keep-alives of the lease.
+	RetryPeriod time.Duration
+
+	// rev is the create revision of Key while it is held.
+	rev int64
+}
+
+func (e *Election) defaults() {
+	if e.TTL <= 0 {
+		e.TTL = DefaultTTL
+	}
+	if e.RetryPeriod <= 0 {
+		e.RetryPeriod = DefaultRetryPeriod
+	}
+}
+
+// held returns a transaction comparison succeeding only while the election
+// is held by this candidate.
+func (e *Election) held() compare {
+	return compare{Result: "EQUAL", Target: "CREATE", Key: []byte(e.Key), CreateRevision: e.rev}
+}
+
+// tryAcquire creates Key attached to lease unless it exists, reporting
+// whether it is held by this candidate afterwards.
+func (e *Election) tryAcquire(ctx context.Context, lease int64) (bool, error) {
+	ok, err := e.Client.txn(ctx, txnRequest{
+		Compare: []compare{{Result: "EQUAL", Target: "CREATE", Key: []byte(e.Key)}},
+		Success: []requestOp{{RequestPut: &putRequest{Key: []byte(e.Key), Value: []byte(e.Identity), Lease: lease}}},
+	})
+	if err != nil || !ok {
+		return false, err
+	}
+	kv, err := e.Client.get(ctx, e.Key)
+	if err != nil {
+		return false, err
+	}
+	if kv == nil || kv.Lease != lease {
+		return false, nil
+	}
+	e.rev = kv.CreateRevision
+	return true, nil
+}
+
+// Run blocks until the election is won, then calls run with a context that
+// is cancelled if the lease cannot be kept alive within its TTL. It returns
+// when run returns or ctx is cancelled, releasing the key. Losing the
+// election is reported as an error so that the process restarts as a
+// candidate.
+func (e *Election) Run(ctx context.Context, run func(context.Context) error) error {
+	e.defaults()
+	lease, err := e.Client.grantLease(ctx, int64(e.TTL/time.Second))
+	if err != nil {
+		return fmt.Errorf("granting etcd lease: %w", err)
+	}
+	defer func() {
+		revokeCtx, cancel := context.WithTimeout(context.Background(), e.RetryPeriod)
+		defer cancel()
+		_ = e.Client.revokeLease(revokeCtx, lease)
+	}()
+
+	for {
+		ok, err := e.tryAcquire(ctx, lease)
+		if err != nil {
+			log.Printf("Acquiring etcd election %s: %v\n", e.Key, err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(e.RetryPeriod):
+		}
+		if alive, err := e.Client.keepAlive(ctx, lease); err == nil && !alive {
+			if lease, err = e.Client.grantLease(ctx, int64(e.TTL/time.Second)); err != nil {
+				return fmt.Errorf("granting etcd lease: %w", err)
+			}
+		}
+	}
+	log.Printf("Won etcd election %s as %s (lease %s)\n", e.Key, e.Identity, strconv.FormatInt(lease, 16))
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- run(leaderCtx) }()
+
+	lastRenew := time.Now()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(e.RetryPeriod):
+		}
+
+		alive, err := e.Client.keepAlive(ctx, lease)
+		if alive {
+			lastRenew = time.Now()
+			continue
+		}
+		if err != nil {
+			log.Printf("Keeping etcd lease of election %s alive: %v\n", e.Key, err)
+		}
+		if (err == nil && !alive) || time.Since(lastRenew) > e.TTL {
+			cancel()
+			<-done
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("lost etcd election %s", e.Key)
+		}
+	}
+}
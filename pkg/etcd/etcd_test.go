@@ -0,0 +1,279 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd serves the part of the etcd JSON gateway used by this package.
+type fakeEtcd struct {
+	mu        sync.Mutex
+	rev       int64
+	kvs       map[string]kv
+	leases    map[int64]bool
+	nextLease int64
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: make(map[string]kv), leases: make(map[int64]bool)}
+}
+
+func (f *fakeEtcd) put(p putRequest) {
+	f.rev++
+	old, ok := f.kvs[string(p.Key)]
+	next := kv{Key: p.Key, Value: p.Value, CreateRevision: f.rev, ModRevision: f.rev, Version: 1, Lease: p.Lease}
+	if ok {
+		next.CreateRevision, next.Version = old.CreateRevision, old.Version+1
+	}
+	f.kvs[string(p.Key)] = next
+}
+
+func (f *fakeEtcd) matching(key, end []byte) []string {
+	var keys []string
+	for k := range f.kvs {
+		if k == string(key) || len(end) > 0 && k >= string(key) && k < string(end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expire expires a lease as if its holder stopped keeping it alive.
+func (f *fakeEtcd) expire(id int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.leases, id)
+	for k, v := range f.kvs {
+		if v.Lease == id {
+			delete(f.kvs, k)
+		}
+	}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dec := json.NewDecoder(r.Body)
+	var out any = struct{}{}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req rangeRequest
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		keys := f.matching(req.Key, req.RangeEnd)
+		if req.SortOrder == "DESCEND" {
+			sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		}
+		if req.Limit > 0 && int64(len(keys)) > req.Limit {
+			keys = keys[:req.Limit]
+		}
+		resp := rangeResponse{Count: int64(len(keys))}
+		for _, k := range keys {
+			resp.Kvs = append(resp.Kvs, f.kvs[k])
+		}
+		out = resp
+	case "/v3/kv/deleterange":
+		var req deleteRangeRequest
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, k := range f.matching(req.Key, req.RangeEnd) {
+			delete(f.kvs, k)
+		}
+	case "/v3/kv/txn":
+		var req txnRequest
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ok := true
+		for _, c := range req.Compare {
+			cur := f.kvs[string(c.Key)]
+			switch c.Target {
+			case "VALUE":
+				ok = ok && bytes.Equal(cur.Value, c.Value)
+			case "CREATE":
+				ok = ok && cur.CreateRevision == c.CreateRevision
+			}
+		}
+		if ok {
+			for _, op := range req.Success {
+				if p := op.RequestPut; p != nil {
+					if p.Lease != 0 && !f.leases[p.Lease] {
+						http.Error(w, `{"error":"etcdserver: requested lease not found"}`, http.StatusBadRequest)
+						return
+					}
+					f.put(*p)
+				}
+			}
+		}
+		out = txnResponse{Succeeded: ok}
+	case "/v3/lease/grant":
+		f.nextLease++
+		f.leases[f.nextLease] = true
+		out = map[string]string{"ID": strconv.FormatInt(f.nextLease, 10), "TTL": "15"}
+	case "/v3/lease/keepalive", "/v3/lease/revoke":
+		var req struct {
+			ID int64 `json:"ID,string"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/v3/lease/revoke" {
+			delete(f.leases, req.ID)
+			for k, v := range f.kvs {
+				if v.Lease == req.ID {
+					delete(f.kvs, k)
+				}
+			}
+			break
+		}
+		result := map[string]string{"ID": strconv.FormatInt(req.ID, 10)}
+		if f.leases[req.ID] {
+			result["TTL"] = "15"
+		}
+		out = map[string]any{"result": result}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func TestStorage(t *testing.T) {
+	fake := newFakeEtcd()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	// The first endpoint is unreachable, the client moves on to the next.
+	client := &Client{Endpoints: []string{"http://127.0.0.1:1", srv.URL}}
+	s := &Storage{Client: client, Prefix: "/rekor-collector/prod/"}
+
+	if _, err := s.Latest(1); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected no lines in empty storage, got %v", err)
+	}
+	legacy := filepath.Join(t.TempDir(), "accepted.txt")
+	if err := os.WriteFile(legacy, []byte("a\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Migrate(legacy); err != nil || n != 2 {
+		t.Fatalf("expected 2 migrated lines, got %d: %v", n, err)
+	}
+	if n, err := s.Migrate(legacy); err != nil || n != 0 {
+		t.Fatalf("expected no migration into filled storage, got %d: %v", n, err)
+	}
+	if err := s.Append([]string{"c", "d", "e"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prune(3); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := s.Latest(10)
+	if err != nil || strings.Join(lines, ",") != "c,d,e" {
+		t.Fatalf("expected lines c,d,e, got %v: %v", lines, err)
+	}
+
+	// A writer that read the pointer before another one moved it is
+	// rejected.
+	var req txnRequest
+	req.Compare = []compare{{Result: "EQUAL", Target: "VALUE", Key: []byte(s.lastKey()), Value: []byte("4")}}
+	if ok, err := client.txn(context.Background(), req); err != nil || ok {
+		t.Errorf("expected stale pointer comparison to fail, got %v: %v", ok, err)
+	}
+
+	// The monitor registry is kept next to the lines.
+	if b, err := s.LoadRegistry(); err != nil || b != nil {
+		t.Fatalf("expected no registry, got %q %v", b, err)
+	}
+	if err := s.SaveRegistry([]byte(`[{"logfile":"a"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.LoadRegistry(); err != nil || string(b) != `[{"logfile":"a"}]` {
+		t.Errorf("expected the saved registry, got %q %v", b, err)
+	}
+	if lines, err := s.Latest(10); err != nil || strings.Join(lines, ",") != "c,d,e" {
+		t.Errorf("expected the registry not to be read as a line, got %v: %v", lines, err)
+	}
+}
+
+func TestElection(t *testing.T) {
+	fake := newFakeEtcd()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := &Client{Endpoints: []string{srv.URL}}
+	a := &Election{Client: client, Key: "/rekor-collector/leader", Identity: "a", RetryPeriod: 10 * time.Millisecond}
+	b := &Election{Client: client, Key: "/rekor-collector/leader", Identity: "b", RetryPeriod: 10 * time.Millisecond}
+	fenced := &Storage{Client: client, Prefix: "/rekor-collector/prod/", Fence: a}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leading := make(chan string, 2)
+	lead := func(name string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			leading <- name
+			<-ctx.Done()
+			return nil
+		}
+	}
+	aDone := make(chan error, 1)
+	go func() { aDone <- a.Run(ctx, lead("a")) }()
+	if got := <-leading; got != "a" {
+		t.Fatalf("expected a to lead, got %s", got)
+	}
+	go func() { _ = b.Run(ctx, lead("b")) }()
+	select {
+	case got := <-leading:
+		t.Fatalf("expected b to wait while a leads, got %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := fenced.Append([]string{"x"}); err != nil {
+		t.Fatalf("append by the leader: %v", err)
+	}
+
+	kv, err := client.get(ctx, a.Key)
+	if err != nil || kv == nil {
+		t.Fatalf("reading election key: %v", err)
+	}
+	fake.expire(kv.Lease)
+	if err := <-aDone; err == nil || !strings.Contains(err.Error(), "lost") {
+		t.Errorf("expected a to lose the election, got %v", err)
+	}
+	if got := <-leading; got != "b" {
+		t.Fatalf("expected b to take over, got %s", got)
+	}
+	if err := fenced.Append([]string{"y"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected the deposed leader's append to be fenced, got %v", err)
+	}
+}
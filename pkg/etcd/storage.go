@@ -0,0 +1,248 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+func init() {
+	collector.RegisterCapability(collector.CapabilityStorage, "etcd")
+}
+
+// maxTxnLines is the number of lines appended in one transaction, below
+// etcd's default limit of 128 operations per transaction.
+const maxTxnLines = 100
+
+// timeout bounds every etcd operation of a Storage, whose methods do not take
+// a context.
+const timeout = 30 * time.Second
+
+// ErrConflict is returned when appending to a Storage that another
+// collector appended to since its latest pointer was read, or when the
+// Storage is fenced by an Election that is no longer held.
+var ErrConflict = errors.New("accepted checkpoints were written by another collector")
+
+// Storage is a collector.Storage keeping the accepted checkpoints in etcd, so
+// that the collectors of a cluster spread over availability zones share one
+// consistent accepted state. Below Prefix, each line is stored at
+// accepted/<sequence number> and last holds the sequence number of the
+// latest line. Appends are transactions conditional on last, so concurrent
+// writers cannot interleave lines. The monitor registry, if any, is kept at
+// registry.
+type Storage struct {
+	Client *Client
+	// Prefix is prepended to every key, e.g. "/rekor-collector/prod/".
+	Prefix string
+	// Cipher, if set, encrypts the lines.
+	Cipher *collector.StateCipher
+	// Fence, if set, makes appends conditional on the election still being
+	// held, so that a collector that lost leadership cannot write.
+	Fence *Election
+}
+
+func (s *Storage) lastKey() string {
+	return s.Prefix + "last"
+}
+
+func (s *Storage) registryKey() string {
+	return s.Prefix + "registry"
+}
+
+// lineKey returns the key of a line. Sequence numbers are zero padded so that
+// keys sort numerically.
+func (s *Storage) lineKey(seq int64) string {
+	return fmt.Sprintf("%saccepted/%020d", s.Prefix, seq)
+}
+
+// last returns the latest pointer, nil if no line was ever stored, and its
+// sequence number.
+func (s *Storage) last(ctx context.Context) (*kv, int64, error) {
+	p, err := s.Client.get(ctx, s.lastKey())
+	if err != nil || p == nil {
+		return nil, 0, err
+	}
+	seq, err := strconv.ParseInt(string(p.Value), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd key %s: %w", s.lastKey(), err)
+	}
+	return p, seq, nil
+}
+
+// Append implements collector.Storage.
+func (s *Storage) Append(lines []string) error {
+	sealed := make([]string, len(lines))
+	for i, l := range lines {
+		var err error
+		if sealed[i], err = s.Cipher.Seal(l); err != nil {
+			return err
+		}
+	}
+	return s.appendSealed(sealed)
+}
+
+// appendSealed appends lines in transactions of up to maxTxnLines lines,
+// each also moving the latest pointer on if nobody else moved it.
+func (s *Storage) appendSealed(lines []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for len(lines) > 0 {
+		chunk := lines
+		if len(chunk) > maxTxnLines {
+			chunk = chunk[:maxTxnLines]
+		}
+		lines = lines[len(chunk):]
+
+		p, seq, err := s.last(ctx)
+		if err != nil {
+			return err
+		}
+		var req txnRequest
+		if p == nil {
+			req.Compare = append(req.Compare, compare{Result: "EQUAL", Target: "CREATE", Key: []byte(s.lastKey())})
+		} else {
+			req.Compare = append(req.Compare, compare{Result: "EQUAL", Target: "VALUE", Key: []byte(s.lastKey()), Value: p.Value})
+		}
+		if s.Fence != nil {
+			req.Compare = append(req.Compare, s.Fence.held())
+		}
+		for _, l := range chunk {
+			seq++
+			req.Success = append(req.Success, requestOp{RequestPut: &putRequest{Key: []byte(s.lineKey(seq)), Value: []byte(l)}})
+		}
+		req.Success = append(req.Success, requestOp{RequestPut: &putRequest{Key: []byte(s.lastKey()), Value: []byte(strconv.FormatInt(seq, 10))}})
+		ok, err := s.Client.txn(ctx, req)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Latest implements collector.Storage.
+func (s *Storage) Latest(n int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	p, _, err := s.last(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("etcd key %s: %w", s.lastKey(), fs.ErrNotExist)
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	prefix := []byte(s.Prefix + "accepted/")
+	var resp rangeResponse
+	err = s.Client.call(ctx, "/v3/kv/range", rangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix), Limit: int64(n), SortOrder: "DESCEND", SortTarget: "KEY"}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		line, err := s.Cipher.Open(string(kv.Value))
+		if err != nil {
+			return nil, fmt.Errorf("etcd key %s: %w", kv.Key, err)
+		}
+		lines[len(lines)-1-i] = line
+	}
+	return lines, nil
+}
+
+// Prune implements collector.Storage.
+func (s *Storage) Prune(keep int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, seq, err := s.last(ctx)
+	if err != nil || seq <= int64(keep) {
+		return err
+	}
+	req := deleteRangeRequest{Key: []byte(s.Prefix + "accepted/"), RangeEnd: []byte(s.lineKey(seq - int64(keep) + 1))}
+	return s.Client.call(ctx, "/v3/kv/deleterange", req, nil)
+}
+
+// LoadRegistry implements collector.RegistryStorage.
+func (s *Storage) LoadRegistry() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	p, err := s.Client.get(ctx, s.registryKey())
+	if err != nil || p == nil {
+		return nil, err
+	}
+	registry, err := s.Cipher.Open(string(p.Value))
+	if err != nil {
+		return nil, fmt.Errorf("etcd key %s: %w", s.registryKey(), err)
+	}
+	return []byte(registry), nil
+}
+
+// SaveRegistry implements collector.RegistryStorage. Like appends, it is
+// conditional on the election still being held.
+func (s *Storage) SaveRegistry(b []byte) error {
+	sealed, err := s.Cipher.Seal(string(b))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var req txnRequest
+	if s.Fence != nil {
+		req.Compare = append(req.Compare, s.Fence.held())
+	}
+	req.Success = append(req.Success, requestOp{RequestPut: &putRequest{Key: []byte(s.registryKey()), Value: []byte(sealed)}})
+	ok, err := s.Client.txn(ctx, req)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Close implements collector.Storage.
+func (s *Storage) Close() error {
+	return nil
+}
+
+// Migrate copies the lines of a legacy accepted file into the storage if it
+// is still empty, returning the number of lines copied. Lines are copied as
+// stored, so the file must be encrypted with the same StateCipher as the
+// storage, if any. A missing file is not an error.
+func (s *Storage) Migrate(filename string) (int, error) {
+	if _, err := s.Latest(0); !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	lines, err := collector.ReadLegacyLines(filename)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.appendSealed(lines); err != nil {
+		return 0, fmt.Errorf("migrating %s: %w", filename, err)
+	}
+	return len(lines), nil
+}
@@ -0,0 +1,162 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"golang.org/x/mod/sumdb/note"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+const (
+	// certRenewMargin is how long before its certificate expires a keyless
+	// cosigning key is replaced.
+	certRenewMargin = time.Minute
+	// certifyTimeout bounds requesting a certificate from Fulcio.
+	certifyTimeout = 30 * time.Second
+)
+
+// KeylessCosigner cosigns checkpoints with ephemeral Ed25519 keys certified
+// by Fulcio for the OIDC identity of the collector, so short-lived collectors
+// need no long-lived key. A new key is certified shortly before the
+// certificate of the current one expires.
+type KeylessCosigner struct {
+	name      string
+	fulcio    *Fulcio
+	tokenFile string
+	now       func() time.Time
+
+	mu       sync.Mutex
+	cosigner collector.Cosigner
+	chain    []*x509.Certificate
+}
+
+// NewKeylessCosigner returns a cosigner named name whose keys are certified
+// by f for the identity token read with ReadIDToken(tokenFile) each time a
+// key is certified. The first key is certified immediately.
+func NewKeylessCosigner(ctx context.Context, name string, f *Fulcio, tokenFile string) (*KeylessCosigner, error) {
+	k := &KeylessCosigner{name: name, fulcio: f, tokenFile: tokenFile, now: time.Now}
+	if err := k.renew(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// renew certifies a new key. It is called with mu held or before k is
+// shared.
+func (k *KeylessCosigner) renew(ctx context.Context) error {
+	token, err := ReadIDToken(k.tokenFile)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("no identity token, set $%s or pass a token file", IDTokenEnv)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := k.fulcio.Certify(ctx, priv, token)
+	if err != nil {
+		return err
+	}
+	k.chain = chain
+	k.cosigner = collector.Ed25519Cosigner(k.name, pub, func(msg []byte) ([]byte, error) {
+		return ed25519.Sign(priv, msg), nil
+	})
+	return nil
+}
+
+// Name returns the key name of the cosignatures.
+func (k *KeylessCosigner) Name() string { return k.name }
+
+// KeyHash returns the key hash of the current key.
+func (k *KeylessCosigner) KeyHash() uint32 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.cosigner.KeyHash()
+}
+
+// Sign signs msg with the current key, certifying a new one first if the
+// certificate of the current key is about to expire.
+func (k *KeylessCosigner) Sign(msg []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.now().Add(certRenewMargin).After(k.chain[0].NotAfter) {
+		ctx, cancel := context.WithTimeout(context.Background(), certifyTimeout)
+		defer cancel()
+		if err := k.renew(ctx); err != nil {
+			return nil, fmt.Errorf("renewing keyless cosigning certificate: %w", err)
+		}
+	}
+	return k.cosigner.Sign(msg)
+}
+
+// Chain returns the PEM encoded certificate chain of the current key.
+func (k *KeylessCosigner) Chain() []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	b, _ := cryptoutils.MarshalCertificatesToPEM(k.chain)
+	return b
+}
+
+// VerifyCosigned checks the output of a KeylessCosigner: that the
+// certificate chain following the note was issued to the identity in opts
+// and that the note has a valid signature named name by the certified key.
+// The certificate is checked at the start of its validity, as the note does
+// not record when it was signed. Signatures of other keys, such as the
+// log's, are not verified.
+func VerifyCosigned(data []byte, name string, opts VerifyOptions) (*note.Note, error) {
+	signed, pemChain := collector.SplitCosigned(data)
+	if len(pemChain) == 0 {
+		return nil, errors.New("cosigned note has no certificate chain")
+	}
+	chain, err := cryptoutils.UnmarshalCertificatesFromPEM(pemChain)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate chain: %w", err)
+	}
+	if err := verifyCertificate(chain, time.Time{}, opts); err != nil {
+		return nil, err
+	}
+
+	pub, ok := chain[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported cosigning key type %T", chain[0].PublicKey)
+	}
+	vkey, err := note.NewEd25519VerifierKey(name, pub)
+	if err != nil {
+		return nil, err
+	}
+	v, err := note.NewVerifier(vkey)
+	if err != nil {
+		return nil, err
+	}
+	n, err := note.Open(signed, note.VerifierList(v))
+	if err != nil {
+		return nil, fmt.Errorf("verifying cosignature: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,88 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package evidence exports the checkpoints a collector accepted, together
+// with the provenance of each decision, as self-contained bundles, and signs
+// and verifies them in the format of cosign's blob signatures so that
+// recipients can check them with standard Sigstore tooling.
+package evidence
+
+import (
+	"math"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// Version is the version of the bundle format.
+const Version = 1
+
+// Bundle is the evidence a collector holds for the checkpoints it accepted.
+type Bundle struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// Origin is the log the bundle is restricted to, or empty if it covers
+	// every log.
+	Origin string `json:"origin,omitempty"`
+	// Checkpoints are the accepted checkpoint lines, oldest first.
+	Checkpoints []string               `json:"checkpoints"`
+	Provenance  []collector.Provenance `json:"provenance"`
+}
+
+// Build collects the latest n accepted checkpoints of origin, or of every
+// log if origin is empty, and the retained provenance records of the same
+// log. All retained checkpoints are included if n is not positive. The files
+// are decrypted with sc if set; provenanceFile may be empty.
+func Build(acceptedFile, provenanceFile, origin string, n int, sc *collector.StateCipher) (*Bundle, error) {
+	if n <= 0 {
+		n = math.MaxInt
+	}
+	lines, err := collector.ReadAccepted(acceptedFile, n, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{
+		Version:     Version,
+		CreatedAt:   time.Now().UTC(),
+		Origin:      origin,
+		Checkpoints: []string{},
+		Provenance:  []collector.Provenance{},
+	}
+	for _, line := range lines {
+		if cl, err := collector.ParseChainedLine(line); err == nil {
+			line = cl.Checkpoint
+		}
+		chpt, err := collector.ParseCheckpoint(line)
+		if err != nil || (origin != "" && chpt.Origin != origin) {
+			continue
+		}
+		b.Checkpoints = append(b.Checkpoints, line)
+	}
+
+	if provenanceFile == "" {
+		return b, nil
+	}
+	records, err := collector.ReadProvenance(provenanceFile, sc)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range records {
+		if origin == "" || p.Origin == origin {
+			b.Provenance = append(b.Provenance, p)
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,290 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+func TestSignWithKey(t *testing.T) {
+	password := []byte("secret")
+	privPEM, pubPEM, err := cryptoutils.GeneratePEMEncodedECDSAKeyPair(elliptic.P256(), cryptoutils.StaticPasswordFunc(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "cosign.key")
+	if err := os.WriteFile(keyFile, privPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKey(keyFile, []byte("wrong")); err == nil {
+		t.Error("loaded an encrypted key with the wrong password")
+	}
+	s, err := LoadKey(keyFile, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(pubPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := []byte(`{"version":1}`)
+	sig, err := s.Sign(context.Background(), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Cert != "" || sig.RekorBundle != nil {
+		t.Errorf("signature = %+v, want only a signature", sig)
+	}
+	if err := Verify(blob, sig, VerifyOptions{PublicKey: pub}); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+	if err := Verify([]byte(`{"version":2}`), sig, VerifyOptions{PublicKey: pub}); err == nil {
+		t.Error("verified the signature of a modified blob")
+	}
+	if err := Verify(blob, sig, VerifyOptions{}); err == nil {
+		t.Error("verified a signature without a key or certificate")
+	}
+}
+
+// fakeFulcio issues certificates from a test CA for the email of any token.
+func fakeFulcio(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/signingCert" {
+			http.NotFound(w, r)
+			return
+		}
+		var req fulcioRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subject, err := tokenSubject(req.Credentials.OIDCIdentityToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		pub, err := cryptoutils.UnmarshalPEMToPublicKey([]byte(req.PublicKeyRequest.PublicKey.Content))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:    big.NewInt(2),
+			NotBefore:       time.Now().Add(-time.Minute),
+			NotAfter:        time.Now().Add(10 * time.Minute),
+			KeyUsage:        x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			EmailAddresses:  []string{subject},
+			ExtraExtensions: []pkix.Extension{{Id: oidIssuer, Value: []byte("https://issuer.example.com")}},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, pub, caKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		leaf, _ := x509.ParseCertificate(der)
+		var resp fulcioResponse
+		resp.EmbeddedSCT = &fulcioChain{}
+		for _, c := range []*x509.Certificate{leaf, ca} {
+			p, _ := cryptoutils.MarshalCertificateToPEM(c)
+			resp.EmbeddedSCT.Chain.Certificates = append(resp.EmbeddedSCT.Chain.Certificates, string(p))
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+// testCA returns a self-signed CA certificate and its key.
+func testCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "test fulcio"}}, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, caKey
+}
+
+// testToken returns an unsigned identity token for email.
+func testToken(email string) string {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1234","email":"` + email + `"}`))
+	return strings.Join([]string{"e30", claims, "c2ln"}, ".")
+}
+
+func TestSignKeyless(t *testing.T) {
+	ca, caKey := testCA(t)
+	srv := fakeFulcio(t, ca, caKey)
+	defer srv.Close()
+
+	s, err := (&Fulcio{URL: srv.URL}).Keyless(context.Background(), testToken("auditor@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := []byte(`{"version":1}`)
+	sig, err := s.Sign(context.Background(), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain, err := sig.Chain(); err != nil || len(chain) != 2 {
+		t.Fatalf("Chain() = %d certificates, %v, want 2", len(chain), err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	opts := VerifyOptions{Roots: roots, Identity: "auditor@example.com", Issuer: "https://issuer.example.com"}
+	if err := Verify(blob, sig, opts); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+	opts.Identity = "someone@example.com"
+	if err := Verify(blob, sig, opts); err == nil {
+		t.Error("verified a signature for the wrong identity")
+	}
+	opts.Identity, opts.Issuer = "auditor@example.com", "https://other.example.com"
+	if err := Verify(blob, sig, opts); err == nil {
+		t.Error("verified a signature for the wrong issuer")
+	}
+	if err := Verify(blob, sig, VerifyOptions{Roots: x509.NewCertPool()}); err == nil {
+		t.Error("verified a certificate from an untrusted CA")
+	}
+}
+
+func TestKeylessCosigner(t *testing.T) {
+	ca, caKey := testCA(t)
+	srv := fakeFulcio(t, ca, caKey)
+	defer srv.Close()
+	t.Setenv(IDTokenEnv, testToken("ci@example.com"))
+
+	k, err := NewKeylessCosigner(context.Background(), "collector.example.com", &Fulcio{URL: srv.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chpt := `rekor.sigstore.dev - 1\n10\nhash10\nTimestamp: 1\n\n— rekor.sigstore.dev AQEBAQEBAQE=\n`
+	signed, err := collector.CosignNote(chpt, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	opts := VerifyOptions{Roots: roots, Identity: "ci@example.com", Issuer: "https://issuer.example.com"}
+	n, err := VerifyCosigned([]byte(signed), "collector.example.com", opts)
+	if err != nil {
+		t.Fatalf("VerifyCosigned() = %v\n%s", err, signed)
+	}
+	if n.Text != "rekor.sigstore.dev - 1\n10\nhash10\nTimestamp: 1\n" || len(n.Sigs) != 1 {
+		t.Errorf("unexpected cosigned note %+v", n)
+	}
+	opts.Identity = "someone@example.com"
+	if _, err := VerifyCosigned([]byte(signed), "collector.example.com", opts); err == nil {
+		t.Error("verified a cosignature for the wrong identity")
+	}
+
+	// A certificate about to expire is replaced along with its key.
+	hash := k.KeyHash()
+	k.now = func() time.Time { return time.Now().Add(time.Hour) }
+	opts.Identity = "ci@example.com"
+	if signed, err = collector.CosignNote(chpt, k); err != nil {
+		t.Fatal(err)
+	}
+	if k.KeyHash() == hash {
+		t.Error("expected a new key after the certificate expired")
+	}
+	if _, err := VerifyCosigned([]byte(signed), "collector.example.com", opts); err != nil {
+		t.Errorf("VerifyCosigned() after renewal = %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	chpt := `rekor.sigstore.dev - 2605736670972794746\n10\nhash10\nTimestamp: 1\n\n— rekor.sigstore.dev sig\n`
+	now := time.Now()
+	b := &ObservationBundle{
+		Version:   Version,
+		Source:    "enclave-a",
+		CreatedAt: now.Add(-time.Minute),
+		Monitors: []MonitorObservations{
+			{Monitor: "/var/lib/a/logInfo.txt", Checkpoints: []string{chpt}},
+			{Monitor: "/var/lib/b/logInfo.txt", Checkpoints: []string{chpt}},
+		},
+	}
+	if _, err := Import(b, dir, time.Hour, now); err != nil {
+		t.Fatal(err)
+	}
+	monitors, err := collector.LoadMonitorList(filepath.Join(dir, collector.ImportedMonitorList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(monitors) != 2 || monitors[0].Network != "enclave-a" || monitors[0].Logfile == monitors[1].Logfile {
+		t.Fatalf("unexpected imported monitors %+v", monitors)
+	}
+	lines, err := collector.ReadLatestCheckpoints(monitors[1].Logfile, 1)
+	if err != nil || len(lines) != 1 || lines[0] != chpt {
+		t.Errorf("imported logfile: %q, %v", lines, err)
+	}
+
+	if _, err := Import(b, dir, time.Hour, now); !errors.Is(err, ErrStale) {
+		t.Errorf("replayed bundle: got %v, want ErrStale", err)
+	}
+	old := *b
+	old.Source, old.CreatedAt = "enclave-b", now.Add(-2*time.Hour)
+	if _, err := Import(&old, dir, time.Hour, now); !errors.Is(err, ErrStale) {
+		t.Errorf("old bundle: got %v, want ErrStale", err)
+	}
+
+	// A newer bundle replaces the observations of its source.
+	b.CreatedAt, b.Monitors = now, b.Monitors[:1]
+	if _, err := Import(b, dir, time.Hour, now); err != nil {
+		t.Fatal(err)
+	}
+	if monitors, _ = collector.LoadMonitorList(filepath.Join(dir, collector.ImportedMonitorList)); len(monitors) != 1 {
+		t.Errorf("got %d monitors after reimport, want 1", len(monitors))
+	}
+}
@@ -0,0 +1,230 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+
+	"github.com/sigstore/rekor-monitor/pkg/retry"
+)
+
+// Defaults of the public Sigstore instance.
+const (
+	DefaultFulcioURL = "https://fulcio.sigstore.dev"
+	DefaultRekorURL  = "https://rekor.sigstore.dev"
+)
+
+// IDTokenEnv is the environment variable holding an OIDC identity token for
+// keyless signing, as used by the Sigstore clients.
+const IDTokenEnv = "SIGSTORE_ID_TOKEN"
+
+// Fulcio is a client of the Fulcio certificate authority, which issues
+// short-lived certificates binding a public key to an OIDC identity.
+type Fulcio struct {
+	URL    string
+	Client *http.Client
+}
+
+type fulcioRequest struct {
+	Credentials struct {
+		OIDCIdentityToken string `json:"oidcIdentityToken"`
+	} `json:"credentials"`
+	PublicKeyRequest struct {
+		PublicKey struct {
+			Algorithm string `json:"algorithm"`
+			Content   string `json:"content"`
+		} `json:"publicKey"`
+		ProofOfPossession []byte `json:"proofOfPossession"`
+	} `json:"publicKeyRequest"`
+}
+
+type fulcioChain struct {
+	Chain struct {
+		Certificates []string `json:"certificates"`
+	} `json:"chain"`
+}
+
+type fulcioResponse struct {
+	EmbeddedSCT *fulcioChain `json:"signedCertificateEmbeddedSct"`
+	DetachedSCT *fulcioChain `json:"signedCertificateDetachedSct"`
+}
+
+// Keyless returns a signer with an ephemeral ECDSA P-256 key certified for
+// the identity of the OIDC token idToken.
+func (f *Fulcio) Keyless(ctx context.Context, idToken string) (*Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := f.Certify(ctx, key, idToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{Key: key, Chain: chain}, nil
+}
+
+// Certify requests a certificate for key bound to the identity of the OIDC
+// token idToken and returns its chain, leaf first.
+func (f *Fulcio) Certify(ctx context.Context, key crypto.Signer, idToken string) ([]*x509.Certificate, error) {
+	subject, err := tokenSubject(idToken)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := keyAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	pub, err := cryptoutils.MarshalPublicKeyToPEM(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	sv, err := signature.LoadSigner(key, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := sv.SignMessage(strings.NewReader(subject))
+	if err != nil {
+		return nil, err
+	}
+
+	var in fulcioRequest
+	in.Credentials.OIDCIdentityToken = idToken
+	in.PublicKeyRequest.PublicKey.Algorithm = algorithm
+	in.PublicKeyRequest.PublicKey.Content = string(pub)
+	in.PublicKeyRequest.ProofOfPossession = proof
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	url := f.URL
+	if url == "" {
+		url = DefaultFulcioURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+"/api/v2/signingCert", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	// Certifying the same key twice is harmless.
+	retry.SetIdempotencyKey(req)
+	httpClient := f.Client
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("requesting signing certificate: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var out fulcioResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decoding signing certificate: %w", err)
+	}
+	sct := out.EmbeddedSCT
+	if sct == nil {
+		sct = out.DetachedSCT
+	}
+	if sct == nil || len(sct.Chain.Certificates) == 0 {
+		return nil, errors.New("no signing certificate returned")
+	}
+	chain, err := cryptoutils.UnmarshalCertificatesFromPEM([]byte(strings.Join(sct.Chain.Certificates, "")))
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing certificate: %w", err)
+	}
+	if err := cryptoutils.EqualKeys(key.Public(), chain[0].PublicKey); err != nil {
+		return nil, fmt.Errorf("signing certificate does not match the key: %w", err)
+	}
+	return chain, nil
+}
+
+// keyAlgorithm returns the Fulcio name of the algorithm of pub.
+func keyAlgorithm(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA", nil
+	case ed25519.PublicKey:
+		return "ED25519", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", pub)
+}
+
+// tokenSubject returns the identity Fulcio expects the proof of possession
+// to be made over: the email of the token if it has one, its subject
+// otherwise. The token is verified by Fulcio, not here.
+func tokenSubject(idToken string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("identity token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("decoding identity token: %w", err)
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("decoding identity token: %w", err)
+	}
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	if claims.Subject == "" {
+		return "", errors.New("identity token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// ReadIDToken returns the OIDC identity token stored in filename, or the
+// one in $SIGSTORE_ID_TOKEN if filename is empty. It returns an empty token
+// if neither is set.
+func ReadIDToken(filename string) (string, error) {
+	if filename == "" {
+		return os.Getenv(IDTokenEnv), nil
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
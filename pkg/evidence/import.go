@@ -0,0 +1,183 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// DefaultImportMaxAge is the age after which observation bundles are too
+// stale to import.
+const DefaultImportMaxAge = 24 * time.Hour
+
+// importClockSkew is how far in the future a bundle may have been created,
+// to allow for clocks that are not synchronized with the collector's.
+const importClockSkew = 5 * time.Minute
+
+// importedSources is the file recording when each source's latest imported
+// bundle was created.
+const importedSources = "sources.json"
+
+// ErrStale is returned when an observation bundle is too old to import or
+// not newer than the last one imported from its source.
+var ErrStale = errors.New("observations are stale")
+
+var safeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// importedList is the monitor list written to the import directory.
+type importedList struct {
+	Monitors []collector.Monitor `json:"monitors"`
+}
+
+// Import writes the checkpoints of a verified observation bundle to dir, a
+// logfile per monitor named after the source and the monitor, and updates
+// the collector.ImportedMonitorList in dir so the monitors take part in the
+// next round of a collector with that import directory. Monitors are
+// tagged with the source as their network. Bundles created more than
+// maxAge before now, or not after the last one imported from the same
+// source, are rejected with ErrStale. A new bundle replaces the previous
+// observations of its source. It returns the monitors that were imported.
+func Import(b *ObservationBundle, dir string, maxAge time.Duration, now time.Time) ([]collector.Monitor, error) {
+	if b.Version != Version {
+		return nil, fmt.Errorf("unsupported observation bundle version %d", b.Version)
+	}
+	source := safeName.ReplaceAllString(b.Source, "-")
+	if strings.Trim(source, ".-") == "" {
+		return nil, fmt.Errorf("invalid source %q", b.Source)
+	}
+	switch {
+	case maxAge > 0 && b.CreatedAt.Before(now.Add(-maxAge)):
+		return nil, fmt.Errorf("bundle created at %s is older than %s: %w", b.CreatedAt.Format(time.RFC3339), maxAge, ErrStale)
+	case b.CreatedAt.After(now.Add(importClockSkew)):
+		return nil, fmt.Errorf("bundle created at %s is in the future", b.CreatedAt.Format(time.RFC3339))
+	}
+	for _, m := range b.Monitors {
+		for _, l := range m.Checkpoints {
+			if _, err := collector.ParseCheckpoint(l); err != nil {
+				return nil, fmt.Errorf("monitor %s: %w", m.Monitor, err)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	sources := make(map[string]time.Time)
+	if err := readJSON(filepath.Join(dir, importedSources), &sources); err != nil {
+		return nil, err
+	}
+	if last, ok := sources[b.Source]; ok && !b.CreatedAt.After(last) {
+		return nil, fmt.Errorf("bundle created at %s is not newer than the last one imported from %s: %w", b.CreatedAt.Format(time.RFC3339), b.Source, ErrStale)
+	}
+	var list importedList
+	if err := readJSON(filepath.Join(dir, collector.ImportedMonitorList), &list); err != nil {
+		return nil, err
+	}
+
+	// Drop the source's previous observations.
+	prefix := source + "-"
+	var kept []collector.Monitor
+	for _, m := range list.Monitors {
+		if m.Network == b.Source && strings.HasPrefix(m.Logfile, prefix) {
+			if err := os.Remove(filepath.Join(dir, m.Logfile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			continue
+		}
+		kept = append(kept, m)
+	}
+
+	var imported []collector.Monitor
+	names := make(map[string]bool)
+	for _, m := range b.Monitors {
+		base := prefix + strings.TrimSuffix(safeName.ReplaceAllString(filepath.Base(m.Monitor), "-"), ".txt")
+		name := base
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		names[name] = true
+		name += ".txt"
+
+		var data []byte
+		for _, l := range m.Checkpoints {
+			data = append(data, l+"\n"...)
+		}
+		if err := writeFile(filepath.Join(dir, name), data); err != nil {
+			return nil, err
+		}
+		imported = append(imported, collector.Monitor{
+			Description: fmt.Sprintf("%s imported from %s", m.Monitor, b.Source),
+			Logfile:     name,
+			Network:     b.Source,
+		})
+	}
+
+	list.Monitors = append(kept, imported...)
+	sort.Slice(list.Monitors, func(i, j int) bool { return list.Monitors[i].Logfile < list.Monitors[j].Logfile })
+	if err := writeJSON(filepath.Join(dir, collector.ImportedMonitorList), list); err != nil {
+		return nil, err
+	}
+	sources[b.Source] = b.CreatedAt
+	if err := writeJSON(filepath.Join(dir, importedSources), sources); err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
+
+// readJSON decodes filename into v, leaving v unchanged if the file does
+// not exist.
+func readJSON(filename string, v any) error {
+	b, err := os.ReadFile(filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	return nil
+}
+
+func writeJSON(filename string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filename, append(b, '\n'))
+}
+
+// writeFile replaces filename atomically, so a collector never reads a
+// partially written file.
+func writeFile(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
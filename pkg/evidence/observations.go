@@ -0,0 +1,72 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// ObservationBundle carries the checkpoints monitors observed from one place,
+// such as an enclave without network access to the collector, so they can
+// be transferred by other means and imported into a collector's rounds.
+type ObservationBundle struct {
+	Version int `json:"version"`
+	// Source names where the observations were made. Imported monitors
+	// are tagged with it as their network unless they have their own.
+	Source    string                `json:"source"`
+	CreatedAt time.Time             `json:"created_at"`
+	Monitors  []MonitorObservations `json:"monitors"`
+}
+
+// MonitorObservations are the latest checkpoints read from a monitor.
+type MonitorObservations struct {
+	Monitor     string    `json:"monitor"`
+	Network     string    `json:"network,omitempty"`
+	ObservedAt  time.Time `json:"observed_at"`
+	Checkpoints []string  `json:"checkpoints"`
+}
+
+// Observe reads the latest n checkpoints of each of the local monitor
+// logfiles into a bundle for source.
+func Observe(source string, monitors []collector.Monitor, n int) (*ObservationBundle, error) {
+	if source == "" {
+		return nil, errors.New("observations need a source")
+	}
+	b := &ObservationBundle{Version: Version, Source: source, CreatedAt: time.Now().UTC()}
+	for _, m := range monitors {
+		lines, err := collector.ReadLatestCheckpoints(m.Logfile, n)
+		if err != nil {
+			return nil, fmt.Errorf("reading monitor %s: %w", m.Logfile, err)
+		}
+		chpts := []string{}
+		for _, l := range lines {
+			if _, err := collector.ParseCheckpoint(l); err == nil {
+				chpts = append(chpts, l)
+			}
+		}
+		b.Monitors = append(b.Monitors, MonitorObservations{
+			Monitor:     m.Logfile,
+			Network:     m.Network,
+			ObservedAt:  time.Now().UTC(),
+			Checkpoints: chpts,
+		})
+	}
+	return b, nil
+}
@@ -0,0 +1,77 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SecondaryLog is a collector.SecondaryLog recording cosigned checkpoints as
+// hashedrekord entries of a Rekor log, signed by the collector.
+type SecondaryLog struct {
+	// Signer returns the signer of a submission, whose RekorURL is the
+	// log. It is called for every submission, so that keyless signers can
+	// be certified anew while their short-lived certificates expire.
+	Signer func(ctx context.Context) (*Signer, error)
+	// BundleFile, if set, is a file a SubmittedCheckpoint is appended to
+	// as a JSON line for every submission, for third parties to verify.
+	BundleFile string
+}
+
+// SubmittedCheckpoint is a cosigned checkpoint and the signature bundle of
+// its entry in the secondary log.
+type SubmittedCheckpoint struct {
+	Checkpoint string     `json:"checkpoint"`
+	Signature  *Signature `json:"signature"`
+}
+
+// Submit implements collector.SecondaryLog.
+func (l *SecondaryLog) Submit(ctx context.Context, cosigned []byte) (string, error) {
+	s, err := l.Signer(ctx)
+	if err != nil {
+		return "", err
+	}
+	if s.RekorURL == "" {
+		return "", errors.New("no Rekor log to submit to")
+	}
+	sig, err := s.Sign(ctx, cosigned)
+	if err != nil {
+		return "", err
+	}
+
+	if l.BundleFile != "" {
+		b, err := json.Marshal(SubmittedCheckpoint{Checkpoint: string(cosigned), Signature: sig})
+		if err != nil {
+			return "", err
+		}
+		f, err := os.OpenFile(l.BundleFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			f.Close()
+			return "", err
+		}
+		if err := f.Close(); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("entry %d of %s", sig.RekorBundle.Payload.LogIndex, s.RekorURL), nil
+}
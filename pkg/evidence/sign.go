@@ -0,0 +1,200 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-openapi/swag"
+	"github.com/sigstore/rekor/pkg/client"
+	"github.com/sigstore/rekor/pkg/generated/client/entries"
+	"github.com/sigstore/rekor/pkg/generated/models"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// PasswordEnv is the environment variable holding the password of an
+// encrypted signing key, as used by cosign.
+const PasswordEnv = "COSIGN_PASSWORD"
+
+// Signature is a detached signature of a blob in the format written by
+// "cosign sign-blob --bundle", so it can be checked with
+// "cosign verify-blob --bundle".
+type Signature struct {
+	Base64Signature string `json:"base64Signature"`
+	// Cert is the base64 encoded PEM certificate chain of a keyless
+	// signature, leaf first. It is empty for signatures made with a
+	// long-lived key.
+	Cert string `json:"cert,omitempty"`
+	// RekorBundle proves that the signature was uploaded to a Rekor log.
+	RekorBundle *RekorBundle `json:"rekorBundle,omitempty"`
+}
+
+// RekorBundle is an offline proof that an entry is in a Rekor log: the log's
+// signed entry timestamp over the entry.
+type RekorBundle struct {
+	SignedEntryTimestamp []byte       `json:"SignedEntryTimestamp"`
+	Payload              RekorPayload `json:"Payload"`
+}
+
+// RekorPayload is the part of a log entry covered by its signed entry
+// timestamp.
+type RekorPayload struct {
+	// Body is the base64 encoded canonical entry.
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+}
+
+// Chain returns the certificate chain of a keyless signature, leaf first, or
+// nil if it was made with a long-lived key.
+func (s *Signature) Chain() ([]*x509.Certificate, error) {
+	if s.Cert == "" {
+		return nil, nil
+	}
+	pemBytes, err := base64.StdEncoding.DecodeString(s.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate: %w", err)
+	}
+	return cryptoutils.UnmarshalCertificatesFromPEM(pemBytes)
+}
+
+// Signer signs blobs with a long-lived key or an ephemeral key certified by
+// Fulcio.
+type Signer struct {
+	Key crypto.Signer
+	// Chain is the certificate chain of a Fulcio-issued key, leaf first.
+	// It is empty for a long-lived key.
+	Chain []*x509.Certificate
+	// RekorURL, if set, is the Rekor log signatures are uploaded to.
+	RekorURL string
+}
+
+// LoadKey reads a PEM encoded private key, such as one created by
+// "cosign generate-key-pair". Encrypted keys are decrypted with password.
+func LoadKey(filename string, password []byte) (*Signer, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cryptoutils.UnmarshalPEMToPrivateKey(b, cryptoutils.StaticPasswordFunc(password))
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key %q: %w", filename, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return &Signer{Key: signer}, nil
+}
+
+// Sign signs blob and, if RekorURL is set, uploads the signature to Rekor.
+func (s *Signer) Sign(ctx context.Context, blob []byte) (*Signature, error) {
+	sv, err := signature.LoadSigner(s.Key, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := sv.SignMessage(bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Signature{Base64Signature: base64.StdEncoding.EncodeToString(sig)}
+	if len(s.Chain) > 0 {
+		pemBytes, err := cryptoutils.MarshalCertificatesToPEM(s.Chain)
+		if err != nil {
+			return nil, err
+		}
+		out.Cert = base64.StdEncoding.EncodeToString(pemBytes)
+	}
+	if s.RekorURL == "" {
+		return out, nil
+	}
+
+	if out.RekorBundle, err = s.upload(ctx, blob, sig); err != nil {
+		return nil, fmt.Errorf("uploading signature to %s: %w", s.RekorURL, err)
+	}
+	return out, nil
+}
+
+// upload records the signature of blob as a hashedrekord entry.
+func (s *Signer) upload(ctx context.Context, blob, sig []byte) (*RekorBundle, error) {
+	var pub []byte
+	var err error
+	if len(s.Chain) > 0 {
+		pub, err = cryptoutils.MarshalCertificateToPEM(s.Chain[0])
+	} else {
+		pub, err = cryptoutils.MarshalPublicKeyToPEM(s.Key.Public())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := client.GetRekorClient(s.RekorURL)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(blob)
+	params := entries.NewCreateLogEntryParamsWithContext(ctx)
+	params.SetProposedEntry(&models.Hashedrekord{
+		APIVersion: swag.String("0.0.1"),
+		Spec: models.HashedrekordV001Schema{
+			Data: &models.HashedrekordV001SchemaData{
+				Hash: &models.HashedrekordV001SchemaDataHash{
+					Algorithm: swag.String(models.HashedrekordV001SchemaDataHashAlgorithmSha256),
+					Value:     swag.String(hex.EncodeToString(digest[:])),
+				},
+			},
+			Signature: &models.HashedrekordV001SchemaSignature{
+				Content:   sig,
+				PublicKey: &models.HashedrekordV001SchemaSignaturePublicKey{Content: pub},
+			},
+		},
+	})
+	resp, err := rc.Entries.CreateLogEntry(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range resp.Payload {
+		if e.Verification == nil || e.IntegratedTime == nil || e.LogIndex == nil || e.LogID == nil {
+			return nil, errors.New("log entry has no signed entry timestamp")
+		}
+		body, ok := e.Body.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected log entry body of type %T", e.Body)
+		}
+		return &RekorBundle{
+			SignedEntryTimestamp: e.Verification.SignedEntryTimestamp,
+			Payload: RekorPayload{
+				Body:           body,
+				IntegratedTime: *e.IntegratedTime,
+				LogIndex:       *e.LogIndex,
+				LogID:          *e.LogID,
+			},
+		}, nil
+	}
+	return nil, errors.New("no log entry returned")
+}
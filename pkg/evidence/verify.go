@@ -0,0 +1,213 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sigstore/rekor/pkg/generated/models"
+	"github.com/sigstore/rekor/pkg/verify"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// Fulcio certificate extensions holding the OIDC issuer of the identity.
+var (
+	oidIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// VerifyOptions configures the verification of a signature.
+type VerifyOptions struct {
+	// PublicKey verifies signatures made with a long-lived key. If it is
+	// nil, the signature must be keyless.
+	PublicKey crypto.PublicKey
+	// Roots are the trusted Fulcio roots. Intermediates are added to the
+	// ones included in the signature.
+	Roots         *x509.CertPool
+	Intermediates *x509.CertPool
+	// Identity and Issuer, if set, must match a subject alternative name
+	// and the OIDC issuer of a keyless signature's certificate.
+	Identity, Issuer string
+	// RekorKey, if set, is the public key of the Rekor log; the signature
+	// must then carry a valid signed entry timestamp for the blob.
+	RekorKey crypto.PublicKey
+}
+
+// Verify checks that sig is a valid signature of blob. The certificate of a
+// keyless signature is checked at the time the signature was logged if its
+// signed entry timestamp is verified, and at the start of its validity
+// otherwise.
+func Verify(blob []byte, sig *Signature, opts VerifyOptions) error {
+	raw, err := base64.StdEncoding.DecodeString(sig.Base64Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	chain, err := sig.Chain()
+	if err != nil {
+		return err
+	}
+
+	pub := opts.PublicKey
+	switch {
+	case pub == nil && len(chain) == 0:
+		return errors.New("signature has no certificate and no public key was given")
+	case pub == nil:
+		pub = chain[0].PublicKey
+	case len(chain) > 0:
+		if err := cryptoutils.EqualKeys(pub, chain[0].PublicKey); err != nil {
+			return fmt.Errorf("certificate does not match the public key: %w", err)
+		}
+	}
+	v, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	if err := v.VerifySignature(bytes.NewReader(raw), bytes.NewReader(blob)); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	var signedAt time.Time
+	if opts.RekorKey != nil {
+		if sig.RekorBundle == nil {
+			return errors.New("signature was not uploaded to Rekor")
+		}
+		if err := verifyRekorBundle(blob, raw, sig.RekorBundle, opts.RekorKey); err != nil {
+			return err
+		}
+		signedAt = time.Unix(sig.RekorBundle.Payload.IntegratedTime, 0)
+	}
+
+	if opts.PublicKey != nil {
+		return nil
+	}
+	return verifyCertificate(chain, signedAt, opts)
+}
+
+// verifyCertificate checks the certificate chain of a keyless signature and
+// the identity it was issued to.
+func verifyCertificate(chain []*x509.Certificate, signedAt time.Time, opts VerifyOptions) error {
+	leaf := chain[0]
+	if signedAt.IsZero() {
+		signedAt = leaf.NotBefore
+	}
+	if opts.Roots == nil {
+		return errors.New("no Fulcio roots to verify the certificate with")
+	}
+	intermediates := x509.NewCertPool()
+	if opts.Intermediates != nil {
+		intermediates = opts.Intermediates.Clone()
+	}
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("verifying certificate: %w", err)
+	}
+
+	if opts.Identity != "" {
+		found := false
+		for _, san := range cryptoutils.GetSubjectAlternateNames(leaf) {
+			found = found || san == opts.Identity
+		}
+		if !found {
+			return fmt.Errorf("certificate was not issued to %s", opts.Identity)
+		}
+	}
+	if opts.Issuer != "" {
+		if issuer := certificateIssuer(leaf); issuer != opts.Issuer {
+			return fmt.Errorf("certificate identity was issued by %q, not %s", issuer, opts.Issuer)
+		}
+	}
+	return nil
+}
+
+// certificateIssuer returns the OIDC issuer recorded in a Fulcio
+// certificate.
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(oidIssuer):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// verifyRekorBundle checks the signed entry timestamp of a bundle and that
+// the logged entry is the signature of blob.
+func verifyRekorBundle(blob, sig []byte, b *RekorBundle, rekorKey crypto.PublicKey) error {
+	v, err := signature.LoadVerifier(rekorKey, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	p := b.Payload
+	e := &models.LogEntryAnon{
+		Body:           p.Body,
+		IntegratedTime: &p.IntegratedTime,
+		LogIndex:       &p.LogIndex,
+		LogID:          &p.LogID,
+		Verification:   &models.LogEntryAnonVerification{SignedEntryTimestamp: b.SignedEntryTimestamp},
+	}
+	if err := verify.VerifySignedEntryTimestamp(context.Background(), e, v); err != nil {
+		return err
+	}
+
+	body, err := base64.StdEncoding.DecodeString(p.Body)
+	if err != nil {
+		return fmt.Errorf("decoding log entry: %w", err)
+	}
+	var entry struct {
+		Kind string                        `json:"kind"`
+		Spec models.HashedrekordV001Schema `json:"spec"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return fmt.Errorf("decoding log entry: %w", err)
+	}
+	if entry.Kind != "hashedrekord" {
+		return fmt.Errorf("unexpected log entry kind %q", entry.Kind)
+	}
+	logged := entry.Spec
+	digest := sha256.Sum256(blob)
+	if logged.Data == nil || logged.Data.Hash == nil || logged.Data.Hash.Value == nil || *logged.Data.Hash.Value != hex.EncodeToString(digest[:]) {
+		return errors.New("log entry is not for this blob")
+	}
+	if logged.Signature == nil || !bytes.Equal(logged.Signature.Content, sig) {
+		return errors.New("log entry is not for this signature")
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package frost implements FROST(Ed25519, SHA-512) threshold signing as
+// specified in RFC 9591. Any threshold of the holders of key shares can
+// jointly produce a signature that verifies as an ordinary Ed25519
+// signature under the group public key, while fewer cannot.
+package frost
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"filippo.io/edwards25519"
+)
+
+// contextString is the FROST(Ed25519, SHA-512) ciphersuite context string.
+const contextString = "FROST-ED25519-SHA512-v1"
+
+// hashToScalar hashes the concatenation of parts with SHA-512 and reduces
+// the digest modulo the group order.
+func hashToScalar(parts ...[]byte) *edwards25519.Scalar {
+	h := sha512.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	s, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		panic(err) // unreachable: a SHA-512 digest is 64 bytes
+	}
+	return s
+}
+
+func h1(m []byte) *edwards25519.Scalar {
+	return hashToScalar([]byte(contextString+"rho"), m)
+}
+
+// h2 is the challenge hash, which carries no context string so that
+// signatures verify as Ed25519.
+func h2(m []byte) *edwards25519.Scalar {
+	return hashToScalar(m)
+}
+
+func h3(m []byte) *edwards25519.Scalar {
+	return hashToScalar([]byte(contextString+"nonce"), m)
+}
+
+func h4(m []byte) []byte {
+	sum := sha512.Sum512(append([]byte(contextString+"msg"), m...))
+	return sum[:]
+}
+
+func h5(m []byte) []byte {
+	sum := sha512.Sum512(append([]byte(contextString+"com"), m...))
+	return sum[:]
+}
+
+// identifier returns the scalar of a participant identifier.
+func identifier(id uint16) *edwards25519.Scalar {
+	var b [32]byte
+	binary.LittleEndian.PutUint16(b[:], id)
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(b[:])
+	if err != nil {
+		panic(err) // unreachable: small values are canonical
+	}
+	return s
+}
+
+func scalarFrom(b []byte) (*edwards25519.Scalar, error) {
+	return edwards25519.NewScalar().SetCanonicalBytes(b)
+}
+
+func pointFrom(b []byte) (*edwards25519.Point, error) {
+	return new(edwards25519.Point).SetBytes(b)
+}
+
+// KeyShare is a participant's share of the group signing key.
+type KeyShare struct {
+	// ID identifies the participant, from 1 to the number of participants.
+	ID uint16 `json:"id"`
+	// Threshold is the number of participants needed to sign.
+	Threshold int `json:"threshold"`
+	// Secret is the participant's secret share.
+	Secret []byte `json:"secret"`
+	// GroupKey is the Ed25519 public key signatures verify under.
+	GroupKey ed25519.PublicKey `json:"group_key"`
+	// PublicShares holds the public key share of every participant, used
+	// to verify their signature shares.
+	PublicShares map[uint16][]byte `json:"public_shares"`
+}
+
+// GenerateShares splits a new random signing key into n shares, any
+// threshold of which can sign, using a trusted dealer. The key itself is
+// discarded.
+func GenerateShares(threshold, n int) ([]KeyShare, error) {
+	if threshold < 2 || threshold > n || n > 0xffff {
+		return nil, fmt.Errorf("invalid threshold %d of %d participants", threshold, n)
+	}
+
+	coeffs := make([]*edwards25519.Scalar, threshold)
+	for i := range coeffs {
+		var b [64]byte
+		if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+			return nil, err
+		}
+		coeffs[i], _ = edwards25519.NewScalar().SetUniformBytes(b[:])
+	}
+	groupKey := new(edwards25519.Point).ScalarBaseMult(coeffs[0]).Bytes()
+
+	shares := make([]KeyShare, n)
+	public := make(map[uint16][]byte, n)
+	for i := range shares {
+		id := uint16(i + 1)
+		// Evaluate the polynomial at id with Horner's method.
+		x := identifier(id)
+		s := edwards25519.NewScalar()
+		for j := threshold - 1; j >= 0; j-- {
+			s.MultiplyAdd(s, x, coeffs[j])
+		}
+		shares[i] = KeyShare{ID: id, Threshold: threshold, Secret: s.Bytes(), GroupKey: groupKey}
+		public[id] = new(edwards25519.Point).ScalarBaseMult(s).Bytes()
+	}
+	for i := range shares {
+		shares[i].PublicShares = public
+	}
+	return shares, nil
+}
+
+// Nonces are the secret nonces of a participant for a single signing
+// operation. They must never be used twice.
+type Nonces struct {
+	hiding, binding *edwards25519.Scalar
+}
+
+// Commitment is a participant's public commitment to its nonces.
+type Commitment struct {
+	ID      uint16 `json:"id"`
+	Hiding  []byte `json:"hiding"`
+	Binding []byte `json:"binding"`
+}
+
+// Commit generates the nonces of a participant for one signing operation
+// and the commitment sent to the coordinator.
+func (k KeyShare) Commit() (*Nonces, Commitment, error) {
+	secret, err := scalarFrom(k.Secret)
+	if err != nil {
+		return nil, Commitment{}, fmt.Errorf("invalid secret share: %w", err)
+	}
+	nonce := func() (*edwards25519.Scalar, error) {
+		var b [32]byte
+		if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+			return nil, err
+		}
+		return h3(append(b[:], secret.Bytes()...)), nil
+	}
+	n := &Nonces{}
+	if n.hiding, err = nonce(); err != nil {
+		return nil, Commitment{}, err
+	}
+	if n.binding, err = nonce(); err != nil {
+		return nil, Commitment{}, err
+	}
+	return n, Commitment{
+		ID:      k.ID,
+		Hiding:  new(edwards25519.Point).ScalarBaseMult(n.hiding).Bytes(),
+		Binding: new(edwards25519.Point).ScalarBaseMult(n.binding).Bytes(),
+	}, nil
+}
+
+// signingPackage holds the values every participant derives from the
+// message and the commitments.
+type signingPackage struct {
+	ids       []uint16
+	binding   map[uint16]*edwards25519.Scalar
+	commit    map[uint16][2]*edwards25519.Point
+	groupR    *edwards25519.Point
+	challenge *edwards25519.Scalar
+}
+
+func newSigningPackage(groupKey ed25519.PublicKey, msg []byte, commitments []Commitment) (*signingPackage, error) {
+	sorted := append([]Commitment(nil), commitments...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	p := &signingPackage{binding: make(map[uint16]*edwards25519.Scalar), commit: make(map[uint16][2]*edwards25519.Point)}
+	var encoded []byte
+	for i, c := range sorted {
+		if c.ID == 0 || (i > 0 && c.ID == sorted[i-1].ID) {
+			return nil, fmt.Errorf("invalid or duplicate participant %d", c.ID)
+		}
+		d, err := pointFrom(c.Hiding)
+		if err != nil {
+			return nil, fmt.Errorf("commitment of participant %d: %w", c.ID, err)
+		}
+		e, err := pointFrom(c.Binding)
+		if err != nil {
+			return nil, fmt.Errorf("commitment of participant %d: %w", c.ID, err)
+		}
+		p.ids = append(p.ids, c.ID)
+		p.commit[c.ID] = [2]*edwards25519.Point{d, e}
+		encoded = append(encoded, identifier(c.ID).Bytes()...)
+		encoded = append(encoded, c.Hiding...)
+		encoded = append(encoded, c.Binding...)
+	}
+
+	prefix := append(append(append([]byte{}, groupKey...), h4(msg)...), h5(encoded)...)
+	p.groupR = edwards25519.NewIdentityPoint()
+	for _, id := range p.ids {
+		rho := h1(append(append([]byte{}, prefix...), identifier(id).Bytes()...))
+		p.binding[id] = rho
+		c := p.commit[id]
+		p.groupR.Add(p.groupR, new(edwards25519.Point).Add(c[0], new(edwards25519.Point).ScalarMult(rho, c[1])))
+	}
+	p.challenge = h2(append(append(p.groupR.Bytes(), groupKey...), msg...))
+	return p, nil
+}
+
+// lagrange returns the Lagrange coefficient of participant id for the
+// participants of the signing package.
+func (p *signingPackage) lagrange(id uint16) *edwards25519.Scalar {
+	x := identifier(id)
+	num, den := identifier(1), identifier(1)
+	for _, other := range p.ids {
+		if other == id {
+			continue
+		}
+		xj := identifier(other)
+		num.Multiply(num, xj)
+		den.Multiply(den, new(edwards25519.Scalar).Subtract(xj, x))
+	}
+	return num.Multiply(num, den.Invert(den))
+}
+
+// Sign computes the participant's signature share of msg. commitments holds
+// the commitments of every participant of the signing operation, including
+// this one.
+func (k KeyShare) Sign(nonces *Nonces, msg []byte, commitments []Commitment) ([]byte, error) {
+	if nonces == nil || nonces.hiding == nil {
+		return nil, errors.New("nonces were already used")
+	}
+	secret, err := scalarFrom(k.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret share: %w", err)
+	}
+	p, err := newSigningPackage(k.GroupKey, msg, commitments)
+	if err != nil {
+		return nil, err
+	}
+	rho, ok := p.binding[k.ID]
+	if !ok {
+		return nil, fmt.Errorf("participant %d has no commitment", k.ID)
+	}
+	if len(p.ids) < k.Threshold {
+		return nil, fmt.Errorf("%d participants, threshold is %d", len(p.ids), k.Threshold)
+	}
+
+	// z = d + e*rho + lambda*s*c
+	z := new(edwards25519.Scalar).Multiply(p.lagrange(k.ID), secret)
+	z.Multiply(z, p.challenge)
+	z.Add(z, nonces.hiding)
+	z.MultiplyAdd(nonces.binding, rho, z)
+	nonces.hiding, nonces.binding = nil, nil
+	return z.Bytes(), nil
+}
+
+// Aggregate verifies the signature shares of the participants, keyed by
+// identifier, and combines them into an Ed25519 signature of msg under
+// groupKey. publicShares holds the public key share of every participant.
+func Aggregate(groupKey ed25519.PublicKey, publicShares map[uint16][]byte, msg []byte, commitments []Commitment, shares map[uint16][]byte) ([]byte, error) {
+	p, err := newSigningPackage(groupKey, msg, commitments)
+	if err != nil {
+		return nil, err
+	}
+	z := edwards25519.NewScalar()
+	for _, id := range p.ids {
+		share, ok := shares[id]
+		if !ok {
+			return nil, fmt.Errorf("missing signature share of participant %d", id)
+		}
+		zi, err := scalarFrom(share)
+		if err != nil {
+			return nil, fmt.Errorf("signature share of participant %d: %w", id, err)
+		}
+		pub, err := pointFrom(publicShares[id])
+		if err != nil {
+			return nil, fmt.Errorf("public key share of participant %d: %w", id, err)
+		}
+		// Check g*z_i == D_i + E_i*rho_i + Y_i*(c*lambda_i).
+		c := p.commit[id]
+		want := new(edwards25519.Point).Add(c[0], new(edwards25519.Point).ScalarMult(p.binding[id], c[1]))
+		want.Add(want, new(edwards25519.Point).ScalarMult(new(edwards25519.Scalar).Multiply(p.challenge, p.lagrange(id)), pub))
+		if new(edwards25519.Point).ScalarBaseMult(zi).Equal(want) != 1 {
+			return nil, fmt.Errorf("invalid signature share of participant %d", id)
+		}
+		z.Add(z, zi)
+	}
+
+	sig := append(p.groupR.Bytes(), z.Bytes()...)
+	if !ed25519.Verify(groupKey, msg, sig) {
+		return nil, errors.New("aggregated signature does not verify")
+	}
+	return sig, nil
+}
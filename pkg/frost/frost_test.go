@@ -0,0 +1,115 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frost
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestThresholdSign(t *testing.T) {
+	shares, err := GenerateShares(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("rekor.sigstore.dev - 2605736670972794746\n10\nhash\n")
+
+	for _, signers := range [][]int{{0, 1}, {0, 2}, {1, 2}, {0, 1, 2}} {
+		nonces := make([]*Nonces, len(signers))
+		var commitments []Commitment
+		for i, s := range signers {
+			n, c, err := shares[s].Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonces[i] = n
+			commitments = append(commitments, c)
+		}
+		sigShares := make(map[uint16][]byte)
+		for i, s := range signers {
+			z, err := shares[s].Sign(nonces[i], msg, commitments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigShares[shares[s].ID] = z
+		}
+
+		sig, err := Aggregate(shares[0].GroupKey, shares[0].PublicShares, msg, commitments, sigShares)
+		if err != nil {
+			t.Fatalf("signers %v: %v", signers, err)
+		}
+		if !ed25519.Verify(shares[0].GroupKey, msg, sig) {
+			t.Errorf("signers %v: signature does not verify", signers)
+		}
+
+		if _, err := shares[signers[0]].Sign(nonces[0], msg, commitments); err == nil {
+			t.Error("expected nonces to be usable only once")
+		}
+		sigShares[shares[signers[0]].ID] = sigShares[shares[signers[1]].ID]
+		if _, err := Aggregate(shares[0].GroupKey, shares[0].PublicShares, msg, commitments, sigShares); err == nil {
+			t.Error("expected an invalid signature share to be rejected")
+		}
+	}
+
+	_, c, err := shares[0].Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := shares[0].Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shares[0].Sign(n, msg, []Commitment{c}); err == nil {
+		t.Error("expected signing with fewer participants than the threshold to fail")
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	shares, err := GenerateShares(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("accepted")
+	refuse := map[uint16]bool{3: true}
+	participants := make(map[uint16]string)
+	for _, s := range shares {
+		id := s.ID
+		p := &Participant{Share: s, Approve: func(m []byte) error {
+			if refuse[id] || string(m) != "accepted" {
+				return errors.New("not accepted")
+			}
+			return nil
+		}}
+		srv := httptest.NewServer(p)
+		defer srv.Close()
+		participants[id] = srv.URL + "/frost/v1"
+	}
+
+	c := &Coordinator{GroupKey: shares[0].GroupKey, Threshold: 2, PublicShares: shares[0].PublicShares, Participants: participants}
+	sig, err := c.Sign(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(shares[0].GroupKey, msg, sig) {
+		t.Error("signature does not verify")
+	}
+	if _, err := c.Sign(context.Background(), []byte("forged")); err == nil {
+		t.Error("expected participants to refuse a message they did not accept")
+	}
+}
@@ -0,0 +1,280 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frost
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the sessions a participant keeps between the two rounds.
+const (
+	sessionTTL  = time.Minute
+	maxSessions = 1024
+)
+
+type commitResponse struct {
+	Session    string     `json:"session"`
+	Commitment Commitment `json:"commitment"`
+}
+
+type signRequest struct {
+	Session     string       `json:"session"`
+	Message     []byte       `json:"message"`
+	Commitments []Commitment `json:"commitments"`
+}
+
+type signResponse struct {
+	Share []byte `json:"share"`
+}
+
+type session struct {
+	nonces     *Nonces
+	commitment Commitment
+	created    time.Time
+}
+
+// Participant serves a key share to a coordinator over HTTP:
+//
+//	POST <prefix>/commit  returns a session and commitment
+//	POST <prefix>/sign    returns a signature share of the message
+//
+// A participant only signs messages Approve accepts, so a coordinator cannot
+// obtain a signature the threshold of participants did not agree with.
+type Participant struct {
+	Share KeyShare
+	// Approve returns an error if the participant must not sign msg.
+	Approve func(msg []byte) error
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Participant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/commit"):
+		resp, err := p.commit()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, resp)
+	case strings.HasSuffix(r.URL.Path, "/sign"):
+		var req signRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		share, err := p.sign(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		writeJSON(w, signResponse{Share: share})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *Participant) commit() (commitResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions == nil {
+		p.sessions = make(map[string]*session)
+	}
+	now := time.Now()
+	for id, s := range p.sessions {
+		if now.Sub(s.created) > sessionTTL {
+			delete(p.sessions, id)
+		}
+	}
+	if len(p.sessions) >= maxSessions {
+		return commitResponse{}, errors.New("too many pending signing sessions")
+	}
+
+	nonces, commitment, err := p.Share.Commit()
+	if err != nil {
+		return commitResponse{}, err
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return commitResponse{}, err
+	}
+	id := hex.EncodeToString(b[:])
+	p.sessions[id] = &session{nonces: nonces, commitment: commitment, created: now}
+	return commitResponse{Session: id, Commitment: commitment}, nil
+}
+
+func (p *Participant) sign(req signRequest) ([]byte, error) {
+	p.mu.Lock()
+	s, ok := p.sessions[req.Session]
+	// A session is used at most once, whatever the outcome.
+	delete(p.sessions, req.Session)
+	p.mu.Unlock()
+	if !ok || time.Since(s.created) > sessionTTL {
+		return nil, errors.New("unknown or expired session")
+	}
+
+	found := false
+	for _, c := range req.Commitments {
+		if c.ID == p.Share.ID {
+			found = bytes.Equal(c.Hiding, s.commitment.Hiding) && bytes.Equal(c.Binding, s.commitment.Binding)
+		}
+	}
+	if !found {
+		return nil, errors.New("commitment of this participant is missing or modified")
+	}
+	if p.Approve == nil {
+		return nil, errors.New("no approval policy configured")
+	}
+	if err := p.Approve(req.Message); err != nil {
+		return nil, fmt.Errorf("refusing to sign: %w", err)
+	}
+	return p.Share.Sign(s.nonces, req.Message, req.Commitments)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Coordinator runs the two signing rounds with remote participants and
+// aggregates their shares.
+type Coordinator struct {
+	GroupKey     ed25519.PublicKey
+	Threshold    int
+	PublicShares map[uint16][]byte
+	// Participants maps participant identifiers to the URL prefix their
+	// Participant handler is served at.
+	Participants map[uint16]string
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Sign produces an Ed25519 signature of msg under the group key with the
+// first Threshold participants, by identifier, that respond to the
+// commitment round.
+func (c *Coordinator) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	type result struct {
+		id   uint16
+		resp commitResponse
+		err  error
+	}
+	results := make(chan result, len(c.Participants))
+	for id, u := range c.Participants {
+		go func(id uint16, u string) {
+			var resp commitResponse
+			err := c.post(ctx, u+"/commit", nil, &resp)
+			if err == nil && resp.Commitment.ID != id {
+				err = fmt.Errorf("participant at %s has identifier %d, expected %d", u, resp.Commitment.ID, id)
+			}
+			results <- result{id, resp, err}
+		}(id, u)
+	}
+	var committed []result
+	var errs []string
+	for range c.Participants {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("participant %d: %v", r.id, r.err))
+			continue
+		}
+		committed = append(committed, r)
+	}
+	if len(committed) < c.Threshold {
+		return nil, fmt.Errorf("%d of %d participants committed, threshold is %d: %s", len(committed), len(c.Participants), c.Threshold, strings.Join(errs, "; "))
+	}
+	sort.Slice(committed, func(i, j int) bool { return committed[i].id < committed[j].id })
+	committed = committed[:c.Threshold]
+
+	commitments := make([]Commitment, len(committed))
+	for i, r := range committed {
+		commitments[i] = r.resp.Commitment
+	}
+
+	type shareResult struct {
+		id    uint16
+		share []byte
+		err   error
+	}
+	shareResults := make(chan shareResult, len(committed))
+	for _, r := range committed {
+		go func(r result) {
+			var resp signResponse
+			err := c.post(ctx, c.Participants[r.id]+"/sign", signRequest{Session: r.resp.Session, Message: msg, Commitments: commitments}, &resp)
+			shareResults <- shareResult{r.id, resp.Share, err}
+		}(r)
+	}
+	shares := make(map[uint16][]byte, len(committed))
+	for range committed {
+		r := <-shareResults
+		if r.err != nil {
+			return nil, fmt.Errorf("participant %d: %w", r.id, r.err)
+		}
+		shares[r.id] = r.share
+	}
+	return Aggregate(c.GroupKey, c.PublicShares, msg, commitments, shares)
+}
+
+func (c *Coordinator) post(ctx context.Context, url string, in, out any) error {
+	var body io.Reader = http.NoBody
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
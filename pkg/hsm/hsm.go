@@ -0,0 +1,57 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hsm signs with Ed25519 keys kept in hardware through PKCS#11, so
+// the collector's cosigning key never leaves the device. YubiKeys and other
+// PIV tokens are supported through their PKCS#11 modules, such as Yubico's
+// ykcs11.
+package hsm
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// PKCS#11 v3.0 values missing from older headers.
+const (
+	ckkECEdwards = 0x40
+	ckmEdDSA     = 0x1057
+)
+
+// Config identifies a key on a PKCS#11 token.
+type Config struct {
+	// Module is the path of the PKCS#11 module, e.g.
+	// /usr/lib/softhsm/libsofthsm2.so or /usr/lib/libykcs11.so.
+	Module string
+	// TokenLabel selects the token; the first token is used if it is
+	// empty.
+	TokenLabel string
+	// KeyLabel is the label of the private and public key objects.
+	KeyLabel string
+	// PIN logs in to the token as a user.
+	PIN string
+}
+
+// decodeEdwardsPoint returns the Ed25519 public key of a CKA_EC_POINT
+// value, which tokens return either DER encoded as an OCTET STRING or raw.
+func decodeEdwardsPoint(b []byte) (ed25519.PublicKey, error) {
+	if len(b) == ed25519.PublicKeySize+2 && b[0] == 0x04 && b[1] == ed25519.PublicKeySize {
+		b = b[2:]
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("EC point of %d bytes is not an Ed25519 public key", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
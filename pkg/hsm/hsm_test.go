@@ -0,0 +1,34 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hsm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeEdwardsPoint(t *testing.T) {
+	raw := bytes.Repeat([]byte{7}, 32)
+	for _, b := range [][]byte{raw, append([]byte{0x04, 32}, raw...)} {
+		pub, err := decodeEdwardsPoint(b)
+		if err != nil || !bytes.Equal(pub, raw) {
+			t.Errorf("decoding %x: got %x, %v", b, pub, err)
+		}
+	}
+	if _, err := decodeEdwardsPoint(append([]byte{0x04, 65}, bytes.Repeat([]byte{7}, 65)...)); err == nil {
+		t.Error("expected an error for a P-256 point")
+	}
+}
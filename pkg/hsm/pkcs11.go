@@ -0,0 +1,156 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package hsm
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Key is an Ed25519 key on a PKCS#11 token.
+type Key struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	priv    pkcs11.ObjectHandle
+	pub     ed25519.PublicKey
+
+	// mu serializes signing operations, which a PKCS#11 session runs one
+	// at a time.
+	mu sync.Mutex
+}
+
+// Open loads the PKCS#11 module, logs in to the token and finds the key.
+func Open(cfg Config) (*Key, error) {
+	ctx := pkcs11.New(cfg.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("loading PKCS#11 module %q failed", cfg.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("initializing PKCS#11 module: %w", err)
+	}
+	k := &Key{ctx: ctx}
+	if err := k.open(cfg); err != nil {
+		k.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *Key) open(cfg Config) error {
+	slots, err := k.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("listing tokens: %w", err)
+	}
+	slot, found := uint(0), false
+	for _, s := range slots {
+		info, err := k.ctx.GetTokenInfo(s)
+		if err != nil {
+			return fmt.Errorf("reading token info: %w", err)
+		}
+		if cfg.TokenLabel == "" || strings.TrimRight(info.Label, " \x00") == cfg.TokenLabel {
+			slot, found = s, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("token %q not found", cfg.TokenLabel)
+	}
+
+	if k.session, err = k.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+		return fmt.Errorf("opening session: %w", err)
+	}
+	if err := k.ctx.Login(k.session, pkcs11.CKU_USER, cfg.PIN); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return fmt.Errorf("logging in to token: %w", err)
+	}
+
+	if k.priv, err = k.find(pkcs11.CKO_PRIVATE_KEY, cfg.KeyLabel); err != nil {
+		return err
+	}
+	pubObj, err := k.find(pkcs11.CKO_PUBLIC_KEY, cfg.KeyLabel)
+	if err != nil {
+		return err
+	}
+	attrs, err := k.ctx.GetAttributeValue(k.session, pubObj, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	if err != nil {
+		return fmt.Errorf("reading public key: %w", err)
+	}
+	k.pub, err = decodeEdwardsPoint(attrs[0].Value)
+	return err
+}
+
+// find returns the single Ed25519 key object of class with the label.
+func (k *Key) find(class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkECEdwards),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := k.ctx.FindObjectsInit(k.session, template); err != nil {
+		return 0, err
+	}
+	objs, _, err := k.ctx.FindObjects(k.session, 2)
+	if finalErr := k.ctx.FindObjectsFinal(k.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("finding key %q: %w", label, err)
+	}
+	if len(objs) != 1 {
+		return 0, fmt.Errorf("found %d Ed25519 keys labelled %q, expected one", len(objs), label)
+	}
+	return objs[0], nil
+}
+
+// Public returns the public key.
+func (k *Key) Public() ed25519.PublicKey {
+	return k.pub
+}
+
+// Sign signs msg with EdDSA on the token.
+func (k *Key) Sign(msg []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.ctx.SignInit(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEdDSA, nil)}, k.priv); err != nil {
+		return nil, fmt.Errorf("signing on token: %w", err)
+	}
+	sig, err := k.ctx.Sign(k.session, msg)
+	if err != nil {
+		return nil, fmt.Errorf("signing on token: %w", err)
+	}
+	if !ed25519.Verify(k.pub, msg, sig) {
+		return nil, errors.New("signature from token does not verify")
+	}
+	return sig, nil
+}
+
+// Close logs out and unloads the module.
+func (k *Key) Close() error {
+	if k.session != 0 {
+		k.ctx.Logout(k.session)
+		k.ctx.CloseSession(k.session)
+	}
+	err := k.ctx.Finalize()
+	k.ctx.Destroy()
+	return err
+}
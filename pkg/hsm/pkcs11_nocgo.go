@@ -0,0 +1,42 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !cgo
+
+package hsm
+
+import (
+	"crypto/ed25519"
+	"errors"
+)
+
+// Key is an Ed25519 key on a PKCS#11 token.
+type Key struct{}
+
+// Open fails: PKCS#11 modules can only be loaded in builds with cgo.
+func Open(Config) (*Key, error) {
+	return nil, errors.New("PKCS#11 support requires a build with cgo enabled")
+}
+
+// Public returns the public key.
+func (k *Key) Public() ed25519.PublicKey { return nil }
+
+// Sign signs msg with EdDSA on the token.
+func (k *Key) Sign([]byte) ([]byte, error) {
+	return nil, errors.New("PKCS#11 support requires a build with cgo enabled")
+}
+
+// Close logs out and unloads the module.
+func (k *Key) Close() error { return nil }
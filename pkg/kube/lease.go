@@ -0,0 +1,233 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// microTime is the layout of Kubernetes MicroTime values.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// Default leader election timings, matching the client-go defaults.
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int32  `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int32  `json:"leaseTransitions,omitempty"`
+}
+
+// lease is a coordination.k8s.io/v1 Lease.
+type lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       leaseSpec  `json:"spec"`
+}
+
+func (c *Client) leasePath(namespace, name string) string {
+	p := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", namespace)
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// LeaderElector holds a Lease so that only one of several replicas runs at a
+// time.
+type LeaderElector struct {
+	Client *Client
+	// Namespace and Name identify the Lease object.
+	Namespace string
+	Name      string
+	// Identity is the holder identity recorded in the Lease, usually the
+	// pod name.
+	Identity string
+	// LeaseDuration is how long other candidates wait before taking over a
+	// lease that is not renewed.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps trying to renew the lease
+	// before giving up leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is the time between attempts to acquire or renew the lease.
+	RetryPeriod time.Duration
+
+	now func() time.Time
+}
+
+func (le *LeaderElector) defaults() {
+	if le.Namespace == "" {
+		le.Namespace = le.Client.Namespace
+	}
+	if le.LeaseDuration <= 0 {
+		le.LeaseDuration = DefaultLeaseDuration
+	}
+	if le.RenewDeadline <= 0 {
+		le.RenewDeadline = DefaultRenewDeadline
+	}
+	if le.RetryPeriod <= 0 {
+		le.RetryPeriod = DefaultRetryPeriod
+	}
+	if le.now == nil {
+		le.now = time.Now
+	}
+}
+
+// tryAcquireOrRenew takes or renews the lease, returning whether it is held
+// by this candidate afterwards.
+func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := le.now()
+	nowStr := now.UTC().Format(microTime)
+	seconds := int32(le.LeaseDuration / time.Second)
+
+	var l lease
+	err := le.Client.do(ctx, http.MethodGet, le.Client.leasePath(le.Namespace, le.Name), nil, &l)
+	if errors.Is(err, ErrNotFound) {
+		transitions := int32(0)
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   objectMeta{Name: le.Name, Namespace: le.Namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       &le.Identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &nowStr,
+				RenewTime:            &nowStr,
+				LeaseTransitions:     &transitions,
+			},
+		}
+		err := le.Client.do(ctx, http.MethodPost, le.Client.leasePath(le.Namespace, ""), &l, nil)
+		if errors.Is(err, ErrConflict) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	held := l.Spec.HolderIdentity != nil && *l.Spec.HolderIdentity == le.Identity
+	if !held && l.Spec.HolderIdentity != nil && *l.Spec.HolderIdentity != "" && !leaseExpired(l.Spec, now) {
+		return false, nil
+	}
+
+	if !held {
+		transitions := int32(1)
+		if l.Spec.LeaseTransitions != nil {
+			transitions = *l.Spec.LeaseTransitions + 1
+		}
+		l.Spec.HolderIdentity = &le.Identity
+		l.Spec.AcquireTime = &nowStr
+		l.Spec.LeaseTransitions = &transitions
+	}
+	l.Spec.RenewTime = &nowStr
+	l.Spec.LeaseDurationSeconds = &seconds
+
+	err = le.Client.do(ctx, http.MethodPut, le.Client.leasePath(le.Namespace, le.Name), &l, nil)
+	if errors.Is(err, ErrConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// leaseExpired reports whether the lease was last renewed longer than its
+// duration ago.
+func leaseExpired(spec leaseSpec, now time.Time) bool {
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	renewed, err := time.Parse(microTime, *spec.RenewTime)
+	if err != nil {
+		renewed, err = time.Parse(time.RFC3339, *spec.RenewTime)
+		if err != nil {
+			return true
+		}
+	}
+	return now.After(renewed.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+// Run blocks until the lease is acquired, then calls run with a context that
+// is cancelled if the lease cannot be renewed within RenewDeadline. It
+// returns when run returns or ctx is cancelled. Losing the lease is reported
+// as an error so that the process restarts as a candidate.
+func (le *LeaderElector) Run(ctx context.Context, run func(context.Context) error) error {
+	le.defaults()
+
+	for {
+		ok, err := le.tryAcquireOrRenew(ctx)
+		if err != nil {
+			log.Printf("Acquiring lease %s/%s: %v\n", le.Namespace, le.Name, err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(le.RetryPeriod):
+		}
+	}
+	log.Printf("Acquired lease %s/%s as %s\n", le.Namespace, le.Name, le.Identity)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- run(leaderCtx) }()
+
+	lastRenew := le.now()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(le.RetryPeriod):
+		}
+
+		ok, err := le.tryAcquireOrRenew(ctx)
+		if ok {
+			lastRenew = le.now()
+			continue
+		}
+		if err != nil {
+			log.Printf("Renewing lease %s/%s: %v\n", le.Namespace, le.Name, err)
+		}
+		if (!ok && err == nil) || le.now().Sub(lastRenew) > le.RenewDeadline {
+			cancel()
+			<-done
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("lost lease %s/%s", le.Namespace, le.Name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeases serves a single Lease with optimistic concurrency.
+type fakeLeases struct {
+	mu      sync.Mutex
+	l       *lease
+	version int
+}
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.l == nil {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(f.l)
+	case http.MethodPost, http.MethodPut:
+		var l lease
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (r.Method == http.MethodPost && f.l != nil) ||
+			(r.Method == http.MethodPut && (f.l == nil || l.Metadata.ResourceVersion != f.l.Metadata.ResourceVersion)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.version++
+		l.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.l = &l
+		_ = json.NewEncoder(w).Encode(f.l)
+	}
+}
+
+func TestLeaderElector(t *testing.T) {
+	srv := httptest.NewServer(&fakeLeases{})
+	defer srv.Close()
+	client := NewClient(srv.URL, "default", "", srv.Client())
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	a := &LeaderElector{Client: client, Name: "collector", Identity: "a", now: clock}
+	b := &LeaderElector{Client: client, Name: "collector", Identity: "b", now: clock}
+	a.defaults()
+	b.defaults()
+	ctx := context.Background()
+
+	if ok, err := a.tryAcquireOrRenew(ctx); !ok || err != nil {
+		t.Fatalf("a acquiring free lease = %v, %v", ok, err)
+	}
+	if ok, err := b.tryAcquireOrRenew(ctx); ok || err != nil {
+		t.Fatalf("b acquiring held lease = %v, %v", ok, err)
+	}
+	if ok, err := a.tryAcquireOrRenew(ctx); !ok || err != nil {
+		t.Fatalf("a renewing lease = %v, %v", ok, err)
+	}
+
+	now = now.Add(DefaultLeaseDuration + time.Second)
+	if ok, err := b.tryAcquireOrRenew(ctx); !ok || err != nil {
+		t.Fatalf("b taking over expired lease = %v, %v", ok, err)
+	}
+	if ok, err := a.tryAcquireOrRenew(ctx); ok || err != nil {
+		t.Fatalf("a renewing lost lease = %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,352 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package postgres stores the accepted checkpoints of collectors in a
+// PostgreSQL database shared by several collectors and their consumers.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"time"
+
+	// Register the PostgreSQL driver.
+	_ "github.com/lib/pq"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+func init() {
+	collector.RegisterCapability(collector.CapabilityStorage, "postgres")
+}
+
+// timeout bounds every database operation of a Storage, whose methods do not
+// take a context.
+const timeout = 30 * time.Second
+
+// driverName is the database/sql driver Storages connect with.
+var driverName = "postgres"
+
+// ErrLocked is returned by Open when another collector writes to the same
+// namespace of the database.
+var ErrLocked = errors.New("another collector holds the write lock of the namespace")
+
+// migrations are applied in order, each at most once, recording the number
+// of applied migrations in rekor_collector_schema. Never change a released
+// migration; append a new one instead.
+var migrations = []string{
+	`CREATE TABLE accepted_checkpoints (
+		id BIGSERIAL PRIMARY KEY,
+		namespace TEXT NOT NULL,
+		line TEXT NOT NULL,
+		created TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX accepted_checkpoints_namespace_id ON accepted_checkpoints (namespace, id)`,
+	`CREATE TABLE monitor_registries (
+		namespace TEXT PRIMARY KEY,
+		registry TEXT NOT NULL,
+		updated TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+}
+
+// migrationLock is the advisory lock serializing migrations of collectors
+// starting at the same time.
+const migrationLock = 0x72656b6f72
+
+// Storage is a collector.Storage keeping the accepted checkpoints of a
+// namespace in the accepted_checkpoints table, one row per line, encrypted
+// with a StateCipher if set, and its monitor registry in a row of
+// monitor_registries. Other collectors and frontends can read the
+// table at any time, but only one Storage per namespace writes to it: Open
+// takes a session-level advisory lock on a dedicated connection and all
+// writes go through that connection, so a collector that lost its
+// connection, and with it the lock, cannot write anymore.
+type Storage struct {
+	db        *sql.DB
+	conn      *sql.Conn
+	namespace string
+	sc        *collector.StateCipher
+}
+
+// Open connects to PostgreSQL with a connection string, applies pending
+// migrations and takes the write lock of the namespace. It returns ErrLocked
+// if another collector holds the lock.
+func Open(ctx context.Context, dsn, namespace string, sc *collector.StateCipher) (*Storage, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{db: db, namespace: namespace, sc: sc}
+	if err := s.open(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenReadOnly connects to PostgreSQL to read the accepted checkpoints of a
+// namespace written by another collector. It neither migrates the schema
+// nor takes the write lock, so a role that can only select from
+// accepted_checkpoints is enough. Writes fail with collector.ErrReadOnly.
+func OpenReadOnly(ctx context.Context, dsn, namespace string, sc *collector.StateCipher) (*Storage, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Storage{db: db, namespace: namespace, sc: sc}, nil
+}
+
+func (s *Storage) open(ctx context.Context) error {
+	if err := migrate(ctx, s.db); err != nil {
+		return fmt.Errorf("migrating PostgreSQL schema: %w", err)
+	}
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, lockKey(s.namespace)).Scan(&locked); err != nil {
+		conn.Close()
+		return fmt.Errorf("taking write lock: %w", err)
+	}
+	if !locked {
+		conn.Close()
+		return ErrLocked
+	}
+	s.conn = conn
+	return nil
+}
+
+// lockKey returns the advisory lock key of a namespace.
+func lockKey(namespace string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("rekor-collector/" + namespace))
+	return int64(h.Sum64())
+}
+
+// migrate applies the migrations that were not applied yet in a single
+// transaction.
+func migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction is committed.
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS rekor_collector_schema (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT version FROM rekor_collector_schema`).Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if _, err := tx.ExecContext(ctx, `INSERT INTO rekor_collector_schema (version) VALUES (0)`); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this collector's %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE rekor_collector_schema SET version = $1`, len(migrations)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Append implements collector.Storage.
+func (s *Storage) Append(lines []string) error {
+	sealed := make([]string, len(lines))
+	for i, l := range lines {
+		var err error
+		if sealed[i], err = s.sc.Seal(l); err != nil {
+			return err
+		}
+	}
+	return s.appendSealed(sealed)
+}
+
+func (s *Storage) appendSealed(lines []string) error {
+	if s.conn == nil {
+		return collector.ErrReadOnly
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction is committed.
+	defer func() { _ = tx.Rollback() }()
+
+	for _, l := range lines {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO accepted_checkpoints (namespace, line) VALUES ($1, $2)`, s.namespace, l); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Latest implements collector.Storage.
+func (s *Storage) Latest(n int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT line FROM accepted_checkpoints WHERE namespace = $1 ORDER BY id DESC LIMIT $2`, s.namespace, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var l string
+		if err := rows.Scan(&l); err != nil {
+			return nil, err
+		}
+		if l, err = s.sc.Open(l); err != nil {
+			return nil, fmt.Errorf("accepted_checkpoints: %w", err)
+		}
+		lines = append([]string{l}, lines...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 && n > 0 {
+		return nil, fmt.Errorf("accepted_checkpoints: %w", fs.ErrNotExist)
+	}
+	return lines, nil
+}
+
+// Prune implements collector.Storage.
+func (s *Storage) Prune(keep int) error {
+	if s.conn == nil {
+		return collector.ErrReadOnly
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := s.conn.ExecContext(ctx, `DELETE FROM accepted_checkpoints WHERE namespace = $1 AND id < (
+		SELECT MIN(id) FROM (SELECT id FROM accepted_checkpoints WHERE namespace = $1 ORDER BY id DESC LIMIT $2) AS kept
+	)`, s.namespace, keep)
+	return err
+}
+
+// LoadRegistry implements collector.RegistryStorage.
+func (s *Storage) LoadRegistry() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var registry string
+	err := s.db.QueryRowContext(ctx, `SELECT registry FROM monitor_registries WHERE namespace = $1`, s.namespace).Scan(&registry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if registry, err = s.sc.Open(registry); err != nil {
+		return nil, fmt.Errorf("monitor_registries: %w", err)
+	}
+	return []byte(registry), nil
+}
+
+// SaveRegistry implements collector.RegistryStorage.
+func (s *Storage) SaveRegistry(b []byte) error {
+	if s.conn == nil {
+		return collector.ErrReadOnly
+	}
+	sealed, err := s.sc.Seal(string(b))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err = s.conn.ExecContext(ctx, `INSERT INTO monitor_registries (namespace, registry) VALUES ($1, $2)
+		ON CONFLICT (namespace) DO UPDATE SET registry = EXCLUDED.registry, updated = now()`, s.namespace, sealed)
+	return err
+}
+
+// Compact implements collector.Compacter. It vacuums the table, which makes
+// the rows deleted by Prune reusable and returns the empty pages at its end
+// to the operating system, and returns the number of bytes the table and
+// its indexes shrank by. The table is shared by every namespace, so writes
+// of other collectors can hide what was reclaimed.
+func (s *Storage) Compact() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	size := func() (int64, error) {
+		var n int64
+		err := s.db.QueryRowContext(ctx, `SELECT pg_total_relation_size('accepted_checkpoints')`).Scan(&n)
+		return n, err
+	}
+	before, err := size()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.db.ExecContext(ctx, `VACUUM accepted_checkpoints`); err != nil {
+		return 0, err
+	}
+	after, err := size()
+	if err != nil || after > before {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+// Migrate copies the lines of a legacy accepted file into the namespace if
+// it is still empty, returning the number of lines copied. Lines are copied
+// as stored, so the file must be encrypted with the same StateCipher as the
+// storage, if any. A missing file is not an error.
+func (s *Storage) Migrate(filename string) (int, error) {
+	if _, err := s.Latest(1); !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	lines, err := collector.ReadLegacyLines(filename)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.appendSealed(lines); err != nil {
+		return 0, fmt.Errorf("migrating %s: %w", filename, err)
+	}
+	return len(lines), nil
+}
+
+// Close releases the write lock and closes the database connections.
+func (s *Storage) Close() error {
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	if dbErr := s.db.Close(); err == nil {
+		err = dbErr
+	}
+	return err
+}
@@ -0,0 +1,319 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rediscache keeps the latest state of a collector in Redis, so that
+// large numbers of verifiers can read it cheaply without touching the
+// collector or its storage.
+package rediscache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// Keys written by a Cache, below its prefix:
+//
+//	latest:<origin>  the latest accepted checkpoint of a log, with the
+//	                 newlines of the note
+//	monitors         a hash from monitor to the JSON encoded Freshness of
+//	                 its latest observation
+const (
+	latestKey   = "latest:"
+	monitorsKey = "monitors"
+)
+
+// DefaultPrefix is the prefix of the keys written by a Cache.
+const DefaultPrefix = "rekor-collector:"
+
+// Freshness is the latest observation of a monitor, as stored in the
+// monitors hash.
+type Freshness struct {
+	Origin    string    `json:"origin"`
+	TreeSize  int64     `json:"treeSize"`
+	Timestamp int64     `json:"timestamp"`
+	Agrees    bool      `json:"agrees"`
+	Seen      time.Time `json:"seen"`
+}
+
+// Cache implements collector.Exporter, writing the accepted checkpoint and
+// the freshness of every monitor of each round to Redis. Durable history is
+// left to the collector's storage; the cache only ever holds the latest
+// state, and each round's writes are applied atomically.
+type Cache struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// TLS, if set, is used to connect to the server.
+	TLS *tls.Config
+	// Username and Password authenticate to the server, if Password is
+	// set.
+	Username, Password string
+	// DB is the database selected after connecting.
+	DB int
+	// Prefix is prepended to every key, DefaultPrefix if empty. The
+	// namespace of a multi-tenant collector follows the prefix.
+	Prefix string
+	// TTL, if set, expires the keys when no round refreshed them for that
+	// long, so that verifiers notice a stopped collector.
+	TTL time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// Parse returns a Cache for a redis:// or rediss:// URL of the form
+// redis://[user:password@]host:port[/db].
+func Parse(rawURL string) (*Cache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Redis URL: %w", err)
+	}
+	c := &Cache{Addr: u.Host}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.TLS = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("unsupported Redis URL scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		c.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.Password, _ = u.User.Password()
+		c.Username = u.User.Username()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.DB, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Export implements collector.Exporter.
+func (c *Cache) Export(ctx context.Context, r collector.RoundReport) error {
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	if r.Namespace != "" {
+		prefix += r.Namespace + ":"
+	}
+	var ttl []string
+	if c.TTL > 0 {
+		ttl = []string{"PX", strconv.FormatInt(c.TTL.Milliseconds(), 10)}
+	}
+
+	cmds := [][]string{{"MULTI"}}
+	if r.Accepted != nil {
+		note := strings.ReplaceAll(r.Accepted.Raw, `\n`, "\n")
+		cmds = append(cmds, append([]string{"SET", prefix + latestKey + r.Accepted.Origin, note}, ttl...))
+	}
+	if len(r.Observations) > 0 {
+		hset := []string{"HSET", prefix + monitorsKey}
+		for _, o := range r.Observations {
+			f, err := json.Marshal(Freshness{Origin: o.Origin, TreeSize: o.TreeSize, Timestamp: o.Timestamp, Agrees: o.Agrees, Seen: r.Time})
+			if err != nil {
+				return err
+			}
+			hset = append(hset, o.Monitor, string(f))
+		}
+		cmds = append(cmds, hset)
+		if c.TTL > 0 {
+			cmds = append(cmds, append([]string{"PEXPIRE", prefix + monitorsKey}, ttl[1]))
+		}
+	}
+	if len(cmds) == 1 {
+		return nil
+	}
+	cmds = append(cmds, []string{"EXEC"})
+	return c.do(ctx, cmds)
+}
+
+// do sends commands in a single pipeline and reads their replies. On any
+// error the connection is dropped and a new one is made by the next call.
+func (c *Cache) do(ctx context.Context, cmds [][]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.dial(ctx); err != nil {
+			return fmt.Errorf("connecting to Redis: %w", err)
+		}
+	}
+	err := c.roundTrip(ctx, cmds)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+func (c *Cache) dial(ctx context.Context) error {
+	d := &net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	if c.TLS != nil {
+		tc := tls.Client(conn, c.TLS)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tc
+	}
+	c.conn = conn
+	c.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	var setup [][]string
+	switch {
+	case c.Password != "" && c.Username != "":
+		setup = append(setup, []string{"AUTH", c.Username, c.Password})
+	case c.Password != "":
+		setup = append(setup, []string{"AUTH", c.Password})
+	}
+	if c.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.DB)})
+	}
+	if err := c.roundTrip(ctx, setup); err != nil {
+		conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// roundTrip writes commands and reads one reply per command. The first error
+// reply is returned after all replies have been read, so that the
+// connection stays usable.
+func (c *Cache) roundTrip(ctx context.Context, cmds [][]string) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	} else if err := c.conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		fmt.Fprintf(c.rw, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(c.rw, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := c.rw.Flush(); err != nil {
+		return err
+	}
+	var first error
+	for range cmds {
+		if err := readReply(c.rw.Reader); err != nil {
+			var redisErr redisError
+			if !errors.As(err, &redisErr) {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply reads and discards a reply in the Redis serialization protocol,
+// returning an error reply, or an error nested in an array reply, as a
+// redisError.
+func readReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("redis: invalid bulk reply %q", line)
+		}
+		if n < 0 {
+			return nil
+		}
+		_, err = io.CopyN(io.Discard, r, int64(n)+2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("redis: invalid array reply %q", line)
+		}
+		var first error
+		for i := 0; i < n; i++ {
+			if err := readReply(r); err != nil {
+				var redisErr redisError
+				if !errors.As(err, &redisErr) {
+					return err
+				}
+				if first == nil {
+					first = err
+				}
+			}
+		}
+		return first
+	default:
+		return fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// Close closes the connection to the server.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
@@ -0,0 +1,223 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rediscache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+// fakeRedis is a Redis server supporting the commands written by Cache.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	ttls    map[string]string
+	authed  []string
+}
+
+func serveFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	t.Helper()
+	f := &fakeRedis{strings: map[string]string{}, hashes: map[string]map[string]string{}, ttls: map[string]string{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, password)
+		}
+	}()
+	return f, ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn, password string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := password == ""
+	var queued [][]string
+	inMulti := false
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(cmd[0])
+		switch {
+		case name == "AUTH":
+			authed = cmd[len(cmd)-1] == password
+			f.mu.Lock()
+			f.authed = append(f.authed, strings.Join(cmd[1:], ":"))
+			f.mu.Unlock()
+			if !authed {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			io.WriteString(conn, "+OK\r\n")
+		case !authed:
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+		case name == "MULTI":
+			inMulti = true
+			io.WriteString(conn, "+OK\r\n")
+		case name == "EXEC":
+			fmt.Fprintf(conn, "*%d\r\n", len(queued))
+			for _, q := range queued {
+				io.WriteString(conn, f.exec(q))
+			}
+			queued, inMulti = nil, false
+		case inMulti:
+			queued = append(queued, cmd)
+			io.WriteString(conn, "+QUEUED\r\n")
+		default:
+			io.WriteString(conn, f.exec(cmd))
+		}
+	}
+}
+
+func (f *fakeRedis) exec(cmd []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(cmd[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		f.strings[cmd[1]] = cmd[2]
+		if len(cmd) == 5 && cmd[3] == "PX" {
+			f.ttls[cmd[1]] = cmd[4]
+		}
+		return "+OK\r\n"
+	case "HSET":
+		if f.hashes[cmd[1]] == nil {
+			f.hashes[cmd[1]] = map[string]string{}
+		}
+		for i := 2; i+1 < len(cmd); i += 2 {
+			f.hashes[cmd[1]][cmd[i]] = cmd[i+1]
+		}
+		return ":1\r\n"
+	case "PEXPIRE":
+		f.ttls[cmd[1]] = cmd[2]
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(buf[:size])
+	}
+	return cmd, nil
+}
+
+func TestCacheExport(t *testing.T) {
+	f, addr := serveFakeRedis(t, "secret")
+	c, err := Parse("redis://collector:secret@" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.TTL = time.Minute
+	defer c.Close()
+
+	origin := "rekor.sigstore.dev - 1"
+	round := func(size int64, monitor string) collector.RoundReport {
+		accepted := &collector.Checkpoint{Origin: origin, Size: size, Raw: fmt.Sprintf(`%s\n%d\nhash\n`, origin, size)}
+		return collector.RoundReport{
+			Round:     strconv.FormatInt(size, 10),
+			Namespace: "tenant-a",
+			Time:      time.Unix(1700000000+size, 0).UTC(),
+			Accepted:  accepted,
+			Observations: []collector.MonitorObservation{
+				{Monitor: monitor, Origin: origin, TreeSize: size, Timestamp: size, Agrees: true},
+			},
+		}
+	}
+	for _, r := range []collector.RoundReport{round(10, "logInfo0.txt"), round(11, "logInfo1.txt")} {
+		if err := c.Export(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.authed) != 1 || f.authed[0] != "collector:secret" {
+		t.Errorf("expected a single authentication on a reused connection, got %v", f.authed)
+	}
+	latest := "rekor-collector:tenant-a:latest:" + origin
+	if got := f.strings[latest]; got != origin+"\n11\nhash\n" {
+		t.Errorf("unexpected latest checkpoint %q", got)
+	}
+	monitors := f.hashes["rekor-collector:tenant-a:monitors"]
+	var fresh Freshness
+	if err := json.Unmarshal([]byte(monitors["logInfo0.txt"]), &fresh); err != nil || fresh.TreeSize != 10 {
+		t.Errorf("unexpected freshness of logInfo0.txt %q: %v", monitors["logInfo0.txt"], err)
+	}
+	if err := json.Unmarshal([]byte(monitors["logInfo1.txt"]), &fresh); err != nil || fresh.TreeSize != 11 || !fresh.Seen.Equal(time.Unix(1700000011, 0)) {
+		t.Errorf("unexpected freshness of logInfo1.txt %q: %v", monitors["logInfo1.txt"], err)
+	}
+	if f.ttls[latest] != "60000" || f.ttls["rekor-collector:tenant-a:monitors"] != "60000" {
+		t.Errorf("expected keys to expire after a minute, got %v", f.ttls)
+	}
+}
+
+func TestCacheAuthFailure(t *testing.T) {
+	_, addr := serveFakeRedis(t, "secret")
+	c, err := Parse("redis://:wrong@" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := collector.RoundReport{Accepted: &collector.Checkpoint{Origin: "o", Raw: "o"}}
+	if err := c.Export(context.Background(), r); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected authentication to fail, got %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry retries outbound HTTP requests that fail transiently, with
+// exponential backoff, per-attempt timeouts and an overall time budget.
+package retry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header identifying repeated attempts of a
+// request that is not idempotent by its method.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Default policy
+const (
+	DefaultAttempts   = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+	DefaultTimeout    = 10 * time.Second
+	DefaultBudget     = 30 * time.Second
+)
+
+// Policy controls how requests are retried.
+type Policy struct {
+	// Attempts is the maximum number of attempts of a request.
+	Attempts int
+	// Backoff is the upper bound of the random delay before the first
+	// retry. It doubles with every retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout bounds every attempt, including reading the response body.
+	Timeout time.Duration
+	// Budget bounds the time spent on all attempts of a request. No retry
+	// is started that would wait beyond it.
+	Budget time.Duration
+}
+
+// DefaultPolicy returns the default policy.
+func DefaultPolicy() Policy {
+	return Policy{
+		Attempts:   DefaultAttempts,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		Timeout:    DefaultTimeout,
+		Budget:     DefaultBudget,
+	}
+}
+
+// Transport is an http.RoundTripper retrying requests that fail with a
+// network error or with status 429, 502, 503 or 504. Requests whose method
+// is not idempotent are only retried if they carry an Idempotency-Key
+// header, see SetIdempotencyKey, so that the server can recognize repeated
+// attempts.
+type Transport struct {
+	// Base sends the requests, http.DefaultTransport if nil.
+	Base   http.RoundTripper
+	Policy Policy
+
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewClient returns an HTTP client retrying requests according to p.
+func NewClient(p Policy) *http.Client {
+	return &http.Client{Transport: &Transport{Policy: p}}
+}
+
+// SetIdempotencyKey marks req as safe to retry by adding a random
+// Idempotency-Key header, unless it already has one.
+func SetIdempotencyKey(req *http.Request) {
+	if req.Header.Get(IdempotencyKeyHeader) != "" {
+		return
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return
+	}
+	req.Header.Set(IdempotencyKeyHeader, hex.EncodeToString(b[:]))
+}
+
+// retryable reports whether req may be sent more than once.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		if req.Header.Get(IdempotencyKeyHeader) == "" {
+			return false
+		}
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryStatus reports whether a response status is worth retrying.
+func retryStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	p := t.Policy
+	if p.Attempts <= 0 {
+		p.Attempts = 1
+	}
+	if !retryable(req) {
+		p.Attempts = 1
+	}
+	sleep := t.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+
+	ctx := req.Context()
+	if p.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Budget)
+		resp, err := t.attempts(ctx, base, req, p, sleep)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+	return t.attempts(ctx, base, req, p, sleep)
+}
+
+func (t *Transport) attempts(ctx context.Context, base http.RoundTripper, req *http.Request, p Policy, sleep func(context.Context, time.Duration) error) (*http.Response, error) {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := t.attempt(ctx, base, req, p.Timeout, attempt)
+		last := attempt >= p.Attempts || ctx.Err() != nil
+		if err == nil && (!retryStatus(resp.StatusCode) || last) {
+			return resp, nil
+		}
+		if last {
+			return nil, err
+		}
+
+		wait := jitter(backoff)
+		if err == nil {
+			if d, ok := retryAfter(resp); ok {
+				wait = d
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			// No time left to retry, return the last result.
+			return resp, err
+		}
+		if err == nil {
+			// Drain a little so the connection can be reused.
+			_, _ = io.CopyN(io.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// attempt sends one attempt of req. The attempt's timeout also covers
+// reading the response body.
+func (t *Transport) attempt(ctx context.Context, base http.RoundTripper, req *http.Request, timeout time.Duration, n int) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	r := req.Clone(ctx)
+	if n > 1 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.Body = body
+	}
+	resp, err := base.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// retryAfter returns the delay requested by a Retry-After header.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// jitter returns a random duration in [0, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(d)))
+	if err != nil {
+		return d
+	}
+	return time.Duration(n.Int64())
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// cancelBody releases the context of a request when its response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
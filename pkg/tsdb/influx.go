@@ -0,0 +1,115 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsdb exports collection rounds to time series databases for long
+// term trend analysis.
+package tsdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+	"github.com/sigstore/rekor-monitor/pkg/retry"
+)
+
+func init() {
+	collector.RegisterCapability(collector.CapabilityStorage, "influxdb")
+}
+
+// Influx writes round reports to InfluxDB using the line protocol. Each
+// monitor observation is written as a rekor_observation point and each
+// round as a rekor_round point.
+type Influx struct {
+	// WriteURL is the write endpoint including the organization, bucket
+	// and precision, e.g.
+	// http://localhost:8086/api/v2/write?org=sigstore&bucket=rekor&precision=ns
+	WriteURL string
+	// Token authenticates to InfluxDB 2, if set.
+	Token  string
+	Client *http.Client
+}
+
+// lineEscaper escapes tag keys and values in the line protocol.
+var lineEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// Lines formats a round report in the InfluxDB line protocol with
+// nanosecond timestamps.
+func Lines(r collector.RoundReport) string {
+	var b strings.Builder
+	ts := strconv.FormatInt(r.Time.UnixNano(), 10)
+	tags := func(pairs ...string) string {
+		var t []string
+		if r.Namespace != "" {
+			pairs = append([]string{"namespace", r.Namespace}, pairs...)
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if pairs[i+1] != "" {
+				t = append(t, pairs[i]+"="+lineEscaper.Replace(pairs[i+1]))
+			}
+		}
+		if len(t) == 0 {
+			return ""
+		}
+		return "," + strings.Join(t, ",")
+	}
+
+	for _, o := range r.Observations {
+		fmt.Fprintf(&b, "rekor_observation%s tree_size=%di,timestamp=%di,agrees=%t,round=%q %s\n",
+			tags("monitor", o.Monitor, "origin", o.Origin), o.TreeSize, o.Timestamp, o.Agrees, r.Round, ts)
+	}
+	origin, size := "", int64(0)
+	if r.Accepted != nil {
+		origin, size = r.Accepted.Origin, r.Accepted.Size
+	}
+	fmt.Fprintf(&b, "rekor_round%s accepted=%t,tree_size=%di,monitors=%di,quorum=%di,round=%q %s\n",
+		tags("origin", origin), r.Accepted != nil, size, len(r.Observations), r.Quorum, r.Round, ts)
+	return b.String()
+}
+
+// Export implements collector.Exporter.
+func (i *Influx) Export(ctx context.Context, r collector.RoundReport) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.WriteURL, bytes.NewBufferString(Lines(r)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.Token != "" {
+		req.Header.Set("Authorization", "Token "+i.Token)
+	}
+	// Points are keyed by round and time, so writing them twice is
+	// harmless and the request may be retried.
+	retry.SetIdempotencyKey(req)
+
+	client := i.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("writing to InfluxDB: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	// Register the PostgreSQL driver.
+	_ "github.com/lib/pq"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+func init() {
+	collector.RegisterCapability(collector.CapabilityStorage, "timescaledb")
+}
+
+// timescaleSchema creates the tables round reports are written to, as
+// TimescaleDB hypertables partitioned by time.
+var timescaleSchema = []string{
+	`CREATE TABLE IF NOT EXISTS rekor_observations (
+		time TIMESTAMPTZ NOT NULL,
+		round TEXT NOT NULL,
+		namespace TEXT NOT NULL,
+		monitor TEXT NOT NULL,
+		origin TEXT NOT NULL,
+		tree_size BIGINT NOT NULL,
+		checkpoint_timestamp BIGINT NOT NULL,
+		agrees BOOLEAN NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS rekor_rounds (
+		time TIMESTAMPTZ NOT NULL,
+		round TEXT NOT NULL,
+		namespace TEXT NOT NULL,
+		origin TEXT NOT NULL,
+		accepted BOOLEAN NOT NULL,
+		tree_size BIGINT NOT NULL,
+		monitors INTEGER NOT NULL,
+		quorum INTEGER NOT NULL
+	)`,
+	`SELECT create_hypertable('rekor_observations', 'time', if_not_exists => TRUE)`,
+	`SELECT create_hypertable('rekor_rounds', 'time', if_not_exists => TRUE)`,
+}
+
+// Timescale writes round reports to TimescaleDB.
+type Timescale struct {
+	db *sql.DB
+}
+
+// OpenTimescale connects to TimescaleDB with a PostgreSQL connection string
+// and creates the tables if needed. The timescaledb extension must be
+// installed in the database.
+func OpenTimescale(ctx context.Context, dsn string) (*Timescale, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range timescaleSchema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating TimescaleDB schema: %w", err)
+		}
+	}
+	return &Timescale{db: db}, nil
+}
+
+// Export implements collector.Exporter. The rows of a round are written in
+// a single transaction.
+func (t *Timescale) Export(ctx context.Context, r collector.RoundReport) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction is committed.
+	defer func() { _ = tx.Rollback() }()
+
+	for _, o := range r.Observations {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO rekor_observations (time, round, namespace, monitor, origin, tree_size, checkpoint_timestamp, agrees) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			r.Time, r.Round, r.Namespace, o.Monitor, o.Origin, o.TreeSize, o.Timestamp, o.Agrees); err != nil {
+			return err
+		}
+	}
+	origin, size := "", int64(0)
+	if r.Accepted != nil {
+		origin, size = r.Accepted.Origin, r.Accepted.Size
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO rekor_rounds (time, round, namespace, origin, accepted, tree_size, monitors, quorum) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		r.Time, r.Round, r.Namespace, origin, r.Accepted != nil, size, len(r.Observations), r.Quorum); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database connection.
+func (t *Timescale) Close() error {
+	return t.db.Close()
+}
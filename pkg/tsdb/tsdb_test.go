@@ -0,0 +1,63 @@
+//
+// Copyright 2021 The Sigstore Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sigstore/rekor-monitor/pkg/collector"
+)
+
+func TestInfluxExport(t *testing.T) {
+	var body, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, auth = string(b), r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	accepted := &collector.Checkpoint{Origin: "rekor.sigstore.dev - 1", Size: 10}
+	r := collector.RoundReport{
+		Round:    "7",
+		Time:     time.Unix(1700000000, 0),
+		Quorum:   2,
+		Accepted: accepted,
+		Observations: []collector.MonitorObservation{
+			{Monitor: "logInfo0.txt", Origin: accepted.Origin, TreeSize: 10, Timestamp: 5, Agrees: true},
+			{Monitor: "logInfo1.txt", Origin: accepted.Origin, TreeSize: 9, Timestamp: 4},
+		},
+	}
+	if err := (&Influx{WriteURL: srv.URL, Token: "secret"}).Export(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `rekor_observation,monitor=logInfo0.txt,origin=rekor.sigstore.dev\ -\ 1 tree_size=10i,timestamp=5i,agrees=true,round="7" 1700000000000000000
+rekor_observation,monitor=logInfo1.txt,origin=rekor.sigstore.dev\ -\ 1 tree_size=9i,timestamp=4i,agrees=false,round="7" 1700000000000000000
+rekor_round,origin=rekor.sigstore.dev\ -\ 1 accepted=true,tree_size=10i,monitors=2i,quorum=2i,round="7" 1700000000000000000
+`
+	if body != want {
+		t.Errorf("unexpected line protocol:\n%s\nwant:\n%s", body, want)
+	}
+	if auth != "Token secret" {
+		t.Errorf("unexpected Authorization header %q", auth)
+	}
+}